@@ -1,22 +1,85 @@
 package main
 
 import (
+	"context"
 	"log"
+	"path/filepath"
 	"time"
 
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
 	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/pkg/errors"
 )
 
 func (p *Plugin) OnActivate() error {
-	p.mmSync = GetSyncInstance()
+	// the plugin still starts if the vector store can't be reached, and searches fail until it's back
+	p.vectorStore = NewVectorStoreConnection(p.getDataDirectory())
+	if err := p.connectVectorStore(p.getConfiguration()); err != nil {
+		return errors.Wrap(err, "failed to connect to the vector store")
+	}
+
+	// the sync state is kept in the KV store, so it's shared by the servers of a cluster.
+	// It used to be kept in a file of each server, which is copied the first time
+	syncStore := db.NewKVDataStore(p.API)
+	if err := db.MigrateBoltDataStore("mm-sync", syncStore); err != nil {
+		log.Printf("error while migrating the sync state to the KV store: %v \n", err)
+	}
+
+	// the keyword index is also shared by the servers, which apply the changes written by the others
+	InitLexicalIndex(syncStore, p.publishLexicalChange)
+
+	// the users, channels and teams are cached, since they are looked up for every post and search result
+	apiClient := NewPluginAPIClient(p.API)
+	p.database = pluginapi.NewClient(p.API, p.Driver).Store
+	if db, err := p.database.GetReplicaDB(); err != nil {
+		log.Printf("error while connecting to the database, the channels are listed from the memberships of every user: %v \n", err)
+	} else {
+		apiClient.db = db
+	}
+	p.mmClient = NewCachedMattermostClient(apiClient)
+	p.mmSync = GetSyncInstance(syncStore)
+	p.mmSync.mmClient = p.mmClient
+	p.mmSync.vectorStore = p.vectorStore
 	p.mmSyncBroker = NewBroker(p)
 	p.slackClient = GetSlackInstance()
 	p.initializeAPI()
 
+	// only one server of the cluster runs the sync
+	p.mmSync.leader = NewSyncLeader(p.API, syncStore, func(isLeader bool) {
+		// the leader also compacts the changes of the keyword index
+		GetLexicalIndex().setCompacts(isLeader)
+
+		if isLeader {
+			// the previous leader may have died while fetching
+			if err := p.mmSync.stopFetch(); err != nil {
+				log.Printf("error while resetting the fetch status: %v \n", err)
+			}
+			return
+		}
+
+		p.mmSyncBroker.stopSync(true)
+	})
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	p.stopSyncLeader = cancelLeader
+	p.syncLeaderDone = make(chan struct{})
+	go func() {
+		defer close(p.syncLeaderDone)
+		p.mmSync.leader.Run(leaderCtx)
+	}()
+
+	reconcileJob, err := p.scheduleReconciliation()
+	if err != nil {
+		log.Printf("error while scheduling the reconciliation: %v \n", err)
+	}
+	p.reconcileJob = reconcileJob
+
 	// on sync status change. replacement for '/status' route
 	go func() {
 		previousIsSyncInProgress := false
 		previousIsFetchInProgress := false
+		previousSyncLeader := ""
 
 		for {
 			isSyncInProgress, err := p.mmSync.GetIsSyncInProgress()
@@ -31,14 +94,27 @@ func (p *Plugin) OnActivate() error {
 				return
 			}
 
-			if isSyncInProgress != previousIsSyncInProgress || isFetchInProgress != previousIsFetchInProgress {
+			syncLeader := p.mmSync.GetSyncLeader()
+
+			// the leader runs the syncs started from any server, and stops the ones stopped from any server
+			if p.mmSync.IsLeader() {
+				if isSyncInProgress && !p.mmSyncBroker.IsSyncRunning() {
+					p.mmSyncBroker.runSync()
+				} else if !isSyncInProgress && p.mmSyncBroker.IsSyncRunning() {
+					p.mmSyncBroker.stopSync(false)
+				}
+			}
+
+			if isSyncInProgress != previousIsSyncInProgress || isFetchInProgress != previousIsFetchInProgress || syncLeader != previousSyncLeader {
 				previousIsSyncInProgress = isSyncInProgress
 				previousIsFetchInProgress = isFetchInProgress
+				previousSyncLeader = syncLeader
 
 				p.API.PublishWebSocketEvent("on_sync_status_change", map[string]interface{}{
 					"status": map[string]interface{}{
 						"is_sync_in_progress":  isSyncInProgress,
 						"is_fetch_in_progress": isFetchInProgress,
+						"sync_leader":          syncLeader,
 					},
 				}, &model.WebsocketBroadcast{})
 			}
@@ -48,3 +124,58 @@ func (p *Plugin) OnActivate() error {
 	}()
 	return nil
 }
+
+const (
+	// the data directory of the server, if the file settings don't set one
+	defaultDataDirectory = "./data/"
+	// the plugin's files, in the data directory
+	pluginDataDirectory = "plugins-data/com.mattermost.semantic-search-plugin"
+)
+
+// Get the directory where the plugin keeps its files, in the data directory of the server,
+// so they are kept when the plugin is upgraded
+func (p *Plugin) getDataDirectory() string {
+	dataDirectory := defaultDataDirectory
+	if config := p.API.GetConfig(); config != nil && config.FileSettings.Directory != nil && *config.FileSettings.Directory != "" {
+		dataDirectory = *config.FileSettings.Directory
+	}
+
+	return filepath.Join(dataDirectory, pluginDataDirectory)
+}
+
+// Connect to the vector store of the configuration. If the vectors were produced by a different
+// model than the configured one, the plugin stays active so the vector store can be reset, and
+// the searches fail with a conflict until then.
+func (p *Plugin) connectVectorStore(config *configuration) error {
+	err := p.vectorStore.Connect(config)
+	if errors.Is(err, ErrEmbeddingModelMismatch) {
+		log.Printf("the vector store must be reset before searching: %v \n", err)
+		return nil
+	}
+
+	return err
+}
+
+func (p *Plugin) OnDeactivate() error {
+	// step down, so another server of the cluster takes over the sync right away
+	if p.stopSyncLeader != nil {
+		p.stopSyncLeader()
+		<-p.syncLeaderDone
+	}
+
+	if p.reconcileJob != nil {
+		p.reconcileJob.Close()
+	}
+
+	if p.vectorStore != nil {
+		p.vectorStore.Close()
+	}
+
+	if p.database != nil {
+		if err := p.database.Close(); err != nil {
+			log.Printf("error while closing the database: %v \n", err)
+		}
+	}
+
+	return nil
+}
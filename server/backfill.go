@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const (
+	// the metadata schema version of the documents once they were all backfilled
+	metadataSchemaVersionKey = "metadata_schema_version"
+	// set once the documents embedded before the lexical index existed were added to it
+	lexicalBackfilledKey = "lexical_backfilled"
+	// number of posts looked up and embedded at a time
+	backfillPerPage = 200
+)
+
+// Embed again the posts whose documents have an older metadata schema version, so their metadata
+// has every field of the current version. It's done once for every new version of the schema.
+func (sync *Sync) backfillMetadata(ctx context.Context) error {
+	if sync.store == nil {
+		return fmt.Errorf("store is not initialized")
+	}
+
+	if version, err := sync.store.Get("sync", metadataSchemaVersionKey); err == nil {
+		if storedVersion, err := strconv.Atoi(string(version)); err == nil && storedVersion >= metadataSchemaVersion {
+			return nil
+		}
+	}
+
+	metadatas, err := sync.vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+	if err != nil {
+		return err
+	}
+
+	postIds := outdatedPostIds(metadatas)
+	log.Printf("Backfilling the metadata of %v posts \n", len(postIds))
+
+	for start := 0; start < len(postIds); start += backfillPerPage {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + backfillPerPage
+		if end > len(postIds) {
+			end = len(postIds)
+		}
+
+		if err := sync.backfillPosts(postIds[start:end]); err != nil {
+			return err
+		}
+	}
+
+	// the posts that couldn't be looked up are backfilled by the next fetch, and the deleted ones
+	// are removed by the reconciliation. The version is only recorded once no other posts are left
+	metadatas, err = sync.vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+	if err != nil {
+		return err
+	}
+
+	postIds = outdatedPostIds(metadatas)
+	orphanedPosts, err := sync.getOrphanedPosts(postIds)
+	if err != nil {
+		return err
+	}
+	if len(orphanedPosts) < len(postIds) {
+		return fmt.Errorf("the metadata of %v posts couldn't be backfilled", len(postIds)-len(orphanedPosts))
+	}
+
+	return sync.store.Put("sync", metadataSchemaVersionKey, []byte(strconv.Itoa(metadataSchemaVersion)))
+}
+
+// Get the ids of the posts with documents of an older metadata schema version
+func outdatedPostIds(metadatas map[string]map[string]interface{}) []string {
+	postIds := []string{}
+	seenPosts := map[string]bool{}
+	for id, metadata := range metadatas {
+		postId := documentPostId(id, metadata)
+		if getMetadataSchemaVersion(metadata) < metadataSchemaVersion && !seenPosts[postId] {
+			seenPosts[postId] = true
+			postIds = append(postIds, postId)
+		}
+	}
+
+	return postIds
+}
+
+// Embed posts again, with the access and team of their current channel
+func (sync *Sync) backfillPosts(postIds []string) error {
+	// the posts that can't be found were deleted, and are removed by the reconciliation
+	postDetails, err := getPostsDetails(sync.mmClient, postIds)
+	if err != nil {
+		log.Printf("error while trying to get the posts to backfill: %v \n", err)
+	}
+
+	channelPosts := map[string][]Post{}
+	for _, postDetail := range postDetails {
+		post := Post(postDetail)
+		if isIndexablePost(post) {
+			channelPosts[post.ChannelId] = append(channelPosts[post.ChannelId], post)
+		}
+	}
+
+	for channelId, posts := range channelPosts {
+		channel, err := sync.mmClient.GetChannelDetails(channelId)
+		if err != nil {
+			return err
+		}
+
+		if err := upsertPostsToVectorStore(sync.vectorStore, posts, getChannelAccess(channel.Type), channel.TeamId, sync.mmClient); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add the documents of the vector store that aren't in the lexical index, which only has the documents
+// embedded since it was added. It's done once, after the lexical index was loaded.
+func (sync *Sync) backfillLexicalIndex(ctx context.Context) error {
+	if sync.store == nil {
+		return fmt.Errorf("store is not initialized")
+	}
+
+	if _, err := sync.store.Get("sync", lexicalBackfilledKey); err == nil {
+		return nil
+	}
+
+	index := GetLexicalIndex()
+	if !index.isLoaded() {
+		return fmt.Errorf("the lexical index is still loading")
+	}
+
+	for _, collectionType := range []string{mattermostCollectionType, slackCollectionType} {
+		metadatas, err := sync.vectorStore.GetMetadatas(ctx, collectionType)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, 0, len(metadatas))
+		for id := range metadatas {
+			ids = append(ids, id)
+		}
+		ids = index.missingIds(ids)
+
+		log.Printf("Adding %v %v documents to the lexical index \n", len(ids), collectionType)
+
+		for start := 0; start < len(ids); start += backfillPerPage {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			end := start + backfillPerPage
+			if end > len(ids) {
+				end = len(ids)
+			}
+
+			documents, err := sync.vectorStore.GetDocuments(ctx, collectionType, ids[start:end])
+			if err != nil {
+				return err
+			}
+
+			pageIds := []string{}
+			pageDocuments := []string{}
+			pageMetadatas := []map[string]interface{}{}
+			for id, document := range documents {
+				pageIds = append(pageIds, id)
+				pageDocuments = append(pageDocuments, document)
+				pageMetadatas = append(pageMetadatas, metadatas[id])
+			}
+
+			if err := index.Upsert(pageIds, pageDocuments, pageMetadatas); err != nil {
+				return err
+			}
+		}
+	}
+
+	return sync.store.Put("sync", lexicalBackfilledKey, []byte("true"))
+}
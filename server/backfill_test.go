@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+func TestBackfillMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	vectorsStore, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer vectorsStore.Close()
+
+	syncStore, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-sync"))
+	assert.Nil(t, err)
+	defer syncStore.Close()
+
+	vectorStore := newEmbeddedVectorStore(newEmbeddedVectorIndex(vectorsStore), nil)
+	client := &countingMattermostClient{fakeMattermostClient: fakeMattermostClient{
+		posts: map[string]PostDetail{
+			"p1": {Id: "p1", UserId: "u1", ChannelId: "c1", Message: "hello"},
+		},
+		channels: map[string]ChannelDetail{"c1": {Id: "c1", Type: "O", Name: "town-square", TeamId: "t1"}},
+		teams:    map[string]TeamDetail{"t1": {Id: "t1", Name: "team"}},
+		users:    map[string]UserDetail{"u1": {Id: "u1", UserName: "user", FirstName: "First", LastName: "Last"}},
+	}}
+
+	// embedded before the names were stored, and one of them was deleted since
+	assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{
+		{Id: "p1", UserId: "u1", ChannelId: "c1", Message: "hello"},
+		{Id: "deleted", UserId: "u1", ChannelId: "c1", Message: "bye"},
+	}, "pub", "t1", nil))
+
+	sync := &Sync{store: syncStore, vectorStore: vectorStore, mmClient: client}
+	assert.Nil(t, sync.backfillMetadata(ctx))
+
+	metadatas, err := vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+	assert.Nil(t, err)
+	assert.Equal(t, metadataSchemaVersion, getMetadataSchemaVersion(metadatas["p1"]))
+	assert.Equal(t, "town-square", metadatas["p1"]["channel_name"])
+	assert.Equal(t, "team", metadatas["p1"]["team_name"])
+	assert.Equal(t, "user", metadatas["p1"]["username"])
+	assert.Equal(t, "FirstLast", metadatas["p1"]["user_display_name"])
+	assert.Equal(t, 1, getMetadataSchemaVersion(metadatas["deleted"]))
+
+	t.Run("the documents are backfilled once", func(t *testing.T) {
+		postLookups := client.lookups["post"]
+		assert.Nil(t, sync.backfillMetadata(ctx))
+		assert.Equal(t, postLookups, client.lookups["post"])
+	})
+
+	t.Run("the version isn't recorded while posts can't be looked up", func(t *testing.T) {
+		assert.Nil(t, syncStore.Delete("sync", metadataSchemaVersionKey))
+		assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{{Id: "p2", UserId: "u1", ChannelId: "c1", Message: "later"}}, "pub", "t1", nil))
+
+		client.posts["p2"] = PostDetail{Id: "p2", UserId: "u1", ChannelId: "c1", Message: "later"}
+		failingClient := &failingPostsClient{MattermostClient: client, failPosts: map[string]bool{"p2": true}}
+		sync := &Sync{store: syncStore, vectorStore: vectorStore, mmClient: failingClient}
+
+		assert.NotNil(t, sync.backfillMetadata(ctx))
+		_, err := syncStore.Get("sync", metadataSchemaVersionKey)
+		assert.NotNil(t, err)
+
+		// the next fetch backfills it
+		failingClient.failPosts = nil
+		assert.Nil(t, sync.backfillMetadata(ctx))
+		_, err = syncStore.Get("sync", metadataSchemaVersionKey)
+		assert.Nil(t, err)
+	})
+}
+
+// failingPostsClient fails to look up some posts
+type failingPostsClient struct {
+	MattermostClient
+	failPosts map[string]bool
+}
+
+func (client *failingPostsClient) GetPostDetails(postId string) (PostDetail, error) {
+	if client.failPosts[postId] {
+		return PostDetail{}, fmt.Errorf("could not get post %v", postId)
+	}
+
+	return client.MattermostClient.GetPostDetails(postId)
+}
+
+func TestBackfillLexicalIndex(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	vectorsStore, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer vectorsStore.Close()
+
+	syncStore, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-sync"))
+	assert.Nil(t, err)
+	defer syncStore.Close()
+
+	// embedded before the lexical index existed
+	vectorStore := newEmbeddedVectorStore(newEmbeddedVectorIndex(vectorsStore), nil)
+	assert.Nil(t, vectorStore.Upsert(ctx, mattermostCollectionType,
+		[]string{"backfill-mm"},
+		[]string{"the backfilled xyzzy message"},
+		[]map[string]interface{}{{"source": "mm", "channel_id": "c1"}},
+	))
+	assert.Nil(t, vectorStore.Upsert(ctx, slackCollectionType,
+		[]string{"backfill-sl"},
+		[]string{"the backfilled plugh message"},
+		[]map[string]interface{}{{"source": "sl", "channel_id": "general"}},
+	))
+
+	sync := &Sync{store: syncStore, vectorStore: vectorStore}
+	assert.Nil(t, sync.backfillLexicalIndex(ctx))
+
+	results := GetLexicalIndex().Search("xyzzy", 10, nil)
+	assert.Equal(t, []string{"backfill-mm"}, resultIds(results))
+	assert.Equal(t, "c1", results[0].Metadata["channel_id"])
+	assert.Equal(t, []string{"backfill-sl"}, resultIds(GetLexicalIndex().Search("plugh", 10, nil)))
+
+	t.Run("the documents are backfilled once", func(t *testing.T) {
+		assert.Nil(t, GetLexicalIndex().Delete([]string{"backfill-mm", "backfill-sl"}))
+		assert.Nil(t, sync.backfillLexicalIndex(ctx))
+		assert.Empty(t, GetLexicalIndex().Search("xyzzy", 10, nil))
+	})
+}
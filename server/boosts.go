@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// ScoreBoosts adjust the scores of the search results, so recent and popular messages rank higher
+type ScoreBoosts struct {
+	// the score of a message is halved every half-life since it was posted. 0 disables the time decay
+	RecencyHalfLife time.Duration
+	// added to the multiplier of pinned posts
+	Pinned float64
+	// multiplied by the log of the number of reactions and replies, and added to the multiplier of the post
+	Reactions float64
+	Replies   float64
+}
+
+func (boosts ScoreBoosts) isEnabled() bool {
+	return boosts != ScoreBoosts{}
+}
+
+// Get the multiplier of a result's score. The slack messages are only boosted by their age.
+func (boosts ScoreBoosts) multiplier(metadata map[string]interface{}, now time.Time) float64 {
+	multiplier := 1.0
+
+	if boosts.RecencyHalfLife > 0 {
+		if createdAt := metadataCreatedAt(metadata); createdAt.Valid {
+			age := now.Sub(time.UnixMilli(createdAt.Int64))
+			if age > 0 {
+				multiplier *= math.Pow(0.5, float64(age)/float64(boosts.RecencyHalfLife))
+			}
+		}
+	}
+
+	engagement := 1.0
+	if isPinned, _ := metadata["is_pinned"].(bool); isPinned {
+		engagement += boosts.Pinned
+	}
+	if reactionCount, ok := metadataNumber(metadata["reaction_count"]); ok && reactionCount > 0 {
+		engagement += boosts.Reactions * math.Log1p(reactionCount)
+	}
+	if replyCount, ok := metadataNumber(metadata["reply_count"]); ok && replyCount > 0 {
+		engagement += boosts.Replies * math.Log1p(replyCount)
+	}
+
+	return multiplier * engagement
+}
+
+// the relevance the lowest negative score is scaled to, above 0 so a boost can still lift it
+const minBoostRelevance = 0.1
+
+// Multiply the score the first candidates results are ordered by with their boost, and sort them by the
+// boosted score. They're the results that were reranked, so their scores are on the same scale, and the
+// others are left after them. The scores are scaled to at most 1 first, as boosting a negative score would lower it.
+func boostResults(results []searchResult, boosts ScoreBoosts, now time.Time, candidates int) []searchResult {
+	if candidates > len(results) {
+		candidates = len(results)
+	}
+
+	boostedResults := append([]searchResult{}, results[:candidates]...)
+	relevances := boostRelevances(boostedResults)
+	for i := range boostedResults {
+		multiplier := boosts.multiplier(boostedResults[i].Metadata, now)
+
+		scores := &boostedResults[i].Scores
+		scores.Boosted = relevances[i] * multiplier
+		scores.Boost = multiplier
+	}
+
+	sort.SliceStable(boostedResults, func(i, j int) bool {
+		return boostedResults[i].Scores.Boosted > boostedResults[j].Scores.Boosted
+	})
+
+	return append(boostedResults, results[candidates:]...)
+}
+
+// Get the scores the results are ordered by, divided by the highest one. If some scores are negative,
+// they're scaled between minBoostRelevance and 1 instead.
+func boostRelevances(results []searchResult) []float64 {
+	relevances := make([]float64, len(results))
+	minScore, maxScore := 0.0, 0.0
+	for i, result := range results {
+		relevances[i] = rankingScore(result.Scores)
+		if i == 0 || relevances[i] < minScore {
+			minScore = relevances[i]
+		}
+		if i == 0 || relevances[i] > maxScore {
+			maxScore = relevances[i]
+		}
+	}
+
+	for i := range relevances {
+		switch {
+		case minScore >= 0 && maxScore > 0:
+			relevances[i] /= maxScore
+		case maxScore > minScore:
+			relevances[i] = minBoostRelevance + (1-minBoostRelevance)*(relevances[i]-minScore)/(maxScore-minScore)
+		default:
+			relevances[i] = 1
+		}
+	}
+
+	return relevances
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScoreBoostsMultiplier(t *testing.T) {
+	now := time.UnixMilli(100 * 24 * time.Hour.Milliseconds())
+	dayAgo := now.Add(-24 * time.Hour).UnixMilli()
+
+	assert.False(t, ScoreBoosts{}.isEnabled())
+
+	t.Run("the score is halved every half-life", func(t *testing.T) {
+		boosts := ScoreBoosts{RecencyHalfLife: 24 * time.Hour}
+		assert.InDelta(t, 1, boosts.multiplier(map[string]interface{}{"create_at": now.UnixMilli()}, now), 0.001)
+		assert.InDelta(t, 0.5, boosts.multiplier(map[string]interface{}{"create_at": dayAgo}, now), 0.001)
+		// the slack messages have their date in seconds
+		assert.InDelta(t, 0.25, boosts.multiplier(map[string]interface{}{"msg_date": now.Add(-48 * time.Hour).Unix()}, now), 0.001)
+		// the messages without a date aren't decayed
+		assert.InDelta(t, 1, boosts.multiplier(map[string]interface{}{}, now), 0.001)
+	})
+
+	t.Run("pins, reactions and replies increase the score", func(t *testing.T) {
+		boosts := ScoreBoosts{Pinned: 0.5, Reactions: 0.1, Replies: 0.2}
+		assert.InDelta(t, 1.5, boosts.multiplier(map[string]interface{}{"is_pinned": true}, now), 0.001)
+		assert.InDelta(t, 1+0.1*1.0986, boosts.multiplier(map[string]interface{}{"reaction_count": 2}, now), 0.001)
+		assert.InDelta(t, 1+0.2*1.0986, boosts.multiplier(map[string]interface{}{"reply_count": float64(2)}, now), 0.001)
+		assert.InDelta(t, 1, boosts.multiplier(map[string]interface{}{"is_pinned": false, "reaction_count": 0}, now), 0.001)
+	})
+}
+
+func TestBoostResults(t *testing.T) {
+	now := time.UnixMilli(100 * 24 * time.Hour.Milliseconds())
+	results := []searchResult{
+		{Id: "old", Scores: ScoreBreakdown{Vector: 0.9}, Metadata: map[string]interface{}{"create_at": now.Add(-30 * 24 * time.Hour).UnixMilli()}},
+		{Id: "recent", Scores: ScoreBreakdown{Vector: 0.8}, Metadata: map[string]interface{}{"create_at": now.UnixMilli()}},
+		{Id: "pinned", Scores: ScoreBreakdown{Vector: 0.5}, Metadata: map[string]interface{}{"create_at": now.UnixMilli(), "is_pinned": true}},
+		{Id: "unrelated", Scores: ScoreBreakdown{Vector: 0.1}, Metadata: map[string]interface{}{"create_at": now.UnixMilli()}},
+	}
+
+	// the scores are divided by the highest one before they're boosted
+	boostedResults := boostResults(results, ScoreBoosts{RecencyHalfLife: 30 * 24 * time.Hour, Pinned: 1}, now, len(results))
+	assert.Equal(t, []string{"pinned", "recent", "old", "unrelated"}, flattenIds(boostedResults))
+	assert.InDelta(t, 10.0/9, boostedResults[0].Scores.Boosted, 0.001)
+	assert.InDelta(t, 2, boostedResults[0].Scores.Boost, 0.001)
+	assert.InDelta(t, 0.5, boostedResults[2].Scores.Boosted, 0.001)
+	assert.InDelta(t, 0.5, rankingScore(boostedResults[2].Scores), 0.001)
+
+	// the results aren't changed
+	assert.Equal(t, []string{"old", "recent", "pinned", "unrelated"}, flattenIds(results))
+	assert.Equal(t, 0.0, results[0].Scores.Boost)
+
+	t.Run("negative scores are boosted up", func(t *testing.T) {
+		// the scores of a reranker, pinning the second result
+		results := []searchResult{
+			{Id: "first", Scores: ScoreBreakdown{Rerank: -1, RerankRank: 1}, Metadata: map[string]interface{}{}},
+			{Id: "pinned", Scores: ScoreBreakdown{Rerank: -2, RerankRank: 2}, Metadata: map[string]interface{}{"is_pinned": true}},
+			{Id: "last", Scores: ScoreBreakdown{Rerank: -4, RerankRank: 3}, Metadata: map[string]interface{}{}},
+		}
+
+		boostedResults := boostResults(results, ScoreBoosts{Pinned: 1}, now, len(results))
+		assert.Equal(t, []string{"pinned", "first", "last"}, flattenIds(boostedResults))
+		assert.InDelta(t, 1.4, boostedResults[0].Scores.Boosted, 0.001)
+		for _, result := range boostedResults {
+			assert.Greater(t, result.Scores.Boosted, 0.0)
+		}
+
+		// the lowest result can still be boosted
+		results[1].Metadata = map[string]interface{}{}
+		results[2].Metadata = map[string]interface{}{"is_pinned": true}
+		boostedResults = boostResults(results, ScoreBoosts{Pinned: 20}, now, len(results))
+		assert.Equal(t, "last", boostedResults[0].Id)
+	})
+
+	t.Run("only the reranked results are boosted", func(t *testing.T) {
+		// the reranker scored the first two results, and the others keep their vector score
+		results := []searchResult{
+			{Id: "reranked1", Scores: ScoreBreakdown{Vector: 0.2, Rerank: 8, RerankRank: 1}, Metadata: map[string]interface{}{}},
+			{Id: "reranked2", Scores: ScoreBreakdown{Vector: 0.3, Rerank: 2, RerankRank: 2}, Metadata: map[string]interface{}{"is_pinned": true}},
+			{Id: "tail1", Scores: ScoreBreakdown{Vector: 0.9}, Metadata: map[string]interface{}{"is_pinned": true}},
+			{Id: "tail2", Scores: ScoreBreakdown{Vector: 0.8}, Metadata: map[string]interface{}{}},
+		}
+
+		boostedResults := boostResults(results, ScoreBoosts{Pinned: 1}, now, 2)
+		assert.Equal(t, []string{"reranked1", "reranked2", "tail1", "tail2"}, flattenIds(boostedResults))
+		assert.InDelta(t, 1, boostedResults[0].Scores.Boosted, 0.001)
+		assert.InDelta(t, 0.5, boostedResults[1].Scores.Boosted, 0.001)
+		assert.Equal(t, 0.0, boostedResults[2].Scores.Boost)
+		assert.Equal(t, 0.0, boostedResults[3].Scores.Boost)
+	})
+}
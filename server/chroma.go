@@ -2,79 +2,308 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"runtime/pprof"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 
 	chroma "github.com/amikos-tech/chroma-go"
 	"github.com/amikos-tech/chroma-go/collection"
+	openapiclient "github.com/amikos-tech/chroma-go/swagger"
 	"github.com/amikos-tech/chroma-go/types"
-	"github.com/amikos-tech/chroma-go/where"
 )
 
-var instance ChromaClient
-var once sync.Once
+// metadata key used to record the model that produced a collection's vectors
+const embeddingModelMetadataKey = "embedding_model"
+
+var ErrEmbeddingModelMismatch = errors.New("embedding model mismatch")
+
+const defaultChromaURL = "http://localhost:8000"
+
+// number of documents requested per page when listing a collection
+const chromaGetPageSize = 1000
+
+// ChromaSettings are the settings used to connect to the chroma server
+type ChromaSettings struct {
+	URL string
+	// APIToken is sent in TokenHeader, either Authorization (as a bearer token) or X-Chroma-Token
+	APIToken    string
+	TokenHeader string
+	// Username and Password are used for basic auth, if no api token is set
+	Username string
+	Password string
+	// CACertificate is a PEM encoded certificate trusted in addition to the system ones
+	CACertificate string
+	Tenant        string
+	Database      string
+	// CollectionPrefix is prepended to the names of the collections, to share a database between servers
+	CollectionPrefix string
+}
 
-type ChromaClient struct {
-	client *chroma.Client
+// chroma collection names must start with a letter or a digit, and may contain dots, dashes and underscores
+var chromaCollectionPrefixRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,39}$`)
+
+// IsValid checks that the settings can be used to create a chroma client
+func (settings ChromaSettings) IsValid() error {
+	if settings.URL != "" {
+		parsedURL, err := url.Parse(settings.URL)
+		if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+			return fmt.Errorf("chroma url must be an http or https url: %v", settings.URL)
+		}
+	}
+
+	if settings.APIToken != "" && settings.Username != "" {
+		return errors.New("chroma can use either an api token or a username and password, not both")
+	}
+
+	switch types.TokenTransportHeader(settings.TokenHeader) {
+	case "", types.AuthorizationTokenHeader, types.XChromaTokenHeader:
+	default:
+		return fmt.Errorf("chroma token header must be either %v or %v", types.AuthorizationTokenHeader, types.XChromaTokenHeader)
+	}
+
+	if settings.CACertificate != "" {
+		if _, err := newHTTPClientWithCA(settings.CACertificate); err != nil {
+			return err
+		}
+	}
+
+	if settings.CollectionPrefix != "" && !chromaCollectionPrefixRegex.MatchString(settings.CollectionPrefix) {
+		return fmt.Errorf("chroma collection prefix must start with a letter or a digit, and only contain letters, digits, dots, dashes and underscores: %v", settings.CollectionPrefix)
+	}
+
+	return nil
 }
 
-func GetChromaInstance() *ChromaClient {
-	fmt.Println("Connecting to Chroma ...")
+// ChromaClient is a VectorStore keeping each source's messages in a chroma collection
+type ChromaClient struct {
+	client           *chroma.Client
+	embedder         Embedder
+	collectionPrefix string
+
+	// the collections already got, by collection type. They're got again after a reset, a
+	// reconnection, or a failed request, in case they were deleted by another server.
+	collectionsLock sync.Mutex
+	collections     map[string]*chroma.Collection
+}
 
-	once.Do(func() {
-		instance.client, _ = chroma.NewClient("http://localhost:8000")
-	})
+// Create a client of the chroma server defined in settings, which embeds the documents using embedder.
+// The server isn't contacted until the client is used.
+func NewChromaClient(settings ChromaSettings, embedder Embedder) (*ChromaClient, error) {
+	chromaURL := settings.URL
+	if chromaURL == "" {
+		chromaURL = defaultChromaURL
+	}
 
-	ctx := context.Background()
+	options := []chroma.ClientOption{}
+	if settings.Tenant != "" {
+		options = append(options, chroma.WithTenant(settings.Tenant))
+	}
+	if settings.Database != "" {
+		options = append(options, chroma.WithDatabase(settings.Database))
+	}
 
-	_, err := instance.client.Heartbeat(ctx)
+	if settings.APIToken != "" {
+		tokenHeader := types.AuthorizationTokenHeader
+		if settings.TokenHeader != "" {
+			tokenHeader = types.TokenTransportHeader(settings.TokenHeader)
+		}
+		options = append(options, chroma.WithAuth(types.NewTokenAuthCredentialsProvider(settings.APIToken, tokenHeader)))
+	} else if settings.Username != "" {
+		options = append(options, chroma.WithAuth(types.NewBasicAuthCredentialsProvider(settings.Username, settings.Password)))
+	}
 
+	client, err := chroma.NewClient(chromaURL, options...)
 	if err != nil {
-		log.Println("... Failed to connect")
-		log.Fatalf("Error while  trying to connect to chroma %v \n", err)
+		return nil, newVectorStoreError("create chroma client", nil, err)
 	}
 
-	fmt.Println("... Connected to Chroma")
-	// profile start
-	pprof.StopCPUProfile()
-	f, fErr := os.Create("after-chroma-connect.pprof")
-	if fErr != nil {
-		fmt.Println("Error: ", fErr)
+	if settings.CACertificate != "" {
+		httpClient, err := newHTTPClientWithCA(settings.CACertificate)
+		if err != nil {
+			return nil, newVectorStoreError("create chroma client", nil, err)
+		}
+		client.ApiClient.GetConfig().HTTPClient = httpClient
 	}
-	pprof.WriteHeapProfile(f)
-	f.Close()
 
-	return &instance
+	return &ChromaClient{
+		client:           client,
+		embedder:         embedder,
+		collectionPrefix: settings.CollectionPrefix,
+		collections:      map[string]*chroma.Collection{},
+	}, nil
 }
 
-func (chromaClient *ChromaClient) ResetData(ctx context.Context) (bool, error) {
-	return chromaClient.client.Reset(ctx)
+// Create an http client trusting the PEM encoded certificates in caCertificate, in addition to the system ones
+func newHTTPClientWithCA(caCertificate string) (*http.Client, error) {
+	certPool, err := x509.SystemCertPool()
+	if err != nil || certPool == nil {
+		certPool = x509.NewCertPool()
+	}
+
+	if !certPool.AppendCertsFromPEM([]byte(caCertificate)) {
+		return nil, errors.New("the CA certificate isn't a valid PEM encoded certificate")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    certPool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// Check that the chroma server can be reached
+func (chromaClient *ChromaClient) Heartbeat(ctx context.Context) error {
+	if _, err := chromaClient.client.Heartbeat(ctx); err != nil {
+		return newVectorStoreError("connect to chroma", ErrVectorStoreUnavailable, err)
+	}
+
+	return nil
 }
 
-func (chromaClient *ChromaClient) GetOrCreateCollection(collectionType string) (*chroma.Collection, error) {
-	// os.Getenv()
+// Delete the plugin's collections, leaving the other collections of the chroma database alone
+func (chromaClient *ChromaClient) Reset(ctx context.Context) error {
+	chromaClient.forgetCollections()
+
+	existingCollections, err := chromaClient.client.ListCollections(ctx)
+	if err != nil {
+		return newVectorStoreError("list collections", nil, err)
+	}
+
+	collectionNames := map[string]bool{
+		chromaClient.collectionName(mattermostCollectionType): true,
+		chromaClient.collectionName(slackCollectionType):      true,
+	}
+
+	for _, existingCollection := range existingCollections {
+		if !collectionNames[existingCollection.Name] {
+			continue
+		}
+
+		if _, err := chromaClient.client.DeleteCollection(ctx, existingCollection.Name); err != nil {
+			return newVectorStoreError("delete collection "+existingCollection.Name, nil, err)
+		}
+	}
 
+	return nil
+}
+
+func (chromaClient *ChromaClient) collectionName(collectionType string) string {
 	if collectionType == "" {
-		collectionType = "mattermost"
+		collectionType = mattermostCollectionType
+	}
+
+	return chromaClient.collectionPrefix + collectionType + "_messages"
+}
+
+// the collections default to the hash embedder if no embedder is set
+func (chromaClient *ChromaClient) getEmbedder() Embedder {
+	if chromaClient.embedder == nil {
+		return NewHashEmbedder()
+	}
+
+	return chromaClient.embedder
+}
+
+func (chromaClient *ChromaClient) VerifyEmbeddingModel(ctx context.Context) error {
+	// the collections are checked again when the client reconnects
+	chromaClient.forgetCollections()
+
+	for _, collectionType := range []string{mattermostCollectionType, slackCollectionType} {
+		if _, err := chromaClient.GetOrCreateCollection(ctx, collectionType); err != nil {
+			return err
+		}
 	}
 
+	return nil
+}
+
+// Get a collection, from the collections already got if possible
+func (chromaClient *ChromaClient) GetOrCreateCollection(ctx context.Context, collectionType string) (*chroma.Collection, error) {
 	if chromaClient == nil {
-		return nil, errors.New("chroma db is not connected")
+		return nil, newVectorStoreError("get collection", ErrVectorStoreUnavailable, errors.New("chroma db is not connected"))
+	}
+
+	chromaClient.collectionsLock.Lock()
+	defer chromaClient.collectionsLock.Unlock()
+
+	if cachedCollection, ok := chromaClient.collections[collectionType]; ok {
+		return cachedCollection, nil
 	}
 
-	collectionName := collectionType + "_messages"
-	metadatas := map[string]interface{}{}
-	embeddingFunction := types.NewConsistentHashEmbeddingFunction()
+	collection, err := chromaClient.getOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	if chromaClient.collections == nil {
+		chromaClient.collections = map[string]*chroma.Collection{}
+	}
+	chromaClient.collections[collectionType] = collection
+
+	return collection, nil
+}
+
+// Get the collections from the chroma server on their next use
+func (chromaClient *ChromaClient) forgetCollections() {
+	chromaClient.collectionsLock.Lock()
+	defer chromaClient.collectionsLock.Unlock()
+
+	chromaClient.collections = map[string]*chroma.Collection{}
+}
+
+// Get the collection of collectionType from the chroma server, or create it
+func (chromaClient *ChromaClient) getOrCreateCollection(ctx context.Context, collectionType string) (*chroma.Collection, error) {
+	collectionName := chromaClient.collectionName(collectionType)
+	embedder := chromaClient.getEmbedder()
+	embeddingFunction := &chromaEmbeddingFunction{embedder: embedder}
+
+	// Returns a collection, if the collection exists and was embedded using the same model.
+	// get or create would overwrite the metadata of an existing collection, so it's checked first
+	existingCollections, err := chromaClient.client.ListCollections(ctx)
+	if err != nil {
+		return nil, newVectorStoreError("list collections", nil, err)
+	}
+
+	for _, existingCollection := range existingCollections {
+		if existingCollection.Name != collectionName {
+			continue
+		}
+
+		// collections created before the model was recorded were embedded using the hash function
+		collectionModel, ok := existingCollection.Metadata[embeddingModelMetadataKey].(string)
+		if !ok {
+			collectionModel = EmbeddingProviderHash
+		}
+
+		if collectionModel != embedder.Model() {
+			return nil, newVectorStoreError("get collection", ErrEmbeddingModelMismatch, fmt.Errorf(
+				"%v was embedded using %q but the configured model is %q, reset the vector store to re-embed the messages",
+				collectionName,
+				collectionModel,
+				embedder.Model(),
+			))
+		}
+
+		existingCollection.EmbeddingFunction = embeddingFunction
+		return existingCollection, nil
+	}
+
+	metadatas := map[string]interface{}{
+		embeddingModelMetadataKey: embedder.Model(),
+	}
 
 	// Creates new collection, if the collection doesn't exist
-	// Returns a collection, if the collection exists
 	newCollection, err := chromaClient.client.NewCollection(
-		context.Background(),
+		ctx,
 		collection.WithName(collectionName),
 		collection.WithMetadatas(metadatas),
 		collection.WithEmbeddingFunction(embeddingFunction),
@@ -82,128 +311,256 @@ func (chromaClient *ChromaClient) GetOrCreateCollection(collectionType string) (
 		collection.WithCreateIfNotExist(true),
 	)
 	if err != nil {
-		return nil, err
+		return nil, newVectorStoreError("create collection", nil, err)
 	}
 
 	return newCollection, nil
 }
 
-func (chromaClient *ChromaClient) Query(query string, mmChannelIds []interface{}) chroma.QueryResults {
-	mattermostCollectionType := "mattermost"
-	slackCollectionType := "slack"
+func (chromaClient *ChromaClient) Upsert(ctx context.Context, collectionType string, ids []string, documents []string, metadatas []map[string]interface{}) error {
+	collection, err := chromaClient.GetOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return err
+	}
+
+	// Even tho the embeddings are not provided, this function call will embed the documents using the embedding function defined in the collection
+	if _, err := collection.Upsert(ctx, nil, metadatas, documents, ids); err != nil {
+		chromaClient.forgetCollections()
+		return newVectorStoreError("upsert to "+collection.Name, nil, err)
+	}
+
+	return nil
+}
+
+func (chromaClient *ChromaClient) Delete(ctx context.Context, collectionType string, ids []string) error {
+	collection, err := chromaClient.GetOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return err
+	}
 
-	// get the mattermost collections
-	mattermostCollection, mmError := chromaClient.GetOrCreateCollection(mattermostCollectionType)
-	if mmError != nil {
-		log.Fatalf("error getting mattermost collection: %v", mmError)
+	if _, err := collection.Delete(ctx, ids, nil, nil); err != nil {
+		chromaClient.forgetCollections()
+		return newVectorStoreError("delete from "+collection.Name, nil, err)
 	}
 
-	// get the slack collections
-	slackCollection, slkError := chromaClient.GetOrCreateCollection(slackCollectionType)
-	if slkError != nil {
-		log.Fatalf("error getting slack collection: %v", slkError)
+	return nil
+}
+
+func (chromaClient *ChromaClient) DeleteWhere(ctx context.Context, collectionType string, whereClause map[string]interface{}) error {
+	collection, err := chromaClient.GetOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return err
+	}
+
+	if _, err := collection.Delete(ctx, nil, whereClause, nil); err != nil {
+		chromaClient.forgetCollections()
+		return newVectorStoreError("delete from "+collection.Name, nil, err)
 	}
 
-	// list of channel ids user belongs to
-	channelIds := mmChannelIds
+	return nil
+}
 
-	queryTexts := []string{query}
-	// TODO: replace this variable with the user defined one
-	n_results := int32(5)
-	inExpression := map[string]interface{}{}
-
-	if len(channelIds) > 0 {
-		inExpr, whrError := where.Where(where.In("channel_id", channelIds))
-		if whrError != nil {
-			log.Fatalf("error while building where clause: %v \n", whrError)
-		}
-		inExpression = inExpr
-	}
-
-	// query the mattermost collection
-	mmResponse, mmResError := mattermostCollection.Query(
-		context.Background(),
-		queryTexts,
-		n_results,
-		inExpression,
-		nil,
-		nil,
+func (chromaClient *ChromaClient) GetMetadatas(ctx context.Context, collectionType string) (map[string]map[string]interface{}, error) {
+	collection, err := chromaClient.GetOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	metadatas := map[string]map[string]interface{}{}
+	for offset := int32(0); ; offset += chromaGetPageSize {
+		results, err := collection.GetWithOptions(ctx,
+			types.WithInclude(types.IMetadatas),
+			types.WithLimit(chromaGetPageSize),
+			types.WithOffset(offset),
+		)
+		if err != nil {
+			chromaClient.forgetCollections()
+			return nil, newVectorStoreError("get from "+collection.Name, nil, err)
+		}
+
+		for i, id := range results.Ids {
+			metadatas[id] = results.Metadatas[i]
+		}
+
+		if len(results.Ids) < chromaGetPageSize {
+			return metadatas, nil
+		}
+	}
+}
+
+// chroma-go doesn't return the embeddings of the query results, so they are got by id
+func (chromaClient *ChromaClient) GetEmbeddings(ctx context.Context, collectionType string, ids []string) (map[string][]float32, error) {
+	embeddings := map[string][]float32{}
+	if len(ids) == 0 {
+		return embeddings, nil
+	}
+
+	collection, err := chromaClient.GetOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := collection.GetWithOptions(ctx,
+		types.WithIds(ids),
+		types.WithInclude(types.IEmbeddings),
 	)
-	if mmResError != nil {
-		log.Fatalf("error while querying mattermost collection: %v \n", mmResError)
+	if err != nil {
+		chromaClient.forgetCollections()
+		return nil, newVectorStoreError("get from "+collection.Name, nil, err)
 	}
 
-	// query the slack collection
-	slkResponse, slkResError := slackCollection.Query(
-		context.Background(),
-		queryTexts,
-		n_results,
-		nil,
-		nil,
-		nil,
+	for i, id := range results.Ids {
+		if i < len(results.Embeddings) && results.Embeddings[i] != nil && results.Embeddings[i].GetFloat32() != nil {
+			embeddings[id] = *results.Embeddings[i].GetFloat32()
+		}
+	}
+
+	return embeddings, nil
+}
+
+func (chromaClient *ChromaClient) GetDocuments(ctx context.Context, collectionType string, ids []string) (map[string]string, error) {
+	documents := map[string]string{}
+	if len(ids) == 0 {
+		return documents, nil
+	}
+
+	collection, err := chromaClient.GetOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := collection.GetWithOptions(ctx,
+		types.WithIds(ids),
+		types.WithInclude(types.IDocuments),
 	)
-	if slkResError != nil {
-		log.Fatalf("error while querying slack collection: %v \n", slkResError)
+	if err != nil {
+		chromaClient.forgetCollections()
+		return nil, newVectorStoreError("get from "+collection.Name, nil, err)
 	}
 
-	// log the response
-	responseJSON, _ := json.MarshalIndent(slkResponse, "->", "  ")
-	fmt.Println(string(responseJSON))
+	for i, id := range results.Ids {
+		if i < len(results.Documents) {
+			documents[id] = results.Documents[i]
+		}
+	}
+
+	return documents, nil
+}
+
+func (chromaClient *ChromaClient) Query(ctx context.Context, query string, mmChannelIds []interface{}, nResults int, minScore float64, filters SearchFilters) ([]searchResult, error) {
+	// get the mattermost collections
+	mattermostCollection, err := chromaClient.GetOrCreateCollection(ctx, mattermostCollectionType)
+	if err != nil {
+		return nil, err
+	}
 
-	// combine the slack and mattermost responses
-	response := chroma.QueryResults{
-		Documents: append(mmResponse.Documents, slkResponse.Documents...),
-		Ids:       append(mmResponse.Ids, slkResponse.Ids...),
-		Metadatas: append(mmResponse.Metadatas, slkResponse.Metadatas...),
-		Distances: append(mmResponse.Distances, slkResponse.Distances...),
+	// get the slack collections
+	slackCollection, err := chromaClient.GetOrCreateCollection(ctx, slackCollectionType)
+	if err != nil {
+		return nil, err
 	}
 
-	// filter out the combined results with distances below a certain threshold defined in "max_chroma_distance"
+	queryTexts := []string{query}
+	n_results := int32(nResults)
 
-	// TODO: replace this variable with the user defined one
-	max_chroma_distance := float32(0.19)
+	// query the mattermost collection only when a post can match the filters,
+	// which always restrict the channels to the ones the user belongs to
+	mmResponse := &chroma.QueryResults{}
+	mmWhere, queryMattermost, err := filters.mattermostWhere(mmChannelIds)
+	if err != nil {
+		return nil, newVectorStoreError("build mattermost where clause", ErrInvalidFilter, err)
+	}
 
-	filteredResponse := chroma.QueryResults{
-		Documents: make([][]string, len(response.Documents)),
-		Ids:       make([][]string, len(response.Ids)),
-		Metadatas: make([][]map[string]interface{}, len(response.Metadatas)),
-		Distances: make([][]float32, len(response.Distances)),
+	if queryMattermost {
+		mmResponse, err = mattermostCollection.Query(ctx, queryTexts, n_results, mmWhere, nil, nil)
+		if err != nil {
+			chromaClient.forgetCollections()
+			return nil, newVectorStoreError("query mattermost collection", chromaQueryErrorKind(err), err)
+		}
 	}
 
-	for i, distances := range response.Distances {
-		for j, distance := range distances {
-			if distance < max_chroma_distance {
-				// Ensure that the sub-slices are initialized
-				if filteredResponse.Documents[i] == nil {
-					filteredResponse.Documents[i] = []string{}
-				}
-				if filteredResponse.Ids[i] == nil {
-					filteredResponse.Ids[i] = []string{}
+	// query the slack collection
+	slkResponse := &chroma.QueryResults{}
+	slkWhere, querySlack, err := filters.slackWhere()
+	if err != nil {
+		return nil, newVectorStoreError("build slack where clause", ErrInvalidFilter, err)
+	}
+
+	if querySlack {
+		slkResponse, err = slackCollection.Query(ctx, queryTexts, n_results, slkWhere, nil, nil)
+		if err != nil {
+			chromaClient.forgetCollections()
+			return nil, newVectorStoreError("query slack collection", chromaQueryErrorKind(err), err)
+		}
+	}
+
+	// filter out the results with distances above a certain threshold defined in "max_chroma_distance"
+	max_chroma_distance := float32(1 - minScore)
+
+	return mergeQueryResults(max_chroma_distance, *mmResponse, *slkResponse), nil
+}
+
+// Chroma rejects invalid where clauses with a 400 or 422 error about the where clause. A rejected
+// token makes the vector store unavailable until the configuration is fixed.
+func chromaQueryErrorKind(err error) error {
+	var openAPIError *openapiclient.GenericOpenAPIError
+	if !errors.As(err, &openAPIError) {
+		return nil
+	}
+
+	// the error is the status of the response, like "400 Bad Request"
+	status := openAPIError.Error()
+	switch {
+	case strings.HasPrefix(status, "401") || strings.HasPrefix(status, "403"):
+		return ErrVectorStoreUnavailable
+	case (strings.HasPrefix(status, "400") || strings.HasPrefix(status, "422")) && strings.Contains(strings.ToLower(string(openAPIError.Body())), "where"):
+		return ErrInvalidFilter
+	}
+
+	return nil
+}
+
+// Merge the results of the collections into a single list sorted by descending similarity.
+// Results further than maxDistance are dropped, and a document returned more than once is only kept with its best score.
+func mergeQueryResults(maxDistance float32, responses ...chroma.QueryResults) []searchResult {
+	results := []searchResult{}
+	positions := map[string]int{}
+
+	for _, response := range responses {
+		for i, ids := range response.Ids {
+			for j, id := range ids {
+				distance := response.Distances[i][j]
+				if distance > maxDistance {
+					continue
 				}
-				if filteredResponse.Metadatas[i] == nil {
-					filteredResponse.Metadatas[i] = []map[string]interface{}{}
+
+				result := searchResult{
+					Id:       id,
+					Document: response.Documents[i][j],
+					Metadata: response.Metadatas[i][j],
+					Scores:   ScoreBreakdown{Vector: float64(1 - distance)},
 				}
-				if filteredResponse.Distances[i] == nil {
-					filteredResponse.Distances[i] = []float32{}
+
+				if position, ok := positions[id]; ok {
+					if result.Scores.Vector > results[position].Scores.Vector {
+						results[position] = result
+					}
+					continue
 				}
 
-				filteredResponse.Documents[i] = append(filteredResponse.Documents[i], response.Documents[i][j])
-				filteredResponse.Ids[i] = append(filteredResponse.Ids[i], response.Ids[i][j])
-				filteredResponse.Metadatas[i] = append(filteredResponse.Metadatas[i], response.Metadatas[i][j])
-				filteredResponse.Distances[i] = append(filteredResponse.Distances[i], response.Distances[i][j])
+				positions[id] = len(results)
+				results = append(results, result)
 			}
 		}
 	}
 
-	// return if no relevant data is found
-	if len(filteredResponse.Documents) == 0 {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Scores.Vector > results[j].Scores.Vector
+	})
+
+	if len(results) == 0 {
 		fmt.Println("No relevant data found")
-		return filteredResponse
 	}
 
-	// // print the response
-	// responseJSON, _ := json.MarshalIndent(filteredResponse, "->", "  ")
-	// fmt.Println(string(responseJSON))
-
-	return filteredResponse
+	return results
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewChromaClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Chroma-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"nanosecond heartbeat": 1}`))
+	}))
+	defer server.Close()
+
+	caCertificate := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	t.Run("connects using the CA certificate and api token", func(t *testing.T) {
+		client, err := NewChromaClient(ChromaSettings{
+			URL:           server.URL,
+			APIToken:      "secret",
+			TokenHeader:   "X-Chroma-Token",
+			CACertificate: caCertificate,
+		}, NewHashEmbedder())
+		assert.Nil(t, err)
+		assert.Nil(t, client.Heartbeat(context.Background()))
+	})
+
+	t.Run("untrusted server is unavailable", func(t *testing.T) {
+		client, err := NewChromaClient(ChromaSettings{URL: server.URL, APIToken: "secret", TokenHeader: "X-Chroma-Token"}, NewHashEmbedder())
+		assert.Nil(t, err)
+		assert.ErrorIs(t, client.Heartbeat(context.Background()), ErrVectorStoreUnavailable)
+	})
+}
+
+func TestChromaClientCollections(t *testing.T) {
+	listCalls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == "/api/v1/version":
+			w.Write([]byte(`"0.4.14"`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/collections":
+			listCalls++
+			w.Write([]byte(`[
+				{"name": "mattermost_messages", "id": "00000000-0000-0000-0000-000000000001", "metadata": {"embedding_model": "hash"}},
+				{"name": "slack_messages", "id": "00000000-0000-0000-0000-000000000002", "metadata": {"embedding_model": "hash"}}
+			]`))
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/delete"):
+			w.Write([]byte(`[]`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error": "unexpected request"}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewChromaClient(ChromaSettings{URL: server.URL}, NewHashEmbedder())
+	assert.Nil(t, err)
+	ctx := context.Background()
+
+	t.Run("the collections are got once", func(t *testing.T) {
+		// once for each collection
+		assert.Nil(t, client.VerifyEmbeddingModel(ctx))
+		assert.Equal(t, 2, listCalls)
+
+		assert.Nil(t, client.Delete(ctx, mattermostCollectionType, []string{"post1"}))
+		assert.Nil(t, client.Delete(ctx, slackCollectionType, []string{"message1"}))
+		assert.Equal(t, 2, listCalls)
+	})
+
+	t.Run("the collections are got again after a failed request", func(t *testing.T) {
+		_, err := client.GetEmbeddings(ctx, mattermostCollectionType, []string{"post1"})
+		assert.NotNil(t, err)
+		assert.Nil(t, client.Delete(ctx, mattermostCollectionType, []string{"post1"}))
+		assert.Equal(t, 3, listCalls)
+	})
+
+	t.Run("the collections are got again when reconnecting", func(t *testing.T) {
+		assert.Nil(t, client.VerifyEmbeddingModel(ctx))
+		assert.Equal(t, 5, listCalls)
+	})
+}
+
+func TestChromaQueryErrorKind(t *testing.T) {
+	status, body := 0, ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == "/api/v1/version":
+			w.Write([]byte(`"0.4.14"`))
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/collections":
+			w.Write([]byte(`[
+				{"name": "mattermost_messages", "id": "00000000-0000-0000-0000-000000000001", "metadata": {"embedding_model": "hash"}},
+				{"name": "slack_messages", "id": "00000000-0000-0000-0000-000000000002", "metadata": {"embedding_model": "hash"}}
+			]`))
+		default:
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewChromaClient(ChromaSettings{URL: server.URL}, NewHashEmbedder())
+	assert.Nil(t, err)
+
+	for name, test := range map[string]struct {
+		status   int
+		body     string
+		expected error
+	}{
+		"invalid where clause": {http.StatusBadRequest, `{"error": "ValueError('Expected where operator to be one of $gt, $gte')"}`, ErrInvalidFilter},
+		"unprocessable where":  {http.StatusUnprocessableEntity, `{"detail": [{"loc": ["body", "where"]}]}`, ErrInvalidFilter},
+		"other bad request":    {http.StatusBadRequest, `{"error": "invalid embedding dimension"}`, nil},
+		"rejected token":       {http.StatusUnauthorized, `{"error": "unauthorized"}`, ErrVectorStoreUnavailable},
+		"forbidden":            {http.StatusForbidden, `{"error": "forbidden where"}`, ErrVectorStoreUnavailable},
+		"collection not found": {http.StatusNotFound, `{"error": "collection not found"}`, nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			status, body = test.status, test.body
+
+			_, err := client.Query(context.Background(), "deploy", []interface{}{"c1"}, 10, 0, SearchFilters{})
+			assert.NotNil(t, err)
+			if test.expected == nil {
+				assert.NotErrorIs(t, err, ErrInvalidFilter)
+				assert.NotErrorIs(t, err, ErrVectorStoreUnavailable)
+			} else {
+				assert.ErrorIs(t, err, test.expected)
+			}
+		})
+	}
+}
+
+// Runs against the chroma server at CHROMA_URL, which must allow resets as the tests reset it
+func TestChromaClientConformance(t *testing.T) {
+	chromaURL := os.Getenv("CHROMA_URL")
+	if chromaURL == "" {
+		t.Skip("CHROMA_URL isn't set")
+	}
+
+	testVectorStoreConformance(t, func(t *testing.T) func(embedder Embedder) VectorStore {
+		// every test uses its own collections
+		settings := ChromaSettings{URL: chromaURL, CollectionPrefix: fmt.Sprintf("test%d-", time.Now().UnixNano())}
+
+		return func(embedder Embedder) VectorStore {
+			client, err := NewChromaClient(settings, embedder)
+			assert.Nil(t, err)
+			return client
+		}
+	})
+}
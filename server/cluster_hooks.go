@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// The lexical index is saved in the KV store, and every server of a cluster keeps its inverted
+// index in memory. The servers tell the others which segments of changes they wrote, so they apply them.
+
+// id of the cluster events with the segments written to the lexical index
+const lexicalChangeEventId = "lexical_change"
+
+// OnPluginClusterEvent is invoked when another server of the cluster publishes an event
+func (p *Plugin) OnPluginClusterEvent(c *plugin.Context, ev model.PluginClusterEvent) {
+	if ev.Id != lexicalChangeEventId {
+		return
+	}
+
+	change := LexicalChange{}
+	if err := json.Unmarshal(ev.Data, &change); err != nil {
+		log.Printf("error while decoding the lexical index change: %v \n", err)
+		return
+	}
+
+	if err := GetLexicalIndex().Refresh(change); err != nil {
+		log.Printf("error while reloading the lexical index: %v \n", err)
+	}
+}
+
+// Tell the other servers of the cluster which segment of the lexical index was written
+func (p *Plugin) publishLexicalChange(change LexicalChange) {
+	changeJSON, err := json.Marshal(change)
+	if err != nil {
+		log.Printf("error while encoding the lexical index change: %v \n", err)
+		return
+	}
+
+	err = p.API.PublishPluginClusterEvent(
+		model.PluginClusterEvent{Id: lexicalChangeEventId, Data: changeJSON},
+		model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable},
+	)
+	if err != nil {
+		log.Printf("error while publishing the lexical index change: %v \n", err)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -18,6 +20,281 @@ import (
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
+	// EmbeddingProvider selects the Embedder used to embed messages: hash, openai or ollama
+	EmbeddingProvider string
+	// EmbeddingURL is the base URL of the embedding service
+	EmbeddingURL string
+	// EmbeddingModel is the name of the model used by the embedding service
+	EmbeddingModel string
+	// EmbeddingAPIKey is sent as a bearer token to OpenAI compatible embedding services
+	EmbeddingAPIKey string
+
+	// VectorStoreBackend selects where the embedded messages are stored: chroma, embedded or pgvector
+	VectorStoreBackend string
+	// PgvectorDataSource is the connection string of the PostgreSQL database used by the pgvector backend
+	PgvectorDataSource string
+
+	// ChromaURL is the URL of the chroma server
+	ChromaURL string
+	// ChromaAPIToken is sent in the ChromaTokenHeader header, Authorization or X-Chroma-Token
+	ChromaAPIToken    string
+	ChromaTokenHeader string
+	// ChromaUsername and ChromaPassword are used for basic auth, if no api token is set
+	ChromaUsername string
+	ChromaPassword string
+	// ChromaCACertificate is a PEM encoded CA certificate used to verify the chroma server
+	ChromaCACertificate string
+	// ChromaTenant and ChromaDatabase hold the collections. Chroma's defaults are used if they're empty
+	ChromaTenant   string
+	ChromaDatabase string
+	// ChromaCollectionPrefix is prepended to the collection names
+	ChromaCollectionPrefix string
+
+	// LLMURL is the base URL of the OpenAI compatible chat completions service
+	LLMURL string
+	// LLMModel is the model used to answer queries. LLM answers are disabled if it's empty
+	LLMModel string
+	// LLMAPIKey is sent as a bearer token to the chat completions service
+	LLMAPIKey string
+	// LLMTemperature is the sampling temperature, a number between 0 and 2
+	LLMTemperature string
+	// LLMMaxTokens is the maximum number of tokens in an answer
+	LLMMaxTokens int
+
+	// SearchResultLimit is the maximum number of results returned in a page, from all sources combined
+	SearchResultLimit int
+	// SearchMinScore is the minimum similarity score (1 - cosine distance) of a result, between 0 and 1
+	SearchMinScore string
+	// SearchLexicalWeight is the weight of the keyword search when it's merged with the vector search,
+	// between 0 and 1. The keyword search is disabled if it's 0
+	SearchLexicalWeight string
+	// SearchMMRLambda is the weight of relevance against diversity when picking the results, between 0 and 1.
+	// Lower values avoid returning many near-identical messages. The diversification is disabled if it's 1
+	SearchMMRLambda string
+
+	// SearchRecencyHalfLife is the number of days after which the score of a message is halved.
+	// Recent messages aren't favoured if it's 0
+	SearchRecencyHalfLife int
+	// SearchPinnedBoost, SearchReactionBoost and SearchReplyBoost increase the score of pinned posts
+	// and of posts with reactions and replies. The boosts are disabled if they're 0
+	SearchPinnedBoost   string
+	SearchReactionBoost string
+	SearchReplyBoost    string
+
+	// RerankURL is the base URL of the rerank service
+	RerankURL string
+	// RerankModel is the model used to rerank the search results. Reranking is disabled if it's empty
+	RerankModel string
+	// RerankAPIKey is sent as a bearer token to the rerank service
+	RerankAPIKey string
+	// RerankCandidates is the number of results fetched and reranked, before the requested page is returned
+	RerankCandidates int
+
+	// ReconciliationInterval is the number of hours between reconciliations of the vector store
+	// with Mattermost. The scheduled reconciliation is disabled if it's 0
+	ReconciliationInterval int
+}
+
+const (
+	defaultSearchResultLimit   = 5
+	maxSearchResultLimit       = 100
+	maxSearchResultDepth       = 1000 // the offset of the last result that can be paged to
+	maxSearchDocuments         = 8000 // the most documents a search fetches to find enough distinct posts
+	defaultSearchMinScore      = 0.81
+	defaultSearchLexicalWeight = 0.3
+	defaultSearchMMRLambda     = 1
+)
+
+// IsValid checks that the configuration values are within their allowed ranges
+func (c *configuration) IsValid() error {
+	switch c.VectorStoreBackend {
+	case "", VectorStoreBackendChroma, VectorStoreBackendEmbedded:
+	case VectorStoreBackendPgvector:
+		if c.PgvectorDataSource == "" {
+			return errors.New("pgvector data source is required for the pgvector vector store")
+		}
+	default:
+		return errors.Errorf("unknown vector store backend: %v", c.VectorStoreBackend)
+	}
+
+	if err := c.getChromaSettings().IsValid(); err != nil {
+		return err
+	}
+
+	if c.SearchResultLimit < 0 || c.SearchResultLimit > maxSearchResultLimit {
+		return errors.Errorf("search result limit must be between 0 (default) and %d", maxSearchResultLimit)
+	}
+
+	if _, err := c.getSearchMinScore(); err != nil {
+		return err
+	}
+
+	if _, err := c.getSearchLexicalWeight(); err != nil {
+		return err
+	}
+
+	if _, err := c.getSearchMMRLambda(); err != nil {
+		return err
+	}
+
+	if _, err := c.getScoreBoosts(); err != nil {
+		return err
+	}
+
+	if c.RerankCandidates < 0 || c.RerankCandidates > maxSearchResultDepth {
+		return errors.Errorf("rerank candidates must be between 0 (default) and %d", maxSearchResultDepth)
+	}
+
+	if c.ReconciliationInterval < 0 {
+		return errors.New("reconciliation interval must be a positive number of hours, or 0 to disable it")
+	}
+
+	if _, err := c.getLLMTemperature(); err != nil {
+		return err
+	}
+
+	if _, err := c.getLLMMaxTokens(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getChromaSettings returns the settings used to connect to the chroma server
+func (c *configuration) getChromaSettings() ChromaSettings {
+	return ChromaSettings{
+		URL:              c.ChromaURL,
+		APIToken:         c.ChromaAPIToken,
+		TokenHeader:      c.ChromaTokenHeader,
+		Username:         c.ChromaUsername,
+		Password:         c.ChromaPassword,
+		CACertificate:    c.ChromaCACertificate,
+		Tenant:           c.ChromaTenant,
+		Database:         c.ChromaDatabase,
+		CollectionPrefix: c.ChromaCollectionPrefix,
+	}
+}
+
+// getSearchResultLimit returns the configured search result limit, or the default one if it's not set
+func (c *configuration) getSearchResultLimit() int {
+	if c.SearchResultLimit == 0 {
+		return defaultSearchResultLimit
+	}
+
+	return c.SearchResultLimit
+}
+
+// getSearchMinScore parses the configured minimum score, or returns the default one if it's not set
+func (c *configuration) getSearchMinScore() (float64, error) {
+	if c.SearchMinScore == "" {
+		return defaultSearchMinScore, nil
+	}
+
+	minScore, err := strconv.ParseFloat(c.SearchMinScore, 64)
+	if err != nil || minScore < 0 || minScore > 1 {
+		return 0, errors.Errorf("search min score must be a number between 0 and 1: %v", c.SearchMinScore)
+	}
+
+	return minScore, nil
+}
+
+// getSearchLexicalWeight parses the configured lexical weight, or returns the default one if it's not set
+func (c *configuration) getSearchLexicalWeight() (float64, error) {
+	if c.SearchLexicalWeight == "" {
+		return defaultSearchLexicalWeight, nil
+	}
+
+	lexicalWeight, err := strconv.ParseFloat(c.SearchLexicalWeight, 64)
+	if err != nil || lexicalWeight < 0 || lexicalWeight > 1 {
+		return 0, errors.Errorf("search lexical weight must be a number between 0 and 1: %v", c.SearchLexicalWeight)
+	}
+
+	return lexicalWeight, nil
+}
+
+// getSearchMMRLambda parses the configured mmr lambda, or returns the default one if it's not set
+func (c *configuration) getSearchMMRLambda() (float64, error) {
+	if c.SearchMMRLambda == "" {
+		return defaultSearchMMRLambda, nil
+	}
+
+	mmrLambda, err := strconv.ParseFloat(c.SearchMMRLambda, 64)
+	if err != nil || mmrLambda < 0 || mmrLambda > 1 {
+		return 0, errors.Errorf("search mmr lambda must be a number between 0 and 1: %v", c.SearchMMRLambda)
+	}
+
+	return mmrLambda, nil
+}
+
+// getScoreBoosts parses the configured recency and engagement boosts, which are disabled if they're not set
+func (c *configuration) getScoreBoosts() (ScoreBoosts, error) {
+	if c.SearchRecencyHalfLife < 0 {
+		return ScoreBoosts{}, errors.New("search recency half-life must be a positive number of days, or 0 to disable it")
+	}
+
+	boosts := ScoreBoosts{RecencyHalfLife: time.Duration(c.SearchRecencyHalfLife) * 24 * time.Hour}
+	for _, boost := range []struct {
+		name   string
+		value  string
+		parsed *float64
+	}{
+		{"pinned", c.SearchPinnedBoost, &boosts.Pinned},
+		{"reaction", c.SearchReactionBoost, &boosts.Reactions},
+		{"reply", c.SearchReplyBoost, &boosts.Replies},
+	} {
+		if boost.value == "" {
+			continue
+		}
+
+		parsedBoost, err := strconv.ParseFloat(boost.value, 64)
+		if err != nil || parsedBoost < 0 {
+			return ScoreBoosts{}, errors.Errorf("search %v boost must be a positive number: %v", boost.name, boost.value)
+		}
+		*boost.parsed = parsedBoost
+	}
+
+	return boosts, nil
+}
+
+// getRerankCandidates returns the configured number of reranked results, or the default one if it's not set
+func (c *configuration) getRerankCandidates() int {
+	if c.RerankCandidates == 0 {
+		return defaultRerankCandidates
+	}
+
+	return c.RerankCandidates
+}
+
+// getReconciliationInterval returns the time between scheduled reconciliations, or 0 if they're disabled
+func (c *configuration) getReconciliationInterval() time.Duration {
+	return time.Duration(c.ReconciliationInterval) * time.Hour
+}
+
+// getLLMTemperature parses the configured llm temperature, or returns the default one if it's not set
+func (c *configuration) getLLMTemperature() (float64, error) {
+	if c.LLMTemperature == "" {
+		return defaultLLMTemperature, nil
+	}
+
+	temperature, err := strconv.ParseFloat(c.LLMTemperature, 64)
+	if err != nil || temperature < 0 || temperature > 2 {
+		return 0, errors.Errorf("llm temperature must be a number between 0 and 2: %v", c.LLMTemperature)
+	}
+
+	return temperature, nil
+}
+
+// getLLMMaxTokens returns the configured max number of generated tokens, or the default one if it's not set
+func (c *configuration) getLLMMaxTokens() (int, error) {
+	if c.LLMMaxTokens < 0 {
+		return 0, errors.Errorf("llm max tokens must not be negative: %v", c.LLMMaxTokens)
+	}
+
+	if c.LLMMaxTokens == 0 {
+		return defaultLLMMaxTokens, nil
+	}
+
+	return c.LLMMaxTokens, nil
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -77,7 +354,18 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	if err := configuration.IsValid(); err != nil {
+		return errors.Wrap(err, "invalid plugin configuration")
+	}
+
 	p.setConfiguration(configuration)
 
+	// reconnect to the vector store if its settings changed, once the plugin is activated
+	if p.vectorStore != nil {
+		if err := p.connectVectorStore(configuration); err != nil {
+			return errors.Wrap(err, "failed to connect to the vector store")
+		}
+	}
+
 	return nil
 }
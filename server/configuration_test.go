@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigurationIsValid(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil((&configuration{}).IsValid())
+	assert.Nil((&configuration{SearchResultLimit: 20, SearchMinScore: "0.5"}).IsValid())
+
+	assert.NotNil((&configuration{SearchResultLimit: -1}).IsValid())
+	assert.NotNil((&configuration{SearchResultLimit: 101}).IsValid())
+	assert.NotNil((&configuration{SearchMinScore: "high"}).IsValid())
+	assert.NotNil((&configuration{SearchMinScore: "1.5"}).IsValid())
+	assert.NotNil((&configuration{SearchLexicalWeight: "-0.1"}).IsValid())
+	assert.Nil((&configuration{SearchMMRLambda: "0.7"}).IsValid())
+	assert.NotNil((&configuration{SearchMMRLambda: "1.5"}).IsValid())
+	assert.Nil((&configuration{SearchRecencyHalfLife: 30, SearchPinnedBoost: "0.5", SearchReactionBoost: "0.1", SearchReplyBoost: "0"}).IsValid())
+	assert.NotNil((&configuration{SearchRecencyHalfLife: -1}).IsValid())
+	assert.NotNil((&configuration{SearchReactionBoost: "-0.1"}).IsValid())
+	assert.NotNil((&configuration{SearchReplyBoost: "many"}).IsValid())
+	assert.Nil((&configuration{RerankModel: "rerank-test", RerankCandidates: 100}).IsValid())
+	assert.NotNil((&configuration{RerankCandidates: -1}).IsValid())
+	assert.NotNil((&configuration{RerankCandidates: 1001}).IsValid())
+	assert.Nil((&configuration{ReconciliationInterval: 24}).IsValid())
+	assert.NotNil((&configuration{ReconciliationInterval: -1}).IsValid())
+	assert.Nil((&configuration{LLMModel: "test-model", LLMTemperature: "0.7", LLMMaxTokens: 100}).IsValid())
+	assert.NotNil((&configuration{LLMTemperature: "hot"}).IsValid())
+	assert.NotNil((&configuration{LLMTemperature: "2.5"}).IsValid())
+	assert.NotNil((&configuration{LLMMaxTokens: -1}).IsValid())
+
+	assert.Nil((&configuration{VectorStoreBackend: VectorStoreBackendEmbedded}).IsValid())
+	assert.Nil((&configuration{VectorStoreBackend: VectorStoreBackendPgvector, PgvectorDataSource: "postgres://localhost/mattermost"}).IsValid())
+	assert.NotNil((&configuration{VectorStoreBackend: VectorStoreBackendPgvector}).IsValid())
+	assert.NotNil((&configuration{VectorStoreBackend: "qdrant"}).IsValid())
+
+	assert.Nil((&configuration{ChromaURL: "https://chroma.example.com:8000", ChromaAPIToken: "token", ChromaTokenHeader: "X-Chroma-Token", ChromaCollectionPrefix: "mm1_"}).IsValid())
+	assert.NotNil((&configuration{ChromaURL: "localhost:8000"}).IsValid())
+	assert.NotNil((&configuration{ChromaAPIToken: "token", ChromaUsername: "user"}).IsValid())
+	assert.NotNil((&configuration{ChromaTokenHeader: "X-Api-Key"}).IsValid())
+	assert.NotNil((&configuration{ChromaCACertificate: "not a certificate"}).IsValid())
+	assert.NotNil((&configuration{ChromaCollectionPrefix: "-mm"}).IsValid())
+}
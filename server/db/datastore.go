@@ -1,31 +1,52 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
-	"log"
+	"time"
 
-	"github.com/boltdb/bolt"
+	bolt "go.etcd.io/bbolt"
 )
 
-type DataStore struct {
+// DataStore stores values by key in buckets
+type DataStore interface {
+	Put(bucketName string, key string, value []byte) error
+	// Get returns an error if the key doesn't exist
+	Get(bucketName string, key string) ([]byte, error)
+	Delete(bucketName string, key string) error
+	// CompareAndSet sets the value only if the current value is oldValue.
+	// A nil oldValue sets the value only if the key doesn't exist.
+	CompareAndSet(bucketName string, key string, oldValue []byte, newValue []byte) (bool, error)
+	ForEach(bucketName string, fn func(key string, value []byte) error) error
+	// Keys returns the keys in the bucket, without reading their values
+	Keys(bucketName string) ([]string, error)
+	DeleteBucket(bucketName string) error
+	Close()
+}
+
+// BoltDataStore is a DataStore in a bolt file of the server the plugin runs on
+type BoltDataStore struct {
 	db *bolt.DB
 }
 
-func GetDataStore(dbName string) *DataStore {
-	// Open the .db data file in your current directory with the name `dbName`. It will be created if it doesn't exist.
+// how long to wait for another process to release a bolt file
+const boltOpenTimeout = 5 * time.Second
+
+func OpenBoltDataStore(dbName string) (*BoltDataStore, error) {
+	// Open the .db data file at the path `dbName`, relative to the current directory. It will be created if it doesn't exist.
 	path := fmt.Sprintf("%s.db", dbName)
-	db, err := bolt.Open(path, 0600, nil)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("could not open %v: %v", path, err)
 	}
-	return &DataStore{db: db}
+	return &BoltDataStore{db: db}, nil
 }
 
-func (store *DataStore) Close() {
+func (store *BoltDataStore) Close() {
 	store.db.Close()
 }
 
-func (store *DataStore) Put(bucketName string, key string, value []byte) error {
+func (store *BoltDataStore) Put(bucketName string, key string, value []byte) error {
 	return store.db.Update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
 
@@ -37,7 +58,26 @@ func (store *DataStore) Put(bucketName string, key string, value []byte) error {
 	})
 }
 
-func (store *DataStore) Get(bucketName string, key string) ([]byte, error) {
+// Put every value in the bucket, by key, in a single transaction
+func (store *BoltDataStore) PutMany(bucketName string, values map[string][]byte) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+
+		if err != nil {
+			return err
+		}
+
+		for key, value := range values {
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *BoltDataStore) Get(bucketName string, key string) ([]byte, error) {
 	var value []byte
 
 	err := store.db.View(func(tx *bolt.Tx) error {
@@ -47,14 +87,127 @@ func (store *DataStore) Get(bucketName string, key string) ([]byte, error) {
 			return fmt.Errorf("bucket %q not found", bucketName)
 		}
 
-		value = bucket.Get([]byte(key))
+		storedValue := bucket.Get([]byte(key))
 
-		if value == nil {
+		if storedValue == nil {
 			return fmt.Errorf("key %q not found", key)
 		}
 
+		// bolt values are only valid during the transaction
+		value = append([]byte{}, storedValue...)
+
 		return nil
 	})
 
 	return value, err
 }
+
+func (store *BoltDataStore) Delete(bucketName string, key string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.Delete([]byte(key))
+	})
+}
+
+// Delete the keys from the bucket in a single transaction
+func (store *BoltDataStore) DeleteMany(bucketName string, keys []string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+
+		if bucket == nil {
+			return nil
+		}
+
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (store *BoltDataStore) CompareAndSet(bucketName string, key string, oldValue []byte, newValue []byte) (bool, error) {
+	isSet := false
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+
+		currentValue := bucket.Get([]byte(key))
+		if oldValue == nil && currentValue != nil || oldValue != nil && !bytes.Equal(currentValue, oldValue) {
+			return nil
+		}
+
+		isSet = true
+		return bucket.Put([]byte(key), newValue)
+	})
+
+	return isSet, err
+}
+
+// Call fn with every key and value in the bucket. Nothing is called if the bucket doesn't exist.
+func (store *BoltDataStore) ForEach(bucketName string, fn func(key string, value []byte) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			return fn(string(key), append([]byte{}, value...))
+		})
+	})
+}
+
+func (store *BoltDataStore) Keys(bucketName string) ([]string, error) {
+	keys := []string{}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(key []byte, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+
+	return keys, err
+}
+
+func (store *BoltDataStore) DeleteBucket(bucketName string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(bucketName))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+
+		return err
+	})
+}
+
+func (store *BoltDataStore) Buckets() ([]string, error) {
+	bucketNames := []string{}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			bucketNames = append(bucketNames, string(name))
+			return nil
+		})
+	})
+
+	return bucketNames, err
+}
@@ -0,0 +1,300 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// KVStoreAPI is the part of the plugin API used to access the plugin's key value store
+type KVStoreAPI interface {
+	KVSet(key string, value []byte) *model.AppError
+	KVGet(key string) ([]byte, *model.AppError)
+	KVDelete(key string) *model.AppError
+	KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError)
+	KVList(page, perPage int) ([]string, *model.AppError)
+}
+
+// KVDataStore is a DataStore in the plugin's key value store, which is shared by every server
+// of a cluster. Values are stored under "<bucket>:<key>", and the keys of each bucket are listed
+// under "<bucketKeysPrefix><bucket>", so a bucket is read without listing every key of the plugin.
+type KVDataStore struct {
+	api KVStoreAPI
+}
+
+const (
+	kvListPageSize = 1000
+	// the prefix of the key lists of the buckets. It has no colon, so it's never the key of a value
+	bucketKeysPrefix = "bucket_keys/"
+	// number of times a key list is updated again when another server changed it at the same time
+	bucketKeysRetries = 20
+)
+
+func NewKVDataStore(api KVStoreAPI) *KVDataStore {
+	return &KVDataStore{api: api}
+}
+
+func kvKey(bucketName string, key string) string {
+	return bucketName + ":" + key
+}
+
+// the plugin API returns a nil *model.AppError on success, which isn't a nil error
+func kvError(err *model.AppError) error {
+	if err == nil {
+		return nil
+	}
+	return err
+}
+
+func (store *KVDataStore) Close() {}
+
+// The key is listed before the value is set, so listing a bucket never misses a value
+func (store *KVDataStore) Put(bucketName string, key string, value []byte) error {
+	if err := store.addBucketKey(bucketName, key); err != nil {
+		return err
+	}
+
+	return kvError(store.api.KVSet(kvKey(bucketName, key), value))
+}
+
+func (store *KVDataStore) Get(bucketName string, key string) ([]byte, error) {
+	value, err := store.api.KVGet(kvKey(bucketName, key))
+	if err != nil {
+		return nil, err
+	}
+
+	if value == nil {
+		return nil, fmt.Errorf("key %q not found", key)
+	}
+
+	return value, nil
+}
+
+func (store *KVDataStore) Delete(bucketName string, key string) error {
+	if err := kvError(store.api.KVDelete(kvKey(bucketName, key))); err != nil {
+		return err
+	}
+
+	return store.updateBucketKeys(bucketName, func(keys []string) []string {
+		return removeKeys(keys, map[string]bool{key: true})
+	})
+}
+
+func (store *KVDataStore) CompareAndSet(bucketName string, key string, oldValue []byte, newValue []byte) (bool, error) {
+	if err := store.addBucketKey(bucketName, key); err != nil {
+		return false, err
+	}
+
+	isSet, err := store.api.KVCompareAndSet(kvKey(bucketName, key), oldValue, newValue)
+	return isSet, kvError(err)
+}
+
+// Call fn with every key and value in the bucket
+func (store *KVDataStore) ForEach(bucketName string, fn func(key string, value []byte) error) error {
+	keys, _, err := store.bucketKeys(bucketName)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		value, err := store.api.KVGet(kvKey(bucketName, key))
+		if err != nil {
+			return err
+		}
+
+		// deleted since it was listed
+		if value == nil {
+			continue
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *KVDataStore) Keys(bucketName string) ([]string, error) {
+	keys, _, err := store.bucketKeys(bucketName)
+	return keys, err
+}
+
+func (store *KVDataStore) DeleteBucket(bucketName string) error {
+	keys, _, err := store.bucketKeys(bucketName)
+	if err != nil {
+		return err
+	}
+
+	deletedKeys := map[string]bool{}
+	for _, key := range keys {
+		if err := kvError(store.api.KVDelete(kvKey(bucketName, key))); err != nil {
+			return err
+		}
+		deletedKeys[key] = true
+	}
+
+	// the keys added since the bucket was listed are kept
+	return store.updateBucketKeys(bucketName, func(keys []string) []string {
+		return removeKeys(keys, deletedKeys)
+	})
+}
+
+// Get the keys in a bucket, without the bucket prefix, and the stored key list they were decoded from.
+// The buckets written before their keys were listed are found by listing every key of the plugin once.
+func (store *KVDataStore) bucketKeys(bucketName string) ([]string, []byte, error) {
+	value, appErr := store.api.KVGet(bucketKeysPrefix + bucketName)
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+
+	if value != nil {
+		keys := []string{}
+		if err := json.Unmarshal(value, &keys); err != nil {
+			return nil, nil, fmt.Errorf("could not decode the keys of bucket %v: %v", bucketName, err)
+		}
+		return keys, value, nil
+	}
+
+	keys, err := store.listBucketKeys(bucketName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// saved unless another server saved the list first, which is read the next time
+	newValue, err := json.Marshal(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	isSet, appErr := store.api.KVCompareAndSet(bucketKeysPrefix+bucketName, nil, newValue)
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	if !isSet {
+		return store.bucketKeys(bucketName)
+	}
+
+	return keys, newValue, nil
+}
+
+func (store *KVDataStore) addBucketKey(bucketName string, key string) error {
+	return store.updateBucketKeys(bucketName, func(keys []string) []string {
+		for _, bucketKey := range keys {
+			if bucketKey == key {
+				return keys
+			}
+		}
+
+		return append(keys, key)
+	})
+}
+
+// Change the key list of a bucket with update, which returns the list unchanged if there's nothing to save.
+// The list is compared and set, and updated again if another server changed it at the same time.
+func (store *KVDataStore) updateBucketKeys(bucketName string, update func(keys []string) []string) error {
+	for attempt := 0; attempt < bucketKeysRetries; attempt++ {
+		keys, oldValue, err := store.bucketKeys(bucketName)
+		if err != nil {
+			return err
+		}
+
+		newKeys := update(append([]string{}, keys...))
+		if len(newKeys) == len(keys) {
+			return nil
+		}
+
+		newValue, err := json.Marshal(newKeys)
+		if err != nil {
+			return err
+		}
+
+		isSet, appErr := store.api.KVCompareAndSet(bucketKeysPrefix+bucketName, oldValue, newValue)
+		if appErr != nil {
+			return appErr
+		}
+		if isSet {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("could not update the keys of bucket %v, as they kept changing", bucketName)
+}
+
+func removeKeys(keys []string, removedKeys map[string]bool) []string {
+	remainingKeys := []string{}
+	for _, key := range keys {
+		if !removedKeys[key] {
+			remainingKeys = append(remainingKeys, key)
+		}
+	}
+
+	return remainingKeys
+}
+
+// List the keys in a bucket by going through every key of the plugin
+func (store *KVDataStore) listBucketKeys(bucketName string) ([]string, error) {
+	prefix := kvKey(bucketName, "")
+	keys := []string{}
+
+	for page := 0; ; page++ {
+		pageKeys, err := store.api.KVList(page, kvListPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range pageKeys {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, strings.TrimPrefix(key, prefix))
+			}
+		}
+
+		if len(pageKeys) < kvListPageSize {
+			return keys, nil
+		}
+	}
+}
+
+// Copy the values of the bolt file named dbName into store, if the file exists, and rename
+// the file so it's only copied once. Values that already exist in store are kept, so the
+// first server of a cluster to migrate its file wins.
+func MigrateBoltDataStore(dbName string, store DataStore) error {
+	path := fmt.Sprintf("%s.db", dbName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	boltStore, err := OpenBoltDataStore(dbName)
+	if err != nil {
+		return err
+	}
+
+	bucketNames, err := boltStore.Buckets()
+	if err != nil {
+		boltStore.Close()
+		return err
+	}
+
+	migratedKeys := 0
+	for _, bucketName := range bucketNames {
+		err := boltStore.ForEach(bucketName, func(key string, value []byte) error {
+			isSet, err := store.CompareAndSet(bucketName, key, nil, value)
+			if isSet {
+				migratedKeys++
+			}
+			return err
+		})
+		if err != nil {
+			boltStore.Close()
+			return err
+		}
+	}
+
+	boltStore.Close()
+	log.Printf("Migrated %v keys from %v \n", migratedKeys, path)
+
+	return os.Rename(path, path+".migrated")
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKVStoreAPI is an in-memory plugin key value store
+type fakeKVStoreAPI struct {
+	values    map[string][]byte
+	listCalls int
+}
+
+func newFakeKVStoreAPI() *fakeKVStoreAPI {
+	return &fakeKVStoreAPI{values: map[string][]byte{}}
+}
+
+func (api *fakeKVStoreAPI) KVSet(key string, value []byte) *model.AppError {
+	if value == nil {
+		delete(api.values, key)
+		return nil
+	}
+
+	api.values[key] = value
+	return nil
+}
+
+func (api *fakeKVStoreAPI) KVGet(key string) ([]byte, *model.AppError) {
+	return api.values[key], nil
+}
+
+func (api *fakeKVStoreAPI) KVDelete(key string) *model.AppError {
+	delete(api.values, key)
+	return nil
+}
+
+func (api *fakeKVStoreAPI) KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError) {
+	currentValue, exists := api.values[key]
+	if oldValue == nil && exists || oldValue != nil && !bytes.Equal(currentValue, oldValue) {
+		return false, nil
+	}
+
+	api.values[key] = newValue
+	return true, nil
+}
+
+func (api *fakeKVStoreAPI) KVList(page, perPage int) ([]string, *model.AppError) {
+	api.listCalls++
+
+	keys := []string{}
+	for key := range api.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	start := page * perPage
+	if start >= len(keys) {
+		return []string{}, nil
+	}
+
+	end := start + perPage
+	if end > len(keys) {
+		end = len(keys)
+	}
+
+	return keys[start:end], nil
+}
+
+func TestKVDataStore(t *testing.T) {
+	api := newFakeKVStoreAPI()
+	store := NewKVDataStore(api)
+
+	_, err := store.Get("sync", "last_fetched_at")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, store.Put("sync", "last_fetched_at", []byte("10")))
+	value, err := store.Get("sync", "last_fetched_at")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("10"), value)
+	assert.Equal(t, []byte("10"), api.values["sync:last_fetched_at"])
+
+	isSet, err := store.CompareAndSet("sync", "last_fetched_at", nil, []byte("20"))
+	assert.Nil(t, err)
+	assert.False(t, isSet)
+
+	isSet, err = store.CompareAndSet("sync", "last_fetched_at", []byte("10"), []byte("20"))
+	assert.Nil(t, err)
+	assert.True(t, isSet)
+
+	for i := 0; i < kvListPageSize+1; i++ {
+		assert.Nil(t, store.Put("channels", string(rune('a'+i%26))+string(rune('0'+i/26)), []byte("1")))
+	}
+
+	count := 0
+	assert.Nil(t, store.ForEach("channels", func(key string, value []byte) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, kvListPageSize+1, count)
+
+	// the keys of the buckets are listed without listing every key of the plugin
+	assert.Equal(t, 2, api.listCalls)
+
+	assert.Nil(t, store.DeleteBucket("channels"))
+	assert.Nil(t, store.Delete("sync", "last_fetched_at"))
+	assert.Equal(t, map[string][]byte{
+		"bucket_keys/sync":     []byte("[]"),
+		"bucket_keys/channels": []byte("[]"),
+	}, api.values)
+	assert.Equal(t, 2, api.listCalls)
+
+	t.Run("the keys of buckets written before they were listed are found once", func(t *testing.T) {
+		api.values["cursors:c1"] = []byte("1")
+		api.values["cursors:c2"] = []byte("2")
+
+		for i := 0; i < 2; i++ {
+			keys := []string{}
+			assert.Nil(t, store.ForEach("cursors", func(key string, value []byte) error {
+				keys = append(keys, key)
+				return nil
+			}))
+			assert.Equal(t, []string{"c1", "c2"}, keys)
+		}
+		assert.Equal(t, 3, api.listCalls)
+
+		assert.Nil(t, store.Put("cursors", "c3", []byte("3")))
+		assert.Nil(t, store.Delete("cursors", "c1"))
+		assert.Equal(t, []byte(`["c2","c3"]`), api.values["bucket_keys/cursors"])
+	})
+}
+
+func TestMigrateBoltDataStore(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "mm-sync")
+
+	boltStore, err := OpenBoltDataStore(dbName)
+	assert.Nil(t, err)
+	assert.Nil(t, boltStore.Put("sync", "last_fetched_at", []byte("10")))
+	assert.Nil(t, boltStore.Put("sync", "total_fetched_posts", []byte("5")))
+	boltStore.Close()
+
+	api := newFakeKVStoreAPI()
+	store := NewKVDataStore(api)
+	// another server of the cluster already migrated its file
+	assert.Nil(t, store.Put("sync", "total_fetched_posts", []byte("7")))
+
+	assert.Nil(t, MigrateBoltDataStore(dbName, store))
+	assert.Equal(t, []byte("10"), api.values["sync:last_fetched_at"])
+	assert.Equal(t, []byte("7"), api.values["sync:total_fetched_posts"])
+
+	_, err = os.Stat(dbName + ".db")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dbName + ".db.migrated")
+	assert.Nil(t, err)
+
+	// nothing to migrate anymore
+	assert.Nil(t, MigrateBoltDataStore(dbName, store))
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The posts are embedded as documents of at most chunkSize characters. Longer posts are split into
+// overlapping chunks, so they fit the embedding models' input and each chunk keeps a precise meaning.
+// Replies are embedded along with the start of their thread, since short replies like "yes, do that"
+// mean nothing on their own.
+const (
+	chunkSize    = 1000
+	chunkOverlap = 200
+	// the last chunk of a post takes the rest of the message, so a post isn't split into too many documents
+	maxPostChunks = 64
+	// number of earlier posts of the thread embedded with a reply, and their maximum length
+	threadWindowSize     = 3
+	threadContextMaxSize = 500
+)
+
+// The version of the documents' metadata. The documents with an older version are backfilled.
+// Version 2 added the names of the post's team, channel and user, so search results are shown without looking them up.
+// Version 3 added whether the post is pinned and its numbers of replies and reactions, which boost the search results.
+const metadataSchemaVersion = 3
+
+// postDocument is a chunk of a post, as it's stored in the vector store
+type postDocument struct {
+	Id       string
+	Document string
+	Metadata map[string]interface{}
+}
+
+// A text chunk of a message, between the start and end rune offsets
+type textChunk struct {
+	Text  string
+	Start int
+	End   int
+}
+
+// Get the id of a post's chunk. The first chunk has the post's id, like the posts embedded before
+// they were chunked, and the post ids never contain a dash.
+func postChunkId(postId string, chunkIndex int) string {
+	if chunkIndex == 0 {
+		return postId
+	}
+
+	return fmt.Sprintf("%v-%d", postId, chunkIndex)
+}
+
+// Get a where clause matching the chunks of posts from a chunk index on. fromChunks maps
+// post ids to the index of their first chunk to match, so 0 matches every chunk of a post.
+func postChunksWhere(fromChunks map[string]int) map[string]interface{} {
+	// the posts are grouped by first chunk, sorted so the same posts always give the same clause
+	postIds := map[int][]string{}
+	chunkIndexes := []int{}
+	for postId, fromChunk := range fromChunks {
+		if _, ok := postIds[fromChunk]; !ok {
+			chunkIndexes = append(chunkIndexes, fromChunk)
+		}
+		postIds[fromChunk] = append(postIds[fromChunk], postId)
+	}
+	sort.Ints(chunkIndexes)
+
+	clauses := []map[string]interface{}{}
+	for _, fromChunk := range chunkIndexes {
+		sort.Strings(postIds[fromChunk])
+		clause := map[string]interface{}{"post_id": map[string]interface{}{"$in": toInterfaceSlice(postIds[fromChunk])}}
+
+		if fromChunk > 0 {
+			clause = map[string]interface{}{"$and": []map[string]interface{}{
+				clause,
+				{"chunk_index": map[string]interface{}{"$gte": fromChunk}},
+			}}
+		}
+
+		clauses = append(clauses, clause)
+	}
+
+	// chroma requires at least two clauses in an $or
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+
+	return map[string]interface{}{"$or": clauses}
+}
+
+// Get the id of the post a document was built from
+func documentPostId(id string, metadata map[string]interface{}) string {
+	if postId, ok := metadata["post_id"].(string); ok && postId != "" {
+		return postId
+	}
+
+	return id
+}
+
+// Split a message into chunks of at most size characters, which overlap by overlap characters.
+// Chunks end at a space if there's one in their second half, so words aren't split.
+func chunkText(text string, size int, overlap int) []textChunk {
+	runes := []rune(text)
+	chunks := []textChunk{}
+
+	for start := 0; start < len(runes); {
+		end := start + size
+		if end >= len(runes) || len(chunks) == maxPostChunks-1 {
+			end = len(runes)
+		} else {
+			for i := end; i > start+size/2; i-- {
+				if unicode.IsSpace(runes[i]) {
+					end = i
+					break
+				}
+			}
+		}
+
+		chunks = append(chunks, textChunk{
+			Text:  strings.TrimSpace(string(runes[start:end])),
+			Start: start,
+			End:   end,
+		})
+
+		if end == len(runes) {
+			break
+		}
+
+		// start the next chunk at a word of the overlap
+		next := end - overlap
+		if next <= start {
+			next = end
+		}
+		for i := next; i < end; i++ {
+			if unicode.IsSpace(runes[i]) {
+				next = i + 1
+				break
+			}
+		}
+		start = next
+	}
+
+	return chunks
+}
+
+// Build the documents of posts, with the thread context of replies. The earlier posts of a
+// thread are taken from posts, and its root is fetched with mmClient if it's not one of them.
+func buildPostDocuments(posts []Post, access string, teamId string, mmClient MattermostClient) []postDocument {
+	threadPosts := map[string][]Post{}
+	for _, post := range posts {
+		rootId := post.Id
+		if post.RootId != "" {
+			rootId = post.RootId
+		}
+		threadPosts[rootId] = append(threadPosts[rootId], post)
+	}
+
+	for rootId, thread := range threadPosts {
+		sort.SliceStable(thread, func(i, j int) bool {
+			return thread[i].CreateAt < thread[j].CreateAt
+		})
+
+		if thread[0].Id != rootId && mmClient != nil {
+			root, err := mmClient.GetPostDetails(rootId)
+			if err != nil {
+				log.Printf("error while trying to get the root post %v: %v \n", rootId, err)
+			} else if isIndexablePost(Post(root)) {
+				thread = append([]Post{Post(root)}, thread...)
+			}
+		}
+
+		threadPosts[rootId] = thread
+	}
+
+	documents := []postDocument{}
+	for _, post := range posts {
+		threadContext := ""
+		if post.RootId != "" {
+			threadContext = getThreadContext(threadPosts[post.RootId], post)
+		}
+
+		chunks := chunkText(post.Message, chunkSize, chunkOverlap)
+		for i, chunk := range chunks {
+			document := chunk.Text
+			if threadContext != "" {
+				document = threadContext + "\n" + document
+			}
+
+			documents = append(documents, postDocument{
+				Id:       postChunkId(post.Id, i),
+				Document: document,
+				Metadata: map[string]interface{}{
+					"source":      "mm",
+					"access":      access,
+					"channel_id":  post.ChannelId,
+					"user_id":     post.UserId,
+					"team_id":     teamId,
+					"create_at":   int(post.CreateAt),
+					"update_at":   int(post.UpdateAt),
+					"post_id":     post.Id,
+					"root_id":     post.RootId,
+					"chunk_index": i,
+					"chunk_count": len(chunks),
+					"chunk_start": chunk.Start,
+					"chunk_end":   chunk.End,
+					// the chunks of a post share its engagement signals
+					"is_pinned":      post.IsPinned,
+					"reply_count":    int(post.ReplyCount),
+					"reaction_count": post.ReactionCount,
+				},
+			})
+		}
+	}
+
+	if mmClient != nil {
+		enrichPostDocuments(documents, mmClient)
+	}
+
+	return documents
+}
+
+// Add the names of the posts' team, channel and user to the documents' metadata. The documents
+// whose names can't all be found keep the previous schema version, so they are backfilled later.
+func enrichPostDocuments(documents []postDocument, mmClient MattermostClient) {
+	userIds := []string{}
+	for _, document := range documents {
+		userIds = append(userIds, document.Metadata["user_id"].(string))
+	}
+
+	users, err := getUsersDetails(mmClient, userIds)
+	if err != nil {
+		log.Printf("error while trying to get the users of the posts: %v \n", err)
+	}
+
+	channels := map[string]ChannelDetail{}
+	teams := map[string]TeamDetail{}
+	for _, document := range documents {
+		metadata := document.Metadata
+
+		channelId := metadata["channel_id"].(string)
+		channel, ok := channels[channelId]
+		if !ok {
+			channel, err = mmClient.GetChannelDetails(channelId)
+			if err != nil {
+				log.Printf("error while trying to get channel %v: %v \n", channelId, err)
+				continue
+			}
+			channels[channelId] = channel
+		}
+
+		// direct and group channels have no team
+		team, ok := teams[channel.TeamId]
+		if !ok && channel.TeamId != "" {
+			team, err = mmClient.GetTeamDetails(channel.TeamId)
+			if err != nil {
+				log.Printf("error while trying to get team %v: %v \n", channel.TeamId, err)
+				continue
+			}
+			teams[channel.TeamId] = team
+		}
+
+		user, ok := users[metadata["user_id"].(string)]
+		if !ok {
+			continue
+		}
+
+		metadata["team_name"] = team.Name
+		metadata["channel_name"] = channel.Name
+		metadata["channel_display_name"] = channel.DisplayName
+		metadata["username"] = user.UserName
+		metadata["user_display_name"] = userDisplayName(user)
+		metadata["schema_version"] = metadataSchemaVersion
+	}
+}
+
+// Get the version of a document's metadata, 1 for the documents embedded before it was recorded
+func getMetadataSchemaVersion(metadata map[string]interface{}) int {
+	version, ok := metadataNumber(metadata["schema_version"])
+	if !ok {
+		return 1
+	}
+
+	return int(version)
+}
+
+// Get the messages of the thread posted before a reply, up to threadWindowSize of them:
+// the thread's root and the replies right before the reply
+func getThreadContext(thread []Post, reply Post) string {
+	earlierPosts := []Post{}
+	for _, post := range thread {
+		if post.Id != reply.Id && post.CreateAt <= reply.CreateAt {
+			earlierPosts = append(earlierPosts, post)
+		}
+	}
+
+	if len(earlierPosts) == 0 {
+		return ""
+	}
+
+	window := earlierPosts
+	if len(window) > threadWindowSize {
+		// keep the root, which is the first post of the thread if it was found
+		window = append([]Post{earlierPosts[0]}, earlierPosts[len(earlierPosts)-threadWindowSize+1:]...)
+	}
+
+	messageSize := threadContextMaxSize / len(window)
+	messages := []string{}
+	for _, post := range window {
+		message := []rune(post.Message)
+		if len(message) > messageSize {
+			message = message[:messageSize]
+		}
+		messages = append(messages, strings.TrimSpace(string(message)))
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// Get the chunk of a post's message a document was built from, if the post was split into chunks
+func getDocumentHighlight(message string, metadata map[string]interface{}) string {
+	chunkCount, ok := metadataNumber(metadata["chunk_count"])
+	if !ok || chunkCount <= 1 {
+		return ""
+	}
+
+	start, startOk := metadataNumber(metadata["chunk_start"])
+	end, endOk := metadataNumber(metadata["chunk_end"])
+	runes := []rune(message)
+	if !startOk || !endOk || start < 0 || int(end) > len(runes) || start >= end {
+		return ""
+	}
+
+	return strings.TrimSpace(string(runes[int(start):int(end)]))
+}
+
+// Keep the best result of each post, as the chunks of a post are separate results.
+// The results must be sorted by descending score.
+func collapsePostChunks(results []searchResult) []searchResult {
+	collapsedResults := []searchResult{}
+	seenPosts := map[string]bool{}
+
+	for _, result := range results {
+		postId := documentPostId(result.Id, result.Metadata)
+		if seenPosts[postId] {
+			continue
+		}
+
+		seenPosts[postId] = true
+		collapsedResults = append(collapsedResults, result)
+	}
+
+	return collapsedResults
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkText(t *testing.T) {
+	assert.Empty(t, chunkText("", 10, 2))
+	assert.Equal(t, []textChunk{{Text: "short", Start: 0, End: 5}}, chunkText("short", 10, 2))
+
+	text := "one two three four five six seven eight nine ten"
+	chunks := chunkText(text, 20, 8)
+	assert.Greater(t, len(chunks), 1)
+
+	runes := []rune(text)
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, chunk.End-chunk.Start, 20)
+		assert.Equal(t, strings.TrimSpace(string(runes[chunk.Start:chunk.End])), chunk.Text)
+		if i > 0 {
+			// the chunks overlap, and start at a word
+			assert.Less(t, chunk.Start, chunks[i-1].End)
+			assert.Equal(t, ' ', runes[chunk.Start-1])
+		}
+	}
+	assert.Equal(t, len(runes), chunks[len(chunks)-1].End)
+
+	// the last chunk takes the rest of a very long message
+	chunks = chunkText(strings.Repeat("a", maxPostChunks*20), 10, 0)
+	assert.Len(t, chunks, maxPostChunks)
+	assert.Equal(t, maxPostChunks*20, chunks[maxPostChunks-1].End)
+}
+
+func TestBuildPostDocuments(t *testing.T) {
+	mmClient := &fakeMattermostClient{posts: map[string]PostDetail{
+		"root": {Id: "root", ChannelId: "c1", Message: "should we ship the release on friday?", CreateAt: 1},
+	}}
+
+	posts := []Post{
+		{Id: "r1", RootId: "root", ChannelId: "c1", Message: "yes, do that", CreateAt: 2, UpdateAt: 2},
+		{Id: "r2", RootId: "root", ChannelId: "c1", Message: "agreed", CreateAt: 3, UpdateAt: 3},
+		{Id: "long", ChannelId: "c1", Message: strings.Repeat("word ", chunkSize/2), CreateAt: 4, UpdateAt: 4},
+	}
+
+	documents := buildPostDocuments(posts, "pub", "t1", mmClient)
+
+	assert.Equal(t, "r1", documents[0].Id)
+	assert.Equal(t, "should we ship the release on friday?\nyes, do that", documents[0].Document)
+	assert.Equal(t, "should we ship the release on friday?\nyes, do that\nagreed", documents[1].Document)
+	assert.Equal(t, "root", documents[1].Metadata["root_id"])
+
+	longDocuments := documents[2:]
+	assert.Equal(t, 3, len(longDocuments))
+	for i, document := range longDocuments {
+		assert.Equal(t, postChunkId("long", i), document.Id)
+		assert.Equal(t, "long", documentPostId(document.Id, document.Metadata))
+		assert.Equal(t, i, document.Metadata["chunk_index"])
+		assert.Equal(t, 3, document.Metadata["chunk_count"])
+		assert.Equal(t, document.Document, getDocumentHighlight(posts[2].Message, document.Metadata))
+	}
+
+	// the chunks of a post are matched by post_id, from a chunk index on
+	for fromChunk, expected := range map[int][]bool{0: {true, true, true}, 2: {false, false, true}} {
+		for i, document := range longDocuments {
+			matches, err := matchesWhere(document.Metadata, postChunksWhere(map[string]int{"long": fromChunk, "other": 0}))
+			assert.Nil(t, err)
+			assert.Equal(t, expected[i], matches)
+		}
+	}
+
+	// replies are embedded without context if their root can't be found
+	documents = buildPostDocuments([]Post{{Id: "r3", RootId: "missing", Message: "ok"}}, "pub", "t1", mmClient)
+	assert.Equal(t, "ok", documents[0].Document)
+}
+
+func TestCollapsePostChunks(t *testing.T) {
+	results := []searchResult{
+		{Id: "p1-1", Metadata: map[string]interface{}{"post_id": "p1"}},
+		{Id: "p2", Metadata: map[string]interface{}{}},
+		{Id: "p1", Metadata: map[string]interface{}{"post_id": "p1"}},
+	}
+
+	collapsedResults := collapsePostChunks(results)
+	assert.Equal(t, []string{"p1-1", "p2"}, []string{collapsedResults[0].Id, collapsedResults[1].Id})
+	assert.Len(t, collapsedResults, 2)
+
+	// a single chunk has no highlight
+	assert.Equal(t, "", getDocumentHighlight("message", map[string]interface{}{"chunk_count": 1, "chunk_start": 0, "chunk_end": 7}))
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	chroma "github.com/amikos-tech/chroma-go"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+// EmbeddedVectorStore is a VectorStore keeping the embedded messages on disk in the plugin's
+// directory, so no vector database has to be deployed. Queries compare the query with every
+// message of a collection (a flat index), which is fast enough for a few hundred thousand messages.
+type EmbeddedVectorStore struct {
+	index    *embeddedVectorIndex
+	embedder Embedder
+}
+
+// embeddedVectorIndex holds the collections of the embedded store. The entries are saved in a
+// bucket per collection, and loaded in memory when the plugin starts. It's shared by the stores
+// created from different settings, since the data store file can only be opened once.
+type embeddedVectorIndex struct {
+	lock  sync.RWMutex
+	store *db.BoltDataStore
+	// collection name -> document id -> entry
+	collections map[string]map[string]embeddedEntry
+	// collection name -> embedding model
+	models map[string]string
+}
+
+type embeddedEntry struct {
+	Document  string                 `json:"document"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	Embedding []float32              `json:"embedding"`
+}
+
+const (
+	// the name of the data store file, in the data directory
+	embeddedStoreName = "mm-vectors"
+	// records the embedding model of each collection
+	embeddedCollectionsBucket = "collections"
+)
+
+var embeddedIndexInstance *embeddedVectorIndex
+var embeddedIndexLock sync.Mutex
+
+// Open the embedded index in the data directory, once. Opening is retried by the next call if it fails.
+func getEmbeddedVectorIndex(dataDirectory string) (*embeddedVectorIndex, error) {
+	embeddedIndexLock.Lock()
+	defer embeddedIndexLock.Unlock()
+
+	if embeddedIndexInstance != nil {
+		return embeddedIndexInstance, nil
+	}
+
+	if err := os.MkdirAll(dataDirectory, 0700); err != nil {
+		return nil, fmt.Errorf("could not create the data directory: %v", err)
+	}
+
+	store, err := db.OpenBoltDataStore(filepath.Join(dataDirectory, embeddedStoreName))
+	if err != nil {
+		return nil, err
+	}
+
+	index := newEmbeddedVectorIndex(store)
+	if err := index.load(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("could not load the embedded vector store: %v", err)
+	}
+
+	embeddedIndexInstance = index
+	return embeddedIndexInstance, nil
+}
+
+func newEmbeddedVectorIndex(store *db.BoltDataStore) *embeddedVectorIndex {
+	return &embeddedVectorIndex{
+		store:       store,
+		collections: map[string]map[string]embeddedEntry{},
+		models:      map[string]string{},
+	}
+}
+
+// Load the collections recorded in the data store
+func (index *embeddedVectorIndex) load() error {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	return index.store.ForEach(embeddedCollectionsBucket, func(collectionName string, model []byte) error {
+		index.models[collectionName] = string(model)
+		entries := map[string]embeddedEntry{}
+
+		err := index.store.ForEach(collectionName, func(id string, value []byte) error {
+			entry := embeddedEntry{}
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return fmt.Errorf("could not decode %v in %v: %v", id, collectionName, err)
+			}
+
+			entries[id] = entry
+			return nil
+		})
+
+		index.collections[collectionName] = entries
+		return err
+	})
+}
+
+// Create a vector store keeping the messages in the plugin's data directory, which embeds the documents using embedder
+func NewEmbeddedVectorStore(dataDirectory string, embedder Embedder) (*EmbeddedVectorStore, error) {
+	index, err := getEmbeddedVectorIndex(dataDirectory)
+	if err != nil {
+		return nil, newVectorStoreError("open embedded store", nil, err)
+	}
+
+	return newEmbeddedVectorStore(index, embedder), nil
+}
+
+func newEmbeddedVectorStore(index *embeddedVectorIndex, embedder Embedder) *EmbeddedVectorStore {
+	if embedder == nil {
+		embedder = NewHashEmbedder()
+	}
+
+	return &EmbeddedVectorStore{index: index, embedder: embedder}
+}
+
+func embeddedCollectionName(collectionType string) string {
+	if collectionType == "" {
+		collectionType = mattermostCollectionType
+	}
+
+	return collectionType + "_messages"
+}
+
+// Get the entries of a collection, or nil if it doesn't exist yet.
+// The index must be locked for reading.
+func (store *EmbeddedVectorStore) getCollection(collectionType string) (string, map[string]embeddedEntry, error) {
+	collectionName := embeddedCollectionName(collectionType)
+	index := store.index
+
+	collectionModel, ok := index.models[collectionName]
+	if !ok {
+		return collectionName, nil, nil
+	}
+
+	if collectionModel != store.embedder.Model() {
+		return "", nil, newVectorStoreError("get collection", ErrEmbeddingModelMismatch, fmt.Errorf(
+			"%v was embedded using %q but the configured model is %q, reset the vector store to re-embed the messages",
+			collectionName,
+			collectionModel,
+			store.embedder.Model(),
+		))
+	}
+
+	return collectionName, index.collections[collectionName], nil
+}
+
+// Get the entries of a collection, creating it if it doesn't exist.
+// The index must be locked for writing.
+func (store *EmbeddedVectorStore) getOrCreateCollection(collectionType string) (string, map[string]embeddedEntry, error) {
+	collectionName, entries, err := store.getCollection(collectionType)
+	if err != nil || entries != nil {
+		return collectionName, entries, err
+	}
+
+	index := store.index
+	if err := index.store.Put(embeddedCollectionsBucket, collectionName, []byte(store.embedder.Model())); err != nil {
+		return "", nil, newVectorStoreError("create collection", nil, err)
+	}
+
+	index.models[collectionName] = store.embedder.Model()
+	index.collections[collectionName] = map[string]embeddedEntry{}
+
+	return collectionName, index.collections[collectionName], nil
+}
+
+func (store *EmbeddedVectorStore) VerifyEmbeddingModel(ctx context.Context) error {
+	store.index.lock.Lock()
+	defer store.index.lock.Unlock()
+
+	for _, collectionType := range []string{mattermostCollectionType, slackCollectionType} {
+		if _, _, err := store.getOrCreateCollection(collectionType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *EmbeddedVectorStore) Upsert(ctx context.Context, collectionType string, ids []string, documents []string, metadatas []map[string]interface{}) error {
+	if len(ids) != len(documents) || len(ids) != len(metadatas) {
+		return newVectorStoreError("upsert", nil, errors.New("ids, documents and metadatas must have the same length"))
+	}
+
+	// embed before locking, as the embedding service can be slow
+	embeddings, err := store.embedder.EmbedDocuments(ctx, documents)
+	if err != nil {
+		return newVectorStoreError("embed documents", nil, err)
+	}
+
+	store.index.lock.Lock()
+	defer store.index.lock.Unlock()
+
+	collectionName, entries, err := store.getOrCreateCollection(collectionType)
+	if err != nil {
+		return err
+	}
+
+	values := map[string][]byte{}
+	for i, id := range ids {
+		entry := embeddedEntry{
+			Document:  documents[i],
+			Metadata:  metadatas[i],
+			Embedding: embeddings[i],
+		}
+
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return newVectorStoreError("upsert to "+collectionName, nil, err)
+		}
+		values[id] = value
+	}
+
+	// saved in a single transaction, as each one syncs the file
+	if err := store.index.store.PutMany(collectionName, values); err != nil {
+		return newVectorStoreError("upsert to "+collectionName, nil, err)
+	}
+
+	for id, value := range values {
+		// decode the metadata again, so its numbers are float64 like the ones loaded from disk
+		entry := embeddedEntry{}
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return newVectorStoreError("upsert to "+collectionName, nil, err)
+		}
+		entries[id] = entry
+	}
+
+	return nil
+}
+
+func (store *EmbeddedVectorStore) Delete(ctx context.Context, collectionType string, ids []string) error {
+	store.index.lock.Lock()
+	defer store.index.lock.Unlock()
+
+	collectionName, entries, err := store.getOrCreateCollection(collectionType)
+	if err != nil {
+		return err
+	}
+
+	return store.deleteEntries(collectionName, entries, ids)
+}
+
+func (store *EmbeddedVectorStore) DeleteWhere(ctx context.Context, collectionType string, whereClause map[string]interface{}) error {
+	store.index.lock.Lock()
+	defer store.index.lock.Unlock()
+
+	collectionName, entries, err := store.getCollection(collectionType)
+	if err != nil {
+		return err
+	}
+
+	ids := []string{}
+	for id, entry := range entries {
+		matchesFilters, err := matchesWhere(entry.Metadata, whereClause)
+		if err != nil {
+			return newVectorStoreError("delete from "+collectionName, ErrInvalidFilter, err)
+		}
+
+		if matchesFilters {
+			ids = append(ids, id)
+		}
+	}
+
+	return store.deleteEntries(collectionName, entries, ids)
+}
+
+// Delete entries of a collection, in a single transaction.
+// The index must be locked for writing.
+func (store *EmbeddedVectorStore) deleteEntries(collectionName string, entries map[string]embeddedEntry, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := store.index.store.DeleteMany(collectionName, ids); err != nil {
+		return newVectorStoreError("delete from "+collectionName, nil, err)
+	}
+
+	for _, id := range ids {
+		delete(entries, id)
+	}
+
+	return nil
+}
+
+func (store *EmbeddedVectorStore) GetMetadatas(ctx context.Context, collectionType string) (map[string]map[string]interface{}, error) {
+	store.index.lock.RLock()
+	defer store.index.lock.RUnlock()
+
+	_, entries, err := store.getCollection(collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	metadatas := map[string]map[string]interface{}{}
+	for id, entry := range entries {
+		metadatas[id] = entry.Metadata
+	}
+
+	return metadatas, nil
+}
+
+func (store *EmbeddedVectorStore) GetEmbeddings(ctx context.Context, collectionType string, ids []string) (map[string][]float32, error) {
+	store.index.lock.RLock()
+	defer store.index.lock.RUnlock()
+
+	_, entries, err := store.getCollection(collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	embeddings := map[string][]float32{}
+	for _, id := range ids {
+		if entry, ok := entries[id]; ok {
+			embeddings[id] = entry.Embedding
+		}
+	}
+
+	return embeddings, nil
+}
+
+func (store *EmbeddedVectorStore) GetDocuments(ctx context.Context, collectionType string, ids []string) (map[string]string, error) {
+	store.index.lock.RLock()
+	defer store.index.lock.RUnlock()
+
+	_, entries, err := store.getCollection(collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := map[string]string{}
+	for _, id := range ids {
+		if entry, ok := entries[id]; ok {
+			documents[id] = entry.Document
+		}
+	}
+
+	return documents, nil
+}
+
+func (store *EmbeddedVectorStore) Query(ctx context.Context, query string, mmChannelIds []interface{}, nResults int, minScore float64, filters SearchFilters) ([]searchResult, error) {
+	mmWhere, queryMattermost, err := filters.mattermostWhere(mmChannelIds)
+	if err != nil {
+		return nil, newVectorStoreError("build mattermost where clause", ErrInvalidFilter, err)
+	}
+
+	slkWhere, querySlack, err := filters.slackWhere()
+	if err != nil {
+		return nil, newVectorStoreError("build slack where clause", ErrInvalidFilter, err)
+	}
+
+	queryEmbedding, err := store.embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, newVectorStoreError("embed query", nil, err)
+	}
+
+	store.index.lock.RLock()
+	defer store.index.lock.RUnlock()
+
+	mmResponse := chroma.QueryResults{}
+	if queryMattermost {
+		mmResponse, err = store.queryCollection(mattermostCollectionType, queryEmbedding, mmWhere, nResults)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	slkResponse := chroma.QueryResults{}
+	if querySlack {
+		slkResponse, err = store.queryCollection(slackCollectionType, queryEmbedding, slkWhere, nResults)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return mergeQueryResults(float32(1-minScore), mmResponse, slkResponse), nil
+}
+
+// Find the nResults entries of a collection closest to the query embedding that match the where clause.
+// The results are returned like chroma's, so both stores merge them the same way.
+// The index must be locked for reading.
+func (store *EmbeddedVectorStore) queryCollection(collectionType string, queryEmbedding []float32, whereClause map[string]interface{}, nResults int) (chroma.QueryResults, error) {
+	collectionName, entries, err := store.getCollection(collectionType)
+	if err != nil {
+		return chroma.QueryResults{}, err
+	}
+
+	type match struct {
+		id       string
+		distance float32
+	}
+
+	matches := []match{}
+	for id, entry := range entries {
+		matchesFilters, err := matchesWhere(entry.Metadata, whereClause)
+		if err != nil {
+			return chroma.QueryResults{}, newVectorStoreError("query "+collectionName, ErrInvalidFilter, err)
+		}
+
+		if matchesFilters {
+			matches = append(matches, match{id: id, distance: cosineDistance(queryEmbedding, entry.Embedding)})
+		}
+	}
+
+	// the ids break ties, so the results don't depend on the map order
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].id < matches[j].id
+	})
+
+	if len(matches) > nResults {
+		matches = matches[:nResults]
+	}
+
+	response := chroma.QueryResults{
+		Ids:       [][]string{{}},
+		Documents: [][]string{{}},
+		Metadatas: [][]map[string]interface{}{{}},
+		Distances: [][]float32{{}},
+	}
+
+	for _, match := range matches {
+		entry := entries[match.id]
+		response.Ids[0] = append(response.Ids[0], match.id)
+		response.Documents[0] = append(response.Documents[0], entry.Document)
+		response.Metadatas[0] = append(response.Metadatas[0], entry.Metadata)
+		response.Distances[0] = append(response.Distances[0], match.distance)
+	}
+
+	return response, nil
+}
+
+// Remove every collection
+func (store *EmbeddedVectorStore) Reset(ctx context.Context) error {
+	store.index.lock.Lock()
+	defer store.index.lock.Unlock()
+
+	for collectionName := range store.index.models {
+		if err := store.index.store.DeleteBucket(collectionName); err != nil {
+			return newVectorStoreError("reset embedded store", nil, err)
+		}
+	}
+
+	if err := store.index.store.DeleteBucket(embeddedCollectionsBucket); err != nil {
+		return newVectorStoreError("reset embedded store", nil, err)
+	}
+
+	store.index.collections = map[string]map[string]embeddedEntry{}
+	store.index.models = map[string]string{}
+
+	return nil
+}
+
+// Get the cosine distance (1 - cosine similarity) of two vectors, like chroma's cosine space
+func cosineDistance(a []float32, b []float32) float32 {
+	if len(a) != len(b) {
+		return 1
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+
+	if normA == 0 || normB == 0 {
+		return 1
+	}
+
+	return float32(1 - dot/(math.Sqrt(normA)*math.Sqrt(normB)))
+}
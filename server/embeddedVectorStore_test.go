@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+func newTestEmbeddedVectorIndex(t *testing.T) *embeddedVectorIndex {
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	t.Cleanup(store.Close)
+
+	return newEmbeddedVectorIndex(store)
+}
+
+func TestEmbeddedVectorStoreConformance(t *testing.T) {
+	testVectorStoreConformance(t, func(t *testing.T) func(embedder Embedder) VectorStore {
+		index := newTestEmbeddedVectorIndex(t)
+
+		return func(embedder Embedder) VectorStore {
+			return newEmbeddedVectorStore(index, embedder)
+		}
+	})
+}
+
+func TestEmbeddedVectorStoreLoad(t *testing.T) {
+	ctx := context.Background()
+	index := newTestEmbeddedVectorIndex(t)
+	store := newEmbeddedVectorStore(index, NewHashEmbedder())
+
+	assert.Nil(t, store.Upsert(ctx, mattermostCollectionType,
+		[]string{"p1", "p2"},
+		[]string{"deploy the api server", "the build is broken"},
+		[]map[string]interface{}{
+			{"source": "mm", "access": "pub", "channel_id": "c1"},
+			{"source": "mm", "access": "pub", "channel_id": "c1"},
+		},
+	))
+	assert.Nil(t, store.Delete(ctx, mattermostCollectionType, []string{"p1"}))
+
+	// the collections are loaded again from the data store
+	loadedIndex := newEmbeddedVectorIndex(index.store)
+	assert.Nil(t, loadedIndex.load())
+	assert.Equal(t, index.collections, loadedIndex.collections)
+	assert.Equal(t, map[string]string{"mattermost_messages": EmbeddingProviderHash}, loadedIndex.models)
+
+	results, err := newEmbeddedVectorStore(loadedIndex, NewHashEmbedder()).Query(ctx, "the build is broken", []interface{}{"c1"}, 5, 0.99, SearchFilters{})
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "p2", results[0].Id)
+
+	mismatchedStore := newEmbeddedVectorStore(loadedIndex, &modelEmbedder{HashEmbedder: NewHashEmbedder(), model: "other:model"})
+	assert.ErrorIs(t, mismatchedStore.Upsert(ctx, mattermostCollectionType, []string{"p3"}, []string{"lunch"}, []map[string]interface{}{{}}), ErrEmbeddingModelMismatch)
+}
+
+func TestEmbeddedVectorStoreReadsDontCreateCollections(t *testing.T) {
+	ctx := context.Background()
+	index := newTestEmbeddedVectorIndex(t)
+	store := newEmbeddedVectorStore(index, NewHashEmbedder())
+
+	results, err := store.Query(ctx, "the build is broken", []interface{}{"c1"}, 5, 0, SearchFilters{})
+	assert.Nil(t, err)
+	assert.Empty(t, results)
+
+	metadatas, err := store.GetMetadatas(ctx, mattermostCollectionType)
+	assert.Nil(t, err)
+	assert.Empty(t, metadatas)
+
+	// the searches only take the read lock, so the collections are created by the writes
+	assert.Empty(t, index.models)
+}
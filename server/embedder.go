@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amikos-tech/chroma-go/types"
+)
+
+const (
+	EmbeddingProviderHash   = "hash"
+	EmbeddingProviderOpenAI = "openai"
+	EmbeddingProviderOllama = "ollama"
+)
+
+// Embedder turns documents and queries into vectors
+type Embedder interface {
+	EmbedDocuments(ctx context.Context, documents []string) ([][]float32, error)
+	EmbedQuery(ctx context.Context, query string) ([]float32, error)
+	// Model identifies the model that produced the vectors, e.g. "openai:text-embedding-3-small".
+	// It's stored with the collections so a model change can be detected.
+	Model() string
+}
+
+// Create the embedder selected in the plugin configuration
+func NewEmbedder(config *configuration) (Embedder, error) {
+	switch config.EmbeddingProvider {
+	case "", EmbeddingProviderHash:
+		return NewHashEmbedder(), nil
+	case EmbeddingProviderOpenAI:
+		if config.EmbeddingModel == "" {
+			return nil, fmt.Errorf("embedding model is required for the %v embedding provider", config.EmbeddingProvider)
+		}
+
+		baseURL := config.EmbeddingURL
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+
+		return NewOpenAIEmbedder(baseURL, config.EmbeddingModel, config.EmbeddingAPIKey), nil
+	case EmbeddingProviderOllama:
+		if config.EmbeddingModel == "" {
+			return nil, fmt.Errorf("embedding model is required for the %v embedding provider", config.EmbeddingProvider)
+		}
+
+		baseURL := config.EmbeddingURL
+		if baseURL == "" {
+			baseURL = "http://localhost:11434"
+		}
+
+		return NewOllamaEmbedder(baseURL, config.EmbeddingModel), nil
+	}
+
+	return nil, fmt.Errorf("unknown embedding provider: %v", config.EmbeddingProvider)
+}
+
+// ---------------- Hash Embedder ----------------
+
+// HashEmbedder hashes documents into vectors. It's not a semantic model, but it
+// doesn't need any external service, which makes it useful for development.
+type HashEmbedder struct {
+	embeddingFunction types.EmbeddingFunction
+}
+
+func NewHashEmbedder() *HashEmbedder {
+	return &HashEmbedder{embeddingFunction: types.NewConsistentHashEmbeddingFunction()}
+}
+
+func (embedder *HashEmbedder) EmbedDocuments(ctx context.Context, documents []string) ([][]float32, error) {
+	embeddings, err := embedder.embeddingFunction.EmbedDocuments(ctx, documents)
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float32, 0, len(embeddings))
+	for _, embedding := range embeddings {
+		vectors = append(vectors, *embedding.GetFloat32())
+	}
+
+	return vectors, nil
+}
+
+func (embedder *HashEmbedder) EmbedQuery(ctx context.Context, query string) ([]float32, error) {
+	embedding, err := embedder.embeddingFunction.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return *embedding.GetFloat32(), nil
+}
+
+func (embedder *HashEmbedder) Model() string {
+	return EmbeddingProviderHash
+}
+
+// ---------------- OpenAI Embedder ----------------
+
+// OpenAIEmbedder uses an OpenAI compatible `/embeddings` endpoint
+type OpenAIEmbedder struct {
+	baseURL    string
+	model      string
+	apiKey     string
+	httpClient *http.Client
+}
+
+type openAIEmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+func NewOpenAIEmbedder(baseURL string, model string, apiKey string) *OpenAIEmbedder {
+	return &OpenAIEmbedder{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		model:      model,
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (embedder *OpenAIEmbedder) EmbedDocuments(ctx context.Context, documents []string) ([][]float32, error) {
+	if len(documents) == 0 {
+		return [][]float32{}, nil
+	}
+
+	headers := map[string]string{}
+	if embedder.apiKey != "" {
+		headers["Authorization"] = "Bearer " + embedder.apiKey
+	}
+
+	embeddingRes := openAIEmbeddingResponse{}
+	err := postJSON(ctx, embedder.httpClient, embedder.baseURL+"/embeddings", headers, openAIEmbeddingRequest{
+		Model: embedder.model,
+		Input: documents,
+	}, &embeddingRes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(embeddingRes.Data) != len(documents) {
+		return nil, fmt.Errorf("embedder: expected %d embeddings, got %d", len(documents), len(embeddingRes.Data))
+	}
+
+	// the embeddings may be returned in any order, so they are placed using their index
+	vectors := make([][]float32, len(documents))
+	for _, data := range embeddingRes.Data {
+		if data.Index < 0 || data.Index >= len(vectors) {
+			return nil, fmt.Errorf("embedder: embedding index out of range: %d", data.Index)
+		}
+		vectors[data.Index] = data.Embedding
+	}
+
+	return vectors, nil
+}
+
+func (embedder *OpenAIEmbedder) EmbedQuery(ctx context.Context, query string) ([]float32, error) {
+	vectors, err := embedder.EmbedDocuments(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+
+	return vectors[0], nil
+}
+
+func (embedder *OpenAIEmbedder) Model() string {
+	return EmbeddingProviderOpenAI + ":" + embedder.model
+}
+
+// ---------------- Ollama Embedder ----------------
+
+// OllamaEmbedder uses the `/api/embed` endpoint of an Ollama style local server
+type OllamaEmbedder struct {
+	baseURL    string
+	model      string
+	httpClient *http.Client
+}
+
+type ollamaEmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type ollamaEmbeddingResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+func NewOllamaEmbedder(baseURL string, model string) *OllamaEmbedder {
+	return &OllamaEmbedder{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		model:      model,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (embedder *OllamaEmbedder) EmbedDocuments(ctx context.Context, documents []string) ([][]float32, error) {
+	if len(documents) == 0 {
+		return [][]float32{}, nil
+	}
+
+	embeddingRes := ollamaEmbeddingResponse{}
+	err := postJSON(ctx, embedder.httpClient, embedder.baseURL+"/api/embed", nil, ollamaEmbeddingRequest{
+		Model: embedder.model,
+		Input: documents,
+	}, &embeddingRes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(embeddingRes.Embeddings) != len(documents) {
+		return nil, fmt.Errorf("embedder: expected %d embeddings, got %d", len(documents), len(embeddingRes.Embeddings))
+	}
+
+	return embeddingRes.Embeddings, nil
+}
+
+func (embedder *OllamaEmbedder) EmbedQuery(ctx context.Context, query string) ([]float32, error) {
+	vectors, err := embedder.EmbedDocuments(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+
+	return vectors[0], nil
+}
+
+func (embedder *OllamaEmbedder) Model() string {
+	return EmbeddingProviderOllama + ":" + embedder.model
+}
+
+// ---------------- Chroma Embedding Function ----------------
+
+// chromaEmbeddingFunction lets chroma collections embed documents using an Embedder
+type chromaEmbeddingFunction struct {
+	embedder Embedder
+}
+
+func (ef *chromaEmbeddingFunction) EmbedDocuments(ctx context.Context, documents []string) ([]*types.Embedding, error) {
+	vectors, err := ef.embedder.EmbedDocuments(ctx, documents)
+	if err != nil {
+		return nil, err
+	}
+
+	return types.NewEmbeddingsFromFloat32(vectors), nil
+}
+
+func (ef *chromaEmbeddingFunction) EmbedQuery(ctx context.Context, document string) (*types.Embedding, error) {
+	vector, err := ef.embedder.EmbedQuery(ctx, document)
+	if err != nil {
+		return nil, err
+	}
+
+	return types.NewEmbeddingFromFloat32(vector), nil
+}
+
+func (ef *chromaEmbeddingFunction) EmbedRecords(ctx context.Context, records []*types.Record, force bool) error {
+	return types.EmbedRecordsDefaultImpl(ef, ctx, records, force)
+}
+
+// ---------------- Utility Functions ----------------
+
+// Send a JSON request body and decode the JSON response into responseBody
+func postJSON(ctx context.Context, httpClient *http.Client, reqUrl string, headers map[string]string, requestBody interface{}, responseBody interface{}) error {
+	requestJSON, err := json.Marshal(requestBody)
+	if err != nil {
+		return fmt.Errorf("client: could not encode json: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqUrl, bytes.NewReader(requestJSON))
+	if err != nil {
+		return fmt.Errorf("client: could not create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	response, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("client: error making http request: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("client: request to %v failed. Status code: %d", reqUrl, response.StatusCode)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(responseBody)
+	if err != nil {
+		return fmt.Errorf("client: could not decode json: %v", err)
+	}
+
+	return nil
+}
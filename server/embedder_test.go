@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEmbedder(t *testing.T) {
+	assert := assert.New(t)
+
+	embedder, err := NewEmbedder(&configuration{})
+	assert.Nil(err)
+	assert.Equal("hash", embedder.Model())
+
+	embedder, err = NewEmbedder(&configuration{EmbeddingProvider: "openai", EmbeddingModel: "text-embedding-3-small"})
+	assert.Nil(err)
+	assert.Equal("openai:text-embedding-3-small", embedder.Model())
+
+	embedder, err = NewEmbedder(&configuration{EmbeddingProvider: "ollama", EmbeddingModel: "nomic-embed-text"})
+	assert.Nil(err)
+	assert.Equal("ollama:nomic-embed-text", embedder.Model())
+
+	_, err = NewEmbedder(&configuration{EmbeddingProvider: "ollama"})
+	assert.NotNil(err)
+
+	_, err = NewEmbedder(&configuration{EmbeddingProvider: "unknown"})
+	assert.NotNil(err)
+}
+
+func TestOpenAIEmbedder(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/embeddings", r.URL.Path)
+		assert.Equal("Bearer secret", r.Header.Get("Authorization"))
+
+		request := openAIEmbeddingRequest{}
+		assert.Nil(json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal("test-model", request.Model)
+		assert.Equal([]string{"first", "second"}, request.Input)
+
+		// return the embeddings out of order
+		w.Write([]byte(`{"data": [{"index": 1, "embedding": [0, 1]}, {"index": 0, "embedding": [1, 0]}]}`))
+	}))
+	defer server.Close()
+
+	embedder := NewOpenAIEmbedder(server.URL+"/v1/", "test-model", "secret")
+
+	vectors, err := embedder.EmbedDocuments(context.Background(), []string{"first", "second"})
+	assert.Nil(err)
+	assert.Equal([][]float32{{1, 0}, {0, 1}}, vectors)
+}
+
+func TestOllamaEmbedder(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/api/embed", r.URL.Path)
+
+		request := ollamaEmbeddingRequest{}
+		assert.Nil(json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal("test-model", request.Model)
+
+		w.Write([]byte(`{"embeddings": [[0.5, 0.5]]}`))
+	}))
+	defer server.Close()
+
+	embedder := NewOllamaEmbedder(server.URL, "test-model")
+
+	vector, err := embedder.EmbedQuery(context.Background(), "query")
+	assert.Nil(err)
+	assert.Equal([]float32{0.5, 0.5}, vector)
+}
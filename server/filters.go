@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amikos-tech/chroma-go/where"
+)
+
+// SearchFilters restrict the search to messages matching the metadata stored at index time
+type SearchFilters struct {
+	ChannelIds []string `json:"channel_ids"`
+	UserIds    []string `json:"user_ids"`
+	TeamId     string   `json:"team_id"`
+	Since      int64    `json:"since"`  // unix time in milliseconds, inclusive
+	Until      int64    `json:"until"`  // unix time in milliseconds, inclusive
+	Source     string   `json:"source"` // mm / sl
+	Access     string   `json:"access"` // pub / pri
+}
+
+// Get the search filters from the query fields of a search request.
+// Ids are comma separated, and dates are either unix milliseconds or YYYY-MM-DD dates.
+func parseSearchFilters(queryFields url.Values) (SearchFilters, error) {
+	filters := SearchFilters{
+		ChannelIds: splitQueryField(queryFields.Get("channel_ids")),
+		UserIds:    splitQueryField(queryFields.Get("user_ids")),
+		TeamId:     queryFields.Get("team_id"),
+		Source:     queryFields.Get("source"),
+		Access:     queryFields.Get("access"),
+	}
+
+	if filters.Source != "" && filters.Source != "mm" && filters.Source != "sl" {
+		return SearchFilters{}, fmt.Errorf("source query field must be either mm or sl")
+	}
+
+	if filters.Access != "" && filters.Access != "pub" && filters.Access != "pri" {
+		return SearchFilters{}, fmt.Errorf("access query field must be either pub or pri")
+	}
+
+	if queryFields.Get("since") != "" {
+		since, err := parseFilterTime(queryFields.Get("since"), false)
+		if err != nil {
+			return SearchFilters{}, fmt.Errorf("since query field is invalid: %v", err)
+		}
+		filters.Since = since
+	}
+
+	if queryFields.Get("until") != "" {
+		until, err := parseFilterTime(queryFields.Get("until"), true)
+		if err != nil {
+			return SearchFilters{}, fmt.Errorf("until query field is invalid: %v", err)
+		}
+		filters.Until = until
+	}
+
+	if filters.Since > 0 && filters.Until > 0 && filters.Since > filters.Until {
+		return SearchFilters{}, fmt.Errorf("since cannot be greater than until")
+	}
+
+	return filters, nil
+}
+
+// Parse unix milliseconds or a YYYY-MM-DD date. A date used as an upper bound
+// includes the whole day.
+func parseFilterTime(value string, endOfDay bool) (int64, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return millis, nil
+	}
+
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return 0, fmt.Errorf("expected unix milliseconds or a YYYY-MM-DD date: %v", value)
+	}
+
+	if endOfDay {
+		date = date.Add(24*time.Hour - time.Millisecond)
+	}
+
+	return date.UnixMilli(), nil
+}
+
+func splitQueryField(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+
+	return values
+}
+
+// Build the where clause used to query the mattermost collection.
+// The channels are always limited to the ones the user belongs to. Returns false
+// if no mattermost message can match the filters, so the collection shouldn't be queried.
+func (filters SearchFilters) mattermostWhere(mmChannelIds []interface{}) (map[string]interface{}, bool, error) {
+	if filters.Source != "" && filters.Source != "mm" {
+		return nil, false, nil
+	}
+
+	channelIds := mmChannelIds
+	if len(filters.ChannelIds) > 0 {
+		channelIds = intersectChannelIds(mmChannelIds, filters.ChannelIds)
+	}
+
+	// an unfiltered query would return posts from channels the user can't access
+	if len(channelIds) == 0 {
+		return nil, false, nil
+	}
+
+	operations := []where.WhereOperation{where.In("channel_id", channelIds)}
+
+	if len(filters.UserIds) > 0 {
+		operations = append(operations, where.In("user_id", toInterfaceSlice(filters.UserIds)))
+	}
+	if filters.TeamId != "" {
+		operations = append(operations, where.Eq("team_id", filters.TeamId))
+	}
+	if filters.Access != "" {
+		operations = append(operations, where.Eq("access", filters.Access))
+	}
+	if filters.Since > 0 {
+		operations = append(operations, where.Gte("create_at", int(filters.Since)))
+	}
+	if filters.Until > 0 {
+		operations = append(operations, where.Lte("create_at", int(filters.Until)))
+	}
+
+	whereClause, err := buildWhereClause(operations)
+	return whereClause, true, err
+}
+
+// Build the where clause used to query the slack collection. Slack messages are public,
+// aren't linked to mattermost channels, users or teams, and are dated by day in unix seconds.
+// Returns false if no slack message can match the filters.
+func (filters SearchFilters) slackWhere() (map[string]interface{}, bool, error) {
+	if filters.Source != "" && filters.Source != "sl" {
+		return nil, false, nil
+	}
+
+	if len(filters.ChannelIds) > 0 || len(filters.UserIds) > 0 || filters.TeamId != "" || filters.Access == "pri" {
+		return nil, false, nil
+	}
+
+	operations := []where.WhereOperation{}
+
+	if filters.Since > 0 {
+		// messages are dated at the start of their day
+		sinceDay := time.UnixMilli(filters.Since).UTC().Truncate(24 * time.Hour)
+		operations = append(operations, where.Gte("msg_date", int(sinceDay.Unix())))
+	}
+	if filters.Until > 0 {
+		operations = append(operations, where.Lte("msg_date", int(filters.Until/1000)))
+	}
+
+	whereClause, err := buildWhereClause(operations)
+	return whereClause, true, err
+}
+
+// Check if a document's metadata matches the filters, the same way the where clauses
+// filter the collections. Mattermost messages must be in one of the user's channels,
+// and messages from other sources must be public.
+func (filters SearchFilters) matches(metadata map[string]interface{}, mmChannelIds []interface{}) bool {
+	source, _ := metadata["source"].(string)
+	access, _ := metadata["access"].(string)
+
+	if filters.Source != "" && filters.Source != source {
+		return false
+	}
+	if filters.Access != "" && filters.Access != access {
+		return false
+	}
+
+	if source != "mm" {
+		if access != "pub" || len(filters.ChannelIds) > 0 || len(filters.UserIds) > 0 || filters.TeamId != "" {
+			return false
+		}
+
+		msgDate, _ := metadataNumber(metadata["msg_date"])
+		if filters.Since > 0 && msgDate < float64(time.UnixMilli(filters.Since).UTC().Truncate(24*time.Hour).Unix()) {
+			return false
+		}
+		if filters.Until > 0 && msgDate > float64(filters.Until/1000) {
+			return false
+		}
+
+		return true
+	}
+
+	channelId, _ := metadata["channel_id"].(string)
+	userId, _ := metadata["user_id"].(string)
+	teamId, _ := metadata["team_id"].(string)
+	createAt, _ := metadataNumber(metadata["create_at"])
+
+	channelIds := mmChannelIds
+	if len(filters.ChannelIds) > 0 {
+		channelIds = intersectChannelIds(mmChannelIds, filters.ChannelIds)
+	}
+
+	switch {
+	case !containsValue(channelIds, channelId):
+		return false
+	case len(filters.UserIds) > 0 && !containsValue(toInterfaceSlice(filters.UserIds), userId):
+		return false
+	case filters.TeamId != "" && filters.TeamId != teamId:
+		return false
+	case filters.Since > 0 && createAt < float64(filters.Since):
+		return false
+	case filters.Until > 0 && createAt > float64(filters.Until):
+		return false
+	}
+
+	return true
+}
+
+// Get a number from metadata, which is decoded as a float64 but may also be set as an int
+func metadataNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	}
+
+	return 0, false
+}
+
+func containsValue(values []interface{}, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Combine the operations into a where clause. Chroma requires at least two operations in an $and
+func buildWhereClause(operations []where.WhereOperation) (map[string]interface{}, error) {
+	switch len(operations) {
+	case 0:
+		return nil, nil
+	case 1:
+		return where.Where(operations[0])
+	}
+
+	return where.Where(where.And(operations...))
+}
+
+func intersectChannelIds(mmChannelIds []interface{}, channelIds []string) []interface{} {
+	userChannels := map[string]bool{}
+	for _, channelId := range mmChannelIds {
+		if id, ok := channelId.(string); ok {
+			userChannels[id] = true
+		}
+	}
+
+	intersection := []interface{}{}
+	for _, channelId := range channelIds {
+		if userChannels[channelId] {
+			intersection = append(intersection, channelId)
+		}
+	}
+
+	return intersection
+}
+
+func toInterfaceSlice(values []string) []interface{} {
+	interfaces := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		interfaces = append(interfaces, value)
+	}
+
+	return interfaces
+}
+
+// Evaluate a chroma where clause against a document's metadata, for vector stores that filter the
+// documents themselves. Supports the comparison operators, $in, $nin, $and and $or.
+func matchesWhere(metadata map[string]interface{}, whereClause map[string]interface{}) (bool, error) {
+	for key, condition := range whereClause {
+		var matches bool
+		var err error
+
+		switch key {
+		case "$and", "$or":
+			matches, err = matchesLogicalOperator(metadata, key, condition)
+		default:
+			matches, err = matchesCondition(metadata[key], key, condition)
+		}
+
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchesLogicalOperator(metadata map[string]interface{}, operator string, condition interface{}) (bool, error) {
+	clauses, err := whereSubClauses(operator, condition)
+	if err != nil {
+		return false, err
+	}
+
+	for _, clause := range clauses {
+		matches, err := matchesWhere(metadata, clause)
+		if err != nil {
+			return false, err
+		}
+
+		if operator == "$or" && matches {
+			return true, nil
+		}
+		if operator == "$and" && !matches {
+			return false, nil
+		}
+	}
+
+	return operator == "$and", nil
+}
+
+// Get the where clauses combined by an $and or $or operator
+func whereSubClauses(operator string, condition interface{}) ([]map[string]interface{}, error) {
+	var clauses []map[string]interface{}
+	switch typedCondition := condition.(type) {
+	case []map[string]interface{}:
+		clauses = typedCondition
+	case []interface{}:
+		for _, clause := range typedCondition {
+			clauseMap, ok := clause.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%v expects a list of where clauses", operator)
+			}
+			clauses = append(clauses, clauseMap)
+		}
+	default:
+		return nil, fmt.Errorf("%v expects a list of where clauses", operator)
+	}
+
+	if len(clauses) < 2 {
+		return nil, fmt.Errorf("%v expects at least two where clauses", operator)
+	}
+
+	return clauses, nil
+}
+
+func matchesCondition(value interface{}, key string, condition interface{}) (bool, error) {
+	operations, ok := condition.(map[string]interface{})
+	if !ok {
+		// a plain value is compared for equality
+		operations = map[string]interface{}{"$eq": condition}
+	}
+
+	for operator, operand := range operations {
+		var matches bool
+
+		switch operator {
+		case "$eq":
+			matches = metadataEqual(value, operand)
+		case "$ne":
+			matches = !metadataEqual(value, operand)
+		case "$gt", "$gte", "$lt", "$lte":
+			number, isNumber := metadataNumber(value)
+			bound, isBoundNumber := metadataNumber(operand)
+			if !isBoundNumber {
+				return false, fmt.Errorf("%v on %v expects a number: %v", operator, key, operand)
+			}
+
+			switch operator {
+			case "$gt":
+				matches = isNumber && number > bound
+			case "$gte":
+				matches = isNumber && number >= bound
+			case "$lt":
+				matches = isNumber && number < bound
+			case "$lte":
+				matches = isNumber && number <= bound
+			}
+		case "$in", "$nin":
+			values, ok := operand.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("%v on %v expects a list: %v", operator, key, operand)
+			}
+
+			found := false
+			for _, item := range values {
+				if metadataEqual(value, item) {
+					found = true
+					break
+				}
+			}
+			matches = found == (operator == "$in")
+		default:
+			return false, fmt.Errorf("unsupported where operator %v on %v", operator, key)
+		}
+
+		if !matches {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Compare metadata values, where numbers are equal regardless of their type
+func metadataEqual(value interface{}, other interface{}) bool {
+	number, isNumber := metadataNumber(value)
+	otherNumber, isOtherNumber := metadataNumber(other)
+	if isNumber && isOtherNumber {
+		return number == otherNumber
+	}
+
+	return value == other
+}
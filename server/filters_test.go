@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearchFilters(t *testing.T) {
+	t.Run("parses every filter", func(t *testing.T) {
+		filters, err := parseSearchFilters(url.Values{
+			"channel_ids": {"ch1, ch2,"},
+			"user_ids":    {"usr1"},
+			"team_id":     {"team1"},
+			"since":       {"2024-01-02"},
+			"until":       {"2024-01-02"},
+			"source":      {"mm"},
+			"access":      {"pri"},
+		})
+		assert.Nil(t, err)
+
+		day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+		assert.Equal(t, SearchFilters{
+			ChannelIds: []string{"ch1", "ch2"},
+			UserIds:    []string{"usr1"},
+			TeamId:     "team1",
+			Since:      day.UnixMilli(),
+			Until:      day.Add(24*time.Hour).UnixMilli() - 1,
+			Source:     "mm",
+			Access:     "pri",
+		}, filters)
+	})
+
+	t.Run("accepts unix milliseconds", func(t *testing.T) {
+		filters, err := parseSearchFilters(url.Values{"since": {"1700000000000"}})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1700000000000), filters.Since)
+	})
+
+	for name, queryFields := range map[string]url.Values{
+		"unknown source":       {"source": {"email"}},
+		"unknown access":       {"access": {"everyone"}},
+		"invalid date":         {"since": {"yesterday"}},
+		"since is after until": {"since": {"2024-02-01"}, "until": {"2024-01-01"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseSearchFilters(queryFields)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestMattermostWhere(t *testing.T) {
+	userChannels := []interface{}{"ch1", "ch2"}
+
+	t.Run("always restricts to the user's channels", func(t *testing.T) {
+		whereClause, ok, err := SearchFilters{}.mattermostWhere(userChannels)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, map[string]interface{}{
+			"channel_id": map[string]interface{}{"$in": []interface{}{"ch1", "ch2"}},
+		}, whereClause)
+	})
+
+	t.Run("channel filter can't widen the user's channels", func(t *testing.T) {
+		whereClause, ok, err := SearchFilters{ChannelIds: []string{"ch2", "other"}}.mattermostWhere(userChannels)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, map[string]interface{}{
+			"channel_id": map[string]interface{}{"$in": []interface{}{"ch2"}},
+		}, whereClause)
+
+		_, ok, err = SearchFilters{ChannelIds: []string{"other"}}.mattermostWhere(userChannels)
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("combines the filters", func(t *testing.T) {
+		whereClause, ok, err := SearchFilters{
+			UserIds: []string{"usr1"},
+			TeamId:  "team1",
+			Since:   1000,
+			Until:   2000,
+			Access:  "pub",
+		}.mattermostWhere(userChannels)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, map[string]interface{}{
+			"$and": []map[string]interface{}{
+				{"channel_id": map[string]interface{}{"$in": []interface{}{"ch1", "ch2"}}},
+				{"user_id": map[string]interface{}{"$in": []interface{}{"usr1"}}},
+				{"team_id": map[string]interface{}{"$eq": "team1"}},
+				{"access": map[string]interface{}{"$eq": "pub"}},
+				{"create_at": map[string]interface{}{"$gte": 1000}},
+				{"create_at": map[string]interface{}{"$lte": 2000}},
+			},
+		}, whereClause)
+	})
+
+	t.Run("skipped for other sources", func(t *testing.T) {
+		_, ok, err := SearchFilters{Source: "sl"}.mattermostWhere(userChannels)
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	})
+}
+
+func TestSlackWhere(t *testing.T) {
+	t.Run("no filters", func(t *testing.T) {
+		whereClause, ok, err := SearchFilters{}.slackWhere()
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Nil(t, whereClause)
+	})
+
+	t.Run("dates are compared by day", func(t *testing.T) {
+		day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+		whereClause, ok, err := SearchFilters{Since: day.Add(time.Hour).UnixMilli()}.slackWhere()
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, map[string]interface{}{
+			"msg_date": map[string]interface{}{"$gte": int(day.Unix())},
+		}, whereClause)
+	})
+
+	for name, filters := range map[string]SearchFilters{
+		"mattermost source": {Source: "mm"},
+		"channel filter":    {ChannelIds: []string{"ch1"}},
+		"user filter":       {UserIds: []string{"usr1"}},
+		"team filter":       {TeamId: "team1"},
+		"private access":    {Access: "pri"},
+	} {
+		t.Run("skipped for "+name, func(t *testing.T) {
+			_, ok, err := filters.slackWhere()
+			assert.Nil(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestFiltersMatches(t *testing.T) {
+	userChannels := []interface{}{"ch1", "ch2"}
+	post := map[string]interface{}{"source": "mm", "access": "pri", "channel_id": "ch1", "user_id": "usr1", "team_id": "team1", "create_at": float64(1500)}
+	slackMessage := map[string]interface{}{"source": "sl", "access": "pub", "msg_date": float64(86400)}
+
+	assert.True(t, SearchFilters{}.matches(post, userChannels))
+	assert.True(t, SearchFilters{UserIds: []string{"usr1"}, TeamId: "team1", Since: 1000, Until: 2000}.matches(post, userChannels))
+	assert.False(t, SearchFilters{}.matches(post, []interface{}{"ch2"}))
+	assert.False(t, SearchFilters{ChannelIds: []string{"ch2"}}.matches(post, userChannels))
+	assert.False(t, SearchFilters{Since: 2000}.matches(post, userChannels))
+	assert.False(t, SearchFilters{Source: "sl"}.matches(post, userChannels))
+
+	assert.True(t, SearchFilters{Since: 86400*1000 + 1}.matches(slackMessage, userChannels))
+	assert.False(t, SearchFilters{Until: 1000}.matches(slackMessage, userChannels))
+	assert.False(t, SearchFilters{TeamId: "team1"}.matches(slackMessage, userChannels))
+}
+
+func TestMatchesWhere(t *testing.T) {
+	metadata := map[string]interface{}{"channel_id": "ch1", "user_id": "usr1", "create_at": float64(1500)}
+
+	whereClause, _, err := SearchFilters{UserIds: []string{"usr1", "usr2"}, Since: 1000, Until: 2000}.mattermostWhere([]interface{}{"ch1"})
+	assert.Nil(t, err)
+
+	matches, err := matchesWhere(metadata, whereClause)
+	assert.Nil(t, err)
+	assert.True(t, matches)
+
+	for name, whereClause := range map[string]map[string]interface{}{
+		"other channel": {"channel_id": map[string]interface{}{"$in": []interface{}{"ch2"}}},
+		"excluded user": {"user_id": map[string]interface{}{"$nin": []interface{}{"usr1"}}},
+		"too old":       {"create_at": map[string]interface{}{"$gt": 1500}},
+		"missing field": {"team_id": map[string]interface{}{"$eq": "team1"}},
+		"no clause of $or": {"$or": []map[string]interface{}{
+			{"channel_id": map[string]interface{}{"$eq": "ch2"}},
+			{"user_id": map[string]interface{}{"$ne": "usr1"}},
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			matches, err := matchesWhere(metadata, whereClause)
+			assert.Nil(t, err)
+			assert.False(t, matches)
+		})
+	}
+
+	t.Run("unsupported operator", func(t *testing.T) {
+		_, err := matchesWhere(metadata, map[string]interface{}{"channel_id": map[string]interface{}{"$like": "ch%"}})
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Generator produces an answer from a conversation with an LLM
+type Generator interface {
+	Generate(ctx context.Context, messages []ChatMessage) (string, error)
+	// GenerateStream calls onToken with every token as it's generated, and returns the full answer
+	GenerateStream(ctx context.Context, messages []ChatMessage, onToken func(token string)) (string, error)
+}
+
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+const (
+	defaultLLMTemperature = 0.2
+	defaultLLMMaxTokens   = 512
+)
+
+// Create the generator defined in the plugin configuration.
+// Returns nil if no LLM model is configured.
+func NewGenerator(config *configuration) (Generator, error) {
+	if config.LLMModel == "" {
+		return nil, nil
+	}
+
+	baseURL := config.LLMURL
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+
+	temperature, err := config.getLLMTemperature()
+	if err != nil {
+		return nil, err
+	}
+
+	maxTokens, err := config.getLLMMaxTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewOpenAIGenerator(baseURL, config.LLMModel, config.LLMAPIKey, temperature, maxTokens), nil
+}
+
+// ---------------- OpenAI Generator ----------------
+
+// OpenAIGenerator uses an OpenAI compatible `/chat/completions` endpoint
+type OpenAIGenerator struct {
+	baseURL     string
+	model       string
+	apiKey      string
+	temperature float64
+	maxTokens   int
+	httpClient  *http.Client
+}
+
+type chatCompletionRequest struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	Temperature float64       `json:"temperature"`
+	MaxTokens   int           `json:"max_tokens"`
+	Stream      bool          `json:"stream,omitempty"`
+}
+
+type chatCompletionResponse struct {
+	Choices []struct {
+		Message ChatMessage `json:"message"`
+	} `json:"choices"`
+}
+
+type chatCompletionChunk struct {
+	Choices []struct {
+		Delta ChatMessage `json:"delta"`
+	} `json:"choices"`
+}
+
+func NewOpenAIGenerator(baseURL string, model string, apiKey string, temperature float64, maxTokens int) *OpenAIGenerator {
+	return &OpenAIGenerator{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		model:       model,
+		apiKey:      apiKey,
+		temperature: temperature,
+		maxTokens:   maxTokens,
+		httpClient:  &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+func (generator *OpenAIGenerator) Generate(ctx context.Context, messages []ChatMessage) (string, error) {
+	completionRes := chatCompletionResponse{}
+	err := postJSON(ctx, generator.httpClient, generator.baseURL+"/chat/completions", generator.headers(), chatCompletionRequest{
+		Model:       generator.model,
+		Messages:    messages,
+		Temperature: generator.temperature,
+		MaxTokens:   generator.maxTokens,
+	}, &completionRes)
+	if err != nil {
+		return "", err
+	}
+
+	if len(completionRes.Choices) == 0 {
+		return "", fmt.Errorf("generator: no choices returned by the model")
+	}
+
+	return completionRes.Choices[0].Message.Content, nil
+}
+
+func (generator *OpenAIGenerator) GenerateStream(ctx context.Context, messages []ChatMessage, onToken func(token string)) (string, error) {
+	requestJSON, err := json.Marshal(chatCompletionRequest{
+		Model:       generator.model,
+		Messages:    messages,
+		Temperature: generator.temperature,
+		MaxTokens:   generator.maxTokens,
+		Stream:      true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("client: could not encode json: %v", err)
+	}
+
+	reqUrl := generator.baseURL + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqUrl, bytes.NewReader(requestJSON))
+	if err != nil {
+		return "", fmt.Errorf("client: could not create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	for key, value := range generator.headers() {
+		req.Header.Set(key, value)
+	}
+
+	response, err := generator.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("client: error making http request: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("client: request to %v failed. Status code: %d", reqUrl, response.StatusCode)
+	}
+
+	// the completion is streamed as server-sent events, each holding a chunk of the answer
+	answer := strings.Builder{}
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		chunk := chatCompletionChunk{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("client: could not decode json: %v", err)
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+
+			answer.WriteString(choice.Delta.Content)
+			onToken(choice.Delta.Content)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("client: error while reading the streamed response: %v", err)
+	}
+
+	return answer.String(), nil
+}
+
+func (generator *OpenAIGenerator) headers() map[string]string {
+	headers := map[string]string{}
+	if generator.apiKey != "" {
+		headers["Authorization"] = "Bearer " + generator.apiKey
+	}
+
+	return headers
+}
+
+// ---------------- Prompt ----------------
+
+const llmSystemPrompt = `You are an assistant answering questions about a team's chat history.
+Answer using only the numbered messages you are given. Cite every message you use with its number in square brackets, e.g. [1] or [2][3].
+If the messages don't contain the answer, say that you couldn't find it in the conversations.`
+
+var llmPromptTemplate = template.Must(template.New("prompt").Funcs(template.FuncMap{
+	"inc": func(idx int) int { return idx + 1 },
+}).Parse(`Messages:
+{{range $idx, $metadata := .Metadatas}}[{{inc $idx}}] ({{$metadata.Time}}) {{$metadata.UserName}} in #{{$metadata.ChannelName}}: {{$metadata.Message}}
+{{end}}
+Question: {{.Query}}`))
+
+// Build the messages sent to the LLM. The retrieved messages are numbered starting
+// from 1, in the same order as the search results, so the answer can cite them.
+func buildLLMPrompt(query string, metadatas []MetadataSchema) ([]ChatMessage, error) {
+	prompt := bytes.Buffer{}
+	err := llmPromptTemplate.Execute(&prompt, map[string]interface{}{
+		"Query":     query,
+		"Metadatas": metadatas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while building the llm prompt: %v", err)
+	}
+
+	return []ChatMessage{
+		{Role: "system", Content: llmSystemPrompt},
+		{Role: "user", Content: prompt.String()},
+	}, nil
+}
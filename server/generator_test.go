@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewGenerator(t *testing.T) {
+	assert := assert.New(t)
+
+	generator, err := NewGenerator(&configuration{})
+	assert.Nil(err)
+	assert.Nil(generator)
+
+	generator, err = NewGenerator(&configuration{LLMModel: "test-model", LLMTemperature: "0.7", LLMMaxTokens: 100})
+	assert.Nil(err)
+	assert.Equal(0.7, generator.(*OpenAIGenerator).temperature)
+	assert.Equal(100, generator.(*OpenAIGenerator).maxTokens)
+
+	_, err = NewGenerator(&configuration{LLMModel: "test-model", LLMTemperature: "hot"})
+	assert.NotNil(err)
+
+	_, err = NewGenerator(&configuration{LLMModel: "test-model", LLMMaxTokens: -1})
+	assert.NotNil(err)
+}
+
+func TestOpenAIGenerator(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/chat/completions", r.URL.Path)
+
+		request := chatCompletionRequest{}
+		assert.Nil(json.NewDecoder(r.Body).Decode(&request))
+		assert.Equal("test-model", request.Model)
+		assert.Equal(0.5, request.Temperature)
+		assert.Equal(64, request.MaxTokens)
+		assert.Len(request.Messages, 2)
+
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "The release is on Friday [1]."}}]}`))
+	}))
+	defer server.Close()
+
+	generator := NewOpenAIGenerator(server.URL, "test-model", "", 0.5, 64)
+	messages, err := buildLLMPrompt("when is the release?", []MetadataSchema{{Message: "release is on friday"}})
+	assert.Nil(err)
+
+	answer, err := generator.Generate(context.Background(), messages)
+	assert.Nil(err)
+	assert.Equal("The release is on Friday [1].", answer)
+}
+
+func TestBuildLLMPrompt(t *testing.T) {
+	assert := assert.New(t)
+
+	messages, err := buildLLMPrompt("when is the release?", []MetadataSchema{
+		{UserName: "alice", ChannelName: "ops", Time: "01 Jan 24 10:00 UTC", Message: "release is on friday"},
+		{UserName: "bob", ChannelName: "dev", Time: "02 Jan 24 10:00 UTC", Message: "moved to monday"},
+	})
+	assert.Nil(err)
+	assert.Equal("system", messages[0].Role)
+	assert.Equal("user", messages[1].Role)
+	assert.Equal(`Messages:
+[1] (01 Jan 24 10:00 UTC) alice in #ops: release is on friday
+[2] (02 Jan 24 10:00 UTC) bob in #dev: moved to monday
+
+Question: when is the release?`, messages[1].Content)
+}
+
+func TestOpenAIGeneratorStream(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := chatCompletionRequest{}
+		assert.Nil(json.NewDecoder(r.Body).Decode(&request))
+		assert.True(request.Stream)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\": [{\"delta\": {\"role\": \"assistant\"}}]}\n\n"))
+		w.Write([]byte("data: {\"choices\": [{\"delta\": {\"content\": \"On \"}}]}\n\n"))
+		w.Write([]byte("data: {\"choices\": [{\"delta\": {\"content\": \"Friday [1].\"}}]}\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer server.Close()
+
+	generator := NewOpenAIGenerator(server.URL, "test-model", "", 0.5, 64)
+
+	tokens := []string{}
+	answer, err := generator.GenerateStream(context.Background(), []ChatMessage{{Role: "user", Content: "when?"}}, func(token string) {
+		tokens = append(tokens, token)
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"On ", "Friday [1]."}, tokens)
+	assert.Equal("On Friday [1].", answer)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -29,8 +30,8 @@ func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Req
 func (p *Plugin) initializeAPI() {
 	router := mux.NewRouter()
 
-	router.HandleFunc("/search", p.handleSearch)
-	// router.Use(p.requireAuth)
+	router.Handle("/search", p.requireAuth(http.HandlerFunc(p.handleSearch)))
+	router.Handle("/search/stream", p.requireAuth(http.HandlerFunc(p.handleSearchStream)))
 
 	syncRouter := router.PathPrefix("/sync").Subrouter()
 	// syncRouter.Use(p.requireAdmin)
@@ -40,7 +41,8 @@ func (p *Plugin) initializeAPI() {
 	syncRouter.HandleFunc("/is_sync_in_progress", p.handleIsSyncInProgress)
 	syncRouter.HandleFunc("/fetch_interval", p.handleFetchInterval)
 	syncRouter.HandleFunc("/last_fetched_at", p.handleLastFetchedAt)
-	syncRouter.HandleFunc("/reset", p.handleReset)
+	syncRouter.Handle("/reset", p.requireAdmin(http.HandlerFunc(p.handleReset)))
+	syncRouter.Handle("/reconcile", p.requireAdmin(http.HandlerFunc(p.handleReconcile)))
 
 	slackRouter := router.PathPrefix("/slack").Subrouter()
 	// slackRouter.Use(p.requireAdmin)
@@ -69,7 +71,7 @@ func (p *Plugin) requireAdmin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userId := r.Header.Get("Mattermost-User-ID")
 		if !p.API.HasPermissionTo(userId, model.PermissionManageSystem) {
-			http.Error(w, "UnAuthorized: Allowed only for admin", http.StatusUnauthorized)
+			http.Error(w, "Forbidden: Allowed only for admin", http.StatusForbidden)
 			return
 		}
 
@@ -92,17 +94,199 @@ func (p *Plugin) handleSearch(w http.ResponseWriter, r *http.Request) {
 
 	userId := r.Header.Get("Mattermost-User-ID")
 
-	searchResponse := Search(query, userId)
+	options, err := p.parseSearchOptions(r)
+	if err != nil {
+		writeSearchError(w, http.StatusBadRequest, SearchError{Code: "invalid_request", Message: err.Error()})
+		return
+	}
+
+	// search the free text of the query with the filters of its search operators
+	query, err = p.applySearchOperators(query, userId, &options)
+	if err != nil {
+		writeSearchError(w, http.StatusBadRequest, SearchError{Code: "invalid_request", Message: err.Error()})
+		return
+	}
+
+	searchResponse, err := p.Search(r.Context(), query, userId, options)
+	if err != nil {
+		log.Printf("error while searching: %v \n", err)
+		writeSearchError(w, vectorStoreErrorStatus(err), newSearchError(err))
+		return
+	}
 
 	searchResponseJSON, err := json.Marshal(searchResponse)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	io.Writer.Write(w, searchResponseJSON)
+}
+
+// SearchError is the body of a failed search response, which the RHS displays
+type SearchError struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+// Create the search error matching the kind of err, with a message that can be shown to the user
+func newSearchError(err error) SearchError {
+	switch {
+	case errors.Is(err, ErrInvalidFilter):
+		return SearchError{Code: "invalid_filter", Message: "The search filters are invalid: " + err.Error()}
+	case errors.Is(err, ErrVectorStoreUnavailable):
+		return SearchError{Code: "vector_store_unavailable", Message: "The search service is unavailable. Please try again later."}
+	case errors.Is(err, ErrVectorStoreTimeout):
+		return SearchError{Code: "vector_store_timeout", Message: "The search took too long. Please try again."}
+	case errors.Is(err, ErrEmbeddingModelMismatch):
+		return SearchError{Code: "embedding_model_mismatch", Message: "The messages must be synced again after the embedding model was changed. Please contact your system administrator."}
+	}
+
+	var vectorStoreError *VectorStoreError
+	if errors.As(err, &vectorStoreError) {
+		return SearchError{Code: "vector_store_error", Message: "Something went wrong while searching. Please try again."}
+	}
+
+	return SearchError{Code: "search_error", Message: err.Error()}
+}
+
+func writeSearchError(w http.ResponseWriter, status int, searchError SearchError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(searchError); err != nil {
+		log.Printf("error while trying to encode search error: %v \n", err)
+	}
+}
+
+// Get the search options from the query fields of a search request
+func (p *Plugin) parseSearchOptions(r *http.Request) (SearchOptions, error) {
+	config := p.getConfiguration()
+
+	minScore, err := config.getSearchMinScore()
+	if err != nil {
+		return SearchOptions{}, err
+	}
+
+	lexicalWeight, err := config.getSearchLexicalWeight()
+	if err != nil {
+		return SearchOptions{}, err
+	}
+
+	mmrLambda, err := config.getSearchMMRLambda()
+	if err != nil {
+		return SearchOptions{}, err
+	}
+
+	boosts, err := config.getScoreBoosts()
+	if err != nil {
+		return SearchOptions{}, err
+	}
+
+	options := SearchOptions{
+		Limit:         config.getSearchResultLimit(),
+		MinScore:      minScore,
+		LexicalWeight: lexicalWeight,
+		Rerank:        config.RerankModel != "",
+		MMRLambda:     mmrLambda,
+		Boosts:        boosts,
+	}
+
+	if r.URL.Query().Has("limit") {
+		limit, parseError := strconv.Atoi(r.URL.Query().Get("limit"))
+		if parseError != nil || limit < 1 || limit > maxSearchResultLimit {
+			return SearchOptions{}, fmt.Errorf("limit query field must be a number between 1 and %d", maxSearchResultLimit)
+		}
+		options.Limit = limit
+	}
+
+	if r.URL.Query().Has("min_score") {
+		minScore, parseError := strconv.ParseFloat(r.URL.Query().Get("min_score"), 64)
+		if parseError != nil || minScore < 0 || minScore > 1 {
+			return SearchOptions{}, fmt.Errorf("min_score query field must be a number between 0 and 1")
+		}
+		options.MinScore = minScore
+	}
+
+	if r.URL.Query().Has("offset") && r.URL.Query().Has("cursor") {
+		return SearchOptions{}, fmt.Errorf("offset and cursor query fields can't be used together")
+	}
+
+	if r.URL.Query().Has("offset") {
+		offset, parseError := strconv.Atoi(r.URL.Query().Get("offset"))
+		if parseError != nil || offset < 0 {
+			return SearchOptions{}, fmt.Errorf("offset query field must be a positive number")
+		}
+		options.Offset = offset
+	}
+
+	if r.URL.Query().Has("cursor") {
+		offset, parseError := decodeSearchCursor(r.URL.Query().Get("cursor"))
+		if parseError != nil {
+			return SearchOptions{}, fmt.Errorf("cursor query field is invalid")
+		}
+		options.Offset = offset
+	}
+
+	if options.Offset+options.Limit > maxSearchResultDepth {
+		return SearchOptions{}, fmt.Errorf("can't get search results past the first %d", maxSearchResultDepth)
+	}
 
-	responseJSON, _ := json.MarshalIndent(searchResponse, "->", "  ")
-	fmt.Println(string(responseJSON))
+	if r.URL.Query().Has("lexical_weight") {
+		lexicalWeight, parseError := strconv.ParseFloat(r.URL.Query().Get("lexical_weight"), 64)
+		if parseError != nil || lexicalWeight < 0 || lexicalWeight > 1 {
+			return SearchOptions{}, fmt.Errorf("lexical_weight query field must be a number between 0 and 1")
+		}
+		options.LexicalWeight = lexicalWeight
+	}
+
+	if r.URL.Query().Has("mmr_lambda") {
+		mmrLambda, parseError := strconv.ParseFloat(r.URL.Query().Get("mmr_lambda"), 64)
+		if parseError != nil || mmrLambda < 0 || mmrLambda > 1 {
+			return SearchOptions{}, fmt.Errorf("mmr_lambda query field must be a number between 0 and 1")
+		}
+		options.MMRLambda = mmrLambda
+	}
+
+	if r.URL.Query().Has("with_scores") {
+		withScores, parseError := strconv.ParseBool(r.URL.Query().Get("with_scores"))
+		if parseError != nil {
+			return SearchOptions{}, fmt.Errorf("with_scores query field must be a boolean")
+		}
+		options.WithScores = withScores
+	}
+
+	if r.URL.Query().Has("rerank") {
+		rerank, parseError := strconv.ParseBool(r.URL.Query().Get("rerank"))
+		if parseError != nil {
+			return SearchOptions{}, fmt.Errorf("rerank query field must be a boolean")
+		}
+		options.Rerank = rerank
+	}
+
+	if r.URL.Query().Has("with_llm") {
+		withLLM, parseError := strconv.ParseBool(r.URL.Query().Get("with_llm"))
+		if parseError != nil {
+			return SearchOptions{}, fmt.Errorf("with_llm query field must be a boolean")
+		}
+		options.WithLLM = withLLM
+	}
+
+	filters, err := parseSearchFilters(r.URL.Query())
+	if err != nil {
+		return SearchOptions{}, err
+	}
+	options.Filters = filters
+
+	if options.WithLLM && config.LLMModel == "" {
+		return SearchOptions{}, fmt.Errorf("llm response requested, but no llm model is configured")
+	}
+
+	if options.Rerank && config.RerankModel == "" {
+		return SearchOptions{}, fmt.Errorf("reranking requested, but no rerank model is configured")
+	}
+
+	return options, nil
 }
 
 // Sync handlers
@@ -207,13 +391,67 @@ func (p *Plugin) handleReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isReset, err := ResetVectorStore()
+	scope, err := parseResetScope(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun, err := parseDryRun(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := p.mmSync.Reset(r.Context(), scope, dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), vectorStoreErrorStatus(err))
 		return
 	}
 
-	io.Writer.Write(w, []byte(fmt.Sprintf("Vector store reset successfully: %v", isReset)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Start a reconciliation of the vector store with Mattermost on POST,
+// and get the report of the last reconciliation on GET
+func (p *Plugin) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		mutex, err := p.lockReconciliation()
+		if errors.Is(err, ErrReconcileInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// reconciling takes a while, its report is fetched with GET
+		go func() {
+			defer mutex.Unlock()
+			p.runReconciliation(context.Background())
+		}()
+
+		w.WriteHeader(http.StatusAccepted)
+		io.Writer.Write(w, []byte("Reconciliation started"))
+	case "GET":
+		report, err := p.getReconcileReport()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if report == nil {
+			http.Error(w, "The vector store has never been reconciled", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
 // Slack handlers
@@ -399,8 +637,8 @@ func (p *Plugin) handleUploadStoreSlackData(w http.ResponseWriter, r *http.Reque
 
 			msgDate, dateParseError := time.Parse(time.RFC3339, msgDateStr)
 			if dateParseError != nil {
-				log.Fatalf("error while trying to parse date: %v \n", dateParseError)
-				http.Error(w, "error while trying to parse date", http.StatusInternalServerError)
+				log.Printf("error while trying to parse date: %v \n", dateParseError)
+				http.Error(w, "error while trying to parse date", http.StatusBadRequest)
 				return
 			}
 
@@ -456,10 +694,16 @@ func (p *Plugin) handleUploadStoreSlackData(w http.ResponseWriter, r *http.Reque
 				continue
 			}
 
-			_, upError := GetSlackInstance().slackCollection.Upsert(context.Background(), nil, metadatas, documents, ids)
+			upError := p.vectorStore.Upsert(r.Context(), slackCollectionType, ids, documents, metadatas)
 			if upError != nil {
-				log.Fatalf("Failed to upsert to chroma: %v \n", upError)
-				http.Error(w, "Failed to upsert to chroma", http.StatusInternalServerError)
+				log.Printf("error while upserting to the vector store: %v \n", upError)
+				http.Error(w, "Failed to upsert to the vector store: "+upError.Error(), vectorStoreErrorStatus(upError))
+				return
+			}
+
+			if lexError := GetLexicalIndex().Upsert(ids, documents, metadatas); lexError != nil {
+				log.Printf("error while upserting to the lexical index: %v \n", lexError)
+				http.Error(w, "Failed to upsert to the lexical index", http.StatusInternalServerError)
 				return
 			}
 
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearchOptions(t *testing.T) {
+	plugin := Plugin{configuration: &configuration{SearchResultLimit: 10, SearchMinScore: "0.7"}}
+
+	t.Run("defaults to the configured values", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/search?query=release", nil)
+
+		options, err := plugin.parseSearchOptions(r)
+		assert.Nil(t, err)
+		assert.Equal(t, SearchOptions{Limit: 10, MinScore: 0.7, LexicalWeight: 0.3, MMRLambda: 1}, options)
+	})
+
+	t.Run("overridden per request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/search?query=release&limit=3&min_score=0.5&lexical_weight=0&mmr_lambda=0.5&with_scores=true", nil)
+
+		options, err := plugin.parseSearchOptions(r)
+		assert.Nil(t, err)
+		assert.Equal(t, SearchOptions{Limit: 3, MinScore: 0.5, MMRLambda: 0.5, WithScores: true}, options)
+	})
+
+	t.Run("pages with an offset or a cursor", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/search?query=release&offset=20", nil)
+
+		options, err := plugin.parseSearchOptions(r)
+		assert.Nil(t, err)
+		assert.Equal(t, 20, options.Offset)
+
+		r = httptest.NewRequest(http.MethodGet, "/search?query=release&cursor="+encodeSearchCursor(30), nil)
+
+		options, err = plugin.parseSearchOptions(r)
+		assert.Nil(t, err)
+		assert.Equal(t, 30, options.Offset)
+	})
+
+	t.Run("reranks if a rerank model is configured", func(t *testing.T) {
+		plugin := Plugin{configuration: &configuration{RerankModel: "rerank-test"}}
+		r := httptest.NewRequest(http.MethodGet, "/search?query=release", nil)
+
+		options, err := plugin.parseSearchOptions(r)
+		assert.Nil(t, err)
+		assert.True(t, options.Rerank)
+
+		r = httptest.NewRequest(http.MethodGet, "/search?query=release&rerank=false", nil)
+
+		options, err = plugin.parseSearchOptions(r)
+		assert.Nil(t, err)
+		assert.False(t, options.Rerank)
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		for _, query := range []string{"limit=0", "limit=many", "min_score=2", "with_llm=maybe", "with_llm=true", "lexical_weight=2", "mmr_lambda=-1", "with_scores=maybe", "rerank=maybe", "rerank=true", "offset=-1", "offset=995", "cursor=abc", "offset=1&cursor=" + encodeSearchCursor(1)} {
+			r := httptest.NewRequest(http.MethodGet, "/search?query=release&"+query, nil)
+
+			_, err := plugin.parseSearchOptions(r)
+			assert.NotNil(t, err, query)
+		}
+	})
+}
+
+func TestHandleSearchErrors(t *testing.T) {
+	plugin := Plugin{configuration: &configuration{}, mmClient: &fakeMattermostClient{}}
+
+	r := httptest.NewRequest(http.MethodGet, "/search?query=release&limit=0", nil)
+	w := httptest.NewRecorder()
+	plugin.handleSearch(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"code": "invalid_request", "error": "limit query field must be a number between 1 and 100"}`, w.Body.String())
+
+	r = httptest.NewRequest(http.MethodGet, "/search?query=release+after:yesterday", nil)
+	w = httptest.NewRecorder()
+	plugin.handleSearch(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"code": "invalid_request", "error": "after operator must be a YYYY-MM-DD date: yesterday"}`, w.Body.String())
+
+	searchError := newSearchError(newVectorStoreError("query", ErrVectorStoreUnavailable, errors.New("connection refused")))
+	assert.Equal(t, "vector_store_unavailable", searchError.Code)
+	assert.NotContains(t, searchError.Message, "connection refused")
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+	api.On("HasPermissionTo", "user1", model.PermissionManageSystem).Return(false)
+
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+	plugin.initializeAPI()
+
+	for _, path := range []string{"/sync/reset", "/sync/reconcile"} {
+		t.Run(path+" is forbidden to other users", func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, path, nil)
+			r.Header.Set("Mattermost-User-ID", "user1")
+			w := httptest.NewRecorder()
+
+			plugin.router.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusForbidden, w.Code)
+		})
+	}
+}
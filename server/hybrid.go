@@ -0,0 +1,85 @@
+package main
+
+import "sort"
+
+// searchResult is a message found by the vector search, the lexical search or both
+type searchResult struct {
+	Id       string
+	Document string
+	Metadata map[string]interface{}
+	Scores   ScoreBreakdown
+}
+
+// ScoreBreakdown shows how a result was ranked. The ranks start from 1, and are 0 if
+// the result wasn't found by that search.
+type ScoreBreakdown struct {
+	Vector      float64 `json:"vector"` // similarity score, 1 - cosine distance
+	VectorRank  int     `json:"vector_rank"`
+	Lexical     float64 `json:"lexical"` // BM25 score
+	LexicalRank int     `json:"lexical_rank"`
+	Fused       float64 `json:"fused"`            // reciprocal rank fusion score
+	Rerank      float64 `json:"rerank,omitempty"` // relevance score of the reranker, if the results were reranked
+	RerankRank  int     `json:"rerank_rank,omitempty"`
+	Boost       float64 `json:"boost,omitempty"`   // multiplier of the recency and engagement boosts, if they're enabled
+	Boosted     float64 `json:"boosted,omitempty"` // score scaled to at most 1, multiplied by the boost
+	MMR         float64 `json:"mmr,omitempty"`     // maximal marginal relevance score, if the results were diversified
+}
+
+// dampens the weight of the top ranks in reciprocal rank fusion
+const rrfRankConstant = 60
+
+// Get the results of a lexical search, which are already sorted by descending score
+func lexicalSearchResults(lexicalResults []LexicalResult) []searchResult {
+	results := []searchResult{}
+	for _, lexicalResult := range lexicalResults {
+		results = append(results, searchResult{
+			Id:       lexicalResult.Id,
+			Document: lexicalResult.Document,
+			Metadata: lexicalResult.Metadata,
+			Scores:   ScoreBreakdown{Lexical: lexicalResult.Score},
+		})
+	}
+
+	return results
+}
+
+// Merge the vector and lexical results using weighted reciprocal rank fusion.
+// Every result scores weight / (60 + rank) for each search that found it, where the lexical
+// search has a weight of lexicalWeight and the vector search the rest. The merged results
+// are sorted by descending fused score.
+func fuseResults(vectorResults []searchResult, lexicalResults []searchResult, lexicalWeight float64) []searchResult {
+	fusedResults := []searchResult{}
+	positions := map[string]int{}
+
+	for rank, result := range vectorResults {
+		result.Scores.VectorRank = rank + 1
+		result.Scores.Fused = (1 - lexicalWeight) / float64(rrfRankConstant+rank+1)
+
+		positions[result.Id] = len(fusedResults)
+		fusedResults = append(fusedResults, result)
+	}
+
+	for rank, result := range lexicalResults {
+		lexicalScore := lexicalWeight / float64(rrfRankConstant+rank+1)
+
+		if position, ok := positions[result.Id]; ok {
+			fusedResults[position].Scores.Lexical = result.Scores.Lexical
+			fusedResults[position].Scores.LexicalRank = rank + 1
+			fusedResults[position].Scores.Fused += lexicalScore
+			continue
+		}
+
+		result.Scores.LexicalRank = rank + 1
+		result.Scores.Fused = lexicalScore
+
+		positions[result.Id] = len(fusedResults)
+		fusedResults = append(fusedResults, result)
+	}
+
+	// vector results come first on ties, as they were added first
+	sort.SliceStable(fusedResults, func(i, j int) bool {
+		return fusedResults[i].Scores.Fused > fusedResults[j].Scores.Fused
+	})
+
+	return fusedResults
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuseResults(t *testing.T) {
+	vectorResults := []searchResult{
+		{Id: "a", Metadata: map[string]interface{}{"source": "mm"}, Scores: ScoreBreakdown{Vector: 0.9}},
+		{Id: "b", Metadata: map[string]interface{}{"source": "mm"}, Scores: ScoreBreakdown{Vector: 0.85}},
+	}
+	lexicalResults := []searchResult{
+		{Id: "c", Metadata: map[string]interface{}{"source": "mm"}, Scores: ScoreBreakdown{Lexical: 7.5}},
+		{Id: "b", Metadata: map[string]interface{}{"source": "mm"}, Scores: ScoreBreakdown{Lexical: 3.2}},
+	}
+
+	t.Run("results found by both searches rank first", func(t *testing.T) {
+		results := fuseResults(vectorResults, lexicalResults, 0.5)
+		assert.Equal(t, []string{"b", "a", "c"}, flattenIds(results))
+
+		assert.Equal(t, ScoreBreakdown{
+			Vector:      0.85,
+			VectorRank:  2,
+			Lexical:     3.2,
+			LexicalRank: 2,
+			Fused:       0.5/62 + 0.5/62,
+		}, results[0].Scores)
+	})
+
+	t.Run("the weight favors one search", func(t *testing.T) {
+		assert.Equal(t, []string{"c", "b", "a"}, flattenIds(fuseResults(vectorResults, lexicalResults, 1)))
+		assert.Equal(t, []string{"a", "b", "c"}, flattenIds(fuseResults(vectorResults, lexicalResults, 0)))
+	})
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+// LexicalIndex is a BM25 keyword index of the messages stored in the vector store.
+// It finds exact identifiers like ticket numbers, hostnames and error codes, which the
+// vector search tends to miss. The inverted index is kept in memory, and the changes of the
+// documents are saved as segments in a data store shared by the servers of a cluster, which
+// are read back when the plugin starts. The sync leader compacts the segments into snapshots.
+type LexicalIndex struct {
+	// guards the in memory index
+	lock        sync.RWMutex
+	documents   map[string]lexicalDocument
+	postings    map[string]map[string]int // term -> document id -> term frequency
+	totalLength int
+	// the segments applied to the index
+	segments map[string]bool
+	// whether the segments of the data store were loaded, which they must be before they're compacted
+	loaded bool
+
+	// serializes the changes of the index, which are saved before they're applied in memory,
+	// so the searches aren't blocked while the data store is written
+	writeLock sync.Mutex
+	store     db.DataStore
+	// whether this server compacts the segments
+	compacts atomic.Bool
+	// called with the segments written by this server, so the other servers apply them
+	onChange func(change LexicalChange)
+}
+
+// LexicalChange is a change of the lexical index made by a server
+type LexicalChange struct {
+	Segment string `json:"segment,omitempty"` // the key of the segment holding the changes
+	Reset   bool   `json:"reset"`             // every document was removed
+}
+
+// lexicalSegment is a batch of changes of the lexical index, saved under a single key. The segments are
+// applied in the order of their keys, which start with the time they were written.
+type lexicalSegment struct {
+	Documents map[string]lexicalDocument `json:"documents,omitempty"`
+	Deleted   []string                   `json:"deleted,omitempty"`
+}
+
+type lexicalDocument struct {
+	Document string                 `json:"document"`
+	Metadata map[string]interface{} `json:"metadata"`
+	terms    map[string]int
+	length   int
+}
+
+// LexicalResult is a document matching a lexical search, with its BM25 score
+type LexicalResult struct {
+	Id       string
+	Document string
+	Metadata map[string]interface{}
+	Score    float64
+}
+
+const (
+	lexicalBucket = "lexical_segments"
+	// number of documents in each segment of a snapshot
+	lexicalSnapshotSize = 2000
+	// the segments are compacted once more segments were written since the last snapshot than the
+	// snapshot has, and at least this many, so loading the index reads about twice the snapshot at most
+	lexicalMinCompactSegments = 64
+
+	// BM25 term frequency saturation and document length normalization
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var lexicalInstance *LexicalIndex
+var lexicalOnce sync.Once
+
+// Create the lexical index of the plugin, saved in store, and load its documents in the background.
+// onChange is called with the segments written by this server.
+func InitLexicalIndex(store db.DataStore, onChange func(change LexicalChange)) {
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(store)
+		lexicalInstance.onChange = onChange
+
+		go func(index *LexicalIndex) {
+			if err := index.load(); err != nil {
+				log.Printf("error while loading the lexical index: %v \n", err)
+			}
+		}(lexicalInstance)
+	})
+}
+
+// Get the lexical index of the plugin. Its documents are only kept in memory if it wasn't initialized.
+func GetLexicalIndex() *LexicalIndex {
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	return lexicalInstance
+}
+
+// Create an empty lexical index. The documents are only kept in memory if store is nil.
+func NewLexicalIndex(store db.DataStore) *LexicalIndex {
+	return &LexicalIndex{
+		store:     store,
+		documents: map[string]lexicalDocument{},
+		postings:  map[string]map[string]int{},
+		segments:  map[string]bool{},
+		loaded:    store == nil,
+	}
+}
+
+// The key of a new segment, sorted after the segments written before
+func newLexicalSegmentKey() string {
+	return fmt.Sprintf("%016x-%v", time.Now().UnixNano(), model.NewId())
+}
+
+// The key of a segment of a snapshot of the segments up to lastKey. It's sorted right after them,
+// before the segments written since, as the ids of the segments never contain a ~.
+func lexicalSnapshotKey(lastKey string, part int) string {
+	return fmt.Sprintf("%v-~%06d", lastKey[:16], part)
+}
+
+func isLexicalSnapshotKey(key string) bool {
+	return strings.Contains(key, "~")
+}
+
+// Rebuild the in memory index from the segments in the data store
+func (index *LexicalIndex) load() error {
+	if index.store == nil {
+		return nil
+	}
+
+	index.writeLock.Lock()
+	defer index.writeLock.Unlock()
+
+	return index.reload()
+}
+
+// Rebuild the in memory index. Must be called while holding writeLock.
+func (index *LexicalIndex) reload() error {
+	keys, err := index.store.Keys(lexicalBucket)
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	documents := map[string]lexicalDocument{}
+	for _, key := range keys {
+		segment, err := index.getSegment(key)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range segment.Deleted {
+			delete(documents, id)
+		}
+		for id, document := range segment.Documents {
+			documents[id] = withTerms(document)
+		}
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	index.clear()
+	for id, document := range documents {
+		index.indexDocument(id, document)
+	}
+	for _, key := range keys {
+		index.segments[key] = true
+	}
+	index.loaded = true
+
+	return nil
+}
+
+// Whether the documents of the data store were loaded
+func (index *LexicalIndex) isLoaded() bool {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	return index.loaded
+}
+
+// Make this server compact the segments, or stop it
+func (index *LexicalIndex) setCompacts(compacts bool) {
+	index.compacts.Store(compacts)
+}
+
+// Add or replace documents in the index. ids, documents and metadatas have the same order, like a chroma upsert.
+func (index *LexicalIndex) Upsert(ids []string, documents []string, metadatas []map[string]interface{}) error {
+	if len(ids) != len(documents) || len(ids) != len(metadatas) {
+		return fmt.Errorf("ids, documents and metadatas must have the same length")
+	}
+
+	segment := lexicalSegment{Documents: map[string]lexicalDocument{}}
+	for idx, id := range ids {
+		segment.Documents[id] = lexicalDocument{Document: documents[idx], Metadata: metadatas[idx]}
+	}
+
+	index.writeLock.Lock()
+	defer index.writeLock.Unlock()
+
+	return index.write(segment)
+}
+
+func (index *LexicalIndex) Delete(ids []string) error {
+	index.writeLock.Lock()
+	defer index.writeLock.Unlock()
+
+	return index.write(lexicalSegment{Deleted: ids})
+}
+
+// Delete the documents whose metadata match a chroma where clause
+func (index *LexicalIndex) DeleteWhere(whereClause map[string]interface{}) error {
+	index.lock.RLock()
+	ids := []string{}
+	for id, document := range index.documents {
+		matches, err := matchesWhere(document.Metadata, whereClause)
+		if err != nil {
+			index.lock.RUnlock()
+			return err
+		}
+
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	index.lock.RUnlock()
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return index.Delete(ids)
+}
+
+// Remove every document from the index
+func (index *LexicalIndex) Reset() error {
+	index.writeLock.Lock()
+	defer index.writeLock.Unlock()
+
+	if index.store != nil {
+		if err := index.store.DeleteBucket(lexicalBucket); err != nil {
+			return fmt.Errorf("error while resetting the lexical index: %v", err)
+		}
+	}
+
+	index.lock.Lock()
+	index.clear()
+	index.lock.Unlock()
+
+	index.notify(LexicalChange{Reset: true})
+
+	return nil
+}
+
+// Apply the changes made by another server, reading their segment from the data store
+func (index *LexicalIndex) Refresh(change LexicalChange) error {
+	if index.store == nil {
+		return nil
+	}
+
+	index.writeLock.Lock()
+	defer index.writeLock.Unlock()
+
+	if change.Reset {
+		index.lock.Lock()
+		index.clear()
+		index.lock.Unlock()
+	}
+
+	if change.Segment == "" {
+		return nil
+	}
+
+	segment, err := index.getSegment(change.Segment)
+	if err != nil {
+		// the segment may have been compacted into a snapshot since it was written
+		log.Printf("error while reading the changes of the lexical index, reloading it: %v \n", err)
+		return index.reload()
+	}
+
+	index.apply(change.Segment, segment)
+	return nil
+}
+
+// Save a segment in the data store, then apply it to the index, and compact the segments if there are too many.
+// Must be called while holding writeLock.
+func (index *LexicalIndex) write(segment lexicalSegment) error {
+	if index.store == nil {
+		index.apply("", segment)
+		return nil
+	}
+
+	key := newLexicalSegmentKey()
+	if err := index.putSegment(key, segment); err != nil {
+		return err
+	}
+
+	// read the segment back as it's stored, with numbers as float64 like chroma returns them
+	segment, err := index.getSegment(key)
+	if err != nil {
+		return err
+	}
+
+	index.apply(key, segment)
+	index.notify(LexicalChange{Segment: key})
+
+	if index.needsCompaction() {
+		if err := index.compact(); err != nil {
+			log.Printf("error while compacting the lexical index: %v \n", err)
+		}
+	}
+
+	return nil
+}
+
+func (index *LexicalIndex) putSegment(key string, segment lexicalSegment) error {
+	value, err := json.Marshal(segment)
+	if err != nil {
+		return fmt.Errorf("could not encode lexical segment %v: %v", key, err)
+	}
+
+	if err := index.store.Put(lexicalBucket, key, value); err != nil {
+		return fmt.Errorf("error while saving lexical segment %v: %v", key, err)
+	}
+
+	return nil
+}
+
+func (index *LexicalIndex) getSegment(key string) (lexicalSegment, error) {
+	value, err := index.store.Get(lexicalBucket, key)
+	if err != nil {
+		return lexicalSegment{}, fmt.Errorf("could not get lexical segment %v: %v", key, err)
+	}
+
+	segment := lexicalSegment{}
+	if err := json.Unmarshal(value, &segment); err != nil {
+		return lexicalSegment{}, fmt.Errorf("could not decode lexical segment %v: %v", key, err)
+	}
+
+	return segment, nil
+}
+
+// Apply the changes of a segment to the in memory index. The terms are counted before locking it.
+func (index *LexicalIndex) apply(key string, segment lexicalSegment) {
+	for id, document := range segment.Documents {
+		segment.Documents[id] = withTerms(document)
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	for _, id := range segment.Deleted {
+		index.removeDocument(id)
+	}
+	for id, document := range segment.Documents {
+		index.removeDocument(id)
+		index.indexDocument(id, document)
+	}
+
+	if key != "" {
+		index.segments[key] = true
+	}
+}
+
+// Whether this server should compact the segments. Must be called while holding writeLock.
+func (index *LexicalIndex) needsCompaction() bool {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	if !index.compacts.Load() || !index.loaded {
+		return false
+	}
+
+	snapshotSegments := 0
+	for key := range index.segments {
+		if isLexicalSnapshotKey(key) {
+			snapshotSegments++
+		}
+	}
+
+	writtenSegments := len(index.segments) - snapshotSegments
+	return writtenSegments > lexicalMinCompactSegments && writtenSegments > snapshotSegments
+}
+
+// Replace the segments of the data store with a snapshot of the index. A compaction that fails leaves
+// segments sorted before the snapshot, which it overrides when they're loaded.
+// Must be called while holding writeLock.
+func (index *LexicalIndex) compact() error {
+	keys, err := index.store.Keys(lexicalBucket)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	// the segments of the other servers that weren't received yet are applied, so the snapshot includes them
+	for _, key := range keys {
+		if index.segments[key] {
+			continue
+		}
+
+		segment, err := index.getSegment(key)
+		if err != nil {
+			return err
+		}
+		index.apply(key, segment)
+	}
+
+	index.lock.RLock()
+	ids := make([]string, 0, len(index.documents))
+	documents := make(map[string]lexicalDocument, len(index.documents))
+	for id, document := range index.documents {
+		ids = append(ids, id)
+		documents[id] = lexicalDocument{Document: document.Document, Metadata: document.Metadata}
+	}
+	index.lock.RUnlock()
+	sort.Strings(ids)
+
+	snapshotKeys := []string{}
+	for start := 0; start < len(ids); start += lexicalSnapshotSize {
+		end := start + lexicalSnapshotSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		segment := lexicalSegment{Documents: map[string]lexicalDocument{}}
+		for _, id := range ids[start:end] {
+			segment.Documents[id] = documents[id]
+		}
+
+		key := lexicalSnapshotKey(keys[len(keys)-1], len(snapshotKeys))
+		if err := index.putSegment(key, segment); err != nil {
+			return err
+		}
+		snapshotKeys = append(snapshotKeys, key)
+	}
+
+	for _, key := range keys {
+		if err := index.store.Delete(lexicalBucket, key); err != nil {
+			return fmt.Errorf("error while deleting lexical segment %v: %v", key, err)
+		}
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	index.segments = map[string]bool{}
+	for _, key := range snapshotKeys {
+		index.segments[key] = true
+	}
+
+	return nil
+}
+
+// Get the ids of the documents that aren't in the index
+func (index *LexicalIndex) missingIds(ids []string) []string {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	missingIds := []string{}
+	for _, id := range ids {
+		if _, ok := index.documents[id]; !ok {
+			missingIds = append(missingIds, id)
+		}
+	}
+
+	return missingIds
+}
+
+// must be called while holding the write lock
+func (index *LexicalIndex) clear() {
+	index.documents = map[string]lexicalDocument{}
+	index.postings = map[string]map[string]int{}
+	index.totalLength = 0
+	index.segments = map[string]bool{}
+}
+
+// Tell the other servers about a change. Nothing is shared by the indexes kept in memory.
+func (index *LexicalIndex) notify(change LexicalChange) {
+	if index.store == nil || index.onChange == nil {
+		return
+	}
+
+	index.onChange(change)
+}
+
+// Get the nResults documents with the highest BM25 score for the query, among the documents
+// whose metadata is accepted by match. The results are sorted by descending score.
+func (index *LexicalIndex) Search(query string, nResults int, match func(metadata map[string]interface{}) bool) []LexicalResult {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	results := []LexicalResult{}
+	if len(index.documents) == 0 || nResults <= 0 {
+		return results
+	}
+
+	totalDocuments := float64(len(index.documents))
+	averageLength := float64(index.totalLength) / totalDocuments
+
+	scores := map[string]float64{}
+	for term := range tokenFrequencies(query) {
+		postings := index.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+
+		documentFrequency := float64(len(postings))
+		idf := math.Log(1 + (totalDocuments-documentFrequency+0.5)/(documentFrequency+0.5))
+
+		for id, frequency := range postings {
+			termFrequency := float64(frequency)
+			lengthRatio := float64(index.documents[id].length) / averageLength
+			scores[id] += idf * termFrequency * (bm25K1 + 1) / (termFrequency + bm25K1*(1-bm25B+bm25B*lengthRatio))
+		}
+	}
+
+	for id, score := range scores {
+		document := index.documents[id]
+		if match != nil && !match(document.Metadata) {
+			continue
+		}
+
+		results = append(results, LexicalResult{
+			Id:       id,
+			Document: document.Document,
+			Metadata: document.Metadata,
+			Score:    score,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id < results[j].Id
+	})
+
+	if len(results) > nResults {
+		results = results[:nResults]
+	}
+
+	return results
+}
+
+// Count the terms of a document, so it can be indexed
+func withTerms(document lexicalDocument) lexicalDocument {
+	document.terms = tokenFrequencies(document.Document)
+	document.length = 0
+	for _, frequency := range document.terms {
+		document.length += frequency
+	}
+
+	return document
+}
+
+// must be called while holding the write lock, with a document whose terms were counted
+func (index *LexicalIndex) indexDocument(id string, document lexicalDocument) {
+	for term, frequency := range document.terms {
+		if index.postings[term] == nil {
+			index.postings[term] = map[string]int{}
+		}
+		index.postings[term][id] = frequency
+	}
+
+	index.documents[id] = document
+	index.totalLength += document.length
+}
+
+// must be called while holding the write lock
+func (index *LexicalIndex) removeDocument(id string) {
+	document, ok := index.documents[id]
+	if !ok {
+		return
+	}
+
+	for term := range document.terms {
+		delete(index.postings[term], id)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+
+	index.totalLength -= document.length
+	delete(index.documents, id)
+}
+
+// Count the terms of a text. Words are lower cased and stripped of surrounding punctuation.
+// Words joined by punctuation, like "ERR-1234" or "db01.prod", are kept whole so exact
+// identifiers match, and their parts are added as separate terms.
+func tokenFrequencies(text string) map[string]int {
+	isSeparator := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+
+	frequencies := map[string]int{}
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		word = strings.TrimFunc(word, isSeparator)
+		if word == "" {
+			continue
+		}
+
+		frequencies[word]++
+
+		parts := strings.FieldsFunc(word, isSeparator)
+		if len(parts) > 1 {
+			for _, part := range parts {
+				frequencies[part]++
+			}
+		}
+	}
+
+	return frequencies
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+func resultIds(results []LexicalResult) []string {
+	ids := []string{}
+	for _, result := range results {
+		ids = append(ids, result.Id)
+	}
+
+	return ids
+}
+
+func TestTokenFrequencies(t *testing.T) {
+	assert.Equal(t, map[string]int{
+		"deploy":    2,
+		"db01.prod": 1,
+		"db01":      1,
+		"prod":      1,
+		"failed":    1,
+		"to":        1,
+		"with":      1,
+		"err-1234":  1,
+		"err":       1,
+		"1234":      1,
+	}, tokenFrequencies("Deploy to db01.prod failed with (ERR-1234), deploy"))
+}
+
+func TestLexicalIndex(t *testing.T) {
+	index := NewLexicalIndex(nil)
+
+	err := index.Upsert(
+		[]string{"post1", "post2", "post3"},
+		[]string{
+			"the release is blocked by JIRA-4521",
+			"the release notes are ready",
+			"JIRA-4521 JIRA-4521 is fixed on web-02",
+		},
+		[]map[string]interface{}{
+			{"source": "mm", "channel_id": "ch1"},
+			{"source": "mm", "channel_id": "ch1"},
+			{"source": "mm", "channel_id": "ch2"},
+		},
+	)
+	assert.Nil(t, err)
+
+	t.Run("exact identifiers rank first", func(t *testing.T) {
+		results := index.Search("jira-4521", 10, nil)
+		assert.Equal(t, []string{"post3", "post1"}, resultIds(results))
+		assert.Greater(t, results[0].Score, results[1].Score)
+	})
+
+	t.Run("limits and filters the results", func(t *testing.T) {
+		assert.Equal(t, []string{"post3"}, resultIds(index.Search("jira-4521", 1, nil)))
+
+		results := index.Search("jira-4521", 10, func(metadata map[string]interface{}) bool {
+			return metadata["channel_id"] == "ch1"
+		})
+		assert.Equal(t, []string{"post1"}, resultIds(results))
+	})
+
+	t.Run("no matching terms", func(t *testing.T) {
+		assert.Empty(t, index.Search("hostname", 10, nil))
+	})
+
+	t.Run("upsert replaces and delete removes documents", func(t *testing.T) {
+		assert.Nil(t, index.Upsert([]string{"post3"}, []string{"fixed on web-02"}, []map[string]interface{}{{"source": "mm"}}))
+		assert.Equal(t, []string{"post1"}, resultIds(index.Search("JIRA-4521", 10, nil)))
+		assert.Equal(t, []string{"post3"}, resultIds(index.Search("web-02", 10, nil)))
+
+		assert.Nil(t, index.Delete([]string{"post1"}))
+		assert.Empty(t, index.Search("JIRA-4521", 10, nil))
+	})
+
+	t.Run("reset removes every document", func(t *testing.T) {
+		assert.Nil(t, index.Reset())
+		assert.Empty(t, index.Search("release", 10, nil))
+	})
+}
+
+func TestLexicalIndexRefresh(t *testing.T) {
+	// two servers of a cluster sharing the data store
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-lexical"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	other := NewLexicalIndex(store)
+	index := NewLexicalIndex(store)
+	index.onChange = func(change LexicalChange) {
+		assert.Nil(t, other.Refresh(change))
+	}
+
+	assert.Nil(t, index.Upsert(
+		[]string{"post1", "post2"},
+		[]string{"deploy to staging", "deploy to production"},
+		[]map[string]interface{}{{"source": "mm"}, {"source": "mm"}},
+	))
+	assert.Equal(t, []string{"post1"}, resultIds(other.Search("staging", 10, nil)))
+
+	assert.Nil(t, index.Delete([]string{"post1"}))
+	assert.Equal(t, []string{}, resultIds(other.Search("staging", 10, nil)))
+	assert.Equal(t, []string{"post2"}, resultIds(other.Search("deploy", 10, nil)))
+
+	assert.Nil(t, index.Reset())
+	assert.Equal(t, []string{}, resultIds(other.Search("deploy", 10, nil)))
+}
+
+func TestLexicalIndexLoad(t *testing.T) {
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-lexical"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	index := NewLexicalIndex(store)
+	assert.Nil(t, index.Upsert(
+		[]string{"post1", "post2"},
+		[]string{"deploy to staging", "deploy to production"},
+		[]map[string]interface{}{{"source": "mm", "create_at": 1000}, {"source": "mm"}},
+	))
+	assert.Nil(t, index.Upsert([]string{"post2"}, []string{"rollback production"}, []map[string]interface{}{{"source": "mm"}}))
+	assert.Nil(t, index.Delete([]string{"post1"}))
+	assert.Nil(t, index.Upsert([]string{"post3"}, []string{"deploy to qa"}, []map[string]interface{}{{"source": "mm"}}))
+
+	// a server started after the changes were written
+	restarted := NewLexicalIndex(store)
+	assert.False(t, restarted.isLoaded())
+	assert.Nil(t, restarted.load())
+	assert.True(t, restarted.isLoaded())
+
+	assert.Equal(t, []string{"post3"}, resultIds(restarted.Search("deploy", 10, nil)))
+	assert.Equal(t, []string{"post2"}, resultIds(restarted.Search("rollback", 10, nil)))
+
+	t.Run("a missing segment reloads the index", func(t *testing.T) {
+		assert.Nil(t, index.Upsert([]string{"post4"}, []string{"deploy to dev"}, []map[string]interface{}{{"source": "mm"}}))
+		assert.Nil(t, restarted.Refresh(LexicalChange{Segment: "missing"}))
+		assert.ElementsMatch(t, []string{"post3", "post4"}, resultIds(restarted.Search("deploy", 10, nil)))
+	})
+}
+
+func TestLexicalIndexCompaction(t *testing.T) {
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-lexical"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	index := NewLexicalIndex(store)
+	assert.Nil(t, index.load())
+
+	// only the leader compacts the segments
+	for i := 0; i <= lexicalMinCompactSegments; i++ {
+		assert.Nil(t, index.Upsert([]string{fmt.Sprintf("post%v", i)}, []string{fmt.Sprintf("message %v", i)}, []map[string]interface{}{{"source": "mm"}}))
+	}
+	keys, err := store.Keys(lexicalBucket)
+	assert.Nil(t, err)
+	assert.Len(t, keys, lexicalMinCompactSegments+1)
+
+	index.setCompacts(true)
+	assert.Nil(t, index.Delete([]string{"post0"}))
+
+	keys, err = store.Keys(lexicalBucket)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+	assert.True(t, isLexicalSnapshotKey(keys[0]))
+
+	// the changes written after the snapshot are applied over it
+	assert.Nil(t, index.Upsert([]string{"post1"}, []string{"edited"}, []map[string]interface{}{{"source": "mm"}}))
+
+	restarted := NewLexicalIndex(store)
+	assert.Nil(t, restarted.load())
+	assert.Len(t, restarted.Search("message", 100, nil), lexicalMinCompactSegments-1)
+	assert.Equal(t, []string{"post1"}, resultIds(restarted.Search("edited", 10, nil)))
+}
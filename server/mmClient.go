@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// MattermostClient is used by the sync and search subsystems to read data from Mattermost.
+// It's implemented on top of the in-process plugin API, and can be faked in tests.
+type MattermostClient interface {
+	GetAllChannels() ([]MattermostChannel, error)
+	FetchPostsForPage(channelId string, since int64, page int, perPage int) (PostResponse, error)
+	// Fetch the perPage latest posts created before a post, or the latest posts if postId is empty
+	FetchPostsBefore(channelId string, postId string, perPage int) (PostResponse, error)
+	GetPostDetails(postId string) (PostDetail, error)
+	GetUserDetails(userId string) (UserDetail, error)
+	// Get the users with the usernames, at once. The usernames that don't exist are left out
+	GetUsersByUsernames(usernames []string) ([]UserDetail, error)
+	GetChannelDetails(channelId string) (ChannelDetail, error)
+	GetTeamDetails(teamId string) (TeamDetail, error)
+	GetUserChannelIds(userId string) ([]string, error)
+	GetSiteURL() string
+}
+
+// ErrPostNotFound is returned by GetPostDetails if the post doesn't exist or was deleted
+var ErrPostNotFound = errors.New("post not found")
+
+// number of items requested per page when listing users and channels
+const pluginAPIPerPage = 200
+
+// how long the private, direct and group channels found from the memberships of every user are
+// reused, since listing them takes a request per user. The post hooks index their new posts meanwhile.
+const memberChannelsCacheTTL = time.Hour
+
+// The private, direct and group channels that aren't archived, which the plugin API can't list. The unquoted
+// names are the same in the postgres and mysql schemas of Mattermost.
+const memberChannelsQuery = `SELECT Id, Type, Name, DisplayName, TeamId, TotalMsgCount FROM Channels WHERE DeleteAt = 0 AND Type IN ('P', 'D', 'G')`
+
+type PluginAPIClient struct {
+	api plugin.API
+	// the Mattermost database, which lists the private, direct and group channels in a single query.
+	// Without it, they're collected from the memberships of every user
+	db *sql.DB
+
+	mu                      sync.Mutex
+	memberChannels          []*model.Channel
+	memberChannelsFetchedAt time.Time
+}
+
+func NewPluginAPIClient(api plugin.API) *PluginAPIClient {
+	return &PluginAPIClient{api: api}
+}
+
+// Get all public channels of every team, as well as the private, direct and group channels
+func (client *PluginAPIClient) GetAllChannels() ([]MattermostChannel, error) {
+	channels := []MattermostChannel{}
+	seenChannels := map[string]bool{}
+
+	addChannels := func(modelChannels []*model.Channel) {
+		for _, channel := range modelChannels {
+			if seenChannels[channel.Id] {
+				continue
+			}
+
+			seenChannels[channel.Id] = true
+			channels = append(channels, channelFromModel(channel))
+		}
+	}
+
+	teams, appErr := client.api.GetTeams()
+	if appErr != nil {
+		return nil, fmt.Errorf("client: could not get teams: %v", appErr)
+	}
+
+	for _, team := range teams {
+		for page := 0; ; page++ {
+			publicChannels, appErr := client.api.GetPublicChannelsForTeam(team.Id, page, pluginAPIPerPage)
+			if appErr != nil {
+				return nil, fmt.Errorf("client: could not get public channels for team %v: %v", team.Id, appErr)
+			}
+
+			addChannels(publicChannels)
+
+			if len(publicChannels) < pluginAPIPerPage {
+				break
+			}
+		}
+	}
+
+	memberChannels, err := client.getMemberChannels()
+	if err != nil {
+		return nil, err
+	}
+	addChannels(memberChannels)
+
+	return channels, nil
+}
+
+// Get the private, direct and group channels from the database, or the channels that have at least one member
+// if it can't be read. The channels found from the memberships are reused until they expire
+func (client *PluginAPIClient) getMemberChannels() ([]*model.Channel, error) {
+	if client.db != nil {
+		memberChannels, err := queryMemberChannels(client.db)
+		if err == nil {
+			return memberChannels, nil
+		}
+		log.Printf("error while listing the channels from the database, listing the memberships of every user: %v \n", err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.memberChannels != nil && time.Since(client.memberChannelsFetchedAt) < memberChannelsCacheTTL {
+		return client.memberChannels, nil
+	}
+
+	memberChannels := []*model.Channel{}
+
+	// the plugin API doesn't list private, direct and group channels directly,
+	// so they are collected from the memberships of every user
+	for page := 0; ; page++ {
+		users, appErr := client.api.GetUsers(&model.UserGetOptions{Page: page, PerPage: pluginAPIPerPage})
+		if appErr != nil {
+			return nil, fmt.Errorf("client: could not get users: %v", appErr)
+		}
+
+		for _, user := range users {
+			// an empty team id returns the user's channels across all teams
+			userChannels, appErr := client.api.GetChannelsForTeamForUser("", user.Id, false)
+			if appErr != nil {
+				return nil, fmt.Errorf("client: could not get channels for user %v: %v", user.Id, appErr)
+			}
+
+			memberChannels = append(memberChannels, userChannels...)
+		}
+
+		if len(users) < pluginAPIPerPage {
+			break
+		}
+	}
+
+	client.memberChannels = memberChannels
+	client.memberChannelsFetchedAt = time.Now()
+
+	return memberChannels, nil
+}
+
+func queryMemberChannels(db *sql.DB) ([]*model.Channel, error) {
+	rows, err := db.Query(memberChannelsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberChannels := []*model.Channel{}
+	for rows.Next() {
+		channel := &model.Channel{}
+		if err := rows.Scan(&channel.Id, &channel.Type, &channel.Name, &channel.DisplayName, &channel.TeamId, &channel.TotalMsgCount); err != nil {
+			return nil, err
+		}
+
+		memberChannels = append(memberChannels, channel)
+	}
+
+	return memberChannels, rows.Err()
+}
+
+// Get posts in a channel. If since is set, all posts created, edited or deleted after that
+// time are returned in one page. Otherwise, posts are returned page by page.
+func (client *PluginAPIClient) FetchPostsForPage(channelId string, since int64, page int, perPage int) (PostResponse, error) {
+	var postList *model.PostList
+	var appErr *model.AppError
+
+	if since > 0 {
+		postList, appErr = client.api.GetPostsSince(channelId, since)
+	} else {
+		postList, appErr = client.api.GetPostsForChannel(channelId, page, perPage)
+	}
+	if appErr != nil {
+		return PostResponse{}, fmt.Errorf("client: failed to fetch new posts: %v", appErr)
+	}
+
+	return client.postResponse(channelId, postList), nil
+}
+
+// Get the posts of a channel page by page, from the latest. Each page is fetched before the oldest
+// post of the previous one, so the pages don't move when posts are created or deleted meanwhile.
+func (client *PluginAPIClient) FetchPostsBefore(channelId string, postId string, perPage int) (PostResponse, error) {
+	var postList *model.PostList
+	var appErr *model.AppError
+
+	if postId == "" {
+		postList, appErr = client.api.GetPostsForChannel(channelId, 0, perPage)
+	} else {
+		postList, appErr = client.api.GetPostsBefore(channelId, postId, 0, perPage)
+	}
+	if appErr != nil {
+		return PostResponse{}, fmt.Errorf("client: failed to fetch the posts before %v: %v", postId, appErr)
+	}
+
+	return client.postResponse(channelId, postList), nil
+}
+
+// Convert a page of posts, counting their reactions
+func (client *PluginAPIClient) postResponse(channelId string, postList *model.PostList) PostResponse {
+	postRes := PostResponse{
+		Order:          postList.Order,
+		Posts:          map[string]Post{},
+		PreviousPostId: postList.PrevPostId,
+	}
+
+	reactionPostIds := []string{}
+	for postId, post := range postList.Posts {
+		postRes.Posts[postId] = postFromModel(post)
+		if post.HasReactions {
+			reactionPostIds = append(reactionPostIds, postId)
+		}
+	}
+
+	// the reactions of a page are counted concurrently, since the plugin API gets them post by post
+	reactionCounts, err := client.countReactions(reactionPostIds)
+	if err != nil {
+		log.Printf("error while trying to count the reactions of the posts of channel %v: %v \n", channelId, err)
+	}
+	for postId, reactionCount := range reactionCounts {
+		post := postRes.Posts[postId]
+		post.ReactionCount = reactionCount
+		postRes.Posts[postId] = post
+	}
+
+	return postRes
+}
+
+func (client *PluginAPIClient) GetPostDetails(postId string) (PostDetail, error) {
+	post, appErr := client.api.GetPost(postId)
+	if appErr != nil && appErr.StatusCode == http.StatusNotFound {
+		return PostDetail{}, fmt.Errorf("client: could not get post %v: %w", postId, ErrPostNotFound)
+	}
+	if appErr != nil {
+		return PostDetail{}, fmt.Errorf("client: could not get post %v: %v", postId, appErr)
+	}
+
+	postDetail := PostDetail(postFromModel(post))
+	if post.HasReactions && postDetail.ReactionCount == 0 {
+		reactionCounts, err := client.countReactions([]string{postId})
+		if err != nil {
+			log.Printf("error while trying to count the reactions of post %v: %v \n", postId, err)
+		}
+		postDetail.ReactionCount = reactionCounts[postId]
+	}
+
+	return postDetail, nil
+}
+
+// Count the reactions of posts, by post id, since the plugin API returns the posts without their metadata.
+// The posts are looked up concurrently, and the counts that could be fetched are returned with the last error.
+func (client *PluginAPIClient) countReactions(postIds []string) (map[string]int, error) {
+	values, err := lookupConcurrently(postIds, func(postId string) (interface{}, error) {
+		reactions, appErr := client.api.GetReactions(postId)
+		if appErr != nil {
+			return nil, fmt.Errorf("client: could not get the reactions of post %v: %v", postId, appErr)
+		}
+		return len(reactions), nil
+	})
+
+	reactionCounts := map[string]int{}
+	for postId, value := range values {
+		reactionCounts[postId] = value.(int)
+	}
+
+	return reactionCounts, err
+}
+
+func (client *PluginAPIClient) GetUserDetails(userId string) (UserDetail, error) {
+	user, appErr := client.api.GetUser(userId)
+	if appErr != nil {
+		return UserDetail{}, fmt.Errorf("client: could not get user %v: %v", userId, appErr)
+	}
+
+	return userFromModel(user), nil
+}
+
+func (client *PluginAPIClient) GetUsersByUsernames(usernames []string) ([]UserDetail, error) {
+	users, appErr := client.api.GetUsersByUsernames(usernames)
+	if appErr != nil {
+		return nil, fmt.Errorf("client: could not get users %v: %v", usernames, appErr)
+	}
+
+	userDetails := []UserDetail{}
+	for _, user := range users {
+		userDetails = append(userDetails, userFromModel(user))
+	}
+
+	return userDetails, nil
+}
+
+func (client *PluginAPIClient) GetChannelDetails(channelId string) (ChannelDetail, error) {
+	channel, appErr := client.api.GetChannel(channelId)
+	if appErr != nil {
+		return ChannelDetail{}, fmt.Errorf("client: could not get channel %v: %v", channelId, appErr)
+	}
+
+	return ChannelDetail{
+		Id:          channel.Id,
+		Type:        string(channel.Type),
+		Name:        channel.Name,
+		DisplayName: channel.DisplayName,
+		TeamId:      channel.TeamId,
+	}, nil
+}
+
+func (client *PluginAPIClient) GetTeamDetails(teamId string) (TeamDetail, error) {
+	team, appErr := client.api.GetTeam(teamId)
+	if appErr != nil {
+		return TeamDetail{}, fmt.Errorf("client: could not get team %v: %v", teamId, appErr)
+	}
+
+	return TeamDetail{
+		Id:   team.Id,
+		Name: team.Name,
+	}, nil
+}
+
+// Get the ids of every channel the user is a member of, across all of the user's teams.
+// Direct and group channels don't belong to a team and are returned for every team.
+func (client *PluginAPIClient) GetUserChannelIds(userId string) ([]string, error) {
+	teams, appErr := client.api.GetTeamsForUser(userId)
+	if appErr != nil {
+		return nil, fmt.Errorf("client: could not get teams for user %v: %v", userId, appErr)
+	}
+
+	teamIds := []string{}
+	for _, team := range teams {
+		teamIds = append(teamIds, team.Id)
+	}
+
+	// users without a team can still have direct and group channels
+	if len(teamIds) == 0 {
+		teamIds = append(teamIds, "")
+	}
+
+	channelIds := []string{}
+	seenChannels := map[string]bool{}
+	for _, teamId := range teamIds {
+		channels, appErr := client.api.GetChannelsForTeamForUser(teamId, userId, false)
+		if appErr != nil {
+			return nil, fmt.Errorf("client: could not get channels for user %v: %v", userId, appErr)
+		}
+
+		for _, channel := range channels {
+			if seenChannels[channel.Id] {
+				continue
+			}
+
+			seenChannels[channel.Id] = true
+			channelIds = append(channelIds, channel.Id)
+		}
+	}
+
+	return channelIds, nil
+}
+
+// Get the URL used to build links to users, channels and posts
+func (client *PluginAPIClient) GetSiteURL() string {
+	config := client.api.GetConfig()
+	if config == nil || config.ServiceSettings.SiteURL == nil {
+		return ""
+	}
+
+	return *config.ServiceSettings.SiteURL
+}
+
+// Convert a user received from the plugin API, with the time zone its dates are shown in
+func userFromModel(user *model.User) UserDetail {
+	return UserDetail{
+		Id:        user.Id,
+		UserName:  user.Username,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Timezone:  user.GetPreferredTimezone(),
+	}
+}
+
+func channelFromModel(channel *model.Channel) MattermostChannel {
+	return MattermostChannel{
+		Id:            channel.Id,
+		Type:          string(channel.Type),
+		TeamId:        channel.TeamId,
+		DisplayName:   channel.DisplayName,
+		TotalMsgCount: int(channel.TotalMsgCount),
+	}
+}
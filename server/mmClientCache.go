@@ -0,0 +1,221 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// number of users, channels and teams kept by the cached client, each
+	detailsCacheSize = 1000
+	// users, channels and teams can be renamed, so they are looked up again after a while
+	detailsCacheTTL = 10 * time.Minute
+	// the plugin API has no batch lookup of posts and users, so they are looked up concurrently
+	detailsLookupConcurrency = 8
+)
+
+// lruCache is a bounded cache, which drops the least recently used entry once it's full
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type lruEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+func newLRUCache(capacity int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (cache *lruCache) Get(key string) (interface{}, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false
+	}
+
+	cache.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (cache *lruCache) Add(key string, value interface{}) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	expiresAt := time.Now().Add(cache.ttl)
+	if element, ok := cache.entries[key]; ok {
+		element.Value = &lruEntry{key: key, value: value, expiresAt: expiresAt}
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+
+	if cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// CachedMattermostClient keeps the users, channels and teams it gets from a MattermostClient,
+// which are looked up for every indexed post and search result. Posts aren't cached, since
+// their message is shown in the search results and they can be edited or deleted.
+type CachedMattermostClient struct {
+	MattermostClient
+	users    *lruCache
+	channels *lruCache
+	teams    *lruCache
+}
+
+func NewCachedMattermostClient(client MattermostClient) *CachedMattermostClient {
+	return &CachedMattermostClient{
+		MattermostClient: client,
+		users:            newLRUCache(detailsCacheSize, detailsCacheTTL),
+		channels:         newLRUCache(detailsCacheSize, detailsCacheTTL),
+		teams:            newLRUCache(detailsCacheSize, detailsCacheTTL),
+	}
+}
+
+func (client *CachedMattermostClient) GetUserDetails(userId string) (UserDetail, error) {
+	if user, ok := client.users.Get(userId); ok {
+		return user.(UserDetail), nil
+	}
+
+	user, err := client.MattermostClient.GetUserDetails(userId)
+	if err != nil {
+		return UserDetail{}, err
+	}
+
+	client.users.Add(userId, user)
+	return user, nil
+}
+
+func (client *CachedMattermostClient) GetChannelDetails(channelId string) (ChannelDetail, error) {
+	if channel, ok := client.channels.Get(channelId); ok {
+		return channel.(ChannelDetail), nil
+	}
+
+	channel, err := client.MattermostClient.GetChannelDetails(channelId)
+	if err != nil {
+		return ChannelDetail{}, err
+	}
+
+	client.channels.Add(channelId, channel)
+	return channel, nil
+}
+
+func (client *CachedMattermostClient) GetTeamDetails(teamId string) (TeamDetail, error) {
+	if team, ok := client.teams.Get(teamId); ok {
+		return team.(TeamDetail), nil
+	}
+
+	team, err := client.MattermostClient.GetTeamDetails(teamId)
+	if err != nil {
+		return TeamDetail{}, err
+	}
+
+	client.teams.Add(teamId, team)
+	return team, nil
+}
+
+// Look up the values of ids concurrently. The ids that can't be looked up are missing from the
+// returned map, and the error of one of them is returned.
+func lookupConcurrently(ids []string, lookup func(id string) (interface{}, error)) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	var lastErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	semaphore := make(chan struct{}, detailsLookupConcurrency)
+	seenIds := map[string]bool{}
+	for _, id := range ids {
+		if seenIds[id] {
+			continue
+		}
+		seenIds[id] = true
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			value, err := lookup(id)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			values[id] = value
+		}(id)
+	}
+
+	wg.Wait()
+	return values, lastErr
+}
+
+// Get the details of posts, by id
+func getPostsDetails(mmClient MattermostClient, postIds []string) (map[string]PostDetail, error) {
+	values, err := lookupConcurrently(postIds, func(id string) (interface{}, error) {
+		return mmClient.GetPostDetails(id)
+	})
+
+	posts := map[string]PostDetail{}
+	for id, value := range values {
+		posts[id] = value.(PostDetail)
+	}
+
+	return posts, err
+}
+
+// Get the details of channels, by id
+func getChannelsDetails(mmClient MattermostClient, channelIds []string) (map[string]ChannelDetail, error) {
+	values, err := lookupConcurrently(channelIds, func(id string) (interface{}, error) {
+		return mmClient.GetChannelDetails(id)
+	})
+
+	channels := map[string]ChannelDetail{}
+	for id, value := range values {
+		channels[id] = value.(ChannelDetail)
+	}
+
+	return channels, err
+}
+
+// Get the details of users, by id
+func getUsersDetails(mmClient MattermostClient, userIds []string) (map[string]UserDetail, error) {
+	values, err := lookupConcurrently(userIds, func(id string) (interface{}, error) {
+		return mmClient.GetUserDetails(id)
+	})
+
+	users := map[string]UserDetail{}
+	for id, value := range values {
+		users[id] = value.(UserDetail)
+	}
+
+	return users, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingMattermostClient counts the lookups made through it
+type countingMattermostClient struct {
+	fakeMattermostClient
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (client *countingMattermostClient) count(kind string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.lookups == nil {
+		client.lookups = map[string]int{}
+	}
+	client.lookups[kind]++
+}
+
+func (client *countingMattermostClient) GetPostDetails(postId string) (PostDetail, error) {
+	client.count("post")
+	return client.fakeMattermostClient.GetPostDetails(postId)
+}
+
+func (client *countingMattermostClient) GetUserDetails(userId string) (UserDetail, error) {
+	client.count("user")
+	return client.fakeMattermostClient.GetUserDetails(userId)
+}
+
+func (client *countingMattermostClient) GetChannelDetails(channelId string) (ChannelDetail, error) {
+	client.count("channel")
+	return client.fakeMattermostClient.GetChannelDetails(channelId)
+}
+
+func (client *countingMattermostClient) GetTeamDetails(teamId string) (TeamDetail, error) {
+	client.count("team")
+	return client.fakeMattermostClient.GetTeamDetails(teamId)
+}
+
+func TestLRUCache(t *testing.T) {
+	cache := newLRUCache(2, time.Minute)
+	cache.Add("a", 1)
+	cache.Add("b", 2)
+
+	// a is used, so b is the one dropped
+	_, ok := cache.Get("a")
+	assert.True(t, ok)
+	cache.Add("c", 3)
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	value, ok := cache.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 3, value)
+
+	expiredCache := newLRUCache(2, -time.Second)
+	expiredCache.Add("a", 1)
+	_, ok = expiredCache.Get("a")
+	assert.False(t, ok)
+}
+
+func TestCachedMattermostClient(t *testing.T) {
+	client := &countingMattermostClient{fakeMattermostClient: fakeMattermostClient{
+		users:    map[string]UserDetail{"u1": {Id: "u1"}},
+		channels: map[string]ChannelDetail{"c1": {Id: "c1"}},
+		teams:    map[string]TeamDetail{"t1": {Id: "t1"}},
+		posts:    map[string]PostDetail{"p1": {Id: "p1"}},
+	}}
+	cachedClient := NewCachedMattermostClient(client)
+
+	for i := 0; i < 3; i++ {
+		_, err := cachedClient.GetUserDetails("u1")
+		assert.Nil(t, err)
+		_, err = cachedClient.GetChannelDetails("c1")
+		assert.Nil(t, err)
+		_, err = cachedClient.GetTeamDetails("t1")
+		assert.Nil(t, err)
+		_, err = cachedClient.GetPostDetails("p1")
+		assert.Nil(t, err)
+	}
+
+	// the errors aren't cached
+	_, err := cachedClient.GetUserDetails("u2")
+	assert.NotNil(t, err)
+	_, err = cachedClient.GetUserDetails("u2")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, map[string]int{"user": 3, "channel": 1, "team": 1, "post": 3}, client.lookups)
+}
+
+func TestGetUsersDetails(t *testing.T) {
+	client := &countingMattermostClient{fakeMattermostClient: fakeMattermostClient{
+		users: map[string]UserDetail{"u1": {Id: "u1"}, "u2": {Id: "u2"}},
+	}}
+
+	users, err := getUsersDetails(client, []string{"u1", "u2", "u1", "missing"})
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string]UserDetail{"u1": {Id: "u1"}, "u2": {Id: "u2"}}, users)
+	assert.Equal(t, 3, client.lookups["user"])
+}
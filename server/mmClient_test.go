@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestGetAllChannels(t *testing.T) {
+	assert := assert.New(t)
+	api := &plugintest.API{}
+	defer api.AssertExpectations(t)
+
+	api.On("GetTeams").Return([]*model.Team{{Id: "team1"}}, nil)
+	api.On("GetPublicChannelsForTeam", "team1", 0, pluginAPIPerPage).Return([]*model.Channel{
+		{Id: "town-square", Type: model.ChannelTypeOpen, TotalMsgCount: 3},
+	}, nil)
+	// the memberships of every user are listed once, and reused by the next fetch
+	api.On("GetUsers", mock.Anything).Return([]*model.User{{Id: "user1"}, {Id: "user2"}}, nil).Once()
+	api.On("GetChannelsForTeamForUser", "", "user1", false).Once().Return([]*model.Channel{
+		{Id: "town-square", Type: model.ChannelTypeOpen, TotalMsgCount: 3},
+		{Id: "private", Type: model.ChannelTypePrivate, TotalMsgCount: 2},
+	}, nil)
+	api.On("GetChannelsForTeamForUser", "", "user2", false).Once().Return([]*model.Channel{
+		{Id: "dm", Type: model.ChannelTypeDirect, TotalMsgCount: 1},
+	}, nil)
+
+	client := NewPluginAPIClient(api)
+	for i := 0; i < 2; i++ {
+		channels, err := client.GetAllChannels()
+		assert.Nil(err)
+		assert.Equal([]MattermostChannel{
+			{Id: "town-square", Type: "O", TotalMsgCount: 3},
+			{Id: "private", Type: "P", TotalMsgCount: 2},
+			{Id: "dm", Type: "D", TotalMsgCount: 1},
+		}, channels)
+	}
+}
+
+func TestFetchPostsForPage(t *testing.T) {
+	postList := &model.PostList{
+		Order: []string{"post1"},
+		Posts: map[string]*model.Post{
+			"post1": {Id: "post1", ChannelId: "channel1", Message: "hello", UpdateAt: 10},
+		},
+	}
+	expected := PostResponse{
+		Order: []string{"post1"},
+		Posts: map[string]Post{
+			"post1": {Id: "post1", ChannelId: "channel1", Message: "hello", UpdateAt: 10},
+		},
+	}
+
+	t.Run("page by page without since", func(t *testing.T) {
+		api := &plugintest.API{}
+		defer api.AssertExpectations(t)
+		api.On("GetPostsForChannel", "channel1", 2, 10).Return(postList, nil)
+
+		postRes, err := NewPluginAPIClient(api).FetchPostsForPage("channel1", 0, 2, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, postRes)
+	})
+
+	t.Run("all posts since a given time", func(t *testing.T) {
+		api := &plugintest.API{}
+		defer api.AssertExpectations(t)
+		api.On("GetPostsSince", "channel1", int64(1000)).Return(postList, nil)
+
+		postRes, err := NewPluginAPIClient(api).FetchPostsForPage("channel1", 1000, 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, postRes)
+	})
+
+	t.Run("the reactions of the posts are counted", func(t *testing.T) {
+		api := &plugintest.API{}
+		defer api.AssertExpectations(t)
+		api.On("GetPostsForChannel", "channel1", 0, 10).Return(&model.PostList{
+			Order: []string{"post1", "post2"},
+			Posts: map[string]*model.Post{
+				"post1": {Id: "post1", ChannelId: "channel1", HasReactions: true},
+				"post2": {Id: "post2", ChannelId: "channel1"},
+			},
+		}, nil)
+		api.On("GetReactions", "post1").Return([]*model.Reaction{{PostId: "post1"}, {PostId: "post1"}}, nil).Once()
+
+		postRes, err := NewPluginAPIClient(api).FetchPostsForPage("channel1", 0, 0, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, postRes.Posts["post1"].ReactionCount)
+		assert.Equal(t, 0, postRes.Posts["post2"].ReactionCount)
+	})
+}
+
+func TestFetchPostsBefore(t *testing.T) {
+	postList := &model.PostList{
+		Order: []string{"post1"},
+		Posts: map[string]*model.Post{
+			"post1": {Id: "post1", ChannelId: "channel1", Message: "hello", UpdateAt: 10},
+		},
+	}
+
+	t.Run("the latest posts without a post", func(t *testing.T) {
+		api := &plugintest.API{}
+		defer api.AssertExpectations(t)
+		api.On("GetPostsForChannel", "channel1", 0, 10).Return(postList, nil)
+
+		postRes, err := NewPluginAPIClient(api).FetchPostsBefore("channel1", "", 10)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"post1"}, postRes.Order)
+	})
+
+	t.Run("the posts before a post", func(t *testing.T) {
+		api := &plugintest.API{}
+		defer api.AssertExpectations(t)
+		api.On("GetPostsBefore", "channel1", "post2", 0, 10).Return(postList, nil)
+
+		postRes, err := NewPluginAPIClient(api).FetchPostsBefore("channel1", "post2", 10)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"post1"}, postRes.Order)
+	})
+}
+
+func TestGetAllChannelsFromDatabase(t *testing.T) {
+	t.Run("the memberships are listed if the database can't be read", func(t *testing.T) {
+		api := &plugintest.API{}
+		defer api.AssertExpectations(t)
+
+		api.On("GetTeams").Return([]*model.Team{}, nil)
+		api.On("GetUsers", mock.Anything).Return([]*model.User{{Id: "user1"}}, nil).Once()
+		api.On("GetChannelsForTeamForUser", "", "user1", false).Once().Return([]*model.Channel{{Id: "dm", Type: model.ChannelTypeDirect}}, nil)
+
+		db, err := sql.Open("postgres", "host=/nonexistent connect_timeout=1")
+		assert.Nil(t, err)
+		defer db.Close()
+
+		client := NewPluginAPIClient(api)
+		client.db = db
+		channels, err := client.GetAllChannels()
+		assert.Nil(t, err)
+		assert.Equal(t, []MattermostChannel{{Id: "dm", Type: "D"}}, channels)
+	})
+
+	// Runs against the PostgreSQL database at PGVECTOR_DATA_SOURCE, in a temporary channels table
+	t.Run("the channels are read at once", func(t *testing.T) {
+		dataSource := os.Getenv("PGVECTOR_DATA_SOURCE")
+		if dataSource == "" {
+			t.Skip("PGVECTOR_DATA_SOURCE isn't set")
+		}
+
+		db, err := sql.Open("postgres", dataSource)
+		assert.Nil(t, err)
+		defer db.Close()
+		// the temporary table only exists in its connection
+		db.SetMaxOpenConns(1)
+
+		_, err = db.Exec(`CREATE TEMPORARY TABLE Channels (Id TEXT, Type TEXT, Name TEXT, DisplayName TEXT, TeamId TEXT, TotalMsgCount BIGINT, DeleteAt BIGINT)`)
+		assert.Nil(t, err)
+		_, err = db.Exec(`INSERT INTO Channels VALUES
+			('town-square', 'O', 'town-square', 'Town Square', 'team1', 3, 0),
+			('private', 'P', 'private', 'Private', 'team1', 2, 0),
+			('archived', 'P', 'archived', 'Archived', 'team1', 2, 1000),
+			('dm', 'D', 'user1__user2', '', '', 1, 0)`)
+		assert.Nil(t, err)
+
+		channels, err := queryMemberChannels(db)
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []*model.Channel{
+			{Id: "private", Type: model.ChannelTypePrivate, Name: "private", DisplayName: "Private", TeamId: "team1", TotalMsgCount: 2},
+			{Id: "dm", Type: model.ChannelTypeDirect, Name: "user1__user2", TotalMsgCount: 1},
+		}, channels)
+	})
+}
+
+func TestGetUserChannelIds(t *testing.T) {
+	t.Run("channels across all teams", func(t *testing.T) {
+		api := &plugintest.API{}
+		defer api.AssertExpectations(t)
+
+		api.On("GetTeamsForUser", "user1").Return([]*model.Team{{Id: "team1"}, {Id: "team2"}}, nil)
+		api.On("GetChannelsForTeamForUser", "team1", "user1", false).Return([]*model.Channel{
+			{Id: "town-square"}, {Id: "private"}, {Id: "dm"},
+		}, nil)
+		api.On("GetChannelsForTeamForUser", "team2", "user1", false).Return([]*model.Channel{
+			{Id: "off-topic"}, {Id: "dm"},
+		}, nil)
+
+		channelIds, err := NewPluginAPIClient(api).GetUserChannelIds("user1")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"town-square", "private", "dm", "off-topic"}, channelIds)
+	})
+
+	t.Run("direct channels of a user without a team", func(t *testing.T) {
+		api := &plugintest.API{}
+		defer api.AssertExpectations(t)
+
+		api.On("GetTeamsForUser", "user1").Return([]*model.Team{}, nil)
+		api.On("GetChannelsForTeamForUser", "", "user1", false).Return([]*model.Channel{{Id: "dm"}}, nil)
+
+		channelIds, err := NewPluginAPIClient(api).GetUserChannelIds("user1")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"dm"}, channelIds)
+	})
+}
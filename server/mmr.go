@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+)
+
+// number of results diversified, if the requested pages hold less results
+const defaultMMRCandidates = 50
+
+// Get the embeddings of the results from their collection
+func getResultEmbeddings(ctx context.Context, vectorStore VectorStore, results []searchResult) (map[string][]float32, error) {
+	collectionIds := map[string][]string{}
+	for _, result := range results {
+		collectionType := mattermostCollectionType
+		if result.Metadata["source"] == "sl" {
+			collectionType = slackCollectionType
+		}
+		collectionIds[collectionType] = append(collectionIds[collectionType], result.Id)
+	}
+
+	embeddings := map[string][]float32{}
+	for collectionType, ids := range collectionIds {
+		collectionEmbeddings, err := vectorStore.GetEmbeddings(ctx, collectionType, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		for id, embedding := range collectionEmbeddings {
+			embeddings[id] = embedding
+		}
+	}
+
+	return embeddings, nil
+}
+
+// Reorder the first candidates results with maximal marginal relevance: the results are picked one
+// at a time for their relevance, minus their similarity to the results picked before them. lambda is
+// the weight of the relevance, between 0 and 1. 1 keeps the results in their order, and lower values
+// favour results unlike the ones before them, so a burst of near-identical messages doesn't fill a page.
+func diversifyResults(results []searchResult, embeddings map[string][]float32, lambda float64, candidates int) []searchResult {
+	if candidates > len(results) {
+		candidates = len(results)
+	}
+
+	relevances := normalizedRankingScores(results[:candidates])
+
+	diversifiedResults := []searchResult{}
+	picked := make([]bool, candidates)
+	// the highest similarity of each result to the picked results
+	redundancies := make([]float64, candidates)
+
+	for len(diversifiedResults) < candidates {
+		best := -1
+		bestScore := 0.0
+		for i := range results[:candidates] {
+			if picked[i] {
+				continue
+			}
+
+			score := lambda*relevances[i] - (1-lambda)*redundancies[i]
+			if best == -1 || score > bestScore {
+				best = i
+				bestScore = score
+			}
+		}
+
+		picked[best] = true
+		result := results[best]
+		result.Scores.MMR = bestScore
+		diversifiedResults = append(diversifiedResults, result)
+
+		pickedEmbedding, ok := embeddings[result.Id]
+		if !ok {
+			continue
+		}
+
+		for i, candidate := range results[:candidates] {
+			embedding, ok := embeddings[candidate.Id]
+			if picked[i] || !ok {
+				continue
+			}
+
+			similarity := float64(1 - cosineDistance(pickedEmbedding, embedding))
+			if similarity > redundancies[i] {
+				redundancies[i] = similarity
+			}
+		}
+	}
+
+	return append(diversifiedResults, results[candidates:]...)
+}
+
+// Get the scores the results are ordered by, scaled between 0 and 1. The scores of some rerankers
+// are negative, and the vector scores can be, so the scores of different searches compare alike.
+func normalizedRankingScores(results []searchResult) []float64 {
+	scores := make([]float64, len(results))
+	minScore, maxScore := 0.0, 0.0
+	for i, result := range results {
+		scores[i] = rankingScore(result.Scores)
+		if i == 0 || scores[i] < minScore {
+			minScore = scores[i]
+		}
+		if i == 0 || scores[i] > maxScore {
+			maxScore = scores[i]
+		}
+	}
+
+	for i := range scores {
+		if maxScore > minScore {
+			scores[i] = (scores[i] - minScore) / (maxScore - minScore)
+		} else {
+			scores[i] = 1
+		}
+	}
+
+	return scores
+}
+
+// Get the score the results were last ordered by
+func rankingScore(scores ScoreBreakdown) float64 {
+	if scores.Boost > 0 {
+		return scores.Boosted
+	}
+
+	if scores.RerankRank > 0 {
+		return scores.Rerank
+	}
+
+	if scores.Fused > 0 {
+		return scores.Fused
+	}
+
+	return scores.Vector
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+func TestDiversifyResults(t *testing.T) {
+	// a burst of near-identical messages, and a different one
+	results := []searchResult{
+		{Id: "burst-1", Scores: ScoreBreakdown{Vector: 0.95}},
+		{Id: "burst-2", Scores: ScoreBreakdown{Vector: 0.94}},
+		{Id: "burst-3", Scores: ScoreBreakdown{Vector: 0.93}},
+		{Id: "other", Scores: ScoreBreakdown{Vector: 0.85}},
+		{Id: "not-a-candidate", Scores: ScoreBreakdown{Vector: 0.8}},
+	}
+	embeddings := map[string][]float32{
+		"burst-1": {1, 0},
+		"burst-2": {1, 0.01},
+		"burst-3": {1, 0.02},
+		"other":   {0, 1},
+	}
+
+	diversifiedResults := diversifyResults(results, embeddings, 0.5, 4)
+	assert.Equal(t, []string{"burst-1", "other", "burst-2", "burst-3", "not-a-candidate"}, flattenIds(diversifiedResults))
+	assert.InDelta(t, 0.5, diversifiedResults[0].Scores.MMR, 0.001)
+	assert.Equal(t, 0.0, diversifiedResults[4].Scores.MMR)
+
+	// only the relevance counts with a lambda of 1
+	assert.Equal(t, flattenIds(results), flattenIds(diversifyResults(results, embeddings, 1, 4)))
+
+	// the results without embeddings aren't redundant
+	assert.Equal(t, []string{"burst-1", "burst-2", "burst-3", "other", "not-a-candidate"}, flattenIds(diversifyResults(results, map[string][]float32{}, 0.5, 10)))
+}
+
+func TestGetResultEmbeddings(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	vectorStore := newEmbeddedVectorStore(newEmbeddedVectorIndex(store), NewHashEmbedder())
+	assert.Nil(t, vectorStore.Upsert(ctx, mattermostCollectionType, []string{"p1"}, []string{"from mattermost"}, []map[string]interface{}{{"source": "mm"}}))
+	assert.Nil(t, vectorStore.Upsert(ctx, slackCollectionType, []string{"s1"}, []string{"from slack"}, []map[string]interface{}{{"source": "sl"}}))
+
+	embeddings, err := getResultEmbeddings(ctx, vectorStore, []searchResult{
+		{Id: "p1", Metadata: map[string]interface{}{"source": "mm"}},
+		{Id: "s1", Metadata: map[string]interface{}{"source": "sl"}},
+		{Id: "p2", Metadata: map[string]interface{}{"source": "mm"}},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, embeddings, 2)
+	assert.Contains(t, embeddings, "s1")
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// SearchOperators are the Mattermost search operators typed in a query,
+// like `from:alice in:town-square in:@bob after:2024-01-01 -"standup"`
+type SearchOperators struct {
+	Usernames     []string // from:, with or without the @
+	ChannelNames  []string // in:, the channel names with or without the ~
+	DirectUsers   []string // in:@, the users whose direct messages with the searching user are searched
+	Since         int64    // after: and on:, unix time in milliseconds
+	Until         int64    // before: and on:, unix time in milliseconds
+	ExcludedTerms []string // words and quoted phrases prefixed with -
+}
+
+func (operators SearchOperators) hasDates() bool {
+	return operators.Since > 0 || operators.Until > 0
+}
+
+// a quoted phrase, optionally excluded, or a word
+var searchTermRegexp = regexp.MustCompile(`-?"[^"]*"|\S+`)
+
+// Parse the search operators out of a query, and return the remaining free text, which is embedded.
+// Quoted phrases are kept in the free text, and unknown operators are searched as words.
+// The days of the date operators start at midnight in location.
+func parseSearchOperators(query string, location *time.Location) (string, SearchOperators, error) {
+	operators := SearchOperators{}
+	freeText := []string{}
+
+	for _, term := range searchTermRegexp.FindAllString(query, -1) {
+		if strings.HasPrefix(term, `-"`) {
+			if phrase := strings.TrimSpace(strings.Trim(term[1:], `"`)); phrase != "" {
+				operators.ExcludedTerms = append(operators.ExcludedTerms, phrase)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(term, `"`) {
+			if phrase := strings.TrimSpace(strings.Trim(term, `"`)); phrase != "" {
+				freeText = append(freeText, phrase)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(term, "-") && len(term) > 1 {
+			operators.ExcludedTerms = append(operators.ExcludedTerms, term[1:])
+			continue
+		}
+
+		key, value, isOperator := strings.Cut(term, ":")
+		if !isOperator || value == "" {
+			freeText = append(freeText, term)
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "from":
+			operators.Usernames = append(operators.Usernames, strings.ToLower(strings.TrimPrefix(value, "@")))
+		case "in":
+			if strings.HasPrefix(value, "@") {
+				operators.DirectUsers = append(operators.DirectUsers, strings.ToLower(value[1:]))
+			} else {
+				operators.ChannelNames = append(operators.ChannelNames, strings.ToLower(strings.TrimPrefix(value, "~")))
+			}
+		case "after", "before", "on":
+			if err := operators.addDate(strings.ToLower(key), value, location); err != nil {
+				return "", SearchOperators{}, err
+			}
+		default:
+			freeText = append(freeText, term)
+		}
+	}
+
+	if operators.Since > 0 && operators.Until > 0 && operators.Since > operators.Until {
+		return "", SearchOperators{}, fmt.Errorf("the after, before and on operators don't leave any day to search")
+	}
+
+	return strings.Join(freeText, " "), operators, nil
+}
+
+// Narrow the searched dates to a day operator. The after and before days aren't included, like in Mattermost.
+func (operators *SearchOperators) addDate(operator string, value string, location *time.Location) error {
+	day, err := time.ParseInLocation(time.DateOnly, value, location)
+	if err != nil {
+		return fmt.Errorf("%v operator must be a YYYY-MM-DD date: %v", operator, value)
+	}
+
+	// a day isn't 24 hours long when the clocks change
+	since, until := int64(0), int64(0)
+	switch operator {
+	case "after":
+		since = day.AddDate(0, 0, 1).UnixMilli()
+	case "before":
+		until = day.UnixMilli() - 1
+	case "on":
+		since = day.UnixMilli()
+		until = day.AddDate(0, 0, 1).UnixMilli() - 1
+	}
+
+	if since > operators.Since {
+		operators.Since = since
+	}
+	if until > 0 && (operators.Until == 0 || until < operators.Until) {
+		operators.Until = until
+	}
+
+	return nil
+}
+
+// Parse the search operators of a query into the filters of the search options, resolving the usernames
+// and channel names to ids. Returns the free text of the query, which is searched.
+func (p *Plugin) applySearchOperators(query string, userId string, options *SearchOptions) (string, error) {
+	freeText, operators, err := parseSearchOperators(query, getUserLocation(p.mmClient, userId))
+	if err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(freeText) == "" {
+		return "", fmt.Errorf("the query must contain words to search besides the search operators")
+	}
+
+	// the users of the from and in operators are looked up at once
+	userIds, err := resolveUsernames(p.mmClient, append(append([]string{}, operators.Usernames...), operators.DirectUsers...))
+	if err != nil {
+		return "", err
+	}
+
+	if len(operators.Usernames) > 0 {
+		if len(options.Filters.UserIds) > 0 {
+			return "", fmt.Errorf("from operator and user_ids query field can't be used together")
+		}
+
+		for _, username := range operators.Usernames {
+			options.Filters.UserIds = append(options.Filters.UserIds, userIds[username])
+		}
+	}
+
+	if len(operators.ChannelNames) > 0 || len(operators.DirectUsers) > 0 {
+		if len(options.Filters.ChannelIds) > 0 {
+			return "", fmt.Errorf("in operator and channel_ids query field can't be used together")
+		}
+
+		// the names of direct channels are the ids of their two users
+		directChannelNames := map[string]string{}
+		for _, username := range operators.DirectUsers {
+			directChannelNames[model.GetDMNameFromIds(userId, userIds[username])] = "@" + username
+		}
+
+		channelIds, err := resolveChannelNames(p.mmClient, userId, operators.ChannelNames, directChannelNames)
+		if err != nil {
+			return "", err
+		}
+		options.Filters.ChannelIds = channelIds
+	}
+
+	if operators.hasDates() {
+		if options.Filters.Since > 0 || options.Filters.Until > 0 {
+			return "", fmt.Errorf("after, before and on operators and since and until query fields can't be used together")
+		}
+
+		options.Filters.Since = operators.Since
+		options.Filters.Until = operators.Until
+	}
+
+	options.ExcludedTerms = operators.ExcludedTerms
+
+	return freeText, nil
+}
+
+// Get the ids of users, by username. Every user must exist.
+func resolveUsernames(mmClient MattermostClient, usernames []string) (map[string]string, error) {
+	userIds := map[string]string{}
+	if len(usernames) == 0 {
+		return userIds, nil
+	}
+
+	users, err := mmClient.GetUsersByUsernames(usernames)
+	if err != nil {
+		log.Printf("error while resolving the usernames of the search operators: %v \n", err)
+		return nil, fmt.Errorf("could not find the users of the from and in operators")
+	}
+
+	for _, user := range users {
+		userIds[strings.ToLower(user.UserName)] = user.Id
+	}
+
+	for _, username := range usernames {
+		if _, ok := userIds[username]; !ok {
+			return nil, fmt.Errorf("could not find user %v", username)
+		}
+	}
+
+	return userIds, nil
+}
+
+// Get the preferred time zone of a user, or UTC if it isn't set or can't be found
+func getUserLocation(mmClient MattermostClient, userId string) *time.Location {
+	user, err := mmClient.GetUserDetails(userId)
+	if err != nil {
+		log.Printf("error while getting the time zone of the user: %v \n", err)
+		return time.UTC
+	}
+
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		log.Printf("error while loading the time zone of the user: %v \n", err)
+		return time.UTC
+	}
+
+	return location
+}
+
+// Get the ids of the channels the user belongs to, by name. A name can match a channel in each of the user's teams.
+// directChannelNames maps the names of the direct channels to search to the username they're shown with.
+func resolveChannelNames(mmClient MattermostClient, userId string, channelNames []string, directChannelNames map[string]string) ([]string, error) {
+	userChannelIds, err := mmClient.GetUserChannelIds(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	channels, err := getChannelsDetails(mmClient, userChannelIds)
+	if err != nil {
+		log.Printf("error while getting the channels of the in operator: %v \n", err)
+	}
+
+	channelIds := []string{}
+	for _, channelName := range channelNames {
+		found := false
+		for _, channel := range channels {
+			if strings.ToLower(channel.Name) == channelName {
+				channelIds = append(channelIds, channel.Id)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("in operator: you are not a member of channel %v", channelName)
+		}
+	}
+
+	for directChannelName, username := range directChannelNames {
+		found := false
+		for _, channel := range channels {
+			if channel.Type == string(model.ChannelTypeDirect) && channel.Name == directChannelName {
+				channelIds = append(channelIds, channel.Id)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("in operator: you have no direct messages with %v", username)
+		}
+	}
+
+	return channelIds, nil
+}
+
+// Remove the posts containing an excluded word or phrase, along with all their chunks. Words match whole
+// terms, like in the keyword search, and phrases match anywhere in the message. Both ignore case.
+// The messages of the posts are checked, rather than their documents, which hold the start of the
+// thread of replies and only a chunk of long messages.
+func excludeResults(mmClient MattermostClient, results []searchResult, excludedTerms []string) []searchResult {
+	if len(excludedTerms) == 0 {
+		return results
+	}
+
+	postIds := []string{}
+	for _, result := range results {
+		if result.Metadata["source"] == "mm" {
+			postIds = append(postIds, documentPostId(result.Id, result.Metadata))
+		}
+	}
+
+	posts, err := getPostsDetails(mmClient, postIds)
+	if err != nil {
+		log.Printf("error while getting the messages of the excluded terms: %v \n", err)
+	}
+
+	excludedPosts := map[string]bool{}
+	for _, result := range results {
+		postId := documentPostId(result.Id, result.Metadata)
+
+		// the documents of the posts that can't be found, and the slack messages, are checked instead
+		message := result.Document
+		if post, ok := posts[postId]; ok {
+			message = post.Message
+		}
+
+		if containsExcludedTerm(message, excludedTerms) {
+			excludedPosts[postId] = true
+		}
+	}
+
+	includedResults := []searchResult{}
+	for _, result := range results {
+		if !excludedPosts[documentPostId(result.Id, result.Metadata)] {
+			includedResults = append(includedResults, result)
+		}
+	}
+
+	return includedResults
+}
+
+func containsExcludedTerm(message string, excludedTerms []string) bool {
+	message = strings.ToLower(message)
+	terms := tokenFrequencies(message)
+
+	for _, excludedTerm := range excludedTerms {
+		excludedTerm = strings.ToLower(excludedTerm)
+		if strings.Contains(excludedTerm, " ") {
+			if strings.Contains(message, excludedTerm) {
+				return true
+			}
+		} else if terms[excludedTerm] > 0 {
+			return true
+		}
+	}
+
+	return false
+}
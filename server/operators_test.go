@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearchOperators(t *testing.T) {
+	day := func(date string) int64 {
+		parsedDate, _ := time.Parse(time.DateOnly, date)
+		return parsedDate.UnixMilli()
+	}
+
+	t.Run("operators are parsed out of the free text", func(t *testing.T) {
+		freeText, operators, err := parseSearchOperators(`release notes from:@alice in:~town-square in:@Bob after:2024-01-01 -"daily standup" -draft "go live"`, time.UTC)
+		assert.Nil(t, err)
+		assert.Equal(t, "release notes go live", freeText)
+		assert.Equal(t, SearchOperators{
+			Usernames:     []string{"alice"},
+			ChannelNames:  []string{"town-square"},
+			DirectUsers:   []string{"bob"},
+			Since:         day("2024-01-02"),
+			ExcludedTerms: []string{"daily standup", "draft"},
+		}, operators)
+	})
+
+	t.Run("the dates exclude the after and before days", func(t *testing.T) {
+		_, operators, err := parseSearchOperators("release after:2024-01-01 before:2024-01-10", time.UTC)
+		assert.Nil(t, err)
+		assert.Equal(t, day("2024-01-02"), operators.Since)
+		assert.Equal(t, day("2024-01-10")-1, operators.Until)
+
+		_, operators, err = parseSearchOperators("release on:2024-01-01", time.UTC)
+		assert.Nil(t, err)
+		assert.Equal(t, day("2024-01-01"), operators.Since)
+		assert.Equal(t, day("2024-01-02")-1, operators.Until)
+	})
+
+	t.Run("the days start at midnight in the user's time zone", func(t *testing.T) {
+		location := time.FixedZone("UTC+3", 3*60*60)
+
+		_, operators, err := parseSearchOperators("release on:2024-01-01", location)
+		assert.Nil(t, err)
+		assert.Equal(t, day("2024-01-01")-3*time.Hour.Milliseconds(), operators.Since)
+		assert.Equal(t, day("2024-01-02")-3*time.Hour.Milliseconds()-1, operators.Until)
+	})
+
+	t.Run("unknown operators are searched as words", func(t *testing.T) {
+		freeText, operators, err := parseSearchOperators("error https://example.com status: -", time.UTC)
+		assert.Nil(t, err)
+		assert.Equal(t, "error https://example.com status: -", freeText)
+		assert.Equal(t, SearchOperators{}, operators)
+	})
+
+	t.Run("invalid dates", func(t *testing.T) {
+		for _, query := range []string{"release after:yesterday", "release on:2024-13-01", "release after:2024-01-10 before:2024-01-02"} {
+			_, _, err := parseSearchOperators(query, time.UTC)
+			assert.NotNil(t, err, query)
+		}
+	})
+}
+
+func TestApplySearchOperators(t *testing.T) {
+	client := &fakeMattermostClient{
+		users: map[string]UserDetail{
+			"u1":     {Id: "u1", UserName: "alice"},
+			"member": {Id: "member", UserName: "member", Timezone: "Asia/Tokyo"},
+			"u2":     {Id: "u2", UserName: "carol"},
+		},
+		channels: map[string]ChannelDetail{
+			"c1": {Id: "c1", Name: "town-square", TeamId: "t1"},
+			"c2": {Id: "c2", Name: "town-square", TeamId: "t2"},
+			"c3": {Id: "c3", Name: "private", TeamId: "t1"},
+			"dm": {Id: "dm", Type: "D", Name: model.GetDMNameFromIds("member", "u1")},
+		},
+		userChannels: map[string][]string{"member": {"c1", "c2", "dm"}},
+	}
+	plugin := Plugin{configuration: &configuration{}, mmClient: client}
+
+	t.Run("usernames and channel names are resolved to ids", func(t *testing.T) {
+		options := SearchOptions{}
+		query, err := plugin.applySearchOperators(`release from:Alice in:town-square on:2024-01-01 -standup`, "member", &options)
+		assert.Nil(t, err)
+		assert.Equal(t, "release", query)
+		assert.Equal(t, []string{"u1"}, options.Filters.UserIds)
+		assert.ElementsMatch(t, []string{"c1", "c2"}, options.Filters.ChannelIds)
+		// the day starts at midnight in the user's time zone
+		since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+		assert.Equal(t, since.UnixMilli(), options.Filters.Since)
+		assert.Equal(t, since.AddDate(0, 0, 1).UnixMilli()-1, options.Filters.Until)
+		assert.Equal(t, []string{"standup"}, options.ExcludedTerms)
+	})
+
+	t.Run("in:@ searches the direct messages with the user", func(t *testing.T) {
+		options := SearchOptions{}
+		query, err := plugin.applySearchOperators("release in:@alice in:town-square", "member", &options)
+		assert.Nil(t, err)
+		assert.Equal(t, "release", query)
+		assert.ElementsMatch(t, []string{"c1", "c2", "dm"}, options.Filters.ChannelIds)
+		assert.Empty(t, options.Filters.UserIds)
+	})
+
+	t.Run("a query without operators is searched as it is", func(t *testing.T) {
+		options := SearchOptions{Filters: SearchFilters{UserIds: []string{"u2"}}}
+		query, err := plugin.applySearchOperators("release notes", "member", &options)
+		assert.Nil(t, err)
+		assert.Equal(t, "release notes", query)
+		assert.Equal(t, SearchOptions{Filters: SearchFilters{UserIds: []string{"u2"}}}, options)
+	})
+
+	t.Run("invalid operators", func(t *testing.T) {
+		for _, query := range []string{"from:alice", "release from:bob", "release in:private", "release in:unknown", "release in:@carol", "release in:@bob"} {
+			_, err := plugin.applySearchOperators(query, "member", &SearchOptions{})
+			assert.NotNil(t, err, query)
+		}
+
+		_, err := plugin.applySearchOperators("release from:alice", "member", &SearchOptions{Filters: SearchFilters{UserIds: []string{"u2"}}})
+		assert.NotNil(t, err)
+		_, err = plugin.applySearchOperators("release after:2024-01-01", "member", &SearchOptions{Filters: SearchFilters{Until: 1}})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestExcludeResults(t *testing.T) {
+	client := &fakeMattermostClient{posts: map[string]PostDetail{
+		"reply": {Id: "reply", Message: "the standups are moved"},
+		"long":  {Id: "long", Message: "release notes, and the daily standup notes"},
+	}}
+
+	results := []searchResult{
+		{Id: "standup", Document: "Notes of the daily Standup"},
+		{Id: "standups", Document: "the standups are moved"},
+		{Id: "release", Document: "release notes"},
+	}
+
+	assert.Equal(t, []string{"standups", "release"}, flattenIds(excludeResults(client, results, []string{"standup"})))
+	assert.Equal(t, []string{"standups", "release"}, flattenIds(excludeResults(client, results, []string{"daily standup"})))
+	assert.Equal(t, []string{}, flattenIds(excludeResults(client, results, []string{"notes", "the"})))
+	assert.Equal(t, flattenIds(results), flattenIds(excludeResults(client, results, nil)))
+
+	t.Run("the messages of the posts are checked", func(t *testing.T) {
+		results := []searchResult{
+			// a reply to a thread about the standup
+			{Id: "reply", Document: "daily standup\nthe standups are moved", Metadata: map[string]interface{}{"source": "mm", "post_id": "reply"}},
+			// the first chunk of a long message, whose second chunk mentions the standup
+			{Id: "long", Document: "release notes", Metadata: map[string]interface{}{"source": "mm", "post_id": "long"}},
+			{Id: "long-1", Document: "the daily standup notes", Metadata: map[string]interface{}{"source": "mm", "post_id": "long"}},
+		}
+
+		assert.Equal(t, []string{"reply"}, flattenIds(excludeResults(client, results, []string{"daily standup"})))
+	})
+}
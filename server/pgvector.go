@@ -0,0 +1,893 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	chroma "github.com/amikos-tech/chroma-go"
+	"github.com/lib/pq"
+)
+
+// PgvectorStore is a VectorStore keeping the embedded messages in a PostgreSQL database with the
+// pgvector extension, which can be the database Mattermost already uses. The metadata used by the
+// search filters is stored in its own columns, and the rest in a jsonb column.
+type PgvectorStore struct {
+	db       *sql.DB
+	embedder Embedder
+
+	migrationLock sync.Mutex
+	migrated      bool
+
+	// the collections verified or created by this store, by collection type,
+	// so they aren't looked up on every call
+	collectionsLock sync.Mutex
+	collections     map[string]pgvectorCollection
+}
+
+type pgvectorCollection struct {
+	name string
+	// the number of dimensions of the embeddings, which the embedding index is built for
+	dimension int
+}
+
+// pgvectorMigrations create and update the schema. They're applied in order, and the version
+// of the last applied migration is recorded in semantic_search_migrations.
+// Never edit a migration that was released, add a new one instead.
+var pgvectorMigrations = [][]string{
+	{
+		`CREATE EXTENSION IF NOT EXISTS vector`,
+		`CREATE TABLE IF NOT EXISTS semantic_search_collections (
+			name TEXT PRIMARY KEY,
+			embedding_model TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS semantic_search_documents (
+			collection TEXT NOT NULL REFERENCES semantic_search_collections (name) ON DELETE CASCADE,
+			id TEXT NOT NULL,
+			document TEXT NOT NULL,
+			metadata JSONB NOT NULL DEFAULT '{}',
+			source TEXT,
+			access TEXT,
+			channel_id TEXT,
+			user_id TEXT,
+			team_id TEXT,
+			created_at BIGINT,
+			embedding vector NOT NULL,
+			PRIMARY KEY (collection, id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS semantic_search_documents_channel_idx ON semantic_search_documents (collection, channel_id)`,
+		`CREATE INDEX IF NOT EXISTS semantic_search_documents_user_idx ON semantic_search_documents (collection, user_id)`,
+		`CREATE INDEX IF NOT EXISTS semantic_search_documents_created_at_idx ON semantic_search_documents (collection, created_at)`,
+	},
+	{
+		// the embedding index of a collection is built for the dimension of its model, see pgvectorEmbeddingIndex
+		`ALTER TABLE semantic_search_collections ADD COLUMN IF NOT EXISTS dimension INTEGER`,
+		`UPDATE semantic_search_collections SET dimension = (
+			SELECT vector_dims(embedding) FROM semantic_search_documents
+			WHERE semantic_search_documents.collection = semantic_search_collections.name
+			LIMIT 1
+		)`,
+	},
+	{
+		// the chunks of a post are deleted by post_id
+		`CREATE INDEX IF NOT EXISTS semantic_search_documents_post_idx ON semantic_search_documents (collection, (metadata ->> 'post_id'))`,
+	},
+}
+
+const (
+	// the default and maximum hnsw.ef_search, the number of candidates an index scan keeps
+	pgvectorMinEfSearch = 40
+	pgvectorMaxEfSearch = 1000
+	// the postgres error code of a reference to a missing row
+	pgForeignKeyViolation = "23503"
+)
+
+// held while migrating, so plugin instances of a cluster don't migrate at the same time
+const pgvectorMigrationLockId = 7363616
+
+// columns holding the metadata used by the search filters, by metadata key
+var pgvectorMetadataColumns = map[string]string{
+	"source":     "source",
+	"access":     "access",
+	"channel_id": "channel_id",
+	"user_id":    "user_id",
+	"team_id":    "team_id",
+	"create_at":  "created_at",
+	// slack messages are dated in seconds
+	"msg_date": "(created_at / 1000)",
+	// compared as text, so the index of migration 3 is used
+	"post_id": "(metadata ->> 'post_id')",
+}
+
+// Create a store using the PostgreSQL database at dataSource, which embeds the documents using embedder.
+// The database isn't contacted until the store is used.
+func NewPgvectorStore(dataSource string, embedder Embedder) (*PgvectorStore, error) {
+	if dataSource == "" {
+		return nil, newVectorStoreError("connect to postgres", nil, errors.New("the pgvector data source isn't set"))
+	}
+
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		return nil, newVectorStoreError("connect to postgres", nil, err)
+	}
+
+	if embedder == nil {
+		embedder = NewHashEmbedder()
+	}
+
+	return &PgvectorStore{db: db, embedder: embedder, collections: map[string]pgvectorCollection{}}, nil
+}
+
+func (store *PgvectorStore) Close() error {
+	return store.db.Close()
+}
+
+// Apply the migrations that weren't applied yet
+func (store *PgvectorStore) migrate(ctx context.Context) error {
+	store.migrationLock.Lock()
+	defer store.migrationLock.Unlock()
+
+	if store.migrated {
+		return nil
+	}
+
+	if err := store.db.PingContext(ctx); err != nil {
+		return newVectorStoreError("connect to postgres", ErrVectorStoreUnavailable, err)
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return newVectorStoreError("migrate schema", nil, err)
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`SELECT pg_advisory_xact_lock(` + strconv.Itoa(pgvectorMigrationLockId) + `)`,
+		`CREATE TABLE IF NOT EXISTS semantic_search_migrations (version INTEGER PRIMARY KEY)`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return newVectorStoreError("migrate schema", nil, err)
+		}
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM semantic_search_migrations`).Scan(&version); err != nil {
+		return newVectorStoreError("migrate schema", nil, err)
+	}
+
+	for ; version < len(pgvectorMigrations); version++ {
+		for _, statement := range pgvectorMigrations[version] {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return newVectorStoreError(fmt.Sprintf("apply migration %d", version+1), nil, err)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO semantic_search_migrations (version) VALUES ($1)`, version+1); err != nil {
+			return newVectorStoreError("migrate schema", nil, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return newVectorStoreError("migrate schema", nil, err)
+	}
+
+	store.migrated = true
+	return nil
+}
+
+// Get a collection, creating it if it doesn't exist. The collection is created with the dimension
+// of the embedder, and an embedding index for that dimension.
+func (store *PgvectorStore) getOrCreateCollection(ctx context.Context, collectionType string) (pgvectorCollection, error) {
+	if err := store.migrate(ctx); err != nil {
+		return pgvectorCollection{}, err
+	}
+
+	if collectionType == "" {
+		collectionType = mattermostCollectionType
+	}
+
+	store.collectionsLock.Lock()
+	defer store.collectionsLock.Unlock()
+
+	if collection, ok := store.collections[collectionType]; ok {
+		return collection, nil
+	}
+
+	collection := pgvectorCollection{name: collectionType + "_messages"}
+
+	var collectionModel string
+	var dimension sql.NullInt64
+	selectCollection := func() error {
+		return store.db.QueryRowContext(ctx,
+			`SELECT embedding_model, dimension FROM semantic_search_collections WHERE name = $1`, collection.name,
+		).Scan(&collectionModel, &dimension)
+	}
+
+	err := selectCollection()
+	if errors.Is(err, sql.ErrNoRows) {
+		newDimension, err := store.embeddingDimension(ctx)
+		if err != nil {
+			return pgvectorCollection{}, newVectorStoreError("create collection", nil, err)
+		}
+
+		_, err = store.db.ExecContext(ctx,
+			`INSERT INTO semantic_search_collections (name, embedding_model, dimension) VALUES ($1, $2, $3) ON CONFLICT (name) DO NOTHING`,
+			collection.name, store.embedder.Model(), newDimension,
+		)
+		if err != nil {
+			return pgvectorCollection{}, newVectorStoreError("create collection", nil, err)
+		}
+	}
+
+	// another server of the cluster may have created it in the meantime
+	if err != nil {
+		err = selectCollection()
+	}
+	if err != nil {
+		return pgvectorCollection{}, newVectorStoreError("get collection", nil, err)
+	}
+
+	if collectionModel != store.embedder.Model() {
+		return pgvectorCollection{}, newVectorStoreError("get collection", ErrEmbeddingModelMismatch, fmt.Errorf(
+			"%v was embedded using %q but the configured model is %q, reset the vector store to re-embed the messages",
+			collection.name,
+			collectionModel,
+			store.embedder.Model(),
+		))
+	}
+
+	if dimension.Valid {
+		collection.dimension = int(dimension.Int64)
+	} else {
+		// the collection was empty when the dimensions started being recorded
+		collection.dimension, err = store.embeddingDimension(ctx)
+		if err != nil {
+			return pgvectorCollection{}, newVectorStoreError("get collection", nil, err)
+		}
+
+		_, err = store.db.ExecContext(ctx, `UPDATE semantic_search_collections SET dimension = $1 WHERE name = $2`, collection.dimension, collection.name)
+		if err != nil {
+			return pgvectorCollection{}, newVectorStoreError("get collection", nil, err)
+		}
+	}
+
+	// the index of an existing collection can take a while to build, which isn't interrupted with the request
+	if _, err := store.db.ExecContext(context.WithoutCancel(ctx), pgvectorEmbeddingIndex(collection)); err != nil {
+		return pgvectorCollection{}, newVectorStoreError("create the embedding index of "+collection.name, nil, err)
+	}
+
+	store.collections[collectionType] = collection
+	return collection, nil
+}
+
+// Forget the collections, so they're looked up again. They're removed by a reset, which
+// can be done by another server of the cluster.
+func (store *PgvectorStore) forgetCollections() {
+	store.collectionsLock.Lock()
+	defer store.collectionsLock.Unlock()
+
+	store.collections = map[string]pgvectorCollection{}
+}
+
+// Get the number of dimensions of the embeddings of the embedder
+func (store *PgvectorStore) embeddingDimension(ctx context.Context) (int, error) {
+	embedding, err := store.embedder.EmbedQuery(ctx, "dimension")
+	if err != nil {
+		return 0, fmt.Errorf("could not get the embedding dimension: %v", err)
+	}
+
+	if len(embedding) == 0 {
+		return 0, errors.New("could not get the embedding dimension: the embedder returned an empty embedding")
+	}
+
+	return len(embedding), nil
+}
+
+// The embedding column holds the embeddings of every collection, whose models can have different
+// dimensions, so each collection has a partial HNSW index on the embeddings cast to its dimension.
+// Queries must compare pgvectorEmbedding(collection) to use it.
+func pgvectorEmbeddingIndex(collection pgvectorCollection) string {
+	return `CREATE INDEX IF NOT EXISTS ` + pgvectorEmbeddingIndexName(collection.name) + `
+		ON semantic_search_documents USING hnsw (` + pgvectorEmbedding(collection) + ` vector_cosine_ops)
+		WHERE collection = ` + pq.QuoteLiteral(collection.name)
+}
+
+func pgvectorEmbeddingIndexName(collectionName string) string {
+	return pq.QuoteIdentifier("semantic_search_documents_" + collectionName + "_embedding_idx")
+}
+
+func pgvectorEmbedding(collection pgvectorCollection) string {
+	return `(embedding::vector(` + strconv.Itoa(collection.dimension) + `))`
+}
+
+func (store *PgvectorStore) VerifyEmbeddingModel(ctx context.Context) error {
+	for _, collectionType := range []string{mattermostCollectionType, slackCollectionType} {
+		if _, err := store.getOrCreateCollection(ctx, collectionType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *PgvectorStore) Upsert(ctx context.Context, collectionType string, ids []string, documents []string, metadatas []map[string]interface{}) error {
+	if len(ids) != len(documents) || len(ids) != len(metadatas) {
+		return newVectorStoreError("upsert", nil, errors.New("ids, documents and metadatas must have the same length"))
+	}
+
+	collection, err := store.getOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return err
+	}
+
+	embeddings, err := store.embedder.EmbedDocuments(ctx, documents)
+	if err != nil {
+		return newVectorStoreError("embed documents", nil, err)
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return newVectorStoreError("upsert to "+collection.name, nil, err)
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		if len(embeddings[i]) != collection.dimension {
+			return newVectorStoreError("upsert to "+collection.name, nil, fmt.Errorf(
+				"the embedding of %v has %d dimensions, but the collection has %d", id, len(embeddings[i]), collection.dimension,
+			))
+		}
+
+		metadata, err := json.Marshal(metadatas[i])
+		if err != nil {
+			return newVectorStoreError("upsert to "+collection.name, nil, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO semantic_search_documents
+				(collection, id, document, metadata, source, access, channel_id, user_id, team_id, created_at, embedding)
+			VALUES ($1, $2, $3, $4::jsonb, $5, $6, $7, $8, $9, $10, $11::vector)
+			ON CONFLICT (collection, id) DO UPDATE SET
+				document = EXCLUDED.document,
+				metadata = EXCLUDED.metadata,
+				source = EXCLUDED.source,
+				access = EXCLUDED.access,
+				channel_id = EXCLUDED.channel_id,
+				user_id = EXCLUDED.user_id,
+				team_id = EXCLUDED.team_id,
+				created_at = EXCLUDED.created_at,
+				embedding = EXCLUDED.embedding`,
+			collection.name,
+			id,
+			documents[i],
+			string(metadata),
+			metadataString(metadatas[i], "source"),
+			metadataString(metadatas[i], "access"),
+			metadataString(metadatas[i], "channel_id"),
+			metadataString(metadatas[i], "user_id"),
+			metadataString(metadatas[i], "team_id"),
+			metadataCreatedAt(metadatas[i]),
+			pgvectorLiteral(embeddings[i]),
+		)
+
+		// the collection was removed by a reset, it's created again by the next call
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+			store.forgetCollections()
+		}
+
+		if err != nil {
+			return newVectorStoreError("upsert to "+collection.name, nil, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return newVectorStoreError("upsert to "+collection.name, nil, err)
+	}
+
+	return nil
+}
+
+func (store *PgvectorStore) Delete(ctx context.Context, collectionType string, ids []string) error {
+	collection, err := store.getOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.db.ExecContext(ctx,
+		`DELETE FROM semantic_search_documents WHERE collection = $1 AND id = ANY($2)`,
+		collection.name, pq.Array(ids),
+	)
+	if err != nil {
+		return newVectorStoreError("delete from "+collection.name, nil, err)
+	}
+
+	return nil
+}
+
+func (store *PgvectorStore) DeleteWhere(ctx context.Context, collectionType string, whereClause map[string]interface{}) error {
+	collection, err := store.getOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{collection.name}
+	condition, err := pgvectorCondition(whereClause, &args)
+	if err != nil {
+		return newVectorStoreError("build where clause", ErrInvalidFilter, err)
+	}
+
+	if _, err := store.db.ExecContext(ctx, `DELETE FROM semantic_search_documents WHERE collection = $1 AND `+condition, args...); err != nil {
+		return newVectorStoreError("delete from "+collection.name, nil, err)
+	}
+
+	return nil
+}
+
+func (store *PgvectorStore) GetMetadatas(ctx context.Context, collectionType string) (map[string]map[string]interface{}, error) {
+	collection, err := store.getOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := store.db.QueryContext(ctx, `SELECT id, metadata FROM semantic_search_documents WHERE collection = $1`, collection.name)
+	if err != nil {
+		return nil, newVectorStoreError("get from "+collection.name, nil, err)
+	}
+	defer rows.Close()
+
+	metadatas := map[string]map[string]interface{}{}
+	for rows.Next() {
+		var id string
+		var metadataJSON []byte
+		if err := rows.Scan(&id, &metadataJSON); err != nil {
+			return nil, newVectorStoreError("get from "+collection.name, nil, err)
+		}
+
+		metadata := map[string]interface{}{}
+		if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+			return nil, newVectorStoreError("get from "+collection.name, nil, err)
+		}
+
+		metadatas[id] = metadata
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, newVectorStoreError("get from "+collection.name, nil, err)
+	}
+
+	return metadatas, nil
+}
+
+func (store *PgvectorStore) GetEmbeddings(ctx context.Context, collectionType string, ids []string) (map[string][]float32, error) {
+	embeddings := map[string][]float32{}
+	if len(ids) == 0 {
+		return embeddings, nil
+	}
+
+	collection, err := store.getOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := store.db.QueryContext(ctx, `SELECT id, embedding::text FROM semantic_search_documents WHERE collection = $1 AND id = ANY($2)`, collection.name, pq.Array(ids))
+	if err != nil {
+		return nil, newVectorStoreError("get from "+collection.name, nil, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, embeddingText string
+		if err := rows.Scan(&id, &embeddingText); err != nil {
+			return nil, newVectorStoreError("get from "+collection.name, nil, err)
+		}
+
+		embedding, err := parsePgvectorLiteral(embeddingText)
+		if err != nil {
+			return nil, newVectorStoreError("get from "+collection.name, nil, err)
+		}
+
+		embeddings[id] = embedding
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, newVectorStoreError("get from "+collection.name, nil, err)
+	}
+
+	return embeddings, nil
+}
+
+func (store *PgvectorStore) GetDocuments(ctx context.Context, collectionType string, ids []string) (map[string]string, error) {
+	documents := map[string]string{}
+	if len(ids) == 0 {
+		return documents, nil
+	}
+
+	collection, err := store.getOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := store.db.QueryContext(ctx, `SELECT id, document FROM semantic_search_documents WHERE collection = $1 AND id = ANY($2)`, collection.name, pq.Array(ids))
+	if err != nil {
+		return nil, newVectorStoreError("get from "+collection.name, nil, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, document string
+		if err := rows.Scan(&id, &document); err != nil {
+			return nil, newVectorStoreError("get from "+collection.name, nil, err)
+		}
+
+		documents[id] = document
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, newVectorStoreError("get from "+collection.name, nil, err)
+	}
+
+	return documents, nil
+}
+
+func (store *PgvectorStore) Query(ctx context.Context, query string, mmChannelIds []interface{}, nResults int, minScore float64, filters SearchFilters) ([]searchResult, error) {
+	mmWhere, queryMattermost, err := filters.mattermostWhere(mmChannelIds)
+	if err != nil {
+		return nil, newVectorStoreError("build mattermost where clause", ErrInvalidFilter, err)
+	}
+
+	slkWhere, querySlack, err := filters.slackWhere()
+	if err != nil {
+		return nil, newVectorStoreError("build slack where clause", ErrInvalidFilter, err)
+	}
+
+	queryEmbedding, err := store.embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, newVectorStoreError("embed query", nil, err)
+	}
+
+	mmResponse := chroma.QueryResults{}
+	if queryMattermost {
+		mmResponse, err = store.queryCollection(ctx, mattermostCollectionType, queryEmbedding, mmWhere, nResults)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	slkResponse := chroma.QueryResults{}
+	if querySlack {
+		slkResponse, err = store.queryCollection(ctx, slackCollectionType, queryEmbedding, slkWhere, nResults)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return mergeQueryResults(float32(1-minScore), mmResponse, slkResponse), nil
+}
+
+// Find the nResults documents of a collection closest to the query embedding that match the where clause
+func (store *PgvectorStore) queryCollection(ctx context.Context, collectionType string, queryEmbedding []float32, whereClause map[string]interface{}, nResults int) (chroma.QueryResults, error) {
+	collection, err := store.getOrCreateCollection(ctx, collectionType)
+	if err != nil {
+		return chroma.QueryResults{}, err
+	}
+
+	if len(queryEmbedding) != collection.dimension {
+		return chroma.QueryResults{}, newVectorStoreError("query "+collection.name, nil, fmt.Errorf(
+			"the query embedding has %d dimensions, but the collection has %d", len(queryEmbedding), collection.dimension,
+		))
+	}
+
+	args := []interface{}{pgvectorLiteral(queryEmbedding), nResults}
+	condition, err := pgvectorCondition(whereClause, &args)
+	if err != nil {
+		return chroma.QueryResults{}, newVectorStoreError("query "+collection.name, ErrInvalidFilter, err)
+	}
+
+	tx, err := store.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return chroma.QueryResults{}, newVectorStoreError("query "+collection.name, nil, err)
+	}
+	defer tx.Rollback()
+
+	// the index scan keeps ef_search candidates, which must cover the results before they're filtered
+	efSearch := nResults
+	if efSearch < pgvectorMinEfSearch {
+		efSearch = pgvectorMinEfSearch
+	} else if efSearch > pgvectorMaxEfSearch {
+		efSearch = pgvectorMaxEfSearch
+	}
+	if _, err := tx.ExecContext(ctx, `SET LOCAL hnsw.ef_search = `+strconv.Itoa(efSearch)); err != nil {
+		return chroma.QueryResults{}, newVectorStoreError("query "+collection.name, nil, err)
+	}
+
+	// <=> is pgvector's cosine distance. The embedding and the collection are written like in the
+	// embedding index, so the index is used, and the distance is the only order the index can scan
+	embedding := pgvectorEmbedding(collection)
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, document, metadata, `+embedding+` <=> $1::vector(`+strconv.Itoa(collection.dimension)+`) AS distance
+		FROM semantic_search_documents
+		WHERE collection = `+pq.QuoteLiteral(collection.name)+` AND `+condition+`
+		ORDER BY distance
+		LIMIT $2`,
+		args...,
+	)
+	if err != nil {
+		return chroma.QueryResults{}, newVectorStoreError("query "+collection.name, nil, err)
+	}
+	defer rows.Close()
+
+	response := chroma.QueryResults{
+		Ids:       [][]string{{}},
+		Documents: [][]string{{}},
+		Metadatas: [][]map[string]interface{}{{}},
+		Distances: [][]float32{{}},
+	}
+
+	for rows.Next() {
+		var id, document string
+		var metadataJSON []byte
+		var distance float64
+		if err := rows.Scan(&id, &document, &metadataJSON, &distance); err != nil {
+			return chroma.QueryResults{}, newVectorStoreError("query "+collection.name, nil, err)
+		}
+
+		metadata := map[string]interface{}{}
+		if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+			return chroma.QueryResults{}, newVectorStoreError("query "+collection.name, nil, err)
+		}
+
+		response.Ids[0] = append(response.Ids[0], id)
+		response.Documents[0] = append(response.Documents[0], document)
+		response.Metadatas[0] = append(response.Metadatas[0], metadata)
+		response.Distances[0] = append(response.Distances[0], float32(distance))
+	}
+
+	if err := rows.Err(); err != nil {
+		return chroma.QueryResults{}, newVectorStoreError("query "+collection.name, nil, err)
+	}
+
+	return response, nil
+}
+
+// Remove every collection, along with their documents
+func (store *PgvectorStore) Reset(ctx context.Context) error {
+	if err := store.migrate(ctx); err != nil {
+		return err
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return newVectorStoreError("reset postgres", nil, err)
+	}
+	defer tx.Rollback()
+
+	// the embedding indexes are built for the dimension of the previous model
+	for _, collectionType := range []string{mattermostCollectionType, slackCollectionType} {
+		if _, err := tx.ExecContext(ctx, `DROP INDEX IF EXISTS `+pgvectorEmbeddingIndexName(collectionType+"_messages")); err != nil {
+			return newVectorStoreError("reset postgres", nil, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM semantic_search_collections`); err != nil {
+		return newVectorStoreError("reset postgres", nil, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return newVectorStoreError("reset postgres", nil, err)
+	}
+
+	store.forgetCollections()
+	return nil
+}
+
+// Translate a chroma where clause into an SQL condition, appending its values to args.
+// The metadata stored in columns is compared directly, and the rest through the jsonb column.
+func pgvectorCondition(whereClause map[string]interface{}, args *[]interface{}) (string, error) {
+	if len(whereClause) == 0 {
+		return "TRUE", nil
+	}
+
+	// sorted so the same clause always gives the same query
+	keys := make([]string, 0, len(whereClause))
+	for key := range whereClause {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	conditions := []string{}
+	for _, key := range keys {
+		var condition string
+		var err error
+
+		switch key {
+		case "$and", "$or":
+			condition, err = pgvectorLogicalCondition(key, whereClause[key], args)
+		default:
+			condition, err = pgvectorFieldCondition(key, whereClause[key], args)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		conditions = append(conditions, condition)
+	}
+
+	return strings.Join(conditions, " AND "), nil
+}
+
+func pgvectorLogicalCondition(operator string, condition interface{}, args *[]interface{}) (string, error) {
+	clauses, err := whereSubClauses(operator, condition)
+	if err != nil {
+		return "", err
+	}
+
+	conditions := []string{}
+	for _, clause := range clauses {
+		condition, err := pgvectorCondition(clause, args)
+		if err != nil {
+			return "", err
+		}
+
+		conditions = append(conditions, "("+condition+")")
+	}
+
+	joiner := " AND "
+	if operator == "$or" {
+		joiner = " OR "
+	}
+
+	return "(" + strings.Join(conditions, joiner) + ")", nil
+}
+
+func pgvectorFieldCondition(key string, condition interface{}, args *[]interface{}) (string, error) {
+	operations, ok := condition.(map[string]interface{})
+	if !ok {
+		// a plain value is compared for equality
+		operations = map[string]interface{}{"$eq": condition}
+	}
+
+	column, isColumn := pgvectorMetadataColumns[key]
+	field := column
+	if !isColumn {
+		field = "metadata -> " + pgvectorPlaceholder(args, key) + "::text"
+	}
+
+	// the value of an operand, as a placeholder
+	value := func(operand interface{}) (string, error) {
+		if isColumn {
+			return pgvectorPlaceholder(args, operand), nil
+		}
+
+		operandJSON, err := json.Marshal(operand)
+		if err != nil {
+			return "", err
+		}
+		return pgvectorPlaceholder(args, string(operandJSON)) + "::jsonb", nil
+	}
+
+	operators := make([]string, 0, len(operations))
+	for operator := range operations {
+		operators = append(operators, operator)
+	}
+	sort.Strings(operators)
+
+	conditions := []string{}
+	for _, operator := range operators {
+		operand := operations[operator]
+
+		switch operator {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			if operator != "$eq" && operator != "$ne" {
+				if _, isNumber := metadataNumber(operand); !isNumber {
+					return "", fmt.Errorf("%v on %v expects a number: %v", operator, key, operand)
+				}
+			}
+
+			placeholder, err := value(operand)
+			if err != nil {
+				return "", err
+			}
+
+			sqlOperator := map[string]string{
+				"$eq":  "=",
+				"$ne":  "IS DISTINCT FROM",
+				"$gt":  ">",
+				"$gte": ">=",
+				"$lt":  "<",
+				"$lte": "<=",
+			}[operator]
+			conditions = append(conditions, fmt.Sprintf("%v %v %v", field, sqlOperator, placeholder))
+		case "$in", "$nin":
+			values, ok := operand.([]interface{})
+			if !ok {
+				return "", fmt.Errorf("%v on %v expects a list: %v", operator, key, operand)
+			}
+
+			placeholders := []string{}
+			for _, item := range values {
+				placeholder, err := value(item)
+				if err != nil {
+					return "", err
+				}
+				placeholders = append(placeholders, placeholder)
+			}
+
+			// an empty list matches nothing
+			inCondition := "FALSE"
+			if len(placeholders) > 0 {
+				inCondition = fmt.Sprintf("COALESCE(%v IN (%v), FALSE)", field, strings.Join(placeholders, ", "))
+			}
+
+			if operator == "$nin" {
+				inCondition = "NOT " + inCondition
+			}
+			conditions = append(conditions, inCondition)
+		default:
+			return "", fmt.Errorf("unsupported where operator %v on %v", operator, key)
+		}
+	}
+
+	return strings.Join(conditions, " AND "), nil
+}
+
+// Add a value to the query arguments, and get its placeholder
+func pgvectorPlaceholder(args *[]interface{}, value interface{}) string {
+	*args = append(*args, value)
+	return "$" + strconv.Itoa(len(*args))
+}
+
+// Format a vector the way pgvector parses it, e.g. [0.1,0.2]
+func pgvectorLiteral(vector []float32) string {
+	values := make([]string, 0, len(vector))
+	for _, value := range vector {
+		values = append(values, strconv.FormatFloat(float64(value), 'f', -1, 32))
+	}
+
+	return "[" + strings.Join(values, ",") + "]"
+}
+
+// Parse a vector from pgvector's text format, e.g. [1,2,3]
+func parsePgvectorLiteral(literal string) ([]float32, error) {
+	literal = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(literal), "["), "]")
+	if literal == "" {
+		return []float32{}, nil
+	}
+
+	vector := []float32{}
+	for _, value := range strings.Split(literal, ",") {
+		parsedValue, err := strconv.ParseFloat(strings.TrimSpace(value), 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector value %v: %v", value, err)
+		}
+		vector = append(vector, float32(parsedValue))
+	}
+
+	return vector, nil
+}
+
+func metadataString(metadata map[string]interface{}, key string) sql.NullString {
+	value, ok := metadata[key].(string)
+	return sql.NullString{String: value, Valid: ok}
+}
+
+// Get the date of a message in milliseconds. Mattermost posts are dated in
+// milliseconds by create_at, and slack messages in seconds by msg_date.
+func metadataCreatedAt(metadata map[string]interface{}) sql.NullInt64 {
+	if createAt, ok := metadataNumber(metadata["create_at"]); ok {
+		return sql.NullInt64{Int64: int64(createAt), Valid: true}
+	}
+
+	if msgDate, ok := metadataNumber(metadata["msg_date"]); ok {
+		return sql.NullInt64{Int64: int64(msgDate) * 1000, Valid: true}
+	}
+
+	return sql.NullInt64{}
+}
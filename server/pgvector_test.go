@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPgvectorCondition(t *testing.T) {
+	t.Run("no clause", func(t *testing.T) {
+		args := []interface{}{}
+		condition, err := pgvectorCondition(nil, &args)
+		assert.Nil(t, err)
+		assert.Equal(t, "TRUE", condition)
+		assert.Empty(t, args)
+	})
+
+	t.Run("mattermost filters use the metadata columns", func(t *testing.T) {
+		whereClause, _, err := SearchFilters{UserIds: []string{"usr1"}, Since: 1000}.mattermostWhere([]interface{}{"ch1", "ch2"})
+		assert.Nil(t, err)
+
+		args := []interface{}{"query", "collection"}
+		condition, err := pgvectorCondition(whereClause, &args)
+		assert.Nil(t, err)
+		assert.Equal(t, "((COALESCE(channel_id IN ($3, $4), FALSE)) AND (COALESCE(user_id IN ($5), FALSE)) AND (created_at >= $6))", condition)
+		assert.Equal(t, []interface{}{"query", "collection", "ch1", "ch2", "usr1", 1000}, args)
+	})
+
+	t.Run("slack dates are compared in seconds", func(t *testing.T) {
+		args := []interface{}{}
+		condition, err := pgvectorCondition(map[string]interface{}{"msg_date": map[string]interface{}{"$lte": 2}}, &args)
+		assert.Nil(t, err)
+		assert.Equal(t, "(created_at / 1000) <= $1", condition)
+		assert.Equal(t, []interface{}{2}, args)
+	})
+
+	t.Run("other metadata is compared as json", func(t *testing.T) {
+		args := []interface{}{}
+		condition, err := pgvectorCondition(map[string]interface{}{
+			"$or": []map[string]interface{}{
+				{"channel_name": "general"},
+				{"user_name": map[string]interface{}{"$nin": []interface{}{"bot"}, "$ne": "admin"}},
+			},
+		}, &args)
+		assert.Nil(t, err)
+		assert.Equal(t, "((metadata -> $1::text = $2::jsonb) OR (metadata -> $3::text IS DISTINCT FROM $4::jsonb AND NOT COALESCE(metadata -> $3::text IN ($5::jsonb), FALSE)))", condition)
+		assert.Equal(t, []interface{}{"channel_name", `"general"`, "user_name", `"admin"`, `"bot"`}, args)
+	})
+
+	t.Run("post chunks are matched by the indexed post_id", func(t *testing.T) {
+		args := []interface{}{"collection"}
+		condition, err := pgvectorCondition(postChunksWhere(map[string]int{"p1": 1}), &args)
+		assert.Nil(t, err)
+		assert.Equal(t, "((COALESCE((metadata ->> 'post_id') IN ($2), FALSE)) AND (metadata -> $3::text >= $4::jsonb))", condition)
+		assert.Equal(t, []interface{}{"collection", "p1", "chunk_index", "1"}, args)
+	})
+
+	t.Run("empty lists", func(t *testing.T) {
+		args := []interface{}{}
+		condition, err := pgvectorCondition(map[string]interface{}{
+			"channel_id": map[string]interface{}{"$in": []interface{}{}},
+			"user_id":    map[string]interface{}{"$nin": []interface{}{}},
+		}, &args)
+		assert.Nil(t, err)
+		assert.Equal(t, "FALSE AND NOT FALSE", condition)
+	})
+
+	for name, whereClause := range map[string]map[string]interface{}{
+		"unsupported operator": {"channel_id": map[string]interface{}{"$like": "ch%"}},
+		"range without number": {"create_at": map[string]interface{}{"$gt": "yesterday"}},
+		"single $and clause":   {"$and": []map[string]interface{}{{"channel_id": "ch1"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			args := []interface{}{}
+			_, err := pgvectorCondition(whereClause, &args)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestMetadataCreatedAt(t *testing.T) {
+	assert.Equal(t, sql.NullInt64{Int64: 1500, Valid: true}, metadataCreatedAt(map[string]interface{}{"create_at": 1500}))
+	assert.Equal(t, sql.NullInt64{Int64: 2000, Valid: true}, metadataCreatedAt(map[string]interface{}{"msg_date": int64(2)}))
+	assert.Equal(t, sql.NullInt64{}, metadataCreatedAt(map[string]interface{}{}))
+}
+
+func TestPgvectorLiteral(t *testing.T) {
+	assert.Equal(t, "[0.5,-1,0.1]", pgvectorLiteral([]float32{0.5, -1, 0.1}))
+	assert.Equal(t, "[]", pgvectorLiteral(nil))
+
+	vector, err := parsePgvectorLiteral("[0.5,-1,0.1]")
+	assert.Nil(t, err)
+	assert.Equal(t, []float32{0.5, -1, 0.1}, vector)
+
+	_, err = parsePgvectorLiteral("[0.5,one]")
+	assert.NotNil(t, err)
+}
+
+func TestPgvectorEmbeddingIndex(t *testing.T) {
+	collection := pgvectorCollection{name: "mattermost_messages", dimension: 768}
+
+	statement := pgvectorEmbeddingIndex(collection)
+	assert.Contains(t, statement, `"semantic_search_documents_mattermost_messages_embedding_idx"`)
+	assert.Contains(t, statement, `USING hnsw ((embedding::vector(768)) vector_cosine_ops)`)
+	assert.Contains(t, statement, `WHERE collection = 'mattermost_messages'`)
+	// queries compare the same expression, so the index is used
+	assert.Contains(t, statement, pgvectorEmbedding(collection))
+}
+
+// Runs against the PostgreSQL database at PGVECTOR_DATA_SOURCE, e.g. a pgvector/pgvector container.
+// The tests remove the documents stored in the database.
+func TestPgvectorStoreConformance(t *testing.T) {
+	dataSource := os.Getenv("PGVECTOR_DATA_SOURCE")
+	if dataSource == "" {
+		t.Skip("PGVECTOR_DATA_SOURCE isn't set")
+	}
+
+	testVectorStoreConformance(t, func(t *testing.T) func(embedder Embedder) VectorStore {
+		newStore := func(embedder Embedder) VectorStore {
+			store, err := NewPgvectorStore(dataSource, embedder)
+			assert.Nil(t, err)
+			t.Cleanup(func() { store.Close() })
+			return store
+		}
+
+		// every test starts from an empty database
+		assert.Nil(t, newStore(NewHashEmbedder()).Reset(context.Background()))
+
+		return newStore
+	})
+}
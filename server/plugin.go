@@ -1,21 +1,38 @@
 package main
 
 import (
+	"context"
 	"sync"
 
 	"github.com/gorilla/mux"
 
 	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 )
 
 // Plugin implements the interface expected by the Mattermost server to communicate between the server and plugin processes.
 type Plugin struct {
 	plugin.MattermostPlugin
 
+	mmClient MattermostClient
+
+	// the Mattermost database, which lists the channels the plugin API can't
+	database *pluginapi.StoreService
+
+	vectorStore *VectorStoreConnection
+
 	mmSync *Sync
 
 	mmSyncBroker *Broker
 
+	// stops campaigning to be the sync leader, and closes syncLeaderDone once stepped down
+	stopSyncLeader context.CancelFunc
+	syncLeaderDone chan struct{}
+
+	// reconciles the vector store with Mattermost every configured interval
+	reconcileJob *cluster.Job
+
 	slackClient *Slack
 
 	// configurationLock synchronizes access to the configuration.
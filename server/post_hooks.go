@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// The hooks below keep the mattermost collection up to date as soon as a post is
+// created, edited or deleted. The ticker based sync in syncPosts.go is kept as a
+// backstop that reconciles anything missed while the plugin was down.
+
+// MessageHasBeenPosted is invoked after a post has been committed to the database.
+func (p *Plugin) MessageHasBeenPosted(c *plugin.Context, post *model.Post) {
+	p.indexPost(post)
+
+	// a reply changes the reply count of its root post
+	if post != nil && post.RootId != "" {
+		p.indexRootPost(post.RootId)
+	}
+}
+
+// MessageHasBeenUpdated is invoked after a post has been edited. The edited post keeps
+// the id of the original post, so upserting it replaces the previous document.
+func (p *Plugin) MessageHasBeenUpdated(c *plugin.Context, newPost, oldPost *model.Post) {
+	p.indexPost(newPost)
+}
+
+// MessageHasBeenDeleted is invoked after a post has been deleted from the database.
+func (p *Plugin) MessageHasBeenDeleted(c *plugin.Context, post *model.Post) {
+	if !p.isRealTimeIndexingEnabled() {
+		return
+	}
+
+	if err := deleteFromVectorStore(p.vectorStore, post.Id); err != nil {
+		log.Printf("error while trying to delete post %v: %v \n", post.Id, err)
+	}
+
+	if post.RootId != "" {
+		p.indexRootPost(post.RootId)
+	}
+}
+
+// indexPost pushes a single post through the same filter and upsert path used by StartFetch
+func (p *Plugin) indexPost(post *model.Post) {
+	if post == nil || !p.isRealTimeIndexingEnabled() {
+		return
+	}
+
+	// the posts of the hooks don't have their reactions, which are counted from the stored post
+	indexedPost := postFromModel(post)
+	if post.HasReactions {
+		if postDetail, err := p.mmClient.GetPostDetails(post.Id); err == nil {
+			indexedPost.ReactionCount = postDetail.ReactionCount
+		}
+	}
+
+	p.upsertPost(indexedPost)
+}
+
+// indexRootPost embeds a root post again with its current reply count, once one of its replies was posted or deleted
+func (p *Plugin) indexRootPost(rootId string) {
+	if !p.isRealTimeIndexingEnabled() {
+		return
+	}
+
+	rootPost, err := p.mmClient.GetPostDetails(rootId)
+	if err != nil {
+		log.Printf("error while trying to get root post %v: %v \n", rootId, err)
+		return
+	}
+
+	p.upsertPost(Post(rootPost))
+}
+
+func (p *Plugin) upsertPost(post Post) {
+	channel, err := p.mmClient.GetChannelDetails(post.ChannelId)
+	if err != nil {
+		log.Printf("error while trying to get channel %v: %v \n", post.ChannelId, err)
+		return
+	}
+
+	// remove deleted posts from the vector store and filter out any irrelevant posts
+	filteredPosts, err := deleteAndFilterPost(p.vectorStore, []Post{post})
+	if err != nil {
+		log.Printf("error while trying to filter post %v: %v \n", post.Id, err)
+		return
+	}
+
+	if len(filteredPosts) <= 0 {
+		return
+	}
+
+	if err := upsertPostsToVectorStore(p.vectorStore, filteredPosts, getChannelAccess(channel.Type), channel.TeamId, p.mmClient); err != nil {
+		log.Printf("error while trying to upsert post %v: %v \n", post.Id, err)
+	}
+}
+
+// real-time indexing follows the sync toggle, so posts aren't embedded while sync is turned off
+func (p *Plugin) isRealTimeIndexingEnabled() bool {
+	if p.mmSync == nil {
+		return false
+	}
+
+	isSyncInProgress, err := p.mmSync.GetIsSyncInProgress()
+	if err != nil {
+		log.Println("error while trying to get IsSyncInProgress: ", err)
+		return false
+	}
+
+	return isSyncInProgress
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+func TestPostHooks(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	vectorsStore, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer vectorsStore.Close()
+
+	syncStore, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-sync"))
+	assert.Nil(t, err)
+	defer syncStore.Close()
+
+	connection := newTestVectorStoreConnection()
+	assert.Nil(t, connection.tryConnect(ctx, newEmbeddedVectorStore(newEmbeddedVectorIndex(vectorsStore), NewHashEmbedder())))
+
+	client := &fakeMattermostClient{
+		posts: map[string]PostDetail{
+			"root": {Id: "root", UserId: "u1", ChannelId: "c1", Message: "the release is on friday", ReplyCount: 1},
+		},
+		channels: map[string]ChannelDetail{"c1": {Id: "c1", Type: "O", Name: "town-square", TeamId: "t1"}},
+		teams:    map[string]TeamDetail{"t1": {Id: "t1", Name: "team"}},
+		users:    map[string]UserDetail{"u1": {Id: "u1", UserName: "user"}},
+	}
+
+	mmSync := &Sync{store: syncStore, vectorStore: connection, mmClient: client}
+	plugin := &Plugin{mmClient: client, vectorStore: connection, mmSync: mmSync}
+
+	getMetadatas := func() map[string]map[string]interface{} {
+		metadatas, err := connection.GetMetadatas(ctx, mattermostCollectionType)
+		assert.Nil(t, err)
+		return metadatas
+	}
+
+	t.Run("posts aren't indexed while the sync is off", func(t *testing.T) {
+		plugin.MessageHasBeenPosted(nil, &model.Post{Id: "root", UserId: "u1", ChannelId: "c1", Message: "the release is on friday"})
+		assert.Empty(t, getMetadatas())
+	})
+
+	assert.Nil(t, mmSync.setIsSyncInProgress(true))
+
+	t.Run("posted messages are indexed", func(t *testing.T) {
+		plugin.MessageHasBeenPosted(nil, &model.Post{Id: "root", UserId: "u1", ChannelId: "c1", Message: "the release is on friday"})
+		plugin.MessageHasBeenPosted(nil, &model.Post{Id: "join", UserId: "u1", ChannelId: "c1", Message: "joined the channel", Type: model.PostTypeJoinChannel})
+
+		metadatas := getMetadatas()
+		assert.Len(t, metadatas, 1)
+		assert.Equal(t, "pub", metadatas["root"]["access"])
+		assert.Equal(t, "t1", metadatas["root"]["team_id"])
+	})
+
+	t.Run("a reply updates the reply count of its root", func(t *testing.T) {
+		client.posts["reply"] = PostDetail{Id: "reply", UserId: "u1", ChannelId: "c1", RootId: "root", Message: "moved to monday"}
+		plugin.MessageHasBeenPosted(nil, &model.Post{Id: "reply", UserId: "u1", ChannelId: "c1", RootId: "root", Message: "moved to monday"})
+
+		metadatas := getMetadatas()
+		assert.Contains(t, metadatas, "reply")
+		replyCount, _ := metadataNumber(metadatas["root"]["reply_count"])
+		assert.Equal(t, float64(1), replyCount)
+	})
+
+	t.Run("edited messages are indexed again", func(t *testing.T) {
+		oldPost := &model.Post{Id: "reply", UserId: "u1", ChannelId: "c1", RootId: "root", Message: "moved to monday"}
+		newPost := &model.Post{Id: "reply", UserId: "u1", ChannelId: "c1", RootId: "root", Message: "moved to tuesday", UpdateAt: 20}
+		plugin.MessageHasBeenUpdated(nil, newPost, oldPost)
+
+		updateAt, _ := metadataNumber(getMetadatas()["reply"]["update_at"])
+		assert.Equal(t, float64(20), updateAt)
+	})
+
+	t.Run("deleted messages are removed, and their root updated", func(t *testing.T) {
+		delete(client.posts, "reply")
+		client.posts["root"] = PostDetail{Id: "root", UserId: "u1", ChannelId: "c1", Message: "the release is on friday"}
+		plugin.MessageHasBeenDeleted(nil, &model.Post{Id: "reply", UserId: "u1", ChannelId: "c1", RootId: "root", Message: "moved to tuesday"})
+
+		metadatas := getMetadatas()
+		assert.NotContains(t, metadatas, "reply")
+		replyCount, _ := metadataNumber(metadatas["root"]["reply_count"])
+		assert.Equal(t, float64(0), replyCount)
+	})
+
+	t.Run("nothing is deleted while the sync is off", func(t *testing.T) {
+		assert.Nil(t, mmSync.setIsSyncInProgress(false))
+		plugin.MessageHasBeenDeleted(nil, &model.Post{Id: "root", UserId: "u1", ChannelId: "c1", Message: "the release is on friday"})
+		assert.Contains(t, getMetadatas(), "root")
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+)
+
+// ReconcileReport summarizes the differences found between the Mattermost posts and the
+// documents of the mattermost collection, which have been fixed by the reconciliation
+type ReconcileReport struct {
+	StartedAt  int64 `json:"started_at"`
+	FinishedAt int64 `json:"finished_at"`
+	Channels   int   `json:"channels"`
+	Posts      int   `json:"posts"`
+	// posts that weren't in the vector store
+	Missing int `json:"missing"`
+	// posts edited, moved to a channel with another access, or whose pin, replies or reactions changed since they were embedded
+	Stale int `json:"stale"`
+	// documents of posts that were deleted, or that aren't indexed anymore
+	Orphaned int `json:"orphaned"`
+	// documents of posts that still exist but weren't found in the channels, like the posts of
+	// archived channels. They're kept
+	Unlisted int    `json:"unlisted"`
+	Error    string `json:"error,omitempty"`
+}
+
+const (
+	reconcileMutexKey = "reconcile"
+	reconcileJobKey   = "reconcile"
+	reconcileReport   = "last_reconcile_report"
+	// 200 is the max number of posts per page
+	reconcilePerPage = 200
+	// how often to check whether the scheduled reconciliation was enabled
+	reconcileDisabledCheckTime = 10 * time.Minute
+)
+
+var ErrReconcileInProgress = errors.New("reconciliation is in progress")
+
+// Compare the posts of every channel with the documents of the mattermost collection. The missing
+// and stale posts are embedded, and the documents of posts that no longer exist are deleted.
+// The documents of posts that exist outside the listed channels are kept, and reported as unlisted.
+func (sync *Sync) Reconcile(ctx context.Context, report *ReconcileReport) error {
+	// the documents are listed before walking the channels, so the posts indexed
+	// while reconciling aren't mistaken for orphans
+	storedMetadatas, err := sync.vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+	if err != nil {
+		return err
+	}
+
+	// the first chunk of a post has the post's id, and carries the post's metadata
+	storedPosts := map[string]map[string]interface{}{}
+	for id, metadata := range storedMetadatas {
+		if documentPostId(id, metadata) == id {
+			storedPosts[id] = metadata
+		}
+	}
+
+	channels, err := sync.mmClient.GetAllChannels()
+	if err != nil {
+		return err
+	}
+
+	seenPosts := map[string]bool{}
+	for _, channel := range channels {
+		access := getChannelAccess(channel.Type)
+
+		// each page is fetched before the oldest post of the previous one, so no post is skipped
+		// when posts are created or deleted while the channel is walked
+		beforePostId := ""
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			postsRes, err := sync.mmClient.FetchPostsBefore(channel.Id, beforePostId, reconcilePerPage)
+			if err != nil {
+				return err
+			}
+
+			var posts []Post
+			for _, postId := range postsRes.Order {
+				post := postsRes.Posts[postId]
+				if !isIndexablePost(post) {
+					continue
+				}
+
+				seenPosts[post.Id] = true
+				report.Posts++
+
+				metadata, isStored := storedPosts[post.Id]
+				if !isStored {
+					report.Missing++
+					posts = append(posts, post)
+				} else if isStaleMetadata(metadata, post, access, channel.TeamId) {
+					report.Stale++
+					posts = append(posts, post)
+				}
+			}
+
+			if len(posts) > 0 {
+				if err := upsertPostsToVectorStore(sync.vectorStore, posts, access, channel.TeamId, sync.mmClient); err != nil {
+					return err
+				}
+			}
+
+			if len(postsRes.Order) < reconcilePerPage {
+				break
+			}
+			beforePostId = postsRes.Order[len(postsRes.Order)-1]
+		}
+
+		report.Channels++
+	}
+
+	unseenDocuments := map[string][]string{}
+	unseenPostIds := []string{}
+	for id, metadata := range storedMetadatas {
+		postId := documentPostId(id, metadata)
+		if seenPosts[postId] {
+			continue
+		}
+
+		if _, ok := unseenDocuments[postId]; !ok {
+			unseenPostIds = append(unseenPostIds, postId)
+		}
+		unseenDocuments[postId] = append(unseenDocuments[postId], id)
+	}
+
+	orphanedPosts, err := sync.getOrphanedPosts(unseenPostIds)
+	if err != nil {
+		log.Printf("error while checking whether the posts not found in the channels were deleted: %v \n", err)
+	}
+
+	orphans := []string{}
+	for postId, documentIds := range unseenDocuments {
+		if orphanedPosts[postId] {
+			orphans = append(orphans, documentIds...)
+		} else {
+			report.Unlisted++
+		}
+	}
+
+	if err := deleteDocuments(ctx, sync.vectorStore, mattermostCollectionType, orphans); err != nil {
+		return err
+	}
+	report.Orphaned = len(orphanedPosts)
+
+	return nil
+}
+
+// Get which of the posts were deleted or aren't indexed anymore. The posts not found in the channels
+// can be in channels that aren't listed, like archived channels, so they're looked up one by one.
+// The posts that can't be looked up aren't orphaned, and one of their errors is returned.
+func (sync *Sync) getOrphanedPosts(postIds []string) (map[string]bool, error) {
+	values, err := lookupConcurrently(postIds, func(postId string) (interface{}, error) {
+		post, err := sync.mmClient.GetPostDetails(postId)
+		if errors.Is(err, ErrPostNotFound) {
+			return true, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return !isIndexablePost(Post(post)), nil
+	})
+
+	orphanedPosts := map[string]bool{}
+	for postId, isOrphaned := range values {
+		if isOrphaned.(bool) {
+			orphanedPosts[postId] = true
+		}
+	}
+
+	return orphanedPosts, err
+}
+
+// Whether the document of a post was embedded before the post was last edited, or with another access.
+// The documents embedded before update_at was recorded, or with an older metadata schema, are considered stale.
+func isStaleMetadata(metadata map[string]interface{}, post Post, access string, teamId string) bool {
+	if getMetadataSchemaVersion(metadata) < metadataSchemaVersion {
+		return true
+	}
+
+	updateAt, ok := metadataNumber(metadata["update_at"])
+	if !ok || int64(updateAt) != post.UpdateAt {
+		return true
+	}
+
+	if metadata["access"] != access || metadata["channel_id"] != post.ChannelId || metadata["team_id"] != teamId {
+		return true
+	}
+
+	// the engagement signals can change without the post being edited
+	replyCount, _ := metadataNumber(metadata["reply_count"])
+	reactionCount, _ := metadataNumber(metadata["reaction_count"])
+	return metadata["is_pinned"] != post.IsPinned || int64(replyCount) != post.ReplyCount || int(reactionCount) != post.ReactionCount
+}
+
+// Take the reconciliation lock, shared by the servers of the cluster
+func (p *Plugin) lockReconciliation() (*cluster.Mutex, error) {
+	mutex, err := cluster.NewMutex(p.API, reconcileMutexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := mutex.LockWithContext(ctx); err != nil {
+		return nil, ErrReconcileInProgress
+	}
+
+	return mutex, nil
+}
+
+// Reconcile the vector store with Mattermost, saving the report as it starts and once it's done
+func (p *Plugin) runReconciliation(ctx context.Context) ReconcileReport {
+	report := ReconcileReport{StartedAt: time.Now().UnixMilli()}
+	p.saveReconcileReport(report)
+
+	log.Println("Reconciliation started")
+
+	if err := p.mmSync.Reconcile(ctx, &report); err != nil {
+		log.Printf("error while reconciling the vector store: %v \n", err)
+		report.Error = err.Error()
+	}
+
+	report.FinishedAt = time.Now().UnixMilli()
+	p.saveReconcileReport(report)
+
+	log.Printf("Reconciliation done, %v missing, %v stale, %v orphaned and %v unlisted posts out of %v \n", report.Missing, report.Stale, report.Orphaned, report.Unlisted, report.Posts)
+
+	return report
+}
+
+func (p *Plugin) saveReconcileReport(report ReconcileReport) {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("error while encoding the reconciliation report: %v \n", err)
+		return
+	}
+
+	if err := p.mmSync.store.Put("sync", reconcileReport, reportJSON); err != nil {
+		log.Printf("error while saving the reconciliation report: %v \n", err)
+	}
+}
+
+// Get the report of the last reconciliation, which isn't finished yet if its finished_at is 0
+func (p *Plugin) getReconcileReport() (*ReconcileReport, error) {
+	if p.mmSync.store == nil {
+		return nil, fmt.Errorf("store is not initialized")
+	}
+
+	reportJSON, err := p.mmSync.store.Get("sync", reconcileReport)
+	if err != nil {
+		// never reconciled
+		return nil, nil
+	}
+
+	report := &ReconcileReport{}
+	if err := json.Unmarshal(reportJSON, report); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Schedule the reconciliation on one server of the cluster, every configured interval
+func (p *Plugin) scheduleReconciliation() (*cluster.Job, error) {
+	return cluster.Schedule(p.API, reconcileJobKey, p.nextReconciliationWait, func() {
+		mutex, err := p.lockReconciliation()
+		if err != nil {
+			log.Printf("skipping the scheduled reconciliation: %v \n", err)
+			return
+		}
+		defer mutex.Unlock()
+
+		p.runReconciliation(context.Background())
+	})
+}
+
+// The interval is read every time, so configuration changes apply to the next run
+func (p *Plugin) nextReconciliationWait(now time.Time, metadata cluster.JobMetadata) time.Duration {
+	interval := p.getConfiguration().getReconciliationInterval()
+	if interval == 0 {
+		return reconcileDisabledCheckTime
+	}
+
+	return cluster.MakeWaitForInterval(interval)(now, metadata)
+}
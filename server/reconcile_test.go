@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer store.Close()
+	vectorStore := newEmbeddedVectorStore(newEmbeddedVectorIndex(store), nil)
+
+	client := &pagedMattermostClient{
+		fakeMattermostClient: fakeMattermostClient{
+			channels: map[string]ChannelDetail{
+				"c1": {Id: "c1", Type: "O", Name: "town-square", TeamId: "t1"},
+				"c2": {Id: "c2", Type: "P", Name: "private", TeamId: "t1"},
+			},
+			teams: map[string]TeamDetail{"t1": {Id: "t1", Name: "team"}},
+			users: map[string]UserDetail{"u1": {Id: "u1", UserName: "user"}},
+			// the posts of channels that aren't listed, like archived channels, still exist
+			posts: map[string]PostDetail{
+				"archived": {Id: "archived", UserId: "u1", ChannelId: "c3", Message: "archived message", UpdateAt: 60},
+			},
+		},
+		channelList: []MattermostChannel{
+			{Id: "c1", Type: "O", TeamId: "t1"},
+			{Id: "c2", Type: "P", TeamId: "t1"},
+		},
+		channelPosts: map[string][]Post{
+			"c1": {
+				{Id: "unchanged", UserId: "u1", ChannelId: "c1", Message: "hello", UpdateAt: 10},
+				{Id: "edited", UserId: "u1", ChannelId: "c1", Message: "edited message", UpdateAt: 20},
+				{Id: "missing", UserId: "u1", ChannelId: "c1", Message: "not embedded yet", UpdateAt: 30},
+				{Id: "system", UserId: "u1", ChannelId: "c1", Message: "joined the channel", Type: "system_join_channel", UpdateAt: 40},
+			},
+			// the channel was made private after its posts were embedded
+			"c2": {
+				{Id: "made-private", UserId: "u1", ChannelId: "c2", Message: "secret", UpdateAt: 50},
+			},
+		},
+	}
+
+	assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{
+		{Id: "unchanged", UserId: "u1", ChannelId: "c1", Message: "hello", UpdateAt: 10},
+		{Id: "edited", UserId: "u1", ChannelId: "c1", Message: "message", UpdateAt: 15},
+		{Id: "system", UserId: "u1", ChannelId: "c1", Message: "joined the channel", UpdateAt: 40},
+		{Id: "deleted", UserId: "u1", ChannelId: "c1", Message: "deleted message", UpdateAt: 5},
+		{Id: "archived", UserId: "u1", ChannelId: "c3", Message: "archived message", UpdateAt: 60},
+	}, "pub", "t1", client))
+	assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{
+		{Id: "made-private", UserId: "u1", ChannelId: "c2", Message: "secret", UpdateAt: 50},
+	}, "pub", "t1", client))
+
+	sync := &Sync{mmClient: client, vectorStore: vectorStore}
+
+	report := ReconcileReport{}
+	assert.Nil(t, sync.Reconcile(ctx, &report))
+	assert.Equal(t, ReconcileReport{Channels: 2, Posts: 4, Missing: 1, Stale: 2, Orphaned: 2, Unlisted: 1}, report)
+
+	metadatas, err := vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+	assert.Nil(t, err)
+	assert.Len(t, metadatas, 5)
+	assert.Contains(t, metadatas, "archived")
+	assert.Equal(t, float64(20), metadatas["edited"]["update_at"])
+	assert.Equal(t, float64(30), metadatas["missing"]["update_at"])
+	assert.Equal(t, "pri", metadatas["made-private"]["access"])
+	assert.NotContains(t, metadatas, "deleted")
+	assert.NotContains(t, metadatas, "system")
+
+	t.Run("documents with an older metadata schema are stale", func(t *testing.T) {
+		assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{
+			{Id: "unchanged", UserId: "u1", ChannelId: "c1", Message: "hello", UpdateAt: 10},
+		}, "pub", "t1", nil))
+
+		report := ReconcileReport{}
+		assert.Nil(t, sync.Reconcile(ctx, &report))
+		assert.Equal(t, ReconcileReport{Channels: 2, Posts: 4, Stale: 1, Unlisted: 1}, report)
+
+		metadatas, err := vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+		assert.Nil(t, err)
+		assert.Equal(t, "town-square", metadatas["unchanged"]["channel_name"])
+	})
+
+	t.Run("documents with new reactions or replies are stale", func(t *testing.T) {
+		client.channelPosts["c1"][0].ReactionCount = 2
+		client.channelPosts["c1"][0].IsPinned = true
+
+		report := ReconcileReport{}
+		assert.Nil(t, sync.Reconcile(ctx, &report))
+		assert.Equal(t, ReconcileReport{Channels: 2, Posts: 4, Stale: 1, Unlisted: 1}, report)
+
+		metadatas, err := vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+		assert.Nil(t, err)
+		reactionCount, _ := metadataNumber(metadatas["unchanged"]["reaction_count"])
+		assert.Equal(t, float64(2), reactionCount)
+		assert.Equal(t, true, metadatas["unchanged"]["is_pinned"])
+	})
+
+	t.Run("nothing to fix once reconciled", func(t *testing.T) {
+		report := ReconcileReport{}
+		assert.Nil(t, sync.Reconcile(ctx, &report))
+		assert.Equal(t, ReconcileReport{Channels: 2, Posts: 4, Unlisted: 1}, report)
+	})
+}
+
+func TestReconcilePaging(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer store.Close()
+	vectorStore := newEmbeddedVectorStore(newEmbeddedVectorIndex(store), nil)
+
+	posts := []Post{}
+	for i := 0; i <= reconcilePerPage; i++ {
+		posts = append(posts, Post{Id: fmt.Sprintf("post%v", i), UserId: "u1", ChannelId: "c1", Message: fmt.Sprintf("message %v", i), UpdateAt: 10})
+	}
+
+	client := &pagedMattermostClient{
+		fakeMattermostClient: fakeMattermostClient{
+			channels: map[string]ChannelDetail{"c1": {Id: "c1", Type: "O", Name: "town-square", TeamId: "t1"}},
+			teams:    map[string]TeamDetail{"t1": {Id: "t1", Name: "team"}},
+			users:    map[string]UserDetail{"u1": {Id: "u1", UserName: "user"}},
+		},
+		channelList:  []MattermostChannel{{Id: "c1", Type: "O", TeamId: "t1"}},
+		channelPosts: map[string][]Post{"c1": posts},
+	}
+
+	// the latest post is deleted after the first page, which moves the posts of the next pages
+	client.afterPage = func(channelId string) {
+		client.channelPosts[channelId] = posts[1:]
+	}
+
+	sync := &Sync{mmClient: client, vectorStore: vectorStore}
+
+	report := ReconcileReport{}
+	assert.Nil(t, sync.Reconcile(ctx, &report))
+	assert.Equal(t, reconcilePerPage+1, report.Posts)
+
+	metadatas, err := vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+	assert.Nil(t, err)
+	assert.Contains(t, metadatas, posts[reconcilePerPage].Id)
+}
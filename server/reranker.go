@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reranker scores how relevant each document is to a query, usually with a cross-encoder model
+// that reads the query and the document together. It orders question-style queries better than
+// the similarity of their embeddings.
+type Reranker interface {
+	// Rerank returns the score of each document, in the order of the documents.
+	// It returns nil if the documents are kept in their order.
+	Rerank(ctx context.Context, query string, documents []string) ([]float64, error)
+}
+
+// number of results reranked if it's not configured
+const defaultRerankCandidates = 50
+
+// Create the reranker defined in the plugin configuration.
+// The search results keep their order if no rerank model is configured.
+func NewReranker(config *configuration) Reranker {
+	if config.RerankModel == "" {
+		return NoopReranker{}
+	}
+
+	baseURL := config.RerankURL
+	if baseURL == "" {
+		baseURL = "https://api.cohere.com/v1"
+	}
+
+	return NewHTTPReranker(baseURL, config.RerankModel, config.RerankAPIKey)
+}
+
+// ---------------- Noop Reranker ----------------
+
+// NoopReranker keeps the results in their order
+type NoopReranker struct{}
+
+func (NoopReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	return nil, nil
+}
+
+// ---------------- HTTP Reranker ----------------
+
+// HTTPReranker uses the `/rerank` endpoint of the Cohere, Jina, Voyage and vLLM style rerank APIs
+type HTTPReranker struct {
+	baseURL    string
+	model      string
+	apiKey     string
+	httpClient *http.Client
+}
+
+type rerankRequest struct {
+	Model     string   `json:"model"`
+	Query     string   `json:"query"`
+	Documents []string `json:"documents"`
+	TopN      int      `json:"top_n"`
+}
+
+type rerankResult struct {
+	Index          int     `json:"index"`
+	RelevanceScore float64 `json:"relevance_score"`
+}
+
+// the results are in "results", or in "data" for the Voyage API
+type rerankResponse struct {
+	Results []rerankResult `json:"results"`
+	Data    []rerankResult `json:"data"`
+}
+
+func NewHTTPReranker(baseURL string, model string, apiKey string) *HTTPReranker {
+	return &HTTPReranker{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		model:      model,
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (reranker *HTTPReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	if len(documents) == 0 {
+		return []float64{}, nil
+	}
+
+	headers := map[string]string{}
+	if reranker.apiKey != "" {
+		headers["Authorization"] = "Bearer " + reranker.apiKey
+	}
+
+	rerankRes := rerankResponse{}
+	err := postJSON(ctx, reranker.httpClient, reranker.baseURL+"/rerank", headers, rerankRequest{
+		Model:     reranker.model,
+		Query:     query,
+		Documents: documents,
+		TopN:      len(documents),
+	}, &rerankRes)
+	if err != nil {
+		return nil, err
+	}
+
+	results := rerankRes.Results
+	if len(results) == 0 {
+		results = rerankRes.Data
+	}
+
+	if len(results) != len(documents) {
+		return nil, fmt.Errorf("reranker: expected %d scores, got %d", len(documents), len(results))
+	}
+
+	// the results are sorted by relevance, so they are placed using their index
+	scores := make([]float64, len(documents))
+	for _, result := range results {
+		if result.Index < 0 || result.Index >= len(scores) {
+			return nil, fmt.Errorf("reranker: document index out of range: %d", result.Index)
+		}
+		scores[result.Index] = result.RelevanceScore
+	}
+
+	return scores, nil
+}
+
+// Rerank the first candidates results, which are put before the others. The results keep their
+// order if the reranker doesn't score them.
+func rerankResults(ctx context.Context, reranker Reranker, query string, results []searchResult, candidates int) ([]searchResult, error) {
+	if candidates > len(results) {
+		candidates = len(results)
+	}
+
+	documents := []string{}
+	for _, result := range results[:candidates] {
+		documents = append(documents, result.Document)
+	}
+
+	scores, err := reranker.Rerank(ctx, query, documents)
+	if err != nil || scores == nil {
+		return results, err
+	}
+
+	rerankedResults := append([]searchResult{}, results[:candidates]...)
+	for i := range rerankedResults {
+		rerankedResults[i].Scores.Rerank = scores[i]
+	}
+
+	sort.SliceStable(rerankedResults, func(i, j int) bool {
+		return rerankedResults[i].Scores.Rerank > rerankedResults[j].Scores.Rerank
+	})
+
+	for i := range rerankedResults {
+		rerankedResults[i].Scores.RerankRank = i + 1
+	}
+
+	return append(rerankedResults, results[candidates:]...), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReranker(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(NoopReranker{}, NewReranker(&configuration{}))
+
+	reranker := NewReranker(&configuration{RerankModel: "rerank-test", RerankURL: "http://localhost:8080/v1/"})
+	assert.Equal("http://localhost:8080/v1", reranker.(*HTTPReranker).baseURL)
+}
+
+func TestHTTPReranker(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, resultsKey := range []string{"results", "data"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal("/rerank", r.URL.Path)
+			assert.Equal("Bearer key", r.Header.Get("Authorization"))
+
+			request := rerankRequest{}
+			assert.Nil(json.NewDecoder(r.Body).Decode(&request))
+			assert.Equal("rerank-test", request.Model)
+			assert.Equal("when is the release?", request.Query)
+			assert.Equal([]string{"lunch menu", "release is on friday"}, request.Documents)
+
+			// sorted by relevance, like the rerank APIs
+			w.Write([]byte(`{"` + resultsKey + `": [{"index": 1, "relevance_score": 0.9}, {"index": 0, "relevance_score": 0.1}]}`))
+		}))
+
+		reranker := NewHTTPReranker(server.URL, "rerank-test", "key")
+		scores, err := reranker.Rerank(context.Background(), "when is the release?", []string{"lunch menu", "release is on friday"})
+		assert.Nil(err)
+		assert.Equal([]float64{0.1, 0.9}, scores)
+
+		server.Close()
+	}
+}
+
+// fakeReranker scores the documents with a fixed score per document
+type fakeReranker struct {
+	scores map[string]float64
+	err    error
+}
+
+func (reranker fakeReranker) Rerank(ctx context.Context, query string, documents []string) ([]float64, error) {
+	if reranker.err != nil {
+		return nil, reranker.err
+	}
+
+	scores := []float64{}
+	for _, document := range documents {
+		scores = append(scores, reranker.scores[document])
+	}
+
+	return scores, nil
+}
+
+func TestRerankResults(t *testing.T) {
+	results := []searchResult{
+		{Id: "1", Document: "lunch menu", Scores: ScoreBreakdown{Vector: 0.9}},
+		{Id: "2", Document: "release date", Scores: ScoreBreakdown{Vector: 0.85}},
+		{Id: "3", Document: "release is on friday", Scores: ScoreBreakdown{Vector: 0.8}},
+		{Id: "4", Document: "not a candidate", Scores: ScoreBreakdown{Vector: 0.7}},
+	}
+	reranker := fakeReranker{scores: map[string]float64{"lunch menu": 0.1, "release date": 0.5, "release is on friday": 0.9, "not a candidate": 1}}
+
+	rerankedResults, err := rerankResults(context.Background(), reranker, "when is the release?", results, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3", "2", "1", "4"}, flattenIds(rerankedResults))
+
+	// both scores are kept
+	assert.Equal(t, ScoreBreakdown{Vector: 0.8, Rerank: 0.9, RerankRank: 1}, rerankedResults[0].Scores)
+	assert.Equal(t, ScoreBreakdown{Vector: 0.7}, rerankedResults[3].Scores)
+	assert.Equal(t, "0.900000", formatRerankScore(rerankedResults[0].Scores))
+	assert.Equal(t, "", formatRerankScore(rerankedResults[3].Scores))
+
+	t.Run("keeps the order without scores", func(t *testing.T) {
+		for _, reranker := range []Reranker{NoopReranker{}, fakeReranker{err: errors.New("unavailable")}} {
+			rerankedResults, _ := rerankResults(context.Background(), reranker, "query", results, 10)
+			assert.Equal(t, []string{"1", "2", "3", "4"}, flattenIds(rerankedResults))
+		}
+	})
+}
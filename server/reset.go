@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// ResetScope selects the documents removed by a reset. The empty scope removes the plugin's
+// collections, and a team or channel scope only removes the mattermost posts of that team or channel.
+type ResetScope struct {
+	// mattermost or slack, both sources if it's empty
+	Source    string
+	TeamId    string
+	ChannelId string
+}
+
+// ResetReport tells what a reset removed, or would remove if it's a dry run
+type ResetReport struct {
+	DryRun bool `json:"dry_run"`
+	// collection type -> number of documents. -1 if they couldn't be counted,
+	// since they were embedded with another model than the configured one
+	Documents map[string]int `json:"documents"`
+	// channels whose sync cursor is cleared, so their posts are fetched again on the next sync
+	Channels []string `json:"channels"`
+}
+
+// Parse the scope of a reset from the source, team_id and channel_id query parameters
+func parseResetScope(queryFields url.Values) (ResetScope, error) {
+	scope := ResetScope{
+		Source:    queryFields.Get("source"),
+		TeamId:    queryFields.Get("team_id"),
+		ChannelId: queryFields.Get("channel_id"),
+	}
+
+	return scope, scope.IsValid()
+}
+
+func (scope ResetScope) IsValid() error {
+	switch scope.Source {
+	case "", mattermostCollectionType:
+	case slackCollectionType:
+		if scope.TeamId != "" || scope.ChannelId != "" {
+			return errors.New("teams and channels can only be reset for the mattermost source")
+		}
+	default:
+		return fmt.Errorf("source must be either %v or %v: %v", mattermostCollectionType, slackCollectionType, scope.Source)
+	}
+
+	return nil
+}
+
+// Whether the scope covers every document, so the collections can be removed altogether
+func (scope ResetScope) isEverything() bool {
+	return scope == ResetScope{}
+}
+
+func (scope ResetScope) collectionTypes() []string {
+	if scope.Source == slackCollectionType {
+		return []string{slackCollectionType}
+	}
+
+	if scope.Source == mattermostCollectionType || scope.TeamId != "" || scope.ChannelId != "" {
+		return []string{mattermostCollectionType}
+	}
+
+	return []string{mattermostCollectionType, slackCollectionType}
+}
+
+func (scope ResetScope) matches(metadata map[string]interface{}) bool {
+	if scope.TeamId != "" && metadata["team_id"] != scope.TeamId {
+		return false
+	}
+
+	if scope.ChannelId != "" && metadata["channel_id"] != scope.ChannelId {
+		return false
+	}
+
+	return true
+}
+
+// Remove the documents in scope from the vector store and the lexical index, and clear the sync
+// cursors of their channels. Nothing is removed in a dry run, which only reports what would be.
+func (sync *Sync) Reset(ctx context.Context, scope ResetScope, dryRun bool) (ResetReport, error) {
+	report := ResetReport{DryRun: dryRun, Documents: map[string]int{}}
+
+	if err := scope.IsValid(); err != nil {
+		return report, err
+	}
+
+	// collection type -> ids of the documents in scope
+	removedIds := map[string][]string{}
+	for _, collectionType := range scope.collectionTypes() {
+		metadatas, err := sync.vectorStore.GetMetadatas(ctx, collectionType)
+		if errors.Is(err, ErrEmbeddingModelMismatch) && scope.isEverything() {
+			// resetting everything is how the messages get embedded with a new model
+			report.Documents[collectionType] = -1
+			continue
+		} else if err != nil {
+			return report, err
+		}
+
+		for id, metadata := range metadatas {
+			if scope.matches(metadata) {
+				removedIds[collectionType] = append(removedIds[collectionType], id)
+			}
+		}
+		report.Documents[collectionType] = len(removedIds[collectionType])
+	}
+
+	channelIds, err := sync.getResetChannelIds(scope)
+	if err != nil {
+		return report, err
+	}
+	report.Channels = channelIds
+
+	if dryRun {
+		return report, nil
+	}
+
+	if scope.isEverything() {
+		if err := sync.vectorStore.Reset(ctx); err != nil {
+			return report, err
+		}
+
+		if err := GetLexicalIndex().Reset(); err != nil {
+			return report, err
+		}
+	} else {
+		for collectionType, ids := range removedIds {
+			if err := deleteDocuments(ctx, sync.vectorStore, collectionType, ids); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	for _, channelId := range channelIds {
+		if err := sync.store.Delete(syncCursorsBucket, channelId); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// Get the channels in scope that have a sync cursor
+func (sync *Sync) getResetChannelIds(scope ResetScope) ([]string, error) {
+	channelIds := []string{}
+	if scope.Source == slackCollectionType {
+		return channelIds, nil
+	}
+
+	cursors, err := sync.getChannelCursors()
+	if err != nil {
+		return nil, err
+	}
+
+	// the cursors don't record the channels' team
+	teamChannels := map[string]bool{}
+	if scope.TeamId != "" {
+		channels, err := sync.mmClient.GetAllChannels()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, channel := range channels {
+			if channel.TeamId == scope.TeamId {
+				teamChannels[channel.Id] = true
+			}
+		}
+	}
+
+	for channelId := range cursors {
+		if scope.ChannelId != "" && channelId != scope.ChannelId {
+			continue
+		}
+
+		if scope.TeamId != "" && !teamChannels[channelId] {
+			continue
+		}
+
+		channelIds = append(channelIds, channelId)
+	}
+
+	sort.Strings(channelIds)
+	return channelIds, nil
+}
+
+// Parse the dry_run query parameter, false if it's not set
+func parseDryRun(queryFields url.Values) (bool, error) {
+	if !queryFields.Has("dry_run") {
+		return false, nil
+	}
+
+	dryRun, err := strconv.ParseBool(queryFields.Get("dry_run"))
+	if err != nil {
+		return false, fmt.Errorf("dry_run must be true or false: %v", queryFields.Get("dry_run"))
+	}
+
+	return dryRun, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+func TestParseResetScope(t *testing.T) {
+	scope, err := parseResetScope(url.Values{"team_id": {"t1"}})
+	assert.Nil(t, err)
+	assert.Equal(t, ResetScope{TeamId: "t1"}, scope)
+	assert.Equal(t, []string{mattermostCollectionType}, scope.collectionTypes())
+
+	_, err = parseResetScope(url.Values{"source": {"discord"}})
+	assert.NotNil(t, err)
+
+	_, err = parseResetScope(url.Values{"source": {"slack"}, "channel_id": {"c1"}})
+	assert.NotNil(t, err)
+
+	dryRun, err := parseDryRun(url.Values{"dry_run": {"true"}})
+	assert.Nil(t, err)
+	assert.True(t, dryRun)
+
+	_, err = parseDryRun(url.Values{"dry_run": {"maybe"}})
+	assert.NotNil(t, err)
+}
+
+func TestSyncReset(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	newSync := func(t *testing.T) *Sync {
+		vectorsStore, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+		assert.Nil(t, err)
+		t.Cleanup(func() { vectorsStore.Close() })
+
+		syncStore, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-sync"))
+		assert.Nil(t, err)
+		t.Cleanup(func() { syncStore.Close() })
+
+		vectorStore := newEmbeddedVectorStore(newEmbeddedVectorIndex(vectorsStore), nil)
+		assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{
+			{Id: "p1", ChannelId: "c1", Message: "hello"},
+			{Id: "p2", ChannelId: "c1", Message: "world"},
+		}, "pub", "t1", nil))
+		assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{
+			{Id: "p3", ChannelId: "c2", Message: "other team"},
+		}, "pub", "t2", nil))
+		assert.Nil(t, vectorStore.Upsert(ctx, slackCollectionType, []string{"s1"}, []string{"from slack"}, []map[string]interface{}{{"source": "sl"}}))
+
+		sync := &Sync{
+			store:       syncStore,
+			vectorStore: vectorStore,
+			mmClient: &pagedMattermostClient{channelList: []MattermostChannel{
+				{Id: "c1", TeamId: "t1"},
+				{Id: "c2", TeamId: "t2"},
+			}},
+		}
+		assert.Nil(t, sync.setChannelCursor("c1", ChannelCursor{LastUpdateAt: 10}))
+		assert.Nil(t, sync.setChannelCursor("c2", ChannelCursor{LastUpdateAt: 10}))
+
+		return sync
+	}
+
+	countDocuments := func(t *testing.T, sync *Sync, collectionType string) int {
+		metadatas, err := sync.vectorStore.GetMetadatas(ctx, collectionType)
+		assert.Nil(t, err)
+		return len(metadatas)
+	}
+
+	t.Run("a dry run only reports what would be removed", func(t *testing.T) {
+		sync := newSync(t)
+
+		report, err := sync.Reset(ctx, ResetScope{TeamId: "t1"}, true)
+		assert.Nil(t, err)
+		assert.Equal(t, ResetReport{DryRun: true, Documents: map[string]int{mattermostCollectionType: 2}, Channels: []string{"c1"}}, report)
+
+		assert.Equal(t, 3, countDocuments(t, sync, mattermostCollectionType))
+		cursors, err := sync.getChannelCursors()
+		assert.Nil(t, err)
+		assert.Len(t, cursors, 2)
+	})
+
+	t.Run("resets a channel", func(t *testing.T) {
+		sync := newSync(t)
+
+		report, err := sync.Reset(ctx, ResetScope{ChannelId: "c2"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, ResetReport{Documents: map[string]int{mattermostCollectionType: 1}, Channels: []string{"c2"}}, report)
+
+		assert.Equal(t, 2, countDocuments(t, sync, mattermostCollectionType))
+		assert.Equal(t, 1, countDocuments(t, sync, slackCollectionType))
+		cursors, err := sync.getChannelCursors()
+		assert.Nil(t, err)
+		assert.Contains(t, cursors, "c1")
+		assert.NotContains(t, cursors, "c2")
+	})
+
+	t.Run("resets a source", func(t *testing.T) {
+		sync := newSync(t)
+
+		report, err := sync.Reset(ctx, ResetScope{Source: slackCollectionType}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, ResetReport{Documents: map[string]int{slackCollectionType: 1}, Channels: []string{}}, report)
+
+		assert.Equal(t, 3, countDocuments(t, sync, mattermostCollectionType))
+		assert.Equal(t, 0, countDocuments(t, sync, slackCollectionType))
+	})
+
+	t.Run("resets everything", func(t *testing.T) {
+		sync := newSync(t)
+
+		report, err := sync.Reset(ctx, ResetScope{}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, ResetReport{Documents: map[string]int{mattermostCollectionType: 3, slackCollectionType: 1}, Channels: []string{"c1", "c2"}}, report)
+
+		assert.Equal(t, 0, countDocuments(t, sync, mattermostCollectionType))
+		assert.Equal(t, 0, countDocuments(t, sync, slackCollectionType))
+		cursors, err := sync.getChannelCursors()
+		assert.Nil(t, err)
+		assert.Empty(t, cursors)
+	})
+}
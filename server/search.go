@@ -1,24 +1,24 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
-	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// TODO: implement an authentication method to replace the use of this token
-const token = "Bearer k9pf4m4xapfn9m153gr11cy73e"
-
-// TODO: replace this with a dynamic value from the .env file
-const mmAPI = "http://localhost:8065/api/v4"
-
 type UserDetail struct {
 	Id        string `json:"id"`
 	UserName  string `json:"username"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
+	// the name of the user's preferred time zone, empty if it isn't set
+	Timezone string `json:"timezone,omitempty"`
 }
 
 type TeamDetail struct {
@@ -39,211 +39,571 @@ type PostDetail struct {
 	Message   string `json:"message"`
 	UserId    string `json:"user_id"`
 	Type      string `json:"type"`
+	CreateAt  int64  `json:"create_at"`
 	UpdateAt  int64  `json:"update_at"`
 	DeleteAt  int64  `json:"delete_at"`
 	ChannelId string `json:"channel_id"`
+	RootId    string `json:"root_id"`
+	// engagement signals, which boost the post in the search results
+	IsPinned      bool  `json:"is_pinned"`
+	ReplyCount    int64 `json:"reply_count"`
+	ReactionCount int   `json:"reaction_count"`
 }
 
 type MetadataSchema struct {
-	UserId      string `json:"user_id"` // (not necessary for slack)
-	UserName    string `json:"user_name"`
-	UserDmLink  string `json:"user_dm_link"` // (not necessary for slack)
-	ChannelName string `json:"channel_name"`
-	ChannelLink string `json:"channel_link"` // (not necessary for slack)
-	Message     string `json:"message"`
-	MessageLink string `json:"message_link"` // (not necessary for slack)
-	Time        string `json:"time"`
-	Source      string `json:"source"`
-	Access      string `json:"access"`
-	Score       string `json:"score"`
+	UserId      string          `json:"user_id"` // (not necessary for slack)
+	UserName    string          `json:"user_name"`
+	UserDmLink  string          `json:"user_dm_link"` // (not necessary for slack)
+	ChannelName string          `json:"channel_name"`
+	ChannelLink string          `json:"channel_link"` // (not necessary for slack)
+	Message     string          `json:"message"`
+	Highlight   string          `json:"highlight,omitempty"` // the matching chunk of a long message (not necessary for slack)
+	MessageLink string          `json:"message_link"`        // (not necessary for slack)
+	Time        string          `json:"time"`
+	Source      string          `json:"source"`
+	Access      string          `json:"access"`
+	Score       string          `json:"score"`
+	RerankScore string          `json:"rerank_score,omitempty"` // only set if the results were reranked
+	Scores      *ScoreBreakdown `json:"scores,omitempty"`       // only set if the score breakdown is requested
 }
 
 type SearchRespnse struct {
 	Metadatas   []MetadataSchema `json:"context"` // TODO: rename this to metadatas
 	LLMResponse string           `json:"llm"`     // TODO: rename this to llm_response
+	Citations   []Citation       `json:"citations"`
+	NextCursor  string           `json:"next_cursor,omitempty"` // set if there are more results after this page
+}
+
+// Citation maps a message number cited in the llm response, e.g. [1], to the search result it refers to
+type Citation struct {
+	Number       int    `json:"number"`
+	ContextIndex int    `json:"context_index"`
+	MessageLink  string `json:"message_link"`
+}
+
+const noSearchResultsResponse = "Unable to find conversations related to your query."
+
+type SearchOptions struct {
+	WithLLM  bool    // a boolean used to check if the user wants an llm response
+	Limit    int     // the maximum number of results returned, from all sources combined
+	Offset   int     // the number of results to skip, used to get the next pages of results
+	MinScore float64 // the minimum similarity score of a result
+	Filters  SearchFilters
+
+	ExcludedTerms []string // the words and phrases the results must not contain
+
+	LexicalWeight float64     // the weight of the keyword search when ranking the results, between 0 and 1
+	Rerank        bool        // a boolean used to check if the results are reranked by the configured reranker
+	MMRLambda     float64     // the weight of relevance against diversity of the results, between 0 and 1. 1 disables the diversification
+	Boosts        ScoreBoosts // the recency and engagement boosts of the results, which are disabled if they are zero
+	WithScores    bool        // a boolean used to check if the user wants the vector and lexical scores of each result
 }
 
-func Search(query string, userId string) SearchRespnse {
+func (p *Plugin) Search(ctx context.Context, query string, userId string, options SearchOptions) (SearchRespnse, error) {
 	log.Println("Search started ...")
 
+	metadataDetails, nextCursor, err := p.getSearchContext(ctx, query, userId, options)
+	if err != nil {
+		return SearchRespnse{}, err
+	}
+
+	llmResponse := ""
+	if len(metadataDetails) <= 0 {
+		llmResponse = noSearchResultsResponse
+	} else if options.WithLLM {
+		generator, err := NewGenerator(p.getConfiguration())
+		if err != nil {
+			return SearchRespnse{}, err
+		}
+
+		llmResponse, err = getLLMResponse(ctx, generator, query, metadataDetails, nil)
+		if err != nil {
+			return SearchRespnse{}, err
+		}
+	}
+
+	return SearchRespnse{
+		Metadatas:   metadataDetails,
+		LLMResponse: llmResponse,
+		Citations:   extractCitations(llmResponse, metadataDetails),
+		NextCursor:  nextCursor,
+	}, nil
+}
+
+// Get the messages related to the query from the channels the user has access to,
+// sorted by relevance. Also returns the cursor of the next page of results, or an empty cursor if it's the last page
+func (p *Plugin) getSearchContext(ctx context.Context, query string, userId string, options SearchOptions) ([]MetadataSchema, string, error) {
+	mmClient := p.mmClient
+
 	// get list of channels the user belongs to
-	// TODO: implement this function
-	mmChannelIds := getUserChannels(userId)
+	mmChannelIds, err := getUserChannels(mmClient, userId)
+	if err != nil {
+		return nil, "", err
+	}
 
 	log.Printf("number of channels: %v", len(mmChannelIds))
 
-	client := GetChromaInstance()
+	// fetch enough results from each search to fill the requested page, and one more to know if there's a next page
+	nResults := options.Offset + options.Limit + 1
 
-	// search the chroma collection using the query provided while filtering the result by channel_id the user belongs to
-	response := client.Query(query, mmChannelIds)
+	// reranking and diversification reorder a larger pool of candidates, which holds the requested page
+	candidates := nResults
+	if options.Rerank && p.getConfiguration().getRerankCandidates() > candidates {
+		candidates = p.getConfiguration().getRerankCandidates()
+	}
+	if options.MMRLambda < 1 && defaultMMRCandidates > candidates {
+		candidates = defaultMMRCandidates
+	}
+	nResults = candidates
+
+	// the chunks of a post are collapsed and some posts can be excluded, which leaves fewer posts than
+	// documents. The search is repeated with more documents until there are enough posts, or no more matches
+	var results []searchResult
+	for {
+		var isComplete bool
+		results, isComplete, err = p.searchDocuments(ctx, query, mmChannelIds, nResults, options)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if isComplete || len(results) >= candidates || nResults >= maxSearchDocuments {
+			break
+		}
 
-	// join the documents from the chroma result using "\n" and store it as a context to feed it to LLM
-	llmContext := ""
-	for _, documents := range response.Documents {
-		for _, document := range documents {
-			llmContext += document + "\n"
+		nResults *= 2
+		if nResults > maxSearchDocuments {
+			nResults = maxSearchDocuments
 		}
 	}
 
-	formattedDocuments := []string{}
-	for _, documents := range response.Documents {
-		formattedDocuments = append(formattedDocuments, documents...)
+	if options.Rerank {
+		// the results keep their order if they can't be reranked
+		results, err = rerankResults(ctx, NewReranker(p.getConfiguration()), query, results, candidates)
+		if err != nil {
+			log.Printf("error while reranking the search results: %v \n", err)
+		}
 	}
 
-	formattedMetadatas := []map[string]interface{}{}
-	for _, metadatas := range response.Metadatas {
-		formattedMetadatas = append(formattedMetadatas, metadatas...)
+	if options.Boosts.isEnabled() {
+		results = boostResults(results, options.Boosts, time.Now(), candidates)
 	}
 
-	formattedIds := []string{}
-	for _, ids := range response.Ids {
-		formattedIds = append(formattedIds, ids...)
+	if options.MMRLambda < 1 {
+		pool := results
+		if len(pool) > candidates {
+			pool = pool[:candidates]
+		}
+
+		// the results keep their order if their embeddings can't be found
+		embeddings, err := getResultEmbeddings(ctx, p.vectorStore, pool)
+		if err != nil {
+			log.Printf("error while getting the embeddings of the search results: %v \n", err)
+		} else {
+			results = diversifyResults(results, embeddings, options.MMRLambda, candidates)
+		}
 	}
 
-	formattedDistances := []float32{}
-	for _, distances := range response.Distances {
-		formattedDistances = append(formattedDistances, distances...)
+	results, hasNextPage := paginateResults(results, options.Offset, options.Limit)
+
+	nextCursor := ""
+	if hasNextPage {
+		nextCursor = encodeSearchCursor(options.Offset + options.Limit)
 	}
 
-	metadataDetails := []MetadataSchema{}
-	for idx, formattedMetadata := range formattedMetadatas {
-		// format the metadata using the metadata schema for mattermost data
-		if formattedMetadata["source"].(string) == "mm" {
-			// get message details
-			postDetail := getPostDetails(formattedIds[idx])
+	metadataDetails := formatSearchResults(mmClient, results, options.WithScores)
+
+	return metadataDetails, nextCursor, nil
+}
+
+// Search the documents matching the query in the vector store and the lexical index, and get the
+// best result of each post. Also returns whether every matching document was found, when the
+// searches returned fewer than nResults documents.
+func (p *Plugin) searchDocuments(ctx context.Context, query string, mmChannelIds []interface{}, nResults int, options SearchOptions) ([]searchResult, bool, error) {
+	// search the chroma collection using the query provided while filtering the result by channel_id the user belongs to
+	results, err := p.vectorStore.Query(ctx, query, mmChannelIds, nResults, options.MinScore, options.Filters)
+	if err != nil {
+		return nil, false, err
+	}
+	isComplete := len(results) < nResults
+
+	// drop any result the user isn't allowed to see, in case the query wasn't filtered
+	results = filterAccessibleResults(results, mmChannelIds)
+
+	// merge the messages containing the query's keywords, searched in each source like the collections
+	if options.LexicalWeight > 0 {
+		lexicalResults := []LexicalResult{}
+		for _, source := range []string{"mm", "sl"} {
+			sourceFilters := options.Filters
+			if sourceFilters.Source != "" && sourceFilters.Source != source {
+				continue
+			}
+			sourceFilters.Source = source
+
+			sourceResults := GetLexicalIndex().Search(query, nResults, func(metadata map[string]interface{}) bool {
+				return sourceFilters.matches(metadata, mmChannelIds)
+			})
+			isComplete = isComplete && len(sourceResults) < nResults
+			lexicalResults = append(lexicalResults, sourceResults...)
+		}
 
-			//get user details
-			userDetail := getUserDetails(formattedMetadata["user_id"].(string))
+		sort.SliceStable(lexicalResults, func(i, j int) bool {
+			return lexicalResults[i].Score > lexicalResults[j].Score
+		})
 
-			//get channel details
-			channelDetail := getChannelDetails(formattedMetadata["channel_id"].(string))
+		results = fuseResults(results, lexicalSearchResults(lexicalResults), options.LexicalWeight)
+	}
 
-			// get team details
-			teamDetail := getTeamDetails(channelDetail.TeamId)
+	// the posts are excluded with all their chunks, before their best chunk is kept
+	results = excludeResults(p.mmClient, results, options.ExcludedTerms)
 
-			linkURL := "http://localhost:8065/" + teamDetail.Name
+	// a post is returned once, for its best matching chunk
+	results = collapsePostChunks(results)
+
+	return results, isComplete, nil
+}
+
+// Names shown with a mattermost search result
+type resultNames struct {
+	UserName    string
+	Username    string
+	ChannelName string
+	TeamName    string
+}
+
+// Format the search results using the metadata schema. The posts of the results are looked up at
+// once, and so are the users of the documents embedded before their names were stored in the metadata.
+func formatSearchResults(mmClient MattermostClient, results []searchResult, withScores bool) []MetadataSchema {
+	postIds := []string{}
+	userIds := []string{}
+	for _, result := range results {
+		if result.Metadata["source"] != "mm" {
+			continue
+		}
+
+		postIds = append(postIds, documentPostId(result.Id, result.Metadata))
+		if userId, ok := result.Metadata["user_id"].(string); ok && getMetadataSchemaVersion(result.Metadata) < metadataSchemaVersion {
+			userIds = append(userIds, userId)
+		}
+	}
+
+	posts, err := getPostsDetails(mmClient, postIds)
+	if err != nil {
+		log.Printf("error while trying to get post details: %v \n", err)
+	}
+
+	users, err := getUsersDetails(mmClient, userIds)
+	if err != nil {
+		log.Printf("error while trying to get user details: %v \n", err)
+	}
+
+	metadataDetails := []MetadataSchema{}
+	for _, result := range results {
+		formattedMetadata := result.Metadata
+
+		var scores *ScoreBreakdown
+		if withScores {
+			resultScores := result.Scores
+			scores = &resultScores
+		}
+
+		// the results whose metadata is missing fields are skipped
+		source, _ := formattedMetadata["source"].(string)
+		access, hasAccess := formattedMetadata["access"].(string)
+		if !hasAccess {
+			log.Printf("error while formatting result %v: its metadata has no access \n", result.Id)
+			continue
+		}
+
+		// format the metadata using the metadata schema for mattermost data
+		if source == "mm" {
+			// the post was deleted, or couldn't be found
+			postDetail, ok := posts[documentPostId(result.Id, formattedMetadata)]
+			if !ok {
+				continue
+			}
+
+			userId, ok := formattedMetadata["user_id"].(string)
+			if !ok {
+				log.Printf("error while formatting result %v: its metadata has no user_id \n", result.Id)
+				continue
+			}
+
+			names, err := getResultNames(mmClient, formattedMetadata, users)
+			if err != nil {
+				log.Printf("error while trying to get the names of post %v: %v \n", postDetail.Id, err)
+				continue
+			}
+
+			links := getResultLinks(mmClient.GetSiteURL(), names, postDetail.Id)
 
 			// format the metadata
 			metadataDetails = append(metadataDetails, MetadataSchema{
-				UserId:      userDetail.Id,
-				UserName:    userDetail.FirstName + userDetail.LastName,
-				UserDmLink:  linkURL + "/messages/@" + userDetail.UserName,
-				ChannelName: channelDetail.Name,
-				ChannelLink: linkURL + "/channels/" + channelDetail.Name,
-				Message:     formattedDocuments[idx],
-				MessageLink: linkURL + "/pl/" + postDetail.Id,
+				UserId:      userId,
+				UserName:    names.UserName,
+				UserDmLink:  links.UserDmLink,
+				ChannelName: names.ChannelName,
+				ChannelLink: links.ChannelLink,
+				Message:     postDetail.Message,
+				Highlight:   getDocumentHighlight(postDetail.Message, formattedMetadata),
+				MessageLink: links.MessageLink,
 				Time:        time.Unix(postDetail.UpdateAt/1000, 0).Format(time.RFC822),
-				Source:      formattedMetadata["source"].(string),
-				Access:      formattedMetadata["access"].(string),
-				Score:       fmt.Sprintf("%f", (1 - formattedDistances[idx])),
+				Source:      source,
+				Access:      access,
+				Score:       formatScore(result.Scores),
+				RerankScore: formatRerankScore(result.Scores),
+				Scores:      scores,
 			})
-		} else if formattedMetadata["source"].(string) == "sl" {
+		} else if source == "sl" {
+			userName, hasUserName := formattedMetadata["user_name"].(string)
+			channelName, hasChannelName := formattedMetadata["channel_name"].(string)
+			msgDate, hasMsgDate := metadataNumber(formattedMetadata["msg_date"])
+			if !hasUserName || !hasChannelName || !hasMsgDate {
+				log.Printf("error while formatting result %v: its metadata is missing the user name, channel name or date \n", result.Id)
+				continue
+			}
+
 			metadataDetails = append(metadataDetails, MetadataSchema{
-				UserName:    formattedMetadata["user_name"].(string),
-				ChannelName: formattedMetadata["channel_name"].(string),
-				Message:     formattedDocuments[idx],
-				Time:        time.Unix((int64)(formattedMetadata["msg_date"].(float64)), 0).Format(time.RFC822),
-				Source:      formattedMetadata["source"].(string),
-				Access:      formattedMetadata["access"].(string),
-				Score:       fmt.Sprintf("%f", (1 - formattedDistances[idx])),
+				UserName:    userName,
+				ChannelName: channelName,
+				Message:     result.Document,
+				Time:        time.Unix(int64(msgDate), 0).Format(time.RFC822),
+				Source:      source,
+				Access:      access,
+				Score:       formatScore(result.Scores),
+				RerankScore: formatRerankScore(result.Scores),
+				Scores:      scores,
 			})
 		}
+	}
+
+	return metadataDetails
+}
+
+// Get the names of a mattermost result's user, channel and team from its metadata, or look them up
+// if the document was embedded before they were stored. users holds the users already looked up.
+func getResultNames(mmClient MattermostClient, metadata map[string]interface{}, users map[string]UserDetail) (resultNames, error) {
+	if getMetadataSchemaVersion(metadata) >= metadataSchemaVersion {
+		names := resultNames{}
+		for _, name := range []struct {
+			key    string
+			parsed *string
+		}{
+			{"user_display_name", &names.UserName},
+			{"username", &names.Username},
+			{"channel_name", &names.ChannelName},
+			{"team_name", &names.TeamName},
+		} {
+			value, ok := metadata[name.key].(string)
+			if !ok {
+				return resultNames{}, fmt.Errorf("the metadata has no %v", name.key)
+			}
+			*name.parsed = value
+		}
 
+		return names, nil
 	}
 
-	// TODO: replace this with a dynamic value
-	withLLM := false // a boolean used to check if the user wants an llm response
-	llmResponse := ""
-	if llmContext == "" && len(metadataDetails) <= 0 {
-		llmResponse = "Unable to find conversations related to your query."
-	} else if withLLM {
-		// TODO: implement this function
-		llmResponse = getLLMResponse(llmContext, query)
+	userId, _ := metadata["user_id"].(string)
+	userDetail, ok := users[userId]
+	if !ok {
+		return resultNames{}, fmt.Errorf("user %v not found", userId)
 	}
 
-	return SearchRespnse{
-		Metadatas:   metadataDetails,
-		LLMResponse: llmResponse,
+	channelId, ok := metadata["channel_id"].(string)
+	if !ok {
+		return resultNames{}, fmt.Errorf("the metadata has no channel_id")
+	}
+
+	channelDetail, err := mmClient.GetChannelDetails(channelId)
+	if err != nil {
+		return resultNames{}, err
 	}
-}
 
-func getLLMResponse(llmContext, query string) string {
-	// TODO: implement this
+	// direct and group channels have no team
+	teamDetail := TeamDetail{}
+	if channelDetail.TeamId != "" {
+		teamDetail, err = mmClient.GetTeamDetails(channelDetail.TeamId)
+		if err != nil {
+			return resultNames{}, err
+		}
+	}
 
-	return "llm response"
+	return resultNames{
+		UserName:    userDisplayName(userDetail),
+		Username:    userDetail.UserName,
+		ChannelName: channelDetail.Name,
+		TeamName:    teamDetail.Name,
+	}, nil
 }
 
-func getDetails(reqUrl string, returnDetail interface{}) {
-	req, err := http.NewRequest(http.MethodGet, reqUrl, nil)
-	if err != nil {
-		log.Fatalf("client: could not create request: %s\n", err)
+// resultLinks are the links of a mattermost result to its author's direct messages, its channel and the post
+type resultLinks struct {
+	UserDmLink  string
+	ChannelLink string
+	MessageLink string
+}
+
+// Get the links of a mattermost result. Direct and group channels have no team, so their links
+// open the post through the permalink redirect, which picks one of the user's teams.
+func getResultLinks(siteURL string, names resultNames, postId string) resultLinks {
+	if names.TeamName == "" {
+		permalink := siteURL + "/_redirect/pl/" + postId
+		return resultLinks{UserDmLink: permalink, ChannelLink: permalink, MessageLink: permalink}
 	}
 
-	// TODO: implement an authentication method to replace the use of this token
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", token)
+	linkURL := siteURL + "/" + names.TeamName
 
-	client := http.Client{
-		Timeout: 60 * time.Second,
+	return resultLinks{
+		UserDmLink:  linkURL + "/messages/@" + names.Username,
+		ChannelLink: linkURL + "/channels/" + names.ChannelName,
+		MessageLink: linkURL + "/pl/" + postId,
 	}
-	response, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("client: error making http request: %s\n", err)
+}
+
+// Get the name a user is shown with in the search results
+func userDisplayName(user UserDetail) string {
+	return user.FirstName + user.LastName
+}
+
+// Format the similarity score of a result. Results only found by the lexical search have no similarity score.
+func formatScore(scores ScoreBreakdown) string {
+	if scores.VectorRank == 0 && scores.LexicalRank > 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%f", scores.Vector)
+}
+
+// Format the relevance score of a reranked result, or an empty string if the results weren't reranked
+func formatRerankScore(scores ScoreBreakdown) string {
+	if scores.RerankRank == 0 {
+		return ""
 	}
-	// defer response.Body.Close()
 
-	if response.StatusCode != 200 {
-		log.Fatalf("client: Failed to fetch from %v. Status code: %d", reqUrl, response.StatusCode)
+	return fmt.Sprintf("%f", scores.Rerank)
+}
+
+// Generate an answer to the query from the retrieved messages.
+// If onToken is set, the answer is streamed and onToken is called with every generated token.
+func getLLMResponse(ctx context.Context, generator Generator, query string, metadatas []MetadataSchema, onToken func(token string)) (string, error) {
+	if generator == nil {
+		return "", fmt.Errorf("llm response requested, but no llm model is configured")
 	}
 
-	// automatically filters the response body to only include the fields
-	// specified in Channels struct by json tags
-	err = json.NewDecoder(response.Body).Decode(returnDetail)
+	messages, err := buildLLMPrompt(query, metadatas)
 	if err != nil {
-		log.Fatalf("client: could not decode json: %s\n", err)
+		return "", err
+	}
 
+	var llmResponse string
+	if onToken != nil {
+		llmResponse, err = generator.GenerateStream(ctx, messages, onToken)
+	} else {
+		llmResponse, err = generator.Generate(ctx, messages)
 	}
+	if err != nil {
+		return "", fmt.Errorf("error while generating llm response: %v", err)
+	}
+
+	return llmResponse, nil
 }
 
-func getTeamDetails(teamId string) (teamDetail TeamDetail) {
-	reqUrl := mmAPI + "/teams/" + teamId
+var citationRegex = regexp.MustCompile(`\[(\d+)\]`)
+
+// Get the messages cited in the llm response, in the order they are first cited
+func extractCitations(llmResponse string, metadatas []MetadataSchema) []Citation {
+	citations := []Citation{}
+	seenNumbers := map[int]bool{}
 
-	getDetails(reqUrl, &teamDetail)
+	for _, match := range citationRegex.FindAllStringSubmatch(llmResponse, -1) {
+		number, err := strconv.Atoi(match[1])
+		if err != nil || number < 1 || number > len(metadatas) || seenNumbers[number] {
+			continue
+		}
+
+		seenNumbers[number] = true
+		citations = append(citations, Citation{
+			Number:       number,
+			ContextIndex: number - 1,
+			MessageLink:  metadatas[number-1].MessageLink,
+		})
+	}
 
-	return teamDetail
+	return citations
 }
 
-func getChannelDetails(channelId string) (channelDetail ChannelDetail) {
-	reqUrl := mmAPI + "/channels/" + channelId
+// Get the ids of all channels the user is a member of (public, private, direct and group channels)
+func getUserChannels(mmClient MattermostClient, userId string) ([]interface{}, error) {
+	if userId == "" {
+		return nil, fmt.Errorf("user id is required to get the user's channels")
+	}
 
-	getDetails(reqUrl, &channelDetail)
+	channelIds, err := mmClient.GetUserChannelIds(userId)
+	if err != nil {
+		return nil, err
+	}
 
-	return channelDetail
+	return toInterfaceSlice(channelIds), nil
 }
 
-func getUserDetails(userId string) (userDetail UserDetail) {
-	reqUrl := mmAPI + "/users/" + userId
+// Remove mattermost results from channels the user doesn't belong to, and results from
+// other sources that aren't public
+func filterAccessibleResults(results []searchResult, mmChannelIds []interface{}) []searchResult {
+	userChannels := map[string]bool{}
+	for _, channelId := range mmChannelIds {
+		if id, ok := channelId.(string); ok {
+			userChannels[id] = true
+		}
+	}
+
+	filteredResults := []searchResult{}
+	for _, result := range results {
+		source, _ := result.Metadata["source"].(string)
+		access, _ := result.Metadata["access"].(string)
+		channelId, _ := result.Metadata["channel_id"].(string)
 
-	getDetails(reqUrl, &userDetail)
+		if source == "mm" && !userChannels[channelId] {
+			continue
+		}
+		if source != "mm" && access != "pub" {
+			continue
+		}
 
-	return userDetail
+		filteredResults = append(filteredResults, result)
+	}
+
+	return filteredResults
 }
 
-func getPostDetails(postId string) (postDetail PostDetail) {
-	reqUrl := mmAPI + "/posts/" + postId
+// Get the page of results starting at offset. Also returns true if there are more results after the page
+func paginateResults(results []searchResult, offset int, limit int) ([]searchResult, bool) {
+	if offset >= len(results) {
+		return []searchResult{}, false
+	}
 
-	getDetails(reqUrl, &postDetail)
+	end := offset + limit
+	if end >= len(results) {
+		return results[offset:], false
+	}
 
-	return postDetail
+	return results[offset:end], true
 }
 
-func getUserChannels(userId string) []interface{} {
-	// TODO: implement this
+// The search cursor is an opaque token holding the offset of the next page
+func encodeSearchCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
 
-	// handle the errors in here using log.fatal
+func decodeSearchCursor(cursor string) (int, error) {
+	decodedCursor, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("invalid search cursor")
+	}
 
-	return []interface{}{
-		// "9unddga5zin75goadjbwipz9tr",
-		// "jdwhwtegcpb3tei871ohw9sz9y",
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(decodedCursor), "offset:"))
+	if err != nil || !strings.HasPrefix(string(decodedCursor), "offset:") || offset < 0 {
+		return 0, fmt.Errorf("invalid search cursor")
 	}
+
+	return offset, nil
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Search handler that streams its response as server-sent events.
+//
+// The retrieved messages are sent first in an "onContext" event, followed by the llm
+// response in "onToken" events as the tokens are generated, and finally an "onDone"
+// event with the full llm response and its citations.
+func (p *Plugin) handleSearchStream(w http.ResponseWriter, r *http.Request) {
+	hasQuery := r.URL.Query().Has("query")
+	if !hasQuery {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query().Get("query")
+
+	userId := r.Header.Get("Mattermost-User-ID")
+
+	options, err := p.parseSearchOptions(r)
+	if err != nil {
+		writeSearchError(w, http.StatusBadRequest, SearchError{Code: "invalid_request", Message: err.Error()})
+		return
+	}
+
+	// search the free text of the query with the filters of its search operators
+	query, err = p.applySearchOperators(query, userId, &options)
+	if err != nil {
+		writeSearchError(w, http.StatusBadRequest, SearchError{Code: "invalid_request", Message: err.Error()})
+		return
+	}
+
+	// Set the headers related to event streaming.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Flush the events as they are written, when the writer supports it
+	flusher, _ := w.(http.Flusher)
+
+	// Create a channel in which the handler receives the events of the search
+	messageChan := make(MessageChan)
+
+	go p.streamSearch(r.Context(), query, userId, options, messageChan)
+
+	// Write the events until the search is done and the channel is closed
+	for msg := range messageChan {
+		msgJSON, jsonError := json.Marshal(msg)
+		if jsonError != nil {
+			log.Printf("error while trying to encode search event: %v \n", jsonError)
+			continue
+		}
+
+		fmt.Fprintf(w, "event: %v\n", msg["event"])
+		fmt.Fprintf(w, "data: %s\n\n", msgJSON)
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	log.Println("Finished HTTP request at ", r.URL.Path)
+}
+
+// Run the search and send its events to messageChan. The channel is closed when the search is done.
+func (p *Plugin) streamSearch(ctx context.Context, query string, userId string, options SearchOptions, messageChan MessageChan) {
+	defer close(messageChan)
+
+	// stop sending events once the client disconnects
+	send := func(msg map[string]interface{}) {
+		select {
+		case messageChan <- msg:
+		case <-ctx.Done():
+		}
+	}
+
+	sendError := func(err error) {
+		log.Printf("error while streaming search: %v \n", err)
+		searchError := newSearchError(err)
+		send(map[string]interface{}{
+			"event": "onError",
+			"error": searchError.Message,
+			"code":  searchError.Code,
+		})
+	}
+
+	metadataDetails, nextCursor, err := p.getSearchContext(ctx, query, userId, options)
+	if err != nil {
+		sendError(err)
+		return
+	}
+
+	send(map[string]interface{}{
+		"event":       "onContext",
+		"context":     metadataDetails,
+		"next_cursor": nextCursor,
+	})
+
+	llmResponse := ""
+	if len(metadataDetails) <= 0 {
+		llmResponse = noSearchResultsResponse
+	} else if options.WithLLM {
+		generator, err := NewGenerator(p.getConfiguration())
+		if err != nil {
+			sendError(err)
+			return
+		}
+
+		llmResponse, err = getLLMResponse(ctx, generator, query, metadataDetails, func(token string) {
+			send(map[string]interface{}{
+				"event": "onToken",
+				"token": token,
+			})
+		})
+		if err != nil {
+			sendError(err)
+			return
+		}
+	}
+
+	send(map[string]interface{}{
+		"event":     "onDone",
+		"isDone":    true,
+		"llm":       llmResponse,
+		"citations": extractCitations(llmResponse, metadataDetails),
+	})
+}
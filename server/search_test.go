@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	chroma "github.com/amikos-tech/chroma-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+// fakeMattermostClient is an in-memory MattermostClient used in tests
+type fakeMattermostClient struct {
+	channels     map[string]ChannelDetail
+	teams        map[string]TeamDetail
+	users        map[string]UserDetail
+	posts        map[string]PostDetail
+	userChannels map[string][]string
+}
+
+func (client *fakeMattermostClient) GetAllChannels() ([]MattermostChannel, error) {
+	channels := []MattermostChannel{}
+	for _, channel := range client.channels {
+		channels = append(channels, MattermostChannel{Id: channel.Id, Type: channel.Type, DisplayName: channel.DisplayName})
+	}
+
+	return channels, nil
+}
+
+func (client *fakeMattermostClient) FetchPostsForPage(channelId string, since int64, page int, perPage int) (PostResponse, error) {
+	postRes := PostResponse{Posts: map[string]Post{}}
+	if page > 0 {
+		return postRes, nil
+	}
+
+	for _, post := range client.posts {
+		if post.ChannelId == channelId && post.UpdateAt > since {
+			postRes.Order = append(postRes.Order, post.Id)
+			postRes.Posts[post.Id] = Post(post)
+		}
+	}
+
+	return postRes, nil
+}
+
+func (client *fakeMattermostClient) FetchPostsBefore(channelId string, postId string, perPage int) (PostResponse, error) {
+	if postId != "" {
+		return PostResponse{Posts: map[string]Post{}}, nil
+	}
+
+	return client.FetchPostsForPage(channelId, 0, 0, perPage)
+}
+
+func (client *fakeMattermostClient) GetPostDetails(postId string) (PostDetail, error) {
+	if post, ok := client.posts[postId]; ok {
+		return post, nil
+	}
+
+	return PostDetail{}, fmt.Errorf("post %v: %w", postId, ErrPostNotFound)
+}
+
+func (client *fakeMattermostClient) GetUserDetails(userId string) (UserDetail, error) {
+	if user, ok := client.users[userId]; ok {
+		return user, nil
+	}
+
+	return UserDetail{}, fmt.Errorf("user %v not found", userId)
+}
+
+func (client *fakeMattermostClient) GetUsersByUsernames(usernames []string) ([]UserDetail, error) {
+	users := []UserDetail{}
+	for _, user := range client.users {
+		for _, username := range usernames {
+			if user.UserName == username {
+				users = append(users, user)
+			}
+		}
+	}
+
+	return users, nil
+}
+
+func (client *fakeMattermostClient) GetChannelDetails(channelId string) (ChannelDetail, error) {
+	if channel, ok := client.channels[channelId]; ok {
+		return channel, nil
+	}
+
+	return ChannelDetail{}, fmt.Errorf("channel %v not found", channelId)
+}
+
+func (client *fakeMattermostClient) GetTeamDetails(teamId string) (TeamDetail, error) {
+	if team, ok := client.teams[teamId]; ok {
+		return team, nil
+	}
+
+	return TeamDetail{}, fmt.Errorf("team %v not found", teamId)
+}
+
+func (client *fakeMattermostClient) GetUserChannelIds(userId string) ([]string, error) {
+	return client.userChannels[userId], nil
+}
+
+func (client *fakeMattermostClient) GetSiteURL() string {
+	return "http://mattermost.test"
+}
+
+func newPermissionsFakeClient() *fakeMattermostClient {
+	return &fakeMattermostClient{
+		userChannels: map[string][]string{
+			"member":     {"town-square", "private", "dm"},
+			"non-member": {"town-square"},
+		},
+	}
+}
+
+func newPermissionsQueryResults() []searchResult {
+	return mergeQueryResults(1, chroma.QueryResults{
+		Ids: [][]string{
+			{"public-post", "private-post", "dm-post"},
+			{"slack-post"},
+		},
+		Documents: [][]string{
+			{"public message", "private message", "direct message"},
+			{"slack message"},
+		},
+		Metadatas: [][]map[string]interface{}{
+			{
+				{"source": "mm", "access": "pub", "channel_id": "town-square"},
+				{"source": "mm", "access": "pri", "channel_id": "private"},
+				{"source": "mm", "access": "pri", "channel_id": "dm"},
+			},
+			{
+				{"source": "sl", "access": "pub", "channel_name": "general"},
+			},
+		},
+		Distances: [][]float32{
+			{0.1, 0.1, 0.1},
+			{0.1},
+		},
+	})
+}
+
+func flattenIds(results []searchResult) []string {
+	ids := []string{}
+	for _, result := range results {
+		ids = append(ids, result.Id)
+	}
+
+	return ids
+}
+
+func TestGetUserChannels(t *testing.T) {
+	mmClient := newPermissionsFakeClient()
+
+	t.Run("returns the user's channels", func(t *testing.T) {
+		channelIds, err := getUserChannels(mmClient, "member")
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{"town-square", "private", "dm"}, channelIds)
+	})
+
+	t.Run("requires a user id", func(t *testing.T) {
+		_, err := getUserChannels(mmClient, "")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestFilterAccessibleResults(t *testing.T) {
+	mmClient := newPermissionsFakeClient()
+
+	t.Run("member sees private and direct posts", func(t *testing.T) {
+		channelIds, err := getUserChannels(mmClient, "member")
+		assert.Nil(t, err)
+
+		response := filterAccessibleResults(newPermissionsQueryResults(), channelIds)
+		assert.Equal(t, []string{"public-post", "private-post", "dm-post", "slack-post"}, flattenIds(response))
+	})
+
+	t.Run("non-member never sees a private post", func(t *testing.T) {
+		channelIds, err := getUserChannels(mmClient, "non-member")
+		assert.Nil(t, err)
+
+		response := filterAccessibleResults(newPermissionsQueryResults(), channelIds)
+		assert.Equal(t, []string{"public-post", "slack-post"}, flattenIds(response))
+		for _, result := range response {
+			assert.NotEqual(t, "pri", result.Metadata["access"])
+		}
+	})
+
+	t.Run("user without channels sees no mattermost posts", func(t *testing.T) {
+		response := filterAccessibleResults(newPermissionsQueryResults(), []interface{}{})
+		assert.Equal(t, []string{"slack-post"}, flattenIds(response))
+	})
+
+	t.Run("non public posts from other sources are dropped", func(t *testing.T) {
+		results := newPermissionsQueryResults()
+		results[3].Metadata["access"] = "pri"
+
+		response := filterAccessibleResults(results, []interface{}{"town-square"})
+		assert.Equal(t, []string{"public-post"}, flattenIds(response))
+	})
+}
+
+func TestExtractCitations(t *testing.T) {
+	metadatas := []MetadataSchema{
+		{MessageLink: "http://mattermost.test/team/pl/post1"},
+		{MessageLink: "http://mattermost.test/team/pl/post2"},
+	}
+
+	citations := extractCitations("Moved to Monday [2], it was Friday [1][2]. See also [3] and [0].", metadatas)
+	assert.Equal(t, []Citation{
+		{Number: 2, ContextIndex: 1, MessageLink: "http://mattermost.test/team/pl/post2"},
+		{Number: 1, ContextIndex: 0, MessageLink: "http://mattermost.test/team/pl/post1"},
+	}, citations)
+
+	assert.Equal(t, []Citation{}, extractCitations("", metadatas))
+}
+
+func TestMergeQueryResults(t *testing.T) {
+	mmResponse := chroma.QueryResults{
+		Ids:       [][]string{{"mm-weak", "mm-strong", "shared"}},
+		Documents: [][]string{{"weak", "strong", "shared"}},
+		Metadatas: [][]map[string]interface{}{{{"source": "mm"}, {"source": "mm"}, {"source": "mm"}}},
+		Distances: [][]float32{{0.4, 0.05, 0.3}},
+	}
+	slackResponse := chroma.QueryResults{
+		Ids:       [][]string{{"sl-strong", "shared", "sl-far"}},
+		Documents: [][]string{{"strong", "shared", "far"}},
+		Metadatas: [][]map[string]interface{}{{{"source": "sl"}, {"source": "sl"}, {"source": "sl"}}},
+		Distances: [][]float32{{0.1, 0.2, 0.9}},
+	}
+
+	results := mergeQueryResults(0.5, mmResponse, slackResponse)
+	assert.Equal(t, []string{"mm-strong", "sl-strong", "shared", "mm-weak"}, flattenIds(results))
+
+	// the duplicate keeps its best score
+	assert.InDelta(t, 0.8, results[2].Scores.Vector, 0.0001)
+	assert.Equal(t, "sl", results[2].Metadata["source"])
+
+	assert.Empty(t, mergeQueryResults(0.5))
+}
+
+func TestPaginateResults(t *testing.T) {
+	results := []searchResult{{Id: "1"}, {Id: "2"}, {Id: "3"}}
+
+	page, hasNextPage := paginateResults(results, 0, 2)
+	assert.Equal(t, []string{"1", "2"}, flattenIds(page))
+	assert.True(t, hasNextPage)
+
+	page, hasNextPage = paginateResults(results, 2, 2)
+	assert.Equal(t, []string{"3"}, flattenIds(page))
+	assert.False(t, hasNextPage)
+
+	page, hasNextPage = paginateResults(results, 5, 2)
+	assert.Empty(t, page)
+	assert.False(t, hasNextPage)
+}
+
+func TestSearchCursor(t *testing.T) {
+	offset, err := decodeSearchCursor(encodeSearchCursor(20))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, offset)
+
+	for _, cursor := range []string{"20", "not a cursor", encodeSearchCursor(-1)} {
+		_, err := decodeSearchCursor(cursor)
+		assert.NotNil(t, err, cursor)
+	}
+}
+
+func TestFormatSearchResults(t *testing.T) {
+	client := &countingMattermostClient{fakeMattermostClient: fakeMattermostClient{
+		posts: map[string]PostDetail{
+			"enriched": {Id: "enriched", Message: "indexed with its names"},
+			"legacy":   {Id: "legacy", Message: "indexed before the names"},
+		},
+		users:    map[string]UserDetail{"u1": {Id: "u1", UserName: "user", FirstName: "First", LastName: "Last"}},
+		channels: map[string]ChannelDetail{"c1": {Id: "c1", Name: "town-square", TeamId: "t1"}},
+		teams:    map[string]TeamDetail{"t1": {Id: "t1", Name: "team"}},
+	}}
+
+	results := []searchResult{
+		{Id: "enriched-1", Metadata: map[string]interface{}{
+			"source": "mm", "access": "pub", "user_id": "u1", "channel_id": "c1", "post_id": "enriched",
+			"username": "user", "user_display_name": "FirstLast", "channel_name": "town-square", "team_name": "team",
+			"schema_version": metadataSchemaVersion,
+		}},
+		{Id: "legacy", Metadata: map[string]interface{}{"source": "mm", "access": "pub", "user_id": "u1", "channel_id": "c1"}},
+		{Id: "deleted", Metadata: map[string]interface{}{"source": "mm", "access": "pub", "user_id": "u1", "channel_id": "c1"}},
+	}
+
+	metadatas := formatSearchResults(client, results, false)
+	assert.Len(t, metadatas, 2)
+	for i, postId := range []string{"enriched", "legacy"} {
+		assert.Equal(t, client.posts[postId].Message, metadatas[i].Message)
+		assert.Equal(t, "FirstLast", metadatas[i].UserName)
+		assert.Equal(t, "http://mattermost.test/team/messages/@user", metadatas[i].UserDmLink)
+		assert.Equal(t, "http://mattermost.test/team/channels/town-square", metadatas[i].ChannelLink)
+		assert.Equal(t, "http://mattermost.test/team/pl/"+postId, metadatas[i].MessageLink)
+	}
+
+	// only the names of the legacy documents are looked up
+	assert.Equal(t, map[string]int{"post": 3, "user": 1, "channel": 1, "team": 1}, client.lookups)
+
+	t.Run("results with missing metadata are skipped", func(t *testing.T) {
+		metadatas := formatSearchResults(client, []searchResult{
+			{Id: "enriched", Metadata: map[string]interface{}{
+				"source": "mm", "access": "pub", "user_id": "u1", "channel_id": "c1",
+				"username": "user", "user_display_name": "FirstLast", "channel_name": "town-square",
+				"schema_version": metadataSchemaVersion,
+			}},
+			{Id: "legacy", Metadata: map[string]interface{}{"source": "mm", "user_id": "u1", "channel_id": "c1"}},
+			{Id: "no-date", Document: "hello", Metadata: map[string]interface{}{"source": "sl", "access": "pub", "user_name": "user", "channel_name": "general"}},
+			{Id: "slack", Document: "hi", Metadata: map[string]interface{}{"source": "sl", "access": "pub", "user_name": "user", "channel_name": "general", "msg_date": 1700000000}},
+		}, false)
+		assert.Len(t, metadatas, 1)
+		assert.Equal(t, "hi", metadatas[0].Message)
+	})
+}
+
+func TestSearchDirectMessages(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	connection := newTestVectorStoreConnection()
+	assert.Nil(t, connection.tryConnect(ctx, newEmbeddedVectorStore(newEmbeddedVectorIndex(store), NewHashEmbedder())))
+
+	client := &fakeMattermostClient{
+		posts:        map[string]PostDetail{"dm-post": {Id: "dm-post", UserId: "u1", ChannelId: "dm", Message: "the release is tomorrow"}},
+		users:        map[string]UserDetail{"u1": {Id: "u1", UserName: "user", FirstName: "First", LastName: "Last"}},
+		channels:     map[string]ChannelDetail{"dm": {Id: "dm", Type: "D", Name: "u1__u2"}},
+		userChannels: map[string][]string{"u2": {"dm"}},
+	}
+
+	// direct and group channels have no team
+	assert.Nil(t, upsertPostsToVectorStore(connection, []Post{
+		{Id: "dm-post", UserId: "u1", ChannelId: "dm", Message: "the release is tomorrow"},
+	}, "pri", "", client))
+
+	plugin := Plugin{configuration: &configuration{}, mmClient: client, vectorStore: connection}
+	metadatas, _, err := plugin.getSearchContext(ctx, "release", "u2", SearchOptions{Limit: 10, MMRLambda: 1})
+	assert.Nil(t, err)
+	assert.Len(t, metadatas, 1)
+	assert.Equal(t, "the release is tomorrow", metadatas[0].Message)
+	assert.Equal(t, "u1__u2", metadatas[0].ChannelName)
+	assert.Equal(t, "http://mattermost.test/_redirect/pl/dm-post", metadatas[0].MessageLink)
+
+	t.Run("documents embedded before the names were stored", func(t *testing.T) {
+		metadatas := formatSearchResults(client, []searchResult{
+			{Id: "dm-post", Metadata: map[string]interface{}{"source": "mm", "access": "pri", "user_id": "u1", "channel_id": "dm"}},
+		}, false)
+		assert.Len(t, metadatas, 1)
+		assert.Equal(t, "u1__u2", metadatas[0].ChannelName)
+		assert.Equal(t, "http://mattermost.test/_redirect/pl/dm-post", metadatas[0].MessageLink)
+	})
+}
+
+func TestSearchPagesOfChunkedPosts(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	connection := newTestVectorStoreConnection()
+	assert.Nil(t, connection.tryConnect(ctx, newEmbeddedVectorStore(newEmbeddedVectorIndex(store), NewHashEmbedder())))
+
+	// the long post is split into many chunks, which are the best matches
+	posts := []Post{
+		{Id: "long", UserId: "u1", ChannelId: "c1", Message: strings.Repeat("release train ", 500)},
+		{Id: "lunch", UserId: "u1", ChannelId: "c1", Message: "where do we go for lunch"},
+		{Id: "deploy", UserId: "u1", ChannelId: "c1", Message: "deploy the api server"},
+	}
+	client := &fakeMattermostClient{
+		posts:        map[string]PostDetail{},
+		users:        map[string]UserDetail{"u1": {Id: "u1", UserName: "user"}},
+		channels:     map[string]ChannelDetail{"c1": {Id: "c1", Type: "O", Name: "town-square", TeamId: "t1"}},
+		teams:        map[string]TeamDetail{"t1": {Id: "t1", Name: "team"}},
+		userChannels: map[string][]string{"u2": {"c1"}},
+	}
+	for _, post := range posts {
+		client.posts[post.Id] = PostDetail(post)
+	}
+	assert.Nil(t, upsertPostsToVectorStore(connection, posts, "pub", "t1", client))
+	assert.Greater(t, len(chunkText(posts[0].Message, chunkSize, chunkOverlap)), 3)
+
+	plugin := Plugin{configuration: &configuration{}, mmClient: client, vectorStore: connection}
+	options := SearchOptions{Limit: 2, MMRLambda: 1}
+
+	metadatas, nextCursor, err := plugin.getSearchContext(ctx, "release train release train", "u2", options)
+	assert.Nil(t, err)
+	assert.Len(t, metadatas, 2)
+	assert.NotEmpty(t, nextCursor)
+
+	options.Offset, err = decodeSearchCursor(nextCursor)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, options.Offset)
+
+	lastPage, nextCursor, err := plugin.getSearchContext(ctx, "release train release train", "u2", options)
+	assert.Nil(t, err)
+	assert.Len(t, lastPage, 1)
+	assert.Empty(t, nextCursor)
+
+	// every post is returned once across the pages
+	messages := map[string]bool{}
+	for _, metadata := range append(metadatas, lastPage...) {
+		messages[metadata.Message] = true
+	}
+	assert.Len(t, messages, 3)
+}
@@ -9,8 +9,6 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
-
-	chroma "github.com/amikos-tech/chroma-go"
 )
 
 type PurposeDetail struct {
@@ -47,7 +45,6 @@ type Message struct {
 }
 
 type Slack struct {
-	slackCollection  *chroma.Collection
 	Channels         []SlackChannel
 	FilteredChannels map[string]SlackChannelSpec
 }
@@ -57,16 +54,7 @@ var slackOnce sync.Once
 
 func GetSlackInstance() *Slack {
 	slackOnce.Do(func() {
-		chromaClient := GetChromaInstance()
-
-		newCollection, colError := chromaClient.GetOrCreateCollection("slack")
-		if colError != nil {
-			log.Fatalf("Error while creating / getting collection: %v \n", colError)
-		}
-
-		slackInstance = &Slack{
-			slackCollection: newCollection,
-		}
+		slackInstance = &Slack{}
 	})
 
 	return slackInstance
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ChannelCursor records how far the posts of a channel have been fetched, so a fetch
+// that fails only fetches the failed channel and the ones after it again.
+type ChannelCursor struct {
+	// update_at up to which the posts have been fetched. Once the channel has been fetched completely,
+	// the next fetches only get the posts created, edited or deleted after it
+	LastUpdateAt int64  `json:"last_update_at"`
+	LastPostId   string `json:"last_post_id"`
+	// when the first fetch of the channel started. It becomes LastUpdateAt once the channel has been
+	// fetched completely, so the posts created or edited during the fetch are fetched by the next one
+	FetchStartedAt int64 `json:"fetch_started_at,omitempty"`
+	// oldest post reached by an interrupted first fetch of the channel, which resumes with the posts before it
+	BeforePostId string `json:"before_post_id,omitempty"`
+	// number of the channel's messages already fetched, used to compute the fetch progress
+	FetchedMsgCount int `json:"fetched_msg_count"`
+}
+
+const syncCursorsBucket = "sync_cursors"
+
+// Whether the channel has been fetched completely, so only the posts changed since can be fetched
+func (cursor ChannelCursor) isComplete() bool {
+	return cursor.LastUpdateAt > 0 && cursor.FetchStartedAt == 0
+}
+
+// Whether the first fetch of the channel was interrupted, and can resume from the post it reached
+func (cursor ChannelCursor) canResume() bool {
+	return cursor.FetchStartedAt > 0 && cursor.BeforePostId != ""
+}
+
+// Move the cursor past posts
+func (cursor *ChannelCursor) advance(posts []Post) {
+	for _, post := range posts {
+		if post.UpdateAt > cursor.LastUpdateAt {
+			cursor.LastUpdateAt = post.UpdateAt
+			cursor.LastPostId = post.Id
+		}
+	}
+}
+
+// ----------------------------- Channel Cursors --------------------
+
+func (sync *Sync) getChannelCursors() (map[string]ChannelCursor, error) {
+	if sync.store == nil {
+		return nil, fmt.Errorf("store is not initialized")
+	}
+
+	cursors := map[string]ChannelCursor{}
+	err := sync.store.ForEach(syncCursorsBucket, func(channelId string, value []byte) error {
+		cursor := ChannelCursor{}
+		if err := json.Unmarshal(value, &cursor); err != nil {
+			return fmt.Errorf("could not decode the cursor of channel %v: %v", channelId, err)
+		}
+
+		cursors[channelId] = cursor
+		return nil
+	})
+
+	return cursors, err
+}
+
+func (sync *Sync) setChannelCursor(channelId string, cursor ChannelCursor) error {
+	if sync.store == nil {
+		return fmt.Errorf("store is not initialized")
+	}
+
+	value, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+
+	return sync.store.Put(syncCursorsBucket, channelId, value)
+}
+
+// Forget how far every channel has been fetched, so the next fetch gets all the posts again
+func (sync *Sync) ResetChannelCursors() error {
+	if sync.store == nil {
+		return fmt.Errorf("store is not initialized")
+	}
+
+	return sync.store.DeleteBucket(syncCursorsBucket)
+}
+
+// The posts used to be fetched since a single last_fetched_at, counting the fetched posts
+// in total_fetched_posts. If they were, start every channel from last_fetched_at once,
+// so the posts fetched before aren't embedded again.
+func (sync *Sync) migrateLastFetchedAt(channels []MattermostChannel, cursors map[string]ChannelCursor) error {
+	b, err := sync.store.Get("sync", "total_fetched_posts")
+	if err != nil {
+		// already migrated
+		return nil
+	}
+
+	totalFetchedPosts, _ := strconv.Atoi(string(b))
+	lastFetchedAt, err := sync.GetLastFetchedAt()
+
+	if err == nil && totalFetchedPosts != 0 && lastFetchedAt.UnixMilli() != 0 && len(cursors) == 0 {
+		for _, channel := range channels {
+			cursor := ChannelCursor{
+				LastUpdateAt:    lastFetchedAt.UnixMilli(),
+				FetchedMsgCount: channel.TotalMsgCount,
+			}
+
+			if err := sync.setChannelCursor(channel.Id, cursor); err != nil {
+				return err
+			}
+			cursors[channel.Id] = cursor
+		}
+	}
+
+	return sync.store.Delete("sync", "total_fetched_posts")
+}
+
+// fetchProgress computes the fetch percentage from the messages left to fetch in each channel
+type fetchProgress struct {
+	// channel id -> messages to fetch
+	work map[string]int
+	// channel id -> messages fetched
+	done      map[string]int
+	totalWork int
+	totalDone int
+}
+
+func newFetchProgress(channels []MattermostChannel, cursors map[string]ChannelCursor) *fetchProgress {
+	progress := &fetchProgress{work: map[string]int{}, done: map[string]int{}}
+
+	for _, channel := range channels {
+		work := channel.TotalMsgCount - cursors[channel.Id].FetchedMsgCount
+		if work < 0 {
+			work = 0
+		}
+
+		progress.work[channel.Id] = work
+		progress.totalWork += work
+	}
+
+	return progress
+}
+
+// Count fetched messages of a channel, at most the messages that were left to fetch in it
+func (progress *fetchProgress) add(channelId string, fetched int) {
+	done := progress.done[channelId] + fetched
+	if done > progress.work[channelId] {
+		done = progress.work[channelId]
+	}
+
+	progress.totalDone += done - progress.done[channelId]
+	progress.done[channelId] = done
+}
+
+// Count the messages of a channel that weren't fetched, as the channel is done
+func (progress *fetchProgress) complete(channelId string) {
+	progress.add(channelId, progress.work[channelId])
+}
+
+func (progress *fetchProgress) percentage() float64 {
+	if progress.totalWork == 0 {
+		return 100
+	}
+
+	return float64(progress.totalDone) / float64(progress.totalWork) * 100
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+// pagedMattermostClient returns the posts of each channel page by page, and can fail a channel
+type pagedMattermostClient struct {
+	fakeMattermostClient
+	channelList []MattermostChannel
+	// channel id -> posts, the latest first
+	channelPosts map[string][]Post
+	failChannel  string
+	// called after a page is fetched, to change the posts during a fetch
+	afterPage func(channelId string)
+}
+
+func (client *pagedMattermostClient) GetAllChannels() ([]MattermostChannel, error) {
+	return client.channelList, nil
+}
+
+func (client *pagedMattermostClient) FetchPostsForPage(channelId string, since int64, page int, perPage int) (PostResponse, error) {
+	if channelId == client.failChannel {
+		return PostResponse{}, fmt.Errorf("could not fetch %v", channelId)
+	}
+
+	posts := []Post{}
+	for _, post := range client.channelPosts[channelId] {
+		if post.UpdateAt > since {
+			posts = append(posts, post)
+		}
+	}
+
+	return newPostResponse(posts), nil
+}
+
+func (client *pagedMattermostClient) FetchPostsBefore(channelId string, postId string, perPage int) (PostResponse, error) {
+	if channelId == client.failChannel {
+		return PostResponse{}, fmt.Errorf("could not fetch %v", channelId)
+	}
+
+	channelPosts := client.channelPosts[channelId]
+	start := 0
+	if postId != "" {
+		start = len(channelPosts)
+		for i, post := range channelPosts {
+			if post.Id == postId {
+				start = i + 1
+			}
+		}
+	}
+
+	posts := []Post{}
+	for i := start; i < start+perPage && i < len(channelPosts); i++ {
+		posts = append(posts, channelPosts[i])
+	}
+
+	if client.afterPage != nil {
+		client.afterPage(channelId)
+	}
+
+	return newPostResponse(posts), nil
+}
+
+func newPostResponse(posts []Post) PostResponse {
+	postRes := PostResponse{Posts: map[string]Post{}}
+	for _, post := range posts {
+		postRes.Order = append(postRes.Order, post.Id)
+		postRes.Posts[post.Id] = post
+	}
+
+	return postRes
+}
+
+// recordingVectorStore records the ids of the upserted documents
+type recordingVectorStore struct {
+	fakeVectorStore
+	upserted []string
+}
+
+func (store *recordingVectorStore) Upsert(ctx context.Context, collectionType string, ids []string, documents []string, metadatas []map[string]interface{}) error {
+	store.upserted = append(store.upserted, ids...)
+	return nil
+}
+
+func newChannelPosts(channelId string, count int, updateAt int64) []Post {
+	posts := []Post{}
+	for i := count - 1; i >= 0; i-- {
+		posts = append(posts, Post{
+			Id:        fmt.Sprintf("%v-%02d", channelId, i),
+			ChannelId: channelId,
+			Message:   "message",
+			UpdateAt:  updateAt + int64(i),
+		})
+	}
+
+	return posts
+}
+
+func TestStartFetch(t *testing.T) {
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	// the fetch writes a heap profile to the working directory
+	workingDir, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(workingDir)
+
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-sync"))
+	assert.Nil(t, err)
+	defer store.Close()
+	initializeStore(store)
+
+	client := &pagedMattermostClient{
+		channelList: []MattermostChannel{
+			{Id: "a", Type: "O", TotalMsgCount: 15},
+			{Id: "b", Type: "O", TotalMsgCount: 5},
+		},
+		channelPosts: map[string][]Post{
+			"a": newChannelPosts("a", 15, 1000),
+			"b": newChannelPosts("b", 5, 2000),
+		},
+	}
+	vectorStore := &recordingVectorStore{}
+	sync := &Sync{store: store, mmClient: client, vectorStore: vectorStore}
+
+	fetch := func() ([]float64, error) {
+		percentageChan := make(chan map[string]interface{}, 100)
+		err := sync.StartFetch(percentageChan, context.Background())
+
+		percentages := []float64{}
+		for len(percentageChan) > 0 {
+			if response := <-percentageChan; response["event"] == "onProgress" {
+				percentages = append(percentages, response["data"].(float64))
+			}
+		}
+
+		return percentages, err
+	}
+
+	t.Run("a failed channel doesn't reset the progress of the others", func(t *testing.T) {
+		client.failChannel = "b"
+		fetchStartedAt := model.GetMillis()
+		percentages, err := fetch()
+		assert.NotNil(t, err)
+		assert.Equal(t, []float64{50, 75}, percentages)
+		assert.Len(t, vectorStore.upserted, 15)
+
+		cursors, err := sync.getChannelCursors()
+		assert.Nil(t, err)
+		assert.Len(t, cursors, 1)
+		// the next fetch gets the posts changed since the fetch started
+		assert.GreaterOrEqual(t, cursors["a"].LastUpdateAt, fetchStartedAt)
+		assert.LessOrEqual(t, cursors["a"].LastUpdateAt, model.GetMillis())
+		assert.Equal(t, ChannelCursor{LastUpdateAt: cursors["a"].LastUpdateAt, FetchedMsgCount: 15}, cursors["a"])
+	})
+
+	t.Run("the next fetch continues from the failed channel", func(t *testing.T) {
+		client.failChannel = ""
+		vectorStore.upserted = nil
+
+		percentages, err := fetch()
+		assert.Nil(t, err)
+		assert.Equal(t, []float64{0, 100}, percentages)
+		assert.Len(t, vectorStore.upserted, 5)
+	})
+
+	t.Run("only the posts changed since are fetched", func(t *testing.T) {
+		vectorStore.upserted = nil
+		client.channelList[1].TotalMsgCount = 6
+		client.channelPosts["b"] = append([]Post{{Id: "b-new", ChannelId: "b", Message: "new", UpdateAt: model.GetMillis() + 1}}, client.channelPosts["b"]...)
+
+		percentages, err := fetch()
+		assert.Nil(t, err)
+		assert.Equal(t, []float64{0, 100}, percentages)
+		assert.Equal(t, []string{"b-new"}, vectorStore.upserted)
+	})
+
+	t.Run("resetting the cursors fetches every post again", func(t *testing.T) {
+		vectorStore.upserted = nil
+		assert.Nil(t, sync.ResetChannelCursors())
+
+		_, err := fetch()
+		assert.Nil(t, err)
+		assert.Len(t, vectorStore.upserted, 21)
+	})
+}
+
+func TestFetchChannelWhilePostsChange(t *testing.T) {
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-sync"))
+	assert.Nil(t, err)
+	defer store.Close()
+	initializeStore(store)
+
+	client := &pagedMattermostClient{
+		channelList:  []MattermostChannel{{Id: "a", Type: "O", TotalMsgCount: 25}},
+		channelPosts: map[string][]Post{"a": newChannelPosts("a", 25, 1000)},
+	}
+	vectorStore := &recordingVectorStore{}
+	sync := &Sync{store: store, mmClient: client, vectorStore: vectorStore}
+
+	fetch := func() error {
+		return sync.StartFetch(make(chan map[string]interface{}, 100), context.Background())
+	}
+
+	// after the first page, a post is created and two of the fetched posts are deleted, which moves
+	// the next posts up a page. The fetch is interrupted after the second page, and resumed
+	pages := 0
+	client.afterPage = func(channelId string) {
+		pages++
+		switch pages {
+		case 1:
+			posts := []Post{{Id: "a-new", ChannelId: "a", Message: "new", UpdateAt: model.GetMillis()}}
+			for _, post := range client.channelPosts["a"] {
+				if post.Id != "a-23" && post.Id != "a-22" {
+					posts = append(posts, post)
+				}
+			}
+			client.channelPosts["a"] = posts
+		case 2:
+			client.failChannel = "a"
+		}
+	}
+
+	assert.NotNil(t, fetch())
+	client.failChannel = ""
+	assert.Nil(t, fetch())
+
+	// every post older than the fetched ones is fetched, although the pages moved
+	upserted := map[string]bool{}
+	for _, id := range vectorStore.upserted {
+		upserted[id] = true
+	}
+	for i := 0; i < 25; i++ {
+		assert.True(t, upserted[fmt.Sprintf("a-%02d", i)], "a-%02d wasn't fetched", i)
+	}
+
+	// the post created during the fetch is fetched by the next one
+	assert.False(t, upserted["a-new"])
+	vectorStore.upserted = nil
+	assert.Nil(t, fetch())
+	assert.Equal(t, []string{"a-new"}, vectorStore.upserted)
+}
+
+func TestMigrateLastFetchedAt(t *testing.T) {
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-sync"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	assert.Nil(t, store.Put("sync", "last_fetched_at", []byte("5000")))
+	assert.Nil(t, store.Put("sync", "total_fetched_posts", []byte("12")))
+
+	sync := &Sync{store: store}
+	channels := []MattermostChannel{{Id: "a", TotalMsgCount: 12}}
+	cursors := map[string]ChannelCursor{}
+	assert.Nil(t, sync.migrateLastFetchedAt(channels, cursors))
+
+	expected := map[string]ChannelCursor{"a": {LastUpdateAt: 5000, FetchedMsgCount: 12}}
+	assert.Equal(t, expected, cursors)
+
+	savedCursors, err := sync.getChannelCursors()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, savedCursors)
+
+	// only migrated once
+	_, err = store.Get("sync", "total_fetched_posts")
+	assert.NotNil(t, err)
+	assert.Nil(t, sync.ResetChannelCursors())
+	cursors = map[string]ChannelCursor{}
+	assert.Nil(t, sync.migrateLastFetchedAt(channels, cursors))
+	assert.Empty(t, cursors)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+// SyncLeader elects the server of the cluster that runs the sync, so the posts aren't fetched
+// and embedded by every server. The leader holds a cluster mutex, which expires when the leader
+// dies and stops refreshing it, so another server takes over.
+type SyncLeader struct {
+	api      cluster.MutexPluginAPI
+	store    db.DataStore
+	nodeId   string
+	isLeader atomic.Bool
+	// called when this server becomes the leader, and when it stops being the leader
+	onChange func(isLeader bool)
+	// how often the leader checks that it still holds the mutex
+	checkInterval time.Duration
+}
+
+const (
+	syncLeaderMutexKey         = "sync_leader"
+	syncLeaderKey              = "leader"
+	syncLeaderDefaultCheckTime = 5 * time.Second
+)
+
+func NewSyncLeader(api cluster.MutexPluginAPI, store db.DataStore, onChange func(isLeader bool)) *SyncLeader {
+	return &SyncLeader{
+		api:           api,
+		store:         store,
+		nodeId:        newSyncNodeId(),
+		onChange:      onChange,
+		checkInterval: syncLeaderDefaultCheckTime,
+	}
+}
+
+// Identify this server in the sync status, by its host name and a random suffix
+// as several plugin processes can run on a host
+func newSyncNodeId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "server"
+	}
+
+	return fmt.Sprintf("%v-%v", hostname, model.NewId()[:8])
+}
+
+func (leader *SyncLeader) IsLeader() bool {
+	return leader.isLeader.Load()
+}
+
+// Campaign to become the leader until ctx is done. Blocks until ctx is done,
+// and steps down before returning so another server can take over right away.
+func (leader *SyncLeader) Run(ctx context.Context) {
+	for {
+		mutex, err := cluster.NewMutex(leader.api, syncLeaderMutexKey)
+		if err != nil {
+			log.Printf("error while creating the sync leader mutex: %v \n", err)
+			return
+		}
+
+		if err := mutex.LockWithContext(ctx); err != nil {
+			return
+		}
+
+		// the leader is recorded before acting as one, as the sync status and holdLeadership read it
+		if err := leader.store.Put("sync", syncLeaderKey, []byte(leader.nodeId)); err != nil {
+			log.Printf("error while recording the sync leader: %v \n", err)
+
+			// let another server campaign, and try again later
+			mutex.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(leader.checkInterval):
+				continue
+			}
+		}
+
+		leader.setLeader(true)
+		log.Printf("This server is now the sync leader: %v \n", leader.nodeId)
+
+		holdsMutex := leader.holdLeadership(ctx)
+		leader.setLeader(false)
+
+		// a mutex taken over by another server must not be unlocked, as it would unlock theirs.
+		// It was taken over because refreshing it failed, which also stopped refreshing it
+		if holdsMutex {
+			mutex.Unlock()
+		}
+
+		log.Printf("This server stopped being the sync leader: %v \n", leader.nodeId)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Wait until ctx is done, or until another server became the leader, which happens if the mutex
+// couldn't be refreshed in time. Returns false in the latter case.
+func (leader *SyncLeader) holdLeadership(ctx context.Context) bool {
+	ticker := time.NewTicker(leader.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-ticker.C:
+			leaderId, err := leader.store.Get("sync", syncLeaderKey)
+			if err != nil {
+				log.Printf("error while checking the sync leader: %v \n", err)
+				continue
+			}
+
+			if string(leaderId) != leader.nodeId {
+				log.Printf("%v took over the sync leadership \n", string(leaderId))
+				return false
+			}
+		}
+	}
+}
+
+func (leader *SyncLeader) setLeader(isLeader bool) {
+	leader.isLeader.Store(isLeader)
+
+	if leader.onChange != nil {
+		leader.onChange(isLeader)
+	}
+}
+
+// Get the server that is, or was last, the sync leader. Empty if there never was one.
+func GetSyncLeaderId(store db.DataStore) string {
+	leaderId, err := store.Get("sync", syncLeaderKey)
+	if err != nil {
+		return ""
+	}
+
+	return string(leaderId)
+}
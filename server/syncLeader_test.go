@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+// fakeMutexAPI is an in-memory key value store shared by the servers of a fake cluster
+type fakeMutexAPI struct {
+	lock   sync.Mutex
+	values map[string][]byte
+}
+
+func (api *fakeMutexAPI) KVSetWithOptions(key string, value []byte, options model.PluginKVSetOptions) (bool, *model.AppError) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	currentValue, exists := api.values[key]
+	if options.Atomic && (options.OldValue == nil && exists || options.OldValue != nil && !bytes.Equal(currentValue, options.OldValue)) {
+		return false, nil
+	}
+
+	if value == nil {
+		delete(api.values, key)
+	} else {
+		api.values[key] = value
+	}
+
+	return true, nil
+}
+
+func (api *fakeMutexAPI) LogError(msg string, keyValuePairs ...interface{}) {}
+
+// expire the mutex, as if its holder died
+func (api *fakeMutexAPI) expire(key string) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	delete(api.values, "mutex_"+key)
+}
+
+// syncLeaderChanges records the leadership changes of a server
+type syncLeaderChanges struct {
+	lock    sync.Mutex
+	changes []bool
+}
+
+func (recorder *syncLeaderChanges) onChange(isLeader bool) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	recorder.changes = append(recorder.changes, isLeader)
+}
+
+func (recorder *syncLeaderChanges) get() []bool {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	return append([]bool{}, recorder.changes...)
+}
+
+// failingPutStore can't record values, as if the KV store was unavailable
+type failingPutStore struct {
+	db.DataStore
+	puts atomic.Int32
+}
+
+func (store *failingPutStore) Put(bucketName string, key string, value []byte) error {
+	store.puts.Add(1)
+	return errors.New("the KV store is unavailable")
+}
+
+func TestSyncLeader(t *testing.T) {
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-sync"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	api := &fakeMutexAPI{values: map[string][]byte{}}
+
+	newServer := func() (*SyncLeader, *syncLeaderChanges, context.CancelFunc, chan struct{}) {
+		changes := &syncLeaderChanges{}
+		leader := NewSyncLeader(api, store, changes.onChange)
+		leader.checkInterval = 10 * time.Millisecond
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			leader.Run(ctx)
+		}()
+
+		return leader, changes, cancel, done
+	}
+
+	first, firstChanges, stopFirst, firstDone := newServer()
+	assert.Eventually(t, first.IsLeader, time.Second, 5*time.Millisecond)
+	assert.Equal(t, first.nodeId, GetSyncLeaderId(store))
+
+	second, secondChanges, stopSecond, secondDone := newServer()
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, second.IsLeader())
+
+	t.Run("another server takes over when the leader steps down", func(t *testing.T) {
+		stopFirst()
+		<-firstDone
+
+		assert.False(t, first.IsLeader())
+		assert.Equal(t, []bool{true, false}, firstChanges.get())
+
+		assert.Eventually(t, second.IsLeader, 5*time.Second, 5*time.Millisecond)
+		assert.Equal(t, second.nodeId, GetSyncLeaderId(store))
+		assert.Equal(t, []bool{true}, secondChanges.get())
+	})
+
+	t.Run("the leader steps down when its mutex expired and another server took over", func(t *testing.T) {
+		third, _, stopThird, thirdDone := newServer()
+		defer func() {
+			stopThird()
+			<-thirdDone
+		}()
+
+		api.expire(syncLeaderMutexKey)
+
+		assert.Eventually(t, third.IsLeader, 5*time.Second, 5*time.Millisecond)
+		assert.Eventually(t, func() bool { return !second.IsLeader() }, time.Second, 5*time.Millisecond)
+		assert.Equal(t, third.nodeId, GetSyncLeaderId(store))
+	})
+
+	stopSecond()
+	<-secondDone
+}
+
+func TestSyncLeaderNotRecorded(t *testing.T) {
+	api := &fakeMutexAPI{values: map[string][]byte{}}
+	store := &failingPutStore{}
+
+	changes := &syncLeaderChanges{}
+	leader := NewSyncLeader(api, store, changes.onChange)
+	leader.checkInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leader.Run(ctx)
+	}()
+
+	// the mutex is released for another server, without acting as the leader
+	assert.Eventually(t, func() bool { return store.puts.Load() > 0 }, time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		api.lock.Lock()
+		defer api.lock.Unlock()
+
+		_, locked := api.values["mutex_"+syncLeaderMutexKey]
+		return !locked
+	}, time.Second, 5*time.Millisecond)
+	assert.False(t, leader.IsLeader())
+	assert.Empty(t, changes.get())
+
+	cancel()
+	<-done
+}
@@ -2,19 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
-	"os"
-	"runtime/pprof"
 	"strconv"
 	"sync"
 	"time"
 
-	chroma "github.com/amikos-tech/chroma-go"
 	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+	"github.com/mattermost/mattermost/server/public/model"
 )
 
 type Post struct {
@@ -22,9 +17,15 @@ type Post struct {
 	Message   string `json:"message"`
 	UserId    string `json:"user_id"`
 	Type      string `json:"type"`
+	CreateAt  int64  `json:"create_at"`
 	UpdateAt  int64  `json:"update_at"`
 	DeleteAt  int64  `json:"delete_at"`
 	ChannelId string `json:"channel_id"`
+	RootId    string `json:"root_id"`
+	// engagement signals, which boost the post in the search results
+	IsPinned      bool  `json:"is_pinned"`
+	ReplyCount    int64 `json:"reply_count"`
+	ReactionCount int   `json:"reaction_count"`
 }
 
 type PostResponse struct {
@@ -36,88 +37,62 @@ type PostResponse struct {
 type MattermostChannel struct {
 	Id            string `json:"id"`
 	Type          string `json:"type"`
+	TeamId        string `json:"team_id"`
 	DisplayName   string `json:"display_name"`
 	TotalMsgCount int    `json:"total_msg_count"`
 	// LastFetchedUpdate int64  `json:"last_fetched_update"`
 }
 
 type Sync struct {
-	ticker               *time.Ticker
-	store                *db.DataStore
-	mattermostCollection *chroma.Collection
+	ticker      *time.Ticker
+	mmClient    MattermostClient
+	vectorStore VectorStore
+	store       db.DataStore
+	// only the leader fetches posts, when the plugin runs on a cluster
+	leader *SyncLeader
 }
 
+// number of documents deleted from the vector store at once
+const deletePerPage = 200
+
 var syncInstance *Sync
 var syncOnce sync.Once
 
-func GetSyncInstance() *Sync {
+// Get the sync, keeping its state in store the first time it's called
+func GetSyncInstance(store db.DataStore) *Sync {
 	syncOnce.Do(func() {
-		chromaClient := GetChromaInstance()
-
-		newCollection, colError := chromaClient.GetOrCreateCollection("mattermost")
-		if colError != nil {
-			log.Fatalf("Error while creating / getting collection: %v \n", colError)
-		}
-
-		initializedStore := initializeStore()
+		initializeStore(store)
 
 		syncInstance = &Sync{
-			store:                initializedStore,
-			ticker:               nil,
-			mattermostCollection: newCollection,
+			store:  store,
+			ticker: nil,
 		}
 	})
 
 	return syncInstance
 }
 
-func ResetVectorStore() (bool, error) {
-	chromaClient := GetChromaInstance()
-	return chromaClient.ResetData(context.Background())
-}
-
-// initialize the store in sync. if store is has values do nothing
-func initializeStore() *db.DataStore {
-	store := db.GetDataStore("mm-sync")
-
+// initialize the store in sync. if store is has values do nothing.
+// the values are only set if missing, as another server of the cluster may have set them
+func initializeStore(store db.DataStore) {
 	// set fetch_interval
-	if _, err := store.Get("sync", "fetch_interval"); err != nil {
-		putError := store.Put("sync", "fetch_interval", []byte("15"))
-		if putError != nil {
-			fmt.Println(putError)
-		}
+	if _, err := store.CompareAndSet("sync", "fetch_interval", nil, []byte("15")); err != nil {
+		fmt.Println(err)
 	}
 
 	// set is_fetch_in_progress
-	if _, err := store.Get("sync", "is_fetch_in_progress"); err != nil {
-		putError := store.Put("sync", "is_fetch_in_progress", []byte(strconv.FormatBool(false)))
-		if putError != nil {
-			fmt.Println(putError)
-		}
+	if _, err := store.CompareAndSet("sync", "is_fetch_in_progress", nil, []byte(strconv.FormatBool(false))); err != nil {
+		fmt.Println(err)
 	}
 
 	// set is_sync_in_progress
-	if _, err := store.Get("sync", "is_sync_in_progress"); err != nil {
-		putError := store.Put("sync", "is_sync_in_progress", []byte(strconv.FormatBool(false)))
-		if putError != nil {
-			fmt.Println(putError)
-		}
-	}
-
-	// set total_fetched_posts
-	if _, err := store.Get("sync", "total_fetched_posts"); err != nil {
-		putError := store.Put("sync", "total_fetched_posts", []byte(strconv.Itoa(0)))
-		if putError != nil {
-			fmt.Println(putError)
-		}
+	if _, err := store.CompareAndSet("sync", "is_sync_in_progress", nil, []byte(strconv.FormatBool(false))); err != nil {
+		fmt.Println(err)
 	}
 
 	// set last_fetched_at
-	if _, err := store.Get("sync", "last_fetched_at"); err != nil {
-		putError := store.Put("sync", "last_fetched_at", []byte(strconv.Itoa(0)))
-		if putError != nil {
-			fmt.Println(putError)
-		}
+	if _, err := store.CompareAndSet("sync", "last_fetched_at", nil, []byte(strconv.Itoa(0))); err != nil {
+		fmt.Println(err)
 	}
 
 	// // set chroma_returned_results
@@ -132,11 +107,9 @@ func initializeStore() *db.DataStore {
 	// 	fmt.Println(err)
 	// }
 
-	// if *sync.store == (db.DataStore{}) {
+	// if sync.store == nil {
 	// 	sync.store = store
 	// }
-
-	return store
 }
 
 func (sync *Sync) StopSync() error {
@@ -156,7 +129,9 @@ func (sync *Sync) StopSync() error {
 }
 
 func (sync *Sync) StopTicker() {
-	sync.ticker.Stop()
+	if sync.ticker != nil {
+		sync.ticker.Stop()
+	}
 }
 
 func (sync *Sync) SetTickerNil() {
@@ -176,6 +151,10 @@ func (sync *Sync) StartFetch(percentageChan chan map[string]interface{}, ctx con
 	fmt.Println("*********** Start fetching... ***********")
 	fmt.Println()
 
+	if !sync.IsLeader() {
+		return fmt.Errorf("only the sync leader fetches posts, the leader is %v", sync.GetSyncLeader())
+	}
+
 	// if fetching is in progress return nothing
 	if isFetchInProgress, err := sync.GetIsFetchInProgress(); isFetchInProgress {
 		if err != nil {
@@ -185,192 +164,198 @@ func (sync *Sync) StartFetch(percentageChan chan map[string]interface{}, ctx con
 		return fmt.Errorf("fetch is in progress")
 	}
 
-	// get last synced time from db
-	lastFetchedAt, err := sync.GetLastFetchedAt()
+	// set fetching to true so no other sync can start
+	err := sync.setIsFetchInProgress(true)
 	if err != nil {
 		return err
 	}
-	lastFetchedAtInMilliseconds := lastFetchedAt.UnixMilli()
 
-	// get total fetched posts from db
-	totalFetchedPosts, err := sync.getTotalFetchedPosts()
+	// // Set fetching to false before returning
+	defer sync.stopFetch()
+
+	//save the time where syncing started
+	startSyncTime := time.Now()
+
+	// Get all channels' data
+	channels, err := sync.mmClient.GetAllChannels()
 	if err != nil {
 		return err
 	}
 
-	// set fetching to true so no other sync can start
-	err = sync.setIsFetchInProgress(true)
+	// get how far each channel has been fetched from db
+	cursors, err := sync.getChannelCursors()
 	if err != nil {
 		return err
 	}
 
-	// // Set fetching to false before returning
-	defer sync.stopFetch()
+	if err := sync.migrateLastFetchedAt(channels, cursors); err != nil {
+		return err
+	}
 
-	//save the time where syncing started
-	startSyncTime := time.Now()
+	progress := newFetchProgress(channels, cursors)
+	log.Println("Total MM posts to fetch: ", progress.totalWork)
 
-	// declare a dict to store request parameters
-	// var params map[string]interface{}
-	postParams := url.Values{
-		"since":    {""},
-		"per_page": {"200"},
-		"page":     {"0"},
+	for _, channel := range channels {
+		if err := sync.fetchChannel(ctx, channel, cursors[channel.Id], progress, percentageChan); err != nil {
+			return err
+		}
 	}
+	fmt.Println("Total posts fetched:", progress.totalDone)
 
-	// Assign the since property in the request param to get all posts since that time.
-	// if the since property is not defined all posts will be fetched from MM db
-	if lastFetchedAtInMilliseconds != 0 && totalFetchedPosts != 0 {
-		postParams.Set("since", fmt.Sprintf("%d", lastFetchedAtInMilliseconds))
+	// the posts embedded with an older metadata schema are embedded again
+	if err := sync.backfillMetadata(ctx); err != nil {
+		log.Printf("error while backfilling the documents' metadata: %v \n", err)
 	}
 
-	// Get all channels' data
-	channels, err := GetAllChannels()
-	if err != nil {
-		return err
+	// the documents embedded before the lexical index existed are added to it
+	if err := sync.backfillLexicalIndex(ctx); err != nil {
+		log.Printf("error while backfilling the lexical index: %v \n", err)
 	}
 
-	totalPosts := calcTotalPosts(channels)
-	log.Println("Total MM posts: ", totalPosts)
-	log.Println("Embedded posts so far: ", totalFetchedPosts)
+	// var response [][]byte
 
-	// Get the total number of posts since last sync
-	totalPostsSinceLastSync := totalPosts - totalFetchedPosts
+	// response = append(response, []byte("event: onDone\n"))
+	// response = append(response, []byte(fmt.Sprintf("data: %.2f\n", syncPercentage)))
+	// response = append(response, []byte("\n"))
 
-	var posts []Post
-	loadedPosts := 0
-	var syncPercentage float64
-	previousTotalFetchedPosts := totalFetchedPosts
+	responseJson := map[string]interface{}{
+		"event":  "onDone",
+		"isDone": true,
+	}
 
-	for _, channel := range channels {
-		// 200 is the max number of posts per page
-		postParams.Set("per_page", "10")
-		postParams.Set("page", "0")
+	percentageChan <- responseJson
 
-		// loop through all pages in a channel
+	// Set the last synced time in db
+	sync.setLastFetchedAt(startSyncTime)
+
+	return nil
+}
+
+// Fetch the posts of a channel from its cursor, and save the cursor as the posts are embedded.
+// A channel fetched completely before only gets the posts changed since, in a single page.
+func (sync *Sync) fetchChannel(ctx context.Context, channel MattermostChannel, cursor ChannelCursor, progress *fetchProgress, percentageChan chan map[string]interface{}) error {
+	// 200 is the max number of posts per page
+	perPage := 10
+
+	if cursor.isComplete() {
+		// posts updated in the same millisecond as the last post seen are fetched again
+		postsRes, err := sync.mmClient.FetchPostsForPage(channel.Id, cursor.LastUpdateAt-1, 0, perPage)
+		if err != nil {
+			return err
+		}
+
+		var posts []Post
+		for _, postId := range postsRes.Order {
+			post := postsRes.Posts[postId]
+			if post.Id == cursor.LastPostId && post.UpdateAt == cursor.LastUpdateAt {
+				continue
+			}
+
+			posts = append(posts, post)
+		}
+
+		if err := sync.indexChannelPosts(channel, posts); err != nil {
+			return err
+		}
+
+		cursor.advance(posts)
+	} else {
+		if !cursor.canResume() {
+			cursor = ChannelCursor{FetchStartedAt: model.GetMillis()}
+		}
+
+		// loop through all pages in a channel, from the latest posts or the post an interrupted fetch reached
 		for {
-			// Fetch posts for the current page
-			postsRes, err := FetchPostsForPage(channel.Id, postParams)
+			postsRes, err := sync.mmClient.FetchPostsBefore(channel.Id, cursor.BeforePostId, perPage)
 			if err != nil {
-				sync.setTotalFetchedPosts(previousTotalFetchedPosts)
 				return err
 			}
 
-			if len(postsRes.Order) <= 0 {
-				log.Println("No posts found for channel: ", channel.Id)
-				break
-			}
-
+			var posts []Post
 			// add posts while keeping order
 			for _, postId := range postsRes.Order {
 				posts = append(posts, postsRes.Posts[postId])
 			}
 
-			// get the channel's access restriction (private/ public)
-			access := ""
-			switch channel.Type {
-			case "O":
-				// public channel
-				access = "pub"
-			case "P":
-				// private channel
-				access = "pri"
-			}
-
-			// remove deleted posts from chroma and filter out any irrelevant posts
-			filteredPosts, err := deleteAndFilterPost(posts)
-			if err != nil {
-				sync.setTotalFetchedPosts(previousTotalFetchedPosts)
+			if err := sync.indexChannelPosts(channel, posts); err != nil {
 				return err
 			}
 
-			// upsert the filtered channel posts to chroma
-			if len(filteredPosts) > 0 {
-				loadedPosts = len(filteredPosts)
-				log.Println("Loaded posts: ", loadedPosts)
-
-				if err := upsertPostsToChroma(filteredPosts, access); err != nil {
-					sync.setTotalFetchedPosts(previousTotalFetchedPosts)
-					return err
-				}
-			}
-
-			// Increment the total number of fetched posts
-			sync.setTotalFetchedPosts(totalFetchedPosts + loadedPosts)
+			cursor.FetchedMsgCount += len(posts)
+			progress.add(channel.Id, len(posts))
 
-			// if the previous post id is empty, we have reached the end of the posts for this channel
-			if postsRes.PreviousPostId == "" {
+			// a partial page means we have reached the end of the posts for this channel
+			if len(posts) < perPage {
 				break
 			}
 
-			// Increment the page number
-			page := postParams.Get("page")
-			nxtPage, err := strconv.Atoi(page)
-			if err != nil {
-				sync.setTotalFetchedPosts(previousTotalFetchedPosts)
-				return fmt.Errorf("error converting string to int: %v", err)
+			// the posts are ordered from the latest, so the next page is before the last one
+			cursor.BeforePostId = posts[len(posts)-1].Id
+			if err := sync.setChannelCursor(channel.Id, cursor); err != nil {
+				return err
 			}
-			nxtPage += 1
-
-			postParams.Set("page", strconv.Itoa(nxtPage))
 
-			// Calculate sync percentage
-			if totalPostsSinceLastSync != 0 {
-				syncPercentage = (float64(loadedPosts) / float64(totalPostsSinceLastSync)) * 100
+			if err := sendFetchProgress(ctx, percentageChan, progress); err != nil {
+				return err
 			}
+		}
 
-			select {
-			case <-ctx.Done():
-				log.Println("fetch interrupted")
-				sync.setTotalFetchedPosts(previousTotalFetchedPosts)
-				close(percentageChan)
-				return ctx.Err()
-			default:
-				log.Println("Send percentage from fetch: ", syncPercentage)
-
-				// var response [][]byte
+		if cursor.FetchedMsgCount == 0 {
+			log.Println("No posts found for channel: ", channel.Id)
+		}
 
-				// response = append(response, []byte("event: onProgress\n"))
-				// response = append(response, []byte(fmt.Sprintf("data: %.2f\n", syncPercentage)))
-				// response = append(response, []byte("\n"))
+		// the posts created or edited since the fetch started may be on pages fetched before,
+		// so the next fetch gets them
+		cursor.LastUpdateAt = cursor.FetchStartedAt
+		cursor.LastPostId = ""
+		cursor.FetchStartedAt = 0
+		cursor.BeforePostId = ""
+	}
 
-				responseJson := map[string]interface{}{
-					"event": "onProgress",
-					"data":  syncPercentage,
-				}
+	cursor.FetchedMsgCount = channel.TotalMsgCount
+	if err := sync.setChannelCursor(channel.Id, cursor); err != nil {
+		return err
+	}
 
-				percentageChan <- responseJson
-			}
+	progress.complete(channel.Id)
+	return sendFetchProgress(ctx, percentageChan, progress)
+}
 
-		}
+// Remove the deleted posts of a channel from the vector store, and embed the others
+func (sync *Sync) indexChannelPosts(channel MattermostChannel, posts []Post) error {
+	// remove deleted posts from chroma and filter out any irrelevant posts
+	filteredPosts, err := deleteAndFilterPost(sync.vectorStore, posts)
+	if err != nil {
+		return err
 	}
-	fmt.Println("Total posts:", totalPostsSinceLastSync)
-	fmt.Println("Total posts fetched:", totalFetchedPosts)
 
-	// var response [][]byte
+	if len(filteredPosts) <= 0 {
+		return nil
+	}
 
-	// response = append(response, []byte("event: onDone\n"))
-	// response = append(response, []byte(fmt.Sprintf("data: %.2f\n", syncPercentage)))
-	// response = append(response, []byte("\n"))
+	log.Println("Loaded posts: ", len(filteredPosts))
 
-	responseJson := map[string]interface{}{
-		"event":  "onDone",
-		"isDone": true,
-	}
+	// upsert the filtered channel posts to chroma, with the channel's access restriction (private/ public)
+	return upsertPostsToVectorStore(sync.vectorStore, filteredPosts, getChannelAccess(channel.Type), channel.TeamId, sync.mmClient)
+}
 
-	percentageChan <- responseJson
+func sendFetchProgress(ctx context.Context, percentageChan chan map[string]interface{}, progress *fetchProgress) error {
+	select {
+	case <-ctx.Done():
+		log.Println("fetch interrupted")
+		close(percentageChan)
+		return ctx.Err()
+	default:
+		syncPercentage := progress.percentage()
+		log.Println("Send percentage from fetch: ", syncPercentage)
 
-	// Set the last synced time in db
-	sync.setLastFetchedAt(startSyncTime)
+		responseJson := map[string]interface{}{
+			"event": "onProgress",
+			"data":  syncPercentage,
+		}
 
-	// profile the memory usage
-	pprof.StopCPUProfile()
-	f, fErr := os.Create("after-scan-2.pprof")
-	if fErr != nil {
-		fmt.Println("Error: ", fErr)
+		percentageChan <- responseJson
 	}
-	pprof.WriteHeapProfile(f)
-	f.Close()
 
 	return nil
 }
@@ -387,34 +372,37 @@ func (sync *Sync) stopFetch() error {
 	return nil
 }
 
-func (sync *Sync) StartSync(ctxWithCancel context.Context, percentageChan chan map[string]interface{}) error {
+// Start syncing on the sync leader, which then calls RunSync
+func (sync *Sync) StartSync() error {
 	fmt.Println()
 	fmt.Println("-------------------------------------")
 	fmt.Println("*********** Start syncing ***********")
 	fmt.Println("-------------------------------------")
 	fmt.Println()
 
-	// if syncing is in progress return nothing
-	if isSyncInProgress, err := sync.GetIsSyncInProgress(); isSyncInProgress {
-		if err != nil {
-			return err
-		}
+	// set syncing to true so no other sync can start. Set atomically, as the
+	// sync can be started from any server of the cluster
+	isStarted, err := sync.store.CompareAndSet("sync", "is_sync_in_progress", []byte(strconv.FormatBool(false)), []byte(strconv.FormatBool(true)))
+	if err != nil {
+		return err
+	}
 
+	if !isStarted {
 		return fmt.Errorf("sync is in progress")
 	}
 
+	return nil
+}
+
+// Fetch the posts every fetch interval until ctxWithCancel is done. Only called on the sync leader,
+// which also runs the syncs started by the previous leader.
+func (sync *Sync) RunSync(ctxWithCancel context.Context, percentageChan chan map[string]interface{}) error {
 	// get fetch interval from db
 	fetchInterval, err := sync.GetFetchInterval()
 	if err != nil {
 		return err
 	}
 
-	// set syncing to true so no other sync can start
-	err = sync.setIsSyncInProgress(true)
-	if err != nil {
-		return err
-	}
-
 	// start the ticker
 	sync.ticker = time.NewTicker(time.Duration(fetchInterval) * time.Second)
 
@@ -442,14 +430,6 @@ func (sync *Sync) StartSync(ctxWithCancel context.Context, percentageChan chan m
 			if err != nil {
 				return fmt.Errorf("error while fetching: %v", err)
 			}
-			// profile the memory usage
-			pprof.StopCPUProfile()
-			f, fErr := os.Create("after-scan-select.pprof")
-			if fErr != nil {
-				fmt.Println("Error: ", fErr)
-			}
-			pprof.WriteHeapProfile(f)
-			f.Close()
 		case currentTime := <-time.After(0): // This case runs immediately
 			if !alreadyRun {
 				log.Println("Immediate fetch started: ", currentTime)
@@ -486,7 +466,7 @@ func (sync *Sync) UpdateFetchInterval(newInterval time.Duration) error {
 
 // ----------------------------- Is Sync In Progress --------------------
 func (sync *Sync) setFetchInterval(interval time.Duration) error {
-	if *sync.store == (db.DataStore{}) {
+	if sync.store == nil {
 		return fmt.Errorf("store is not initialized")
 	}
 
@@ -494,7 +474,7 @@ func (sync *Sync) setFetchInterval(interval time.Duration) error {
 }
 
 func (sync *Sync) GetFetchInterval() (int, error) {
-	if *sync.store == (db.DataStore{}) {
+	if sync.store == nil {
 		return 0, fmt.Errorf("store is not initialized")
 	}
 
@@ -509,7 +489,7 @@ func (sync *Sync) GetFetchInterval() (int, error) {
 
 // ----------------------------- Is Sync In Progress --------------------
 func (sync *Sync) setIsSyncInProgress(truthVal bool) error {
-	if *sync.store == (db.DataStore{}) {
+	if sync.store == nil {
 		return fmt.Errorf("store is not initialized")
 	}
 
@@ -517,7 +497,7 @@ func (sync *Sync) setIsSyncInProgress(truthVal bool) error {
 }
 
 func (sync *Sync) GetIsSyncInProgress() (bool, error) {
-	if *sync.store == (db.DataStore{}) {
+	if sync.store == nil {
 		return false, fmt.Errorf("store is not initialized")
 	}
 
@@ -532,7 +512,7 @@ func (sync *Sync) GetIsSyncInProgress() (bool, error) {
 
 // ----------------------------- Is Fetch In Progress --------------------
 func (sync *Sync) setIsFetchInProgress(truthVal bool) error {
-	if *sync.store == (db.DataStore{}) {
+	if sync.store == nil {
 		return fmt.Errorf("store is not initialized")
 	}
 
@@ -540,7 +520,7 @@ func (sync *Sync) setIsFetchInProgress(truthVal bool) error {
 }
 
 func (sync *Sync) GetIsFetchInProgress() (bool, error) {
-	if *sync.store == (db.DataStore{}) {
+	if sync.store == nil {
 		return false, fmt.Errorf("store is not initialized")
 	}
 
@@ -553,40 +533,10 @@ func (sync *Sync) GetIsFetchInProgress() (bool, error) {
 	return strconv.ParseBool(string(b))
 }
 
-// ----------------------------- Is Total Fetched Posts --------------------
-func (sync *Sync) setTotalFetchedPosts(totalPosts int) error {
-	if *sync.store == (db.DataStore{}) {
-		return fmt.Errorf("store is not initialized")
-	}
-
-	return sync.store.Put("sync", "total_fetched_posts", []byte(strconv.Itoa(totalPosts)))
-}
-
-func (sync *Sync) getTotalFetchedPosts() (int, error) {
-	if *sync.store == (db.DataStore{}) {
-		return 0, fmt.Errorf("store is not initialized")
-	}
-
-	b, err := sync.store.Get("sync", "total_fetched_posts")
-
-	if err != nil {
-		return 0, err
-	}
-
-	return strconv.Atoi(string(b))
-
-	// documentCount, err := sync.mattermostCollection.Count(context.Background())
-	// if err != nil {
-	// 	return 0, err
-	// }
-
-	// return int(documentCount), nil
-}
-
 // ----------------------------- Is Last Fetched At --------------------
 
 func (sync *Sync) setLastFetchedAt(startSyncTime time.Time) error {
-	if *sync.store == (db.DataStore{}) {
+	if sync.store == nil {
 		return fmt.Errorf("store is not initialized")
 	}
 
@@ -594,7 +544,7 @@ func (sync *Sync) setLastFetchedAt(startSyncTime time.Time) error {
 }
 
 func (sync *Sync) GetLastFetchedAt() (time.Time, error) {
-	if *sync.store == (db.DataStore{}) {
+	if sync.store == nil {
 		return time.Time{}, fmt.Errorf("store is not initialized")
 	}
 
@@ -614,97 +564,76 @@ func (sync *Sync) GetLastFetchedAt() (time.Time, error) {
 	return time.UnixMilli(lastFetchedAt), nil
 }
 
-// ---------------- Utility Functions ----------------
+// ----------------------------- Sync Leader --------------------
 
-func calcTotalPosts(channels []MattermostChannel) int {
-	total := 0
-	for _, channel := range channels {
-		total += channel.TotalMsgCount
-	}
-	return total
+func (sync *Sync) IsLeader() bool {
+	// the plugin runs on a single server if there's no leader election
+	return sync.leader == nil || sync.leader.IsLeader()
 }
 
-func GetAllChannels() (channels []MattermostChannel, err error) {
-	reqUrl := mmAPI + "/channels"
-
-	req, err := http.NewRequest(http.MethodGet, reqUrl, nil)
-	if err != nil {
-		return nil, fmt.Errorf("client: could not create request: %s", err)
+func (sync *Sync) GetSyncLeader() string {
+	if sync.store == nil {
+		return ""
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", token)
-
-	client := http.Client{
-		Timeout: 10 * time.Second,
-	}
-	response, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("client: error making http request: %s", err)
-	}
-	defer response.Body.Close()
-
-	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("client: Failed to fetch channels. Status code: %d", response.StatusCode)
-	}
-
-	// automatically filters the response body to only include the fields
-	// specified in Channels struct by json tags
-	err = json.NewDecoder(response.Body).Decode(&channels)
-	if err != nil {
-		return nil, fmt.Errorf("client: could not decode json: %s", err)
-	}
-
-	return channels, nil
+	return GetSyncLeaderId(sync.store)
 }
 
-// Get all posts per page in a channel
-func FetchPostsForPage(channelId string, params url.Values) (postRes PostResponse, err error) {
-	reqUrl := mmAPI + "/channels/" + channelId + "/posts"
-
-	req, err := http.NewRequest("GET", reqUrl, nil)
-	if err != nil {
-		return PostResponse{}, fmt.Errorf("client: could not create request: %s", err)
-	}
-
-	req.URL.RawQuery = params.Encode()
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", token)
+// ---------------- Utility Functions ----------------
 
-	client := http.Client{
-		Timeout: 10 * time.Second,
+// Get the access restriction (private/ public) stored with a channel's posts
+func getChannelAccess(channelType string) string {
+	switch channelType {
+	case "O":
+		// public channel
+		return "pub"
+	case "P", "D", "G":
+		// private, direct and group channels
+		return "pri"
 	}
 
-	response, err := client.Do(req)
-	if err != nil {
-		return PostResponse{}, fmt.Errorf("client: error making http request: %s", err)
-	}
-	defer response.Body.Close()
+	return ""
+}
 
-	if response.StatusCode != 200 {
-		return PostResponse{}, fmt.Errorf("client: Failed to fetch new posts. Status code: %d", response.StatusCode)
+// Convert a post received from the plugin API to the post format used while syncing
+func postFromModel(post *model.Post) Post {
+	return Post{
+		Id:         post.Id,
+		Message:    post.Message,
+		UserId:     post.UserId,
+		Type:       post.Type,
+		CreateAt:   post.CreateAt,
+		UpdateAt:   post.UpdateAt,
+		DeleteAt:   post.DeleteAt,
+		ChannelId:  post.ChannelId,
+		RootId:     post.RootId,
+		IsPinned:   post.IsPinned,
+		ReplyCount: post.ReplyCount,
+		// the reactions are only counted if the post was fetched with its metadata
+		ReactionCount: reactionCount(post),
 	}
+}
 
-	err = json.NewDecoder(response.Body).Decode(&postRes)
-	if err != nil {
-		return PostResponse{}, fmt.Errorf("client: could not decode json: %s", err)
+// Count the reactions of a post from its metadata
+func reactionCount(post *model.Post) int {
+	if post.Metadata == nil {
+		return 0
 	}
 
-	return postRes, nil
+	return len(post.Metadata.Reactions)
 }
 
 // Deletes posts that have been deleted from mattermost
 // from chroma database and filters system and non-text
 // messages
-func deleteAndFilterPost(posts []Post) (filteredPosts []Post, err error) {
+func deleteAndFilterPost(vectorStore VectorStore, posts []Post) (filteredPosts []Post, err error) {
 	// TODO: filter out any stickers / emojis
 	// TODO: replace user handles with their real names
 
 	for _, post := range posts {
 		// delete posts from chroma if it's been deleted from mattermost
 		if post.DeleteAt > 0 {
-			err := deleteFromChroma(post.Id)
+			err := deleteFromVectorStore(vectorStore, post.Id)
 			if err != nil {
 				return nil, err
 			}
@@ -716,7 +645,7 @@ func deleteAndFilterPost(posts []Post) (filteredPosts []Post, err error) {
 
 		// filter out posts that are not of type text and empty messages
 		// filter out any irrelevant posts
-		if post.Type == "" && post.Message != "" {
+		if isIndexablePost(post) {
 			// TODO: format the post in this form "(date) user-name: message_text" before append
 			filteredPosts = append(filteredPosts, post)
 		}
@@ -725,6 +654,11 @@ func deleteAndFilterPost(posts []Post) (filteredPosts []Post, err error) {
 	return filteredPosts, nil
 }
 
+// Whether a post is embedded: only text posts that weren't deleted are
+func isIndexablePost(post Post) bool {
+	return post.DeleteAt == 0 && post.Type == "" && post.Message != ""
+}
+
 func removePost(posts []Post, postId string) {
 	for idx, post := range posts {
 		if post.Id == postId {
@@ -733,20 +667,62 @@ func removePost(posts []Post, postId string) {
 	}
 }
 
-func deleteFromChroma(postId string) error {
-	fmt.Println("Deleting post from chroma...", postId)
+func deleteFromVectorStore(vectorStore VectorStore, postId string) error {
+	return deletePostChunks(context.Background(), vectorStore, map[string]int{postId: 0})
+}
 
-	ids := []string{postId}
+// Delete the chunks of posts from the vector store and the lexical index, by post_id. fromChunks maps post ids
+// to the index of their first chunk to delete. Deleting from chunk 0 also deletes the document of a post
+// embedded before the posts were chunked, which has no post_id.
+func deletePostChunks(ctx context.Context, vectorStore VectorStore, fromChunks map[string]int) error {
+	if len(fromChunks) == 0 {
+		return nil
+	}
 
-	_, delError := GetSyncInstance().mattermostCollection.Delete(context.Background(), ids, nil, nil)
-	if delError != nil {
-		return fmt.Errorf("error while deleting from chroma: %v", delError)
+	unchunkedIds := []string{}
+	for postId, fromChunk := range fromChunks {
+		if fromChunk == 0 {
+			unchunkedIds = append(unchunkedIds, postId)
+		}
+	}
+
+	if delError := deleteDocuments(ctx, vectorStore, mattermostCollectionType, unchunkedIds); delError != nil {
+		return fmt.Errorf("error while deleting from the vector store: %v", delError)
+	}
+
+	whereClause := postChunksWhere(fromChunks)
+	if delError := vectorStore.DeleteWhere(ctx, mattermostCollectionType, whereClause); delError != nil {
+		return fmt.Errorf("error while deleting from the vector store: %v", delError)
+	}
+
+	if lexError := GetLexicalIndex().DeleteWhere(whereClause); lexError != nil {
+		return fmt.Errorf("error while deleting from the lexical index: %v", lexError)
+	}
+
+	return nil
+}
+
+// Delete documents from a collection and from the lexical index, a page of ids at a time
+func deleteDocuments(ctx context.Context, vectorStore VectorStore, collectionType string, ids []string) error {
+	for start := 0; start < len(ids); start += deletePerPage {
+		end := start + deletePerPage
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		if err := vectorStore.Delete(ctx, collectionType, ids[start:end]); err != nil {
+			return err
+		}
+
+		if lexError := GetLexicalIndex().Delete(ids[start:end]); lexError != nil {
+			return fmt.Errorf("error while deleting from the lexical index: %v", lexError)
+		}
 	}
 
 	return nil
 }
 
-func upsertPostsToChroma(filteredPosts []Post, access string) (err error) {
+func upsertPostsToVectorStore(vectorStore VectorStore, filteredPosts []Post, access string, teamId string, mmClient MattermostClient) (err error) {
 	// log.Println("Upserting...", len(filteredPosts), access)
 
 	metadatas := []map[string]interface{}{}
@@ -755,27 +731,50 @@ func upsertPostsToChroma(filteredPosts []Post, access string) (err error) {
 
 	/*
 		{
-			"id" : "message_id",
-			"document" : "(date) User: message_text",
+			"id" : "message_id" or "message_id-chunk_index",
+			"document" : "thread_context\nchunk_text",
 			"metadata" : {
 					"source": "mm",
 					"access" : "pri / pub",
 					"channel_id" : "ch_0000",
 					"user_id" : "usr_0000",
+					"team_id" : "tm_0000",
+					"create_at" : 1700000000000,
+					"update_at" : 1700000000000,
+					"post_id" : "message_id",
+					"root_id" : "thread_root_id",
+					"chunk_index" : 0,
+					"chunk_count" : 1,
+					"chunk_start" : 0,
+					"chunk_end" : 1000,
+					"team_name" : "team-name",
+					"channel_name" : "channel-name",
+					"channel_display_name" : "Channel Name",
+					"username" : "user-name",
+					"user_display_name" : "FirstLast",
+					"is_pinned" : false,
+					"reply_count" : 0,
+					"reaction_count" : 0,
+					"schema_version" : 3,
 			}
 		}
 	*/
 
-	// extract the mettadatas, ids and documents from the filtered posts in the above format
+	// split the filtered posts into chunks, embedded along with their thread
+	chunkCounts := map[string]int{}
+	for _, document := range buildPostDocuments(filteredPosts, access, teamId, mmClient) {
+		ids = append(ids, document.Id)
+		documents = append(documents, document.Document)
+		metadatas = append(metadatas, document.Metadata)
+		chunkCounts[documentPostId(document.Id, document.Metadata)]++
+	}
+
+	// an edited post may have been split into more chunks before
+	staleChunks := map[string]int{}
 	for _, post := range filteredPosts {
-		ids = append(ids, post.Id)
-		documents = append(documents, post.Message)
-		metadatas = append(metadatas, map[string]interface{}{
-			"source":     "mm",
-			"access":     access,
-			"channel_id": post.ChannelId,
-			"user_id":    post.UserId,
-		})
+		if post.UpdateAt > post.CreateAt {
+			staleChunks[post.Id] = chunkCounts[post.Id]
+		}
 	}
 
 	// log.Println("Data: ", documents, ids, metadatas)
@@ -783,12 +782,17 @@ func upsertPostsToChroma(filteredPosts []Post, access string) (err error) {
 	cxtWithTimeout, cancelCtxWithTimeout := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancelCtxWithTimeout()
 
-	log.Println("Upserting to chroma...")
+	if upError := vectorStore.Upsert(cxtWithTimeout, mattermostCollectionType, ids, documents, metadatas); upError != nil {
+		return fmt.Errorf("failed to upsert to the vector store: %w", upError)
+	}
+
+	if delError := deletePostChunks(cxtWithTimeout, vectorStore, staleChunks); delError != nil {
+		return fmt.Errorf("failed to delete the stale chunks from the vector store: %w", delError)
+	}
 
-	// Even tho the embeddings are not provided, this function call will embed the documents using the embedding function defined in the collection
-	_, upError := GetSyncInstance().mattermostCollection.Upsert(cxtWithTimeout, nil, metadatas, documents, ids)
-	if upError != nil {
-		return fmt.Errorf("failed to upsert to chroma: %v", upError)
+	// keep the keyword index in step with the vector store
+	if lexError := GetLexicalIndex().Upsert(ids, documents, metadatas); lexError != nil {
+		return fmt.Errorf("failed to upsert to the lexical index: %v", lexError)
 	}
 
 	return nil
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/iCog-Labs-Dev/mm-semantic-search/server/db"
+)
+
+func TestDeletePostChunks(t *testing.T) {
+	ctx := context.Background()
+
+	// keep the lexical index in memory
+	lexicalOnce.Do(func() {
+		lexicalInstance = NewLexicalIndex(nil)
+	})
+
+	store, err := db.OpenBoltDataStore(filepath.Join(t.TempDir(), "mm-vectors"))
+	assert.Nil(t, err)
+	defer store.Close()
+	vectorStore := newEmbeddedVectorStore(newEmbeddedVectorIndex(store), nil)
+
+	postIds := func() []string {
+		metadatas, err := vectorStore.GetMetadatas(ctx, mattermostCollectionType)
+		assert.Nil(t, err)
+
+		ids := []string{}
+		for id := range metadatas {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	longMessage := strings.Repeat("release train ", 250)
+	assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{
+		{Id: "long", ChannelId: "c1", Message: longMessage, CreateAt: 1, UpdateAt: 1},
+		{Id: "other", ChannelId: "c1", Message: longMessage, CreateAt: 1, UpdateAt: 1},
+	}, "pub", "t1", nil))
+	// embedded before the posts were chunked, without a post_id
+	assert.Nil(t, vectorStore.Upsert(ctx, mattermostCollectionType, []string{"unchunked"}, []string{"message"}, []map[string]interface{}{{}}))
+
+	otherIds := []string{}
+	for i := range chunkText(longMessage, chunkSize, chunkOverlap) {
+		otherIds = append(otherIds, postChunkId("other", i))
+	}
+	assert.Greater(t, len(otherIds), 1)
+	assert.Len(t, postIds(), 2*len(otherIds)+1)
+
+	t.Run("an edited post keeps only its new chunks", func(t *testing.T) {
+		assert.Nil(t, upsertPostsToVectorStore(vectorStore, []Post{
+			{Id: "long", ChannelId: "c1", Message: "short now", CreateAt: 1, UpdateAt: 2},
+		}, "pub", "t1", nil))
+
+		assert.ElementsMatch(t, append([]string{"long", "unchunked"}, otherIds...), postIds())
+		assert.Empty(t, GetLexicalIndex().Search("train", 10, func(metadata map[string]interface{}) bool {
+			return metadata["post_id"] == "long"
+		}))
+	})
+
+	t.Run("a deleted post loses every chunk", func(t *testing.T) {
+		assert.Nil(t, deleteFromVectorStore(vectorStore, "other"))
+		assert.Nil(t, deleteFromVectorStore(vectorStore, "unchunked"))
+
+		assert.ElementsMatch(t, []string{"long"}, postIds())
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 
 	"github.com/mattermost/mattermost/server/public/model"
 )
@@ -21,6 +22,12 @@ type Broker struct {
 	ctx            context.Context
 	ctxCancel      context.CancelFunc
 	plugin         *Plugin
+
+	// guards the state of the sync running on this server
+	syncLock      sync.Mutex
+	isSyncRunning bool
+	// keeps the sync in progress when it's stopped here, so the next sync leader runs it
+	keepSyncInProgress bool
 }
 
 // Spawn a go routine handles the addition & removal of
@@ -87,12 +94,6 @@ func (b *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// 	b.closingClients <- messageChan
 	// }()
 
-	if req.URL.Path == "/sync/stop" {
-		log.Printf("stop sync: %v\n", req.URL.Path)
-		b.ctxCancel()
-		b.mmSync.StopTicker()
-	}
-
 	// Listen to connection close
 	notify := req.Context().Done()
 
@@ -102,74 +103,24 @@ func (b *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		b.closingClients <- messageChan
 	}()
 
-	// var percentageChan chan [][]byte
-	var percentageChan chan map[string]interface{}
-
 	if b.mmSync == nil {
 		log.Println("Initializing sync...")
 
-		b.mmSync = GetSyncInstance()
+		b.mmSync = b.plugin.mmSync
 		// b.mmSync.CloseStore()
 	}
 
-	if b.mmSync.IsTickerNil() {
-		// percentageChan = make(chan [][]byte)
-		percentageChan = make(chan map[string]interface{})
-
-		ctxWithCancel, cancelCtx := context.WithCancel(context.Background())
-
-		b.ctx = ctxWithCancel
-		b.ctxCancel = cancelCtx
-
-		go func() {
-			go func() {
-				defer b.mmSync.StopSync()
-				err := b.mmSync.StartSync(ctxWithCancel, percentageChan)
-				if err != nil {
-					log.Println(fmt.Errorf("error while syncing: %s", err))
-					http.Error(
-						rw,
-						fmt.Sprintf("error while syncing: %s", err),
-						http.StatusInternalServerError,
-					)
-					return
-				}
-			}()
-
-			for {
-				select {
-				case <-ctxWithCancel.Done():
-					log.Println("Stop sync!")
-
-					// var response [][]byte
-
-					// response = append(response, []byte("event: onStop\n"))
-					// response = append(response, []byte("data: {}\n"))
-					// response = append(response, []byte("\n"))
-
-					responseJson := map[string]interface{}{
-						"event":     "onStop",
-						"isStopped": true,
-					}
-
-					b.message <- responseJson
-
-					return
-				case percent, ok := <-percentageChan:
-					if !ok {
-						log.Printf("Percentage channel closed!")
-						return
-					}
-
-					fmt.Printf("Syncing posts... %v%% complete\n", percent["data"])
-					fmt.Println()
-					fmt.Println("-------------------------------------")
-					fmt.Println()
-
-					b.message <- percent
-				}
-			}
-		}()
+	// the sync can be started and stopped from any server of the cluster, but only runs on the sync leader.
+	// The leader runs or stops it within a second, see OnActivate
+	if req.URL.Path == "/sync/stop" {
+		log.Printf("stop sync: %v\n", req.URL.Path)
+		b.stopSync(false)
+	} else if err := b.mmSync.StartSync(); err != nil {
+		log.Println(fmt.Errorf("error while starting the sync: %s", err))
+	} else if b.mmSync.IsLeader() {
+		b.runSync()
+	} else {
+		log.Printf("the sync will run on the sync leader: %v \n", b.mmSync.GetSyncLeader())
 	}
 
 	// Block and wait for messages to be broadcasted
@@ -209,6 +160,112 @@ func (b *Broker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	log.Println("Finished HTTP request at ", req.URL.Path)
 }
 
+func (b *Broker) IsSyncRunning() bool {
+	b.syncLock.Lock()
+	defer b.syncLock.Unlock()
+
+	return b.isSyncRunning
+}
+
+// Run the sync on this server, unless it's already running
+func (b *Broker) runSync() {
+	b.syncLock.Lock()
+	defer b.syncLock.Unlock()
+
+	if b.isSyncRunning {
+		return
+	}
+	b.isSyncRunning = true
+	b.keepSyncInProgress = false
+
+	// var percentageChan chan [][]byte
+	percentageChan := make(chan map[string]interface{})
+
+	ctxWithCancel, cancelCtx := context.WithCancel(context.Background())
+
+	b.ctx = ctxWithCancel
+	b.ctxCancel = cancelCtx
+
+	go func() {
+		go func() {
+			defer b.syncStopped()
+			err := b.mmSync.RunSync(ctxWithCancel, percentageChan)
+			if err != nil {
+				log.Println(fmt.Errorf("error while syncing: %s", err))
+				return
+			}
+		}()
+
+		for {
+			select {
+			case <-ctxWithCancel.Done():
+				log.Println("Stop sync!")
+
+				// var response [][]byte
+
+				// response = append(response, []byte("event: onStop\n"))
+				// response = append(response, []byte("data: {}\n"))
+				// response = append(response, []byte("\n"))
+
+				responseJson := map[string]interface{}{
+					"event":     "onStop",
+					"isStopped": true,
+				}
+
+				b.message <- responseJson
+
+				return
+			case percent, ok := <-percentageChan:
+				if !ok {
+					log.Printf("Percentage channel closed!")
+					return
+				}
+
+				fmt.Printf("Syncing posts... %v%% complete\n", percent["data"])
+				fmt.Println()
+				fmt.Println("-------------------------------------")
+				fmt.Println()
+
+				b.message <- percent
+			}
+		}
+	}()
+}
+
+// Stop the sync. If keepInProgress is true, the sync only stops on this server,
+// which stopped being the sync leader, and the next leader runs it.
+func (b *Broker) stopSync(keepInProgress bool) {
+	b.syncLock.Lock()
+	defer b.syncLock.Unlock()
+
+	if !b.isSyncRunning {
+		// the sync runs on another server, which stops when it sees it's not in progress anymore
+		if !keepInProgress {
+			b.mmSync.StopSync()
+		}
+		return
+	}
+
+	b.keepSyncInProgress = keepInProgress
+	b.ctxCancel()
+	b.mmSync.StopTicker()
+}
+
+// Called when the sync running on this server returns
+func (b *Broker) syncStopped() {
+	b.syncLock.Lock()
+	defer b.syncLock.Unlock()
+
+	b.isSyncRunning = false
+
+	if b.keepSyncInProgress {
+		b.mmSync.SetTickerNil()
+		return
+	}
+
+	b.mmSync.StopSync()
+}
+
 // Broker factory
 func NewBroker(p *Plugin) (broker *Broker) {
 	// Instantiate a broker
@@ -218,6 +275,7 @@ func NewBroker(p *Plugin) (broker *Broker) {
 		closingClients: make(chan MessageChan),
 		message:        make(MessageChan),
 		plugin:         p,
+		mmSync:         p.mmSync,
 	}
 
 	// Set it running - listening and broadcasting events
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// VectorStoreConnection is the VectorStore used by the plugin. It forwards every call to the store
+// created from the plugin configuration, and replaces that store when the configuration changes.
+type VectorStoreConnection struct {
+	lock     sync.RWMutex
+	store    VectorStore
+	settings vectorStoreSettings
+	// the plugin's data directory, where the embedded store is kept
+	dataDirectory string
+	// cancels the pending reconnection, when the settings change again
+	cancelReconnect context.CancelFunc
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+}
+
+// vectorStoreSettings are the configuration values used to create the vector store.
+// The store is only replaced if one of them changes.
+type vectorStoreSettings struct {
+	backend           string
+	pgvectorSource    string
+	chroma            ChromaSettings
+	embeddingProvider string
+	embeddingURL      string
+	embeddingModel    string
+	embeddingAPIKey   string
+}
+
+const (
+	vectorStoreMinReconnectBackoff = 1 * time.Second
+	vectorStoreMaxReconnectBackoff = 1 * time.Minute
+	vectorStoreConnectTimeout      = 10 * time.Second
+)
+
+func NewVectorStoreConnection(dataDirectory string) *VectorStoreConnection {
+	return &VectorStoreConnection{
+		dataDirectory: dataDirectory,
+		minBackoff:    vectorStoreMinReconnectBackoff,
+		maxBackoff:    vectorStoreMaxReconnectBackoff,
+	}
+}
+
+func newVectorStoreSettings(config *configuration) vectorStoreSettings {
+	return vectorStoreSettings{
+		backend:           config.VectorStoreBackend,
+		pgvectorSource:    config.PgvectorDataSource,
+		chroma:            config.getChromaSettings(),
+		embeddingProvider: config.EmbeddingProvider,
+		embeddingURL:      config.EmbeddingURL,
+		embeddingModel:    config.EmbeddingModel,
+		embeddingAPIKey:   config.EmbeddingAPIKey,
+	}
+}
+
+// Connect to the vector store defined in the configuration. Nothing is done if the settings didn't change.
+//
+// The first connection attempt is made right away. If the store can't be reached, the connection is
+// retried in the background with an exponential backoff, until it succeeds or the settings change again,
+// and the previous store keeps being used in the meantime. Returns ErrEmbeddingModelMismatch if the
+// collections were embedded by another model, in which case the new store is still used so it can be reset.
+func (connection *VectorStoreConnection) Connect(config *configuration) error {
+	settings := newVectorStoreSettings(config)
+
+	connection.lock.Lock()
+	if connection.cancelReconnect != nil && settings == connection.settings {
+		connection.lock.Unlock()
+		return nil
+	}
+
+	if connection.cancelReconnect != nil {
+		connection.cancelReconnect()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connection.settings = settings
+	connection.cancelReconnect = cancel
+	connection.lock.Unlock()
+
+	embedder, err := NewEmbedder(config)
+	if err != nil {
+		return err
+	}
+
+	store, err := newVectorStore(settings, embedder, connection.dataDirectory)
+	if err != nil {
+		return err
+	}
+
+	err = connection.tryConnect(ctx, store)
+	if err == nil || errors.Is(err, ErrEmbeddingModelMismatch) {
+		return err
+	}
+
+	log.Printf("error while trying to connect to the vector store, retrying in the background: %v \n", err)
+	go connection.reconnect(ctx, store)
+
+	return nil
+}
+
+// Create the vector store of the configured backend
+func newVectorStore(settings vectorStoreSettings, embedder Embedder, dataDirectory string) (VectorStore, error) {
+	switch settings.backend {
+	case "", VectorStoreBackendChroma:
+		return NewChromaClient(settings.chroma, embedder)
+	case VectorStoreBackendEmbedded:
+		return NewEmbeddedVectorStore(dataDirectory, embedder)
+	case VectorStoreBackendPgvector:
+		return NewPgvectorStore(settings.pgvectorSource, embedder)
+	}
+
+	return nil, fmt.Errorf("unknown vector store backend: %v", settings.backend)
+}
+
+// Stop retrying to connect
+func (connection *VectorStoreConnection) Close() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.cancelReconnect != nil {
+		connection.cancelReconnect()
+	}
+}
+
+func (connection *VectorStoreConnection) reconnect(ctx context.Context, store VectorStore) {
+	backoff := connection.minBackoff
+
+	for {
+		select {
+		case <-ctx.Done():
+			// the store was replaced before it could be used
+			closeVectorStore(store)
+			return
+		case <-time.After(backoff):
+		}
+
+		err := connection.tryConnect(ctx, store)
+		if err == nil || errors.Is(err, ErrEmbeddingModelMismatch) {
+			return
+		}
+
+		backoff *= 2
+		if backoff > connection.maxBackoff {
+			backoff = connection.maxBackoff
+		}
+
+		log.Printf("error while trying to reconnect to the vector store, retrying in %v: %v \n", backoff, err)
+	}
+}
+
+// Use the store if it can be reached. ctx is cancelled when newer settings replace the store's settings.
+func (connection *VectorStoreConnection) tryConnect(ctx context.Context, store VectorStore) error {
+	verifyCtx, cancel := context.WithTimeout(ctx, vectorStoreConnectTimeout)
+	defer cancel()
+
+	err := store.VerifyEmbeddingModel(verifyCtx)
+	if err != nil && !errors.Is(err, ErrEmbeddingModelMismatch) {
+		return err
+	}
+
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	// don't replace a store created from newer settings
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if connection.store != store {
+		closeVectorStore(connection.store)
+	}
+	connection.store = store
+	log.Println("Connected to the vector store")
+
+	return err
+}
+
+// Release the connections of a store that isn't used anymore
+func closeVectorStore(store VectorStore) {
+	closer, ok := store.(io.Closer)
+	if !ok {
+		return
+	}
+
+	if err := closer.Close(); err != nil {
+		log.Printf("error while closing the vector store: %v \n", err)
+	}
+}
+
+func (connection *VectorStoreConnection) current() (VectorStore, error) {
+	connection.lock.RLock()
+	defer connection.lock.RUnlock()
+
+	if connection.store == nil {
+		return nil, newVectorStoreError("connect", ErrVectorStoreUnavailable, errors.New("not connected to the vector store yet"))
+	}
+
+	return connection.store, nil
+}
+
+func (connection *VectorStoreConnection) VerifyEmbeddingModel(ctx context.Context) error {
+	store, err := connection.current()
+	if err != nil {
+		return err
+	}
+
+	return store.VerifyEmbeddingModel(ctx)
+}
+
+func (connection *VectorStoreConnection) Upsert(ctx context.Context, collectionType string, ids []string, documents []string, metadatas []map[string]interface{}) error {
+	store, err := connection.current()
+	if err != nil {
+		return err
+	}
+
+	return store.Upsert(ctx, collectionType, ids, documents, metadatas)
+}
+
+func (connection *VectorStoreConnection) Delete(ctx context.Context, collectionType string, ids []string) error {
+	store, err := connection.current()
+	if err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, collectionType, ids)
+}
+
+func (connection *VectorStoreConnection) DeleteWhere(ctx context.Context, collectionType string, whereClause map[string]interface{}) error {
+	store, err := connection.current()
+	if err != nil {
+		return err
+	}
+
+	return store.DeleteWhere(ctx, collectionType, whereClause)
+}
+
+func (connection *VectorStoreConnection) GetMetadatas(ctx context.Context, collectionType string) (map[string]map[string]interface{}, error) {
+	store, err := connection.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GetMetadatas(ctx, collectionType)
+}
+
+func (connection *VectorStoreConnection) GetEmbeddings(ctx context.Context, collectionType string, ids []string) (map[string][]float32, error) {
+	store, err := connection.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GetEmbeddings(ctx, collectionType, ids)
+}
+
+func (connection *VectorStoreConnection) GetDocuments(ctx context.Context, collectionType string, ids []string) (map[string]string, error) {
+	store, err := connection.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GetDocuments(ctx, collectionType, ids)
+}
+
+func (connection *VectorStoreConnection) Query(ctx context.Context, query string, mmChannelIds []interface{}, nResults int, minScore float64, filters SearchFilters) ([]searchResult, error) {
+	store, err := connection.current()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Query(ctx, query, mmChannelIds, nResults, minScore, filters)
+}
+
+func (connection *VectorStoreConnection) Reset(ctx context.Context) error {
+	store, err := connection.current()
+	if err != nil {
+		return err
+	}
+
+	return store.Reset(ctx)
+}
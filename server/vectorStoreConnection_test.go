@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVectorStore is a VectorStore that fails to connect a number of times before succeeding
+type fakeVectorStore struct {
+	lock            sync.Mutex
+	failuresLeft    int
+	verifyError     error
+	connectAttempts int
+	closed          bool
+}
+
+func (store *fakeVectorStore) VerifyEmbeddingModel(ctx context.Context) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.connectAttempts++
+	if store.failuresLeft > 0 {
+		store.failuresLeft--
+		return newVectorStoreError("connect", ErrVectorStoreUnavailable, errors.New("connection refused"))
+	}
+
+	return store.verifyError
+}
+
+func (store *fakeVectorStore) Upsert(ctx context.Context, collectionType string, ids []string, documents []string, metadatas []map[string]interface{}) error {
+	return nil
+}
+
+func (store *fakeVectorStore) Delete(ctx context.Context, collectionType string, ids []string) error {
+	return nil
+}
+
+func (store *fakeVectorStore) DeleteWhere(ctx context.Context, collectionType string, whereClause map[string]interface{}) error {
+	return nil
+}
+
+func (store *fakeVectorStore) GetMetadatas(ctx context.Context, collectionType string) (map[string]map[string]interface{}, error) {
+	return map[string]map[string]interface{}{}, nil
+}
+
+func (store *fakeVectorStore) GetEmbeddings(ctx context.Context, collectionType string, ids []string) (map[string][]float32, error) {
+	return map[string][]float32{}, nil
+}
+
+func (store *fakeVectorStore) GetDocuments(ctx context.Context, collectionType string, ids []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (store *fakeVectorStore) Query(ctx context.Context, query string, mmChannelIds []interface{}, nResults int, minScore float64, filters SearchFilters) ([]searchResult, error) {
+	return []searchResult{{Id: query}}, nil
+}
+
+func (store *fakeVectorStore) Reset(ctx context.Context) error {
+	return nil
+}
+
+func (store *fakeVectorStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.closed = true
+	return nil
+}
+
+func newTestVectorStoreConnection() *VectorStoreConnection {
+	connection := NewVectorStoreConnection("")
+	connection.minBackoff = time.Millisecond
+	connection.maxBackoff = 4 * time.Millisecond
+
+	return connection
+}
+
+func TestVectorStoreConnection(t *testing.T) {
+	t.Run("unavailable until connected", func(t *testing.T) {
+		connection := newTestVectorStoreConnection()
+
+		_, err := connection.Query(context.Background(), "query", nil, 5, 0, SearchFilters{})
+		assert.ErrorIs(t, err, ErrVectorStoreUnavailable)
+
+		assert.Nil(t, connection.tryConnect(context.Background(), &fakeVectorStore{}))
+
+		results, err := connection.Query(context.Background(), "query", nil, 5, 0, SearchFilters{})
+		assert.Nil(t, err)
+		assert.Equal(t, []searchResult{{Id: "query"}}, results)
+	})
+
+	t.Run("reconnects with backoff", func(t *testing.T) {
+		connection := newTestVectorStoreConnection()
+		store := &fakeVectorStore{failuresLeft: 3}
+
+		connection.reconnect(context.Background(), store)
+
+		assert.Equal(t, 4, store.connectAttempts)
+		current, err := connection.current()
+		assert.Nil(t, err)
+		assert.Equal(t, store, current)
+	})
+
+	t.Run("a store with a different embedding model is still used", func(t *testing.T) {
+		connection := newTestVectorStoreConnection()
+		store := &fakeVectorStore{verifyError: newVectorStoreError("get collection", ErrEmbeddingModelMismatch, errors.New("changed"))}
+
+		assert.ErrorIs(t, connection.tryConnect(context.Background(), store), ErrEmbeddingModelMismatch)
+
+		current, err := connection.current()
+		assert.Nil(t, err)
+		assert.Equal(t, store, current)
+	})
+
+	t.Run("stops when the settings change", func(t *testing.T) {
+		connection := newTestVectorStoreConnection()
+		previousStore := &fakeVectorStore{}
+		assert.Nil(t, connection.tryConnect(context.Background(), previousStore))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		connection.reconnect(ctx, &fakeVectorStore{})
+		assert.NotNil(t, connection.tryConnect(ctx, &fakeVectorStore{}))
+
+		current, err := connection.current()
+		assert.Nil(t, err)
+		assert.Equal(t, previousStore, current)
+	})
+
+	t.Run("closes the replaced stores", func(t *testing.T) {
+		connection := newTestVectorStoreConnection()
+		previousStore := &fakeVectorStore{}
+		assert.Nil(t, connection.tryConnect(context.Background(), previousStore))
+
+		store := &fakeVectorStore{}
+		assert.Nil(t, connection.tryConnect(context.Background(), store))
+		assert.True(t, previousStore.closed)
+		assert.False(t, store.closed)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		unusedStore := &fakeVectorStore{}
+		connection.reconnect(ctx, unusedStore)
+		assert.True(t, unusedStore.closed)
+	})
+}
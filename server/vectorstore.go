@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// VectorStore stores the embedded messages of each source in a collection, and finds the
+// messages that are similar to a query. Its methods return a *VectorStoreError, whose kind
+// can be checked with errors.Is.
+type VectorStore interface {
+	// Check that the existing collections were embedded with the configured embedding model
+	VerifyEmbeddingModel(ctx context.Context) error
+	Upsert(ctx context.Context, collectionType string, ids []string, documents []string, metadatas []map[string]interface{}) error
+	Delete(ctx context.Context, collectionType string, ids []string) error
+	// Delete the documents of a collection whose metadata match a chroma where clause
+	DeleteWhere(ctx context.Context, collectionType string, whereClause map[string]interface{}) error
+	// Get the metadata of every document of a collection, by document id
+	GetMetadatas(ctx context.Context, collectionType string) (map[string]map[string]interface{}, error)
+	// Get the embeddings of documents of a collection, by document id. The documents that don't exist are left out
+	GetEmbeddings(ctx context.Context, collectionType string, ids []string) (map[string][]float32, error)
+	// Get the text of documents of a collection, by document id. The documents that don't exist are left out
+	GetDocuments(ctx context.Context, collectionType string, ids []string) (map[string]string, error)
+	// Query the collections for the nResults most similar documents in each collection that match
+	// the filters. The results of all collections are merged into a single list sorted by descending
+	// similarity, keeping only the ones with a similarity score of at least minScore
+	Query(ctx context.Context, query string, mmChannelIds []interface{}, nResults int, minScore float64, filters SearchFilters) ([]searchResult, error)
+	// Remove the plugin's collections, along with their documents
+	Reset(ctx context.Context) error
+}
+
+const (
+	VectorStoreBackendChroma   = "chroma"
+	VectorStoreBackendEmbedded = "embedded"
+	VectorStoreBackendPgvector = "pgvector"
+)
+
+const (
+	mattermostCollectionType = "mattermost"
+	slackCollectionType      = "slack"
+)
+
+var (
+	ErrVectorStoreUnavailable = errors.New("vector store is unavailable")
+	ErrVectorStoreTimeout     = errors.New("vector store timed out")
+	ErrInvalidFilter          = errors.New("invalid search filter")
+)
+
+// VectorStoreError is an error returned by a VectorStore operation. Kind is one of
+// ErrVectorStoreUnavailable, ErrVectorStoreTimeout, ErrInvalidFilter or ErrEmbeddingModelMismatch,
+// or nil if the error isn't one of them.
+type VectorStoreError struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *VectorStoreError) Error() string {
+	if e.Kind == nil {
+		return fmt.Sprintf("vector store: error while trying to %v: %v", e.Op, e.Err)
+	}
+
+	return fmt.Sprintf("vector store: error while trying to %v: %v: %v", e.Op, e.Kind, e.Err)
+}
+
+func (e *VectorStoreError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+
+	return []error{e.Kind, e.Err}
+}
+
+// Wrap an error returned while running op, finding its kind from the error if kind is nil
+func newVectorStoreError(op string, kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var vectorStoreError *VectorStoreError
+	if errors.As(err, &vectorStoreError) {
+		return err
+	}
+
+	if kind == nil {
+		kind = vectorStoreErrorKind(err)
+	}
+
+	return &VectorStoreError{Op: op, Kind: kind, Err: err}
+}
+
+func vectorStoreErrorKind(err error) error {
+	if errors.Is(err, ErrEmbeddingModelMismatch) {
+		return ErrEmbeddingModelMismatch
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrVectorStoreTimeout
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) {
+		if netError.Timeout() {
+			return ErrVectorStoreTimeout
+		}
+
+		// refused connections, unknown hosts, ...
+		return ErrVectorStoreUnavailable
+	}
+
+	return nil
+}
+
+// Get the http status code matching the kind of a vector store error
+func vectorStoreErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidFilter):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrVectorStoreUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrVectorStoreTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrEmbeddingModelMismatch):
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewVectorStoreError(t *testing.T) {
+	t.Run("finds the kind of the error", func(t *testing.T) {
+		refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		assert.ErrorIs(t, newVectorStoreError("query", nil, refused), ErrVectorStoreUnavailable)
+		assert.ErrorIs(t, newVectorStoreError("query", nil, fmt.Errorf("post: %w", context.DeadlineExceeded)), ErrVectorStoreTimeout)
+
+		err := newVectorStoreError("query", nil, errors.New("unknown"))
+		assert.False(t, errors.Is(err, ErrVectorStoreUnavailable) || errors.Is(err, ErrVectorStoreTimeout) || errors.Is(err, ErrInvalidFilter))
+	})
+
+	t.Run("keeps the wrapped error", func(t *testing.T) {
+		cause := errors.New("bad where clause")
+		err := newVectorStoreError("build where clause", ErrInvalidFilter, cause)
+		assert.ErrorIs(t, err, ErrInvalidFilter)
+		assert.ErrorIs(t, err, cause)
+		assert.Equal(t, "vector store: error while trying to build where clause: invalid search filter: bad where clause", err.Error())
+
+		// already wrapped errors are returned as is
+		assert.Equal(t, err, newVectorStoreError("query", ErrVectorStoreTimeout, err))
+		assert.Nil(t, newVectorStoreError("query", nil, nil))
+	})
+}
+
+func TestVectorStoreErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusBadRequest, vectorStoreErrorStatus(newVectorStoreError("query", ErrInvalidFilter, errors.New("bad"))))
+	assert.Equal(t, http.StatusServiceUnavailable, vectorStoreErrorStatus(newVectorStoreError("query", ErrVectorStoreUnavailable, errors.New("down"))))
+	assert.Equal(t, http.StatusGatewayTimeout, vectorStoreErrorStatus(newVectorStoreError("query", ErrVectorStoreTimeout, errors.New("slow"))))
+	assert.Equal(t, http.StatusConflict, vectorStoreErrorStatus(newVectorStoreError("query", ErrEmbeddingModelMismatch, errors.New("changed"))))
+	assert.Equal(t, http.StatusInternalServerError, vectorStoreErrorStatus(errors.New("other")))
+}
+
+// modelEmbedder is a hash embedder reporting another model, to test model changes
+type modelEmbedder struct {
+	*HashEmbedder
+	model string
+}
+
+func (embedder *modelEmbedder) Model() string {
+	return embedder.model
+}
+
+// testVectorStoreConformance checks the behaviour every VectorStore must have. newBackend creates
+// an empty backend, and returns a function creating stores of that backend that embed with embedder.
+func testVectorStoreConformance(t *testing.T, newBackend func(t *testing.T) func(embedder Embedder) VectorStore) {
+	ctx := context.Background()
+	day := int64(24 * time.Hour / time.Millisecond)
+
+	newPopulatedStore := func(t *testing.T) (VectorStore, func(embedder Embedder) VectorStore) {
+		newStore := newBackend(t)
+		store := newStore(NewHashEmbedder())
+		assert.Nil(t, store.VerifyEmbeddingModel(ctx))
+
+		assert.Nil(t, store.Upsert(ctx, mattermostCollectionType,
+			[]string{"p1", "p2", "p3"},
+			[]string{"deploy the api server", "the build is broken", "lunch at noon"},
+			[]map[string]interface{}{
+				{"source": "mm", "access": "pub", "channel_id": "c1", "user_id": "u1", "team_id": "t1", "create_at": 1 * day},
+				{"source": "mm", "access": "pri", "channel_id": "c2", "user_id": "u2", "team_id": "t1", "create_at": 2 * day},
+				{"source": "mm", "access": "pub", "channel_id": "c1", "user_id": "u2", "team_id": "t1", "create_at": 3 * day},
+			},
+		))
+
+		assert.Nil(t, store.Upsert(ctx, slackCollectionType,
+			[]string{"s1"},
+			[]string{"deploy the slack bot"},
+			[]map[string]interface{}{
+				{"source": "sl", "access": "pub", "user_name": "Slack User", "channel_name": "general", "msg_date": 2 * day / 1000},
+			},
+		))
+
+		return store, newStore
+	}
+
+	ids := func(results []searchResult) []string {
+		resultIds := []string{}
+		for _, result := range results {
+			resultIds = append(resultIds, result.Id)
+		}
+		return resultIds
+	}
+
+	mmChannelIds := []interface{}{"c1", "c2"}
+
+	t.Run("finds the most similar documents first", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		results, err := store.Query(ctx, "the build is broken", mmChannelIds, 10, -1, SearchFilters{})
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"p1", "p2", "p3", "s1"}, ids(results))
+		assert.Equal(t, "p2", results[0].Id)
+		assert.Equal(t, "the build is broken", results[0].Document)
+		assert.InDelta(t, 1, results[0].Scores.Vector, 0.001)
+		assert.Equal(t, "c2", results[0].Metadata["channel_id"])
+		assert.Equal(t, float64(2*day), results[0].Metadata["create_at"])
+
+		for i := 1; i < len(results); i++ {
+			assert.GreaterOrEqual(t, results[i-1].Scores.Vector, results[i].Scores.Vector)
+		}
+	})
+
+	t.Run("limits the results of each collection", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		results, err := store.Query(ctx, "the build is broken", mmChannelIds, 1, -1, SearchFilters{})
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"p2", "s1"}, ids(results))
+	})
+
+	t.Run("drops the results below the minimum score", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		results, err := store.Query(ctx, "the build is broken", mmChannelIds, 10, 0.99, SearchFilters{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"p2"}, ids(results))
+	})
+
+	t.Run("only finds posts in the user's channels", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		results, err := store.Query(ctx, "the build is broken", []interface{}{"c1"}, 10, -1, SearchFilters{})
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"p1", "p3", "s1"}, ids(results))
+
+		results, err = store.Query(ctx, "the build is broken", []interface{}{}, 10, -1, SearchFilters{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"s1"}, ids(results))
+	})
+
+	t.Run("applies the filters", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		for name, test := range map[string]struct {
+			filters  SearchFilters
+			expected []string
+		}{
+			"channels": {SearchFilters{ChannelIds: []string{"c2"}}, []string{"p2"}},
+			"users":    {SearchFilters{UserIds: []string{"u2"}}, []string{"p2", "p3"}},
+			"team":     {SearchFilters{TeamId: "t1"}, []string{"p1", "p2", "p3"}},
+			"dates":    {SearchFilters{Since: 2 * day, Until: 2 * day}, []string{"p2", "s1"}},
+			"source":   {SearchFilters{Source: "sl"}, []string{"s1"}},
+			"access":   {SearchFilters{Access: "pri"}, []string{"p2"}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				results, err := store.Query(ctx, "deploy", mmChannelIds, 10, -1, test.filters)
+				assert.Nil(t, err)
+				assert.ElementsMatch(t, test.expected, ids(results))
+			})
+		}
+	})
+
+	t.Run("upsert replaces documents", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		assert.Nil(t, store.Upsert(ctx, mattermostCollectionType,
+			[]string{"p3"},
+			[]string{"the build is fixed"},
+			[]map[string]interface{}{{"source": "mm", "access": "pub", "channel_id": "c1", "user_id": "u2", "team_id": "t1", "create_at": 4 * day}},
+		))
+
+		results, err := store.Query(ctx, "the build is fixed", mmChannelIds, 10, 0.99, SearchFilters{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"p3"}, ids(results))
+		assert.Equal(t, float64(4*day), results[0].Metadata["create_at"])
+	})
+
+	t.Run("deletes documents", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		assert.Nil(t, store.Delete(ctx, mattermostCollectionType, []string{"p2"}))
+		assert.Nil(t, store.Delete(ctx, slackCollectionType, []string{"missing"}))
+
+		results, err := store.Query(ctx, "the build is broken", mmChannelIds, 10, -1, SearchFilters{})
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"p1", "p3", "s1"}, ids(results))
+	})
+
+	t.Run("deletes documents by metadata", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		assert.Nil(t, store.DeleteWhere(ctx, mattermostCollectionType, map[string]interface{}{"user_id": map[string]interface{}{"$in": []interface{}{"u2"}}}))
+
+		results, err := store.Query(ctx, "the build is broken", mmChannelIds, 10, -1, SearchFilters{})
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"p1", "s1"}, ids(results))
+	})
+
+	t.Run("gets the metadata of every document", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		metadatas, err := store.GetMetadatas(ctx, mattermostCollectionType)
+		assert.Nil(t, err)
+		assert.Len(t, metadatas, 3)
+		assert.Equal(t, "c2", metadatas["p2"]["channel_id"])
+		assert.Equal(t, float64(2*day), metadatas["p2"]["create_at"])
+
+		metadatas, err = store.GetMetadatas(ctx, slackCollectionType)
+		assert.Nil(t, err)
+		assert.Len(t, metadatas, 1)
+		assert.Equal(t, "general", metadatas["s1"]["channel_name"])
+	})
+
+	t.Run("gets the embeddings of documents", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		embeddings, err := store.GetEmbeddings(ctx, mattermostCollectionType, []string{"p1", "p2", "missing"})
+		assert.Nil(t, err)
+		assert.Len(t, embeddings, 2)
+
+		queryEmbedding, err := NewHashEmbedder().EmbedQuery(ctx, "the build is broken")
+		assert.Nil(t, err)
+		assert.InDelta(t, 0, cosineDistance(queryEmbedding, embeddings["p2"]), 0.001)
+	})
+
+	t.Run("gets the text of documents", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		documents, err := store.GetDocuments(ctx, mattermostCollectionType, []string{"p2", "missing"})
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"p2": "the build is broken"}, documents)
+	})
+
+	t.Run("reset removes every document", func(t *testing.T) {
+		store, _ := newPopulatedStore(t)
+
+		assert.Nil(t, store.Reset(ctx))
+
+		results, err := store.Query(ctx, "the build is broken", mmChannelIds, 10, -1, SearchFilters{})
+		assert.Nil(t, err)
+		assert.Empty(t, results)
+	})
+
+	t.Run("detects a change of embedding model", func(t *testing.T) {
+		_, newStore := newPopulatedStore(t)
+
+		otherStore := newStore(&modelEmbedder{HashEmbedder: NewHashEmbedder(), model: "other:model"})
+		assert.ErrorIs(t, otherStore.VerifyEmbeddingModel(ctx), ErrEmbeddingModelMismatch)
+
+		_, err := otherStore.Query(ctx, "the build is broken", mmChannelIds, 10, -1, SearchFilters{})
+		assert.ErrorIs(t, err, ErrEmbeddingModelMismatch)
+
+		// the messages can be embedded again with the new model after a reset
+		assert.Nil(t, otherStore.Reset(ctx))
+		assert.Nil(t, otherStore.VerifyEmbeddingModel(ctx))
+	})
+}
@@ -214,6 +214,11 @@ const ToggleSyncSetting: React.FC<ToggleSyncSettingProps> = ({pluginServerRoute,
                 </div> : ''}
             </div>)}
 
+            {/* only the sync leader of the cluster fetches posts */}
+            {syncStatus.sync_leader ? <p className='ss-setting-sync-leader'>
+                {'Sync runs on server: ' + syncStatus.sync_leader}
+            </p> : ''}
+
             <p
                 className='ss-toggle-sync-success-message'
                 style={{display: wasSuccessful ? 'block' : 'none'}}
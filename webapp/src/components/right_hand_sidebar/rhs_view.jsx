@@ -51,7 +51,14 @@ const RHSView = ({pluginServerRoute}) => {
 
             // credentials: 'include',
         }).
-            then((res) => res.json()).
+            then(async (res) => {
+                const body = await res.json();
+                if (!res.ok) {
+                    // failed searches return {code, error}
+                    throw new Error(body.error);
+                }
+                return body;
+            }).
             then((res) => {
                 const responsePayload = {text: res.llm, context: res.context};
                 // eslint-disable-next-line no-console
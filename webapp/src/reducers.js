@@ -47,7 +47,7 @@ const syncStop = (state = false, action) => {
     }
 };
 
-const syncStatus = (state = {is_sync_in_progress: false, is_fetch_in_progress: false}, action) => {
+const syncStatus = (state = {is_sync_in_progress: false, is_fetch_in_progress: false, sync_leader: ''}, action) => {
     switch (action.type) {
     case ActionTypes.SYNC_STATUS_CHANGE:
         return action.status;